@@ -0,0 +1,283 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	DefaultMaxSize  = 100 // megabytes
+	DefaultMaxFiles = 10
+	QueueSize       = 4096 // entries a log can lag behind, more are dropped
+
+	// domain -> its access log and what of its requests is logged
+	logs      = map[string]*Log{}
+	policies  = map[string]*policy{}
+	logsMutex = &sync.RWMutex{}
+
+	// functions the entries of every domain are passed to, whether it has an access log or not
+	subscribers      = []*subscriber{}
+	subscriberCount  int32
+	subscribersMutex = &sync.RWMutex{}
+)
+
+type subscriber struct {
+	handle func(Entry)
+}
+
+// Entry is one request and what happened to it
+type Entry struct {
+	Time           time.Time `json:"time"`
+	Domain         string    `json:"domain"`
+	IP             string    `json:"ip"`
+	Method         string    `json:"method"`
+	URI            string    `json:"uri"`
+	Proto          string    `json:"proto"`
+	Status         int       `json:"status"`
+	Bytes          int64     `json:"bytes"`
+	Referer        string    `json:"referer"`
+	UserAgent      string    `json:"userAgent"`
+	Duration       float64   `json:"duration"` // milliseconds
+	Action         string    `json:"action"`   // "allow", "challenge", "block", "tarpit" or "other"
+	Reason         string    `json:"reason"`
+	SusLv          int       `json:"susLv"`
+	TLSFingerprint string    `json:"tlsFingerprint"`
+	JA4            string    `json:"ja4"`
+
+	Headers map[string]string `json:"headers,omitempty"` // the request headers the domain logs
+}
+
+// Log writes the entries of a domain in its own goroutine, so requests never wait for the disk
+type Log struct {
+	file  fileSettings
+	queue chan Entry
+	done  chan struct{}
+}
+
+// fileSettings are the settings a log has to be opened again for if they change
+type fileSettings struct {
+	File     string
+	Format   string
+	MaxSize  int
+	Rotate   string
+	MaxFiles int
+	Compress bool
+}
+
+// Configure opens the access log of a domain, replacing the one it had. Domains without a file have none.
+// A log whose settings didn't change is kept as it is
+func Configure(domainName string, settings domains.AccessLogSettings) error {
+	switch settings.Format {
+	case "":
+		settings.Format = "combined"
+	case "combined", "json":
+	default:
+		return errors.New("unknown access log format " + settings.Format + ", use combined or json")
+	}
+	switch settings.Rotate {
+	case "", "hourly", "daily":
+	default:
+		return errors.New("unknown access log rotation " + settings.Rotate + ", use hourly or daily")
+	}
+	if settings.MaxSize <= 0 {
+		settings.MaxSize = DefaultMaxSize
+	}
+	if settings.MaxFiles <= 0 {
+		settings.MaxFiles = DefaultMaxFiles
+	}
+	requests, err := newPolicy(settings)
+	if err != nil {
+		return err
+	}
+
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+	policies[domainName] = requests
+
+	wanted := fileSettings{settings.File, settings.Format, settings.MaxSize, settings.Rotate, settings.MaxFiles, settings.Compress}
+	previous, ok := logs[domainName]
+	if ok && previous.file == wanted {
+		return nil
+	}
+
+	var current *Log
+	if settings.File != "" {
+		file := &rotatingFile{settings: wanted}
+		if err := file.open(); err != nil {
+			return err
+		}
+		current = &Log{file: wanted, queue: make(chan Entry, QueueSize), done: make(chan struct{})}
+		go current.run(domainName, file)
+	}
+
+	if ok {
+		close(previous.done)
+		delete(logs, domainName)
+	}
+	if current != nil {
+		logs[domainName] = current
+	}
+	return nil
+}
+
+// Enabled returns whether a domain has an access log or anyone subscribed to entries, so requests skip building
+// entries nobody wants
+func Enabled(domainName string) bool {
+	if atomic.LoadInt32(&subscriberCount) != 0 {
+		return true
+	}
+	logsMutex.RLock()
+	_, ok := logs[domainName]
+	logsMutex.RUnlock()
+	return ok
+}
+
+// Write queues entry to be written to the access log of its domain and passes it to the subscribers, unless the
+// domain doesn't log requests like it. Entries are dropped if the disk can't keep up
+func Write(entry Entry, header http.Header) {
+	logsMutex.RLock()
+	current, ok := logs[entry.Domain]
+	requests := policies[entry.Domain]
+	logsMutex.RUnlock()
+	if requests != nil && !requests.apply(&entry, header) {
+		return
+	}
+
+	if atomic.LoadInt32(&subscriberCount) != 0 {
+		subscribersMutex.RLock()
+		for _, sub := range subscribers {
+			sub.handle(entry)
+		}
+		subscribersMutex.RUnlock()
+	}
+
+	if !ok {
+		return
+	}
+	select {
+	case current.queue <- entry:
+	default:
+	}
+}
+
+// Subscribe passes the entries of every domain to handle, until unsubscribe is called. handle is called by the
+// request the entry is about, so it must not block
+func Subscribe(handle func(Entry)) (unsubscribe func()) {
+	sub := &subscriber{handle: handle}
+	subscribersMutex.Lock()
+	subscribers = append(subscribers, sub)
+	atomic.AddInt32(&subscriberCount, 1)
+	subscribersMutex.Unlock()
+
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			subscribersMutex.Lock()
+			for i, other := range subscribers {
+				if other == sub {
+					subscribers = append(subscribers[:i], subscribers[i+1:]...)
+					break
+				}
+			}
+			atomic.AddInt32(&subscriberCount, -1)
+			subscribersMutex.Unlock()
+		})
+	}
+}
+
+func (current *Log) run(domainName string, file *rotatingFile) {
+	defer pnc.PanicHndl()
+	defer file.close()
+
+	line := []byte{}
+	lastError := time.Time{}
+	for {
+		var entry Entry
+		select {
+		case entry = <-current.queue:
+		case <-current.done:
+			return
+		}
+
+		line = format(line[:0], current.file.Format, entry)
+		if err := file.write(line); err != nil && time.Since(lastError) > time.Minute {
+			lastError = time.Now()
+			logger.Error("Failed to write access log", logger.Domain(domainName), logger.F("file", current.file.File), logger.Err(err))
+		}
+	}
+}
+
+// format appends entry to line in the combined log format, followed by the action, its reason, the duration
+// in milliseconds and the logged headers in the order of their names, or as json
+func format(line []byte, format string, entry Entry) []byte {
+	if format == "json" {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return line
+		}
+		return append(append(line, encoded...), '\n')
+	}
+
+	line = append(line, entry.IP...)
+	line = append(line, " - - ["...)
+	line = entry.Time.AppendFormat(line, "02/Jan/2006:15:04:05 -0700")
+	line = append(line, "] "...)
+	line = quote(line, entry.Method+" "+entry.URI+" "+entry.Proto)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, int64(entry.Status), 10)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, entry.Bytes, 10)
+	line = append(line, ' ')
+	line = quote(line, entry.Referer)
+	line = append(line, ' ')
+	line = quote(line, entry.UserAgent)
+	line = append(line, ' ')
+	line = quote(line, entry.Action)
+	line = append(line, ' ')
+	line = quote(line, entry.Reason)
+	line = append(line, ' ')
+	line = strconv.AppendFloat(line, entry.Duration, 'f', 3, 64)
+	if len(entry.Headers) != 0 {
+		names := make([]string, 0, len(entry.Headers))
+		for name := range entry.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			line = append(line, ' ')
+			line = quote(line, entry.Headers[name])
+		}
+	}
+	return append(line, '\n')
+}
+
+// quote appends value the way nginx and apache do, "-" if it's empty and with quotes and control characters escaped
+func quote(line []byte, value string) []byte {
+	if value == "" {
+		return append(line, `"-"`...)
+	}
+	line = append(line, '"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			line = append(line, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			line = append(line, `\x`...)
+			line = append(line, strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:])...)
+		default:
+			line = append(line, c)
+		}
+	}
+	return append(line, '"')
+}
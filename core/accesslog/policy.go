@@ -0,0 +1,113 @@
+package accesslog
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// policy is what a domain logs of its requests and what is redacted from its entries
+type policy struct {
+	actions    map[string]bool // empty logs every action
+	sampleRate uint64
+	counter    uint64
+	redact     map[string]bool
+	headers    []string
+}
+
+func newPolicy(settings domains.AccessLogSettings) (*policy, error) {
+	requests := &policy{actions: map[string]bool{}, sampleRate: 1, redact: map[string]bool{}}
+	for _, action := range settings.Actions {
+		switch action {
+		case "allow", "challenge", "block", "tarpit", "other":
+			requests.actions[action] = true
+		default:
+			return nil, errors.New("unknown action " + action + ", use allow, challenge, block, tarpit or other")
+		}
+	}
+	if settings.SampleRate > 1 {
+		requests.sampleRate = uint64(settings.SampleRate)
+	}
+	for _, field := range settings.Redact {
+		switch field {
+		case "query", "cookies", "ip":
+			requests.redact[field] = true
+		default:
+			return nil, errors.New("unknown field to redact " + field + ", use query, cookies or ip")
+		}
+	}
+	for _, name := range settings.Headers {
+		requests.headers = append(requests.headers, http.CanonicalHeaderKey(name))
+	}
+	return requests, nil
+}
+
+// apply returns whether entry is logged and adds the headers of the request and redacts entry if it is.
+// Allowed requests are sampled, requests the firewall did something about are always logged
+func (requests *policy) apply(entry *Entry, header http.Header) bool {
+	if len(requests.actions) != 0 && !requests.actions[entry.Action] {
+		return false
+	}
+	if requests.sampleRate > 1 && (entry.Action == "allow" || entry.Action == "other") && atomic.AddUint64(&requests.counter, 1)%requests.sampleRate != 0 {
+		return false
+	}
+
+	if len(requests.headers) != 0 {
+		entry.Headers = make(map[string]string, len(requests.headers))
+		for _, name := range requests.headers {
+			entry.Headers[name] = strings.Join(header.Values(name), ", ")
+		}
+	}
+
+	if requests.redact["query"] {
+		entry.URI = stripQuery(entry.URI)
+		entry.Referer = stripQuery(entry.Referer)
+		if referer, ok := entry.Headers["Referer"]; ok {
+			entry.Headers["Referer"] = stripQuery(referer)
+		}
+	}
+	if requests.redact["cookies"] {
+		if cookies, ok := entry.Headers["Cookie"]; ok {
+			entry.Headers["Cookie"] = RedactCookies(cookies)
+		}
+	}
+	if requests.redact["ip"] {
+		entry.IP = maskIP(entry.IP)
+		if forwarded, ok := entry.Headers["X-Forwarded-For"]; ok && forwarded != "" {
+			entry.Headers["X-Forwarded-For"] = "redacted"
+		}
+	}
+	return true
+}
+
+func stripQuery(uri string) string {
+	if index := strings.IndexAny(uri, "?#"); index != -1 {
+		return uri[:index]
+	}
+	return uri
+}
+
+// RedactCookies keeps the names of the cookies of a Cookie header, their values are replaced
+func RedactCookies(cookies string) string {
+	parts := strings.Split(cookies, ";")
+	for i, part := range parts {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		parts[i] = name + "=redacted"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// maskIP zeroes the last byte of ipv4 and the last 80 bits of ipv6 addresses, like analytics tools anonymize ips
+func maskIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
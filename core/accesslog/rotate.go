@@ -0,0 +1,152 @@
+package accesslog
+
+import (
+	"compress/gzip"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingFile appends to the file of an access log and rotates it once it's too big or, if configured, every hour
+// or day. Rotated files are renamed to <name>-<time><ext>, optionally gzipped, and the oldest above MaxFiles deleted
+type rotatingFile struct {
+	settings fileSettings
+	file     *os.File
+	size     int64
+	period   string // the hour or day the file was started in
+
+	// Compressing and deleting rotated files happens in the background, one rotation after another
+	background sync.Mutex
+}
+
+func (rotating *rotatingFile) open() error {
+	if dir := filepath.Dir(rotating.settings.File); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(rotating.settings.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// A file that was started in an earlier hour or day is rotated by the first write
+	rotating.file, rotating.size = file, info.Size()
+	rotating.period = rotating.periodOf(time.Now())
+	if info.Size() != 0 {
+		rotating.period = rotating.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+func (rotating *rotatingFile) periodOf(t time.Time) string {
+	switch rotating.settings.Rotate {
+	case "hourly":
+		return t.Format("2006010215")
+	case "daily":
+		return t.Format("20060102")
+	}
+	return ""
+}
+
+func (rotating *rotatingFile) write(line []byte) error {
+	if rotating.file == nil {
+		// Opening again after rotating failed, e.g. because the disk was full
+		if err := rotating.open(); err != nil {
+			return err
+		}
+	}
+
+	if rotating.size != 0 && (rotating.size+int64(len(line)) > int64(rotating.settings.MaxSize)*1024*1024 || rotating.periodOf(time.Now()) != rotating.period) {
+		if err := rotating.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := rotating.file.Write(line)
+	rotating.size += int64(n)
+	return err
+}
+
+func (rotating *rotatingFile) rotate() error {
+	rotating.close()
+
+	path := rotating.settings.File
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	rotated := base + "-" + time.Now().Format("20060102-150405.000") + ext
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+
+	go func() {
+		defer pnc.PanicHndl()
+		rotating.background.Lock()
+		defer rotating.background.Unlock()
+		if rotating.settings.Compress {
+			if err := compress(rotated); err != nil {
+				logger.Error("Failed to compress access log", logger.F("file", rotated), logger.Err(err))
+			}
+		}
+
+		// Timestamps sort in the order the files were rotated in, compressed or not. Only rotated files match, not other
+		// logs that share the base name like access-api.log
+		files, _ := filepath.Glob(base + "-[0-9]*-[0-9]*" + ext + "*")
+		sort.Strings(files)
+		for len(files) > rotating.settings.MaxFiles {
+			os.Remove(files[0])
+			files = files[1:]
+		}
+	}()
+
+	return rotating.open()
+}
+
+func (rotating *rotatingFile) close() {
+	if rotating.file != nil {
+		rotating.file.Close()
+		rotating.file = nil
+	}
+}
+
+// compress gzips path to path.gz and removes it
+func compress(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	compressor := gzip.NewWriter(target)
+	if _, err := io.Copy(compressor, source); err != nil {
+		target.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		target.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := target.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	source.Close()
+	return os.Remove(path)
+}
@@ -4,12 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"goProxy/core/domains"
+	"goProxy/core/events"
 	"goProxy/core/firewall"
+	"goProxy/core/plugins"
 	"goProxy/core/proxy"
 	"goProxy/core/utils"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func Process(writer http.ResponseWriter, request *http.Request, domainData domains.DomainData) bool {
@@ -37,7 +42,7 @@ func Process(writer http.ResponseWriter, request *http.Request, domainData domai
 	}
 
 	if apiRequest.Domain == "" {
-		handleProxyActions(apiRequest.Action, writer)
+		handleProxyActions(apiRequest.Action, apiRequest, writer)
 		return true
 	}
 
@@ -50,11 +55,11 @@ func Process(writer http.ResponseWriter, request *http.Request, domainData domai
 	}
 	domainSettings, _ := uncastedDomainSettings.(domains.DomainSettings)
 
-	handleDomainActions(apiRequest.Action, writer, &domainData, &domainSettings)
+	handleDomainActions(apiRequest.Action, apiRequest, writer, &domainData, &domainSettings)
 	return true
 }
 
-func handleProxyActions(action string, writer http.ResponseWriter) {
+func handleProxyActions(action string, params API_REQUEST, writer http.ResponseWriter) {
 	switch action {
 	case "GET_PROXY_STATS":
 		APIResponse(writer, true, map[string]interface{}{
@@ -88,6 +93,92 @@ func handleProxyActions(action string, writer http.ResponseWriter) {
 		APIResponse(writer, true, map[string]interface{}{
 			"TOTAL_FINGERPRINT_REQUESTS": ipsFps,
 		})
+	case "GET_FINGERPRINT_STATS":
+		APIResponse(writer, true, map[string]interface{}{
+			"FINGERPRINT_STATS": firewall.GetFingerprintStats(params.Hours),
+		})
+	case "GET_REPUTATION":
+		if net.ParseIP(params.IP) == nil {
+			APIResponse(writer, false, map[string]interface{}{
+				"ERROR": ERR_INVALID_IP,
+			})
+			return
+		}
+		reputation, found := firewall.ReputationOf(params.IP)
+		if !found {
+			APIResponse(writer, false, map[string]interface{}{
+				"ERROR": ERR_IP_NOT_FOUND,
+			})
+			return
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"REPUTATION": reputation,
+		})
+	case "SET_REPUTATION":
+		if net.ParseIP(params.IP) == nil {
+			APIResponse(writer, false, map[string]interface{}{
+				"ERROR": ERR_INVALID_IP,
+			})
+			return
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"REPUTATION": firewall.SetReputation(params.IP, params.Score),
+		})
+	case "RESET_REPUTATION", "CLEAR_REPUTATIONS":
+		ips := params.IPs
+		if action == "RESET_REPUTATION" {
+			ips = []string{params.IP}
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				APIResponse(writer, false, map[string]interface{}{
+					"ERROR": ERR_INVALID_IP,
+				})
+				return
+			}
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"CLEARED": firewall.ResetReputations(ips),
+		})
+	case "EXPORT_REPUTATIONS":
+		export := firewall.ExportReputations()
+		if params.Format == "csv" {
+			writer.Header().Set("Content-Type", "text/csv")
+			firewall.WriteReputationsCSV(writer, export.Reputations)
+			return
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"EXPORT": export,
+		})
+	case "IMPORT_REPUTATIONS":
+		imported, skipped, err := firewall.ImportReputations(params.Reputations, params.Strategy)
+		if err != nil {
+			APIResponse(writer, false, map[string]interface{}{
+				"ERROR":   ERR_INVALID_REPUTATIONS,
+				"DETAILS": err.Error(),
+			})
+			return
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"IMPORTED": imported,
+			"SKIPPED":  skipped,
+		})
+	case "GET_LOWEST_REPUTATIONS":
+		limit := params.Limit
+		if limit <= 0 {
+			limit = 50
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"REPUTATIONS": firewall.LowestReputations(limit),
+		})
+	case "GET_GEO_PROVIDERS":
+		APIResponse(writer, true, map[string]interface{}{
+			"GEO_PROVIDERS": firewall.GeoProviderHealth(),
+		})
+	case "GET_PLUGINS":
+		APIResponse(writer, true, map[string]interface{}{
+			"PLUGINS": plugins.Status(),
+		})
 	case "GET_IP_CACHE":
 		cacheIps := make(map[string]interface{})
 		firewall.CacheIps.Range(func(key, value any) bool {
@@ -117,7 +208,7 @@ func handleProxyActions(action string, writer http.ResponseWriter) {
 	}
 }
 
-func handleDomainActions(action string, writer http.ResponseWriter, domainData *domains.DomainData, domainSettings *domains.DomainSettings) {
+func handleDomainActions(action string, params API_REQUEST, writer http.ResponseWriter, domainData *domains.DomainData, domainSettings *domains.DomainSettings) {
 	switch action {
 	case "GET_TOTAL_REQUESTS":
 		APIResponse(writer, true, map[string]interface{}{
@@ -143,6 +234,66 @@ func handleDomainActions(action string, writer http.ResponseWriter, domainData *
 		APIResponse(writer, true, map[string]interface{}{
 			"LOGS": domainData.LastLogs,
 		})
+	case "INVALIDATE_CLEARANCES":
+		firewall.InvalidateClearances(domainSettings.ClearanceScope)
+		APIResponse(writer, true, map[string]interface{}{})
+	case "GET_TOP_ATTACKERS":
+		limit := params.Limit
+		if limit <= 0 {
+			limit = 10
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"TOP_ATTACKERS": firewall.TopAttackers(domainSettings.Name, limit),
+		})
+	case "GET_RULE_STATS":
+		APIResponse(writer, true, map[string]interface{}{
+			"RULE_STATS": firewall.GetRuleStats(domainSettings.Name),
+		})
+	case "GET_RULE_GROUPS":
+		disabledGroups := firewall.DisabledRuleGroups(domainSettings.Name)
+		groups := map[string]interface{}{}
+		for group, rules := range ruleGroups(domainSettings) {
+			groups[group] = map[string]interface{}{
+				"ENABLED": !disabledGroups[group],
+				"RULES":   rules,
+			}
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"RULE_GROUPS": groups,
+		})
+	case "ENABLE_RULE_GROUP", "DISABLE_RULE_GROUP":
+		if _, ok := ruleGroups(domainSettings)[params.Group]; !ok {
+			APIResponse(writer, false, map[string]interface{}{
+				"ERROR": ERR_GROUP_NOT_FOUND,
+			})
+			return
+		}
+		firewall.SetRuleGroupEnabled(domainSettings.Name, params.Group, action == "ENABLE_RULE_GROUP")
+		APIResponse(writer, true, map[string]interface{}{})
+	case "EXPORT_RULES":
+		export, err := utils.ExportRules(domainSettings.Name)
+		if err != nil {
+			APIResponse(writer, false, map[string]interface{}{
+				"ERROR": ERR_DOMAIN_NOT_FOUND,
+			})
+			return
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"EXPORT": export,
+		})
+	case "IMPORT_RULES":
+		imported, duplicates, err := utils.ImportRules(domainSettings.Name, params.Rules)
+		if err != nil {
+			APIResponse(writer, false, map[string]interface{}{
+				"ERROR":   ERR_INVALID_RULES,
+				"DETAILS": err.Error(),
+			})
+			return
+		}
+		APIResponse(writer, true, map[string]interface{}{
+			"IMPORTED":   imported,
+			"DUPLICATES": duplicates,
+		})
 	default:
 		APIResponse(writer, false, map[string]interface{}{
 			"ERROR": ERR_ACTION_NOT_FOUND,
@@ -150,8 +301,31 @@ func handleDomainActions(action string, writer http.ResponseWriter, domainData *
 	}
 }
 
+// ruleGroups returns the rule groups of a domain and how many of its enabled rules belong to them
+func ruleGroups(domainSettings *domains.DomainSettings) map[string]int {
+	groups := map[string]int{}
+	for _, rules := range [][]domains.Rule{domainSettings.CustomRules, domainSettings.RemoteRules.Rules()} {
+		for _, rule := range rules {
+			if rule.Group != "" {
+				groups[rule.Group]++
+			}
+		}
+	}
+	return groups
+}
+
 func ProcessV2(w http.ResponseWriter, r *http.Request) bool {
 
+	// Scrapers can't always send the secret, they may use the credentials of the metrics endpoint instead
+	if r.URL.Path == "/_bProxy/api/v2/METRICS" && firewall.MetricsEnabled && firewall.MetricsOnAdmin {
+		secretValid := proxy.APISecret != "" && r.Header.Get("Proxy-Secret") == proxy.APISecret
+		if !secretValid && !(firewall.MetricsCredentials() && firewall.MetricsAuthorized(r)) {
+			return false
+		}
+		firewall.MetricsHandler().ServeHTTP(w, r)
+		return true
+	}
+
 	if r.Header.Get("Proxy-Secret") != proxy.APISecret {
 		return false
 	}
@@ -163,11 +337,39 @@ func ProcessV2(w http.ResponseWriter, r *http.Request) bool {
 		return false
 	}
 
+	// /STREAM_EVENTS?types=
+	if len(parts) == 1 && parts[0] == "STREAM_EVENTS" {
+		streamEvents(w, r)
+		return true
+	}
+
 	if len(parts) == 1 {
 
-		// /:action
+		// /:action?hours=&ip=&ips=&score=&limit=&strategy=&format=
 
-		handleProxyActions(parts[0], w)
+		query := r.URL.Query()
+		params := API_REQUEST{IP: query.Get("ip"), Strategy: query.Get("strategy"), Format: query.Get("format")}
+		params.Hours, _ = strconv.Atoi(query.Get("hours"))
+		params.Score, _ = strconv.Atoi(query.Get("score"))
+		params.Limit, _ = strconv.Atoi(query.Get("limit"))
+		if ips := query.Get("ips"); ips != "" {
+			params.IPs = strings.Split(ips, ",")
+		}
+		if r.Method == http.MethodPost {
+			// Takes an export as is, as json or as csv
+			content, err := io.ReadAll(io.LimitReader(r.Body, 64*1024*1024))
+			if err == nil {
+				params.Reputations, err = firewall.ParseReputations(content, strings.Contains(r.Header.Get("Content-Type"), "csv"))
+			}
+			if err != nil {
+				APIResponse(w, false, map[string]interface{}{
+					"ERROR":   ERR_INVALID_REPUTATIONS,
+					"DETAILS": err.Error(),
+				})
+				return true
+			}
+		}
+		handleProxyActions(parts[0], params, w)
 		return true
 	} else {
 
@@ -186,7 +388,20 @@ func ProcessV2(w http.ResponseWriter, r *http.Request) bool {
 		domainData := domains.DomainsData[parts[0]]
 		firewall.Mutex.RUnlock()
 
-		handleDomainActions(parts[1], w, &domainData, &domainSettingsdomain)
+		params := API_REQUEST{Group: r.URL.Query().Get("group")}
+		if r.Method == http.MethodPost {
+			// Takes an export as is, so rules can be copied by posting the EXPORT of another domain
+			export := utils.RuleExport{}
+			if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+				APIResponse(w, false, map[string]interface{}{
+					"ERROR": ERR_JSON_READ_FAILED,
+				})
+				return true
+			}
+			params.Rules = export.Rules
+		}
+
+		handleDomainActions(parts[1], params, w, &domainData, &domainSettingsdomain)
 		return true
 	}
 }
@@ -208,3 +423,58 @@ func APIResponse(writer http.ResponseWriter, success bool, response map[string]i
 	fmt.Fprint(writer, string(jsonResponse))
 	return nil
 }
+
+// streamEvents sends the events of the proxy as server-sent events until the client goes away. ?types= only sends the listed types
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		APIResponse(w, false, map[string]interface{}{
+			"ERROR": ERR_STREAM_UNSUPPORTED,
+		})
+		return
+	}
+
+	types := []string{}
+	if query := r.URL.Query().Get("types"); query != "" {
+		types = strings.Split(query, ",")
+	}
+	for _, eventType := range types {
+		if !events.Known(eventType) {
+			APIResponse(w, false, map[string]interface{}{
+				"ERROR":   ERR_UNKNOWN_EVENT,
+				"DETAILS": eventType,
+			})
+			return
+		}
+	}
+
+	stream := make(events.ChannelSink, 256)
+	unsubscribe := events.Subscribe(types, stream, nil)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments keep proxies in between from closing the stream while nothing happens
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-stream:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -1,15 +1,42 @@
 package api
 
+import (
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+)
+
 const (
 	ERR_DOMAIN_NOT_FOUND = "ERR_DOMAIN_NOT_FOUND"
 	ERR_ACTION_NOT_FOUND = "ERR_ACTION_NOT_FOUND"
 	ERR_BODY_READ_FAILED = "ERR_BODY_READ_FAILED"
 	ERR_JSON_READ_FAILED = "ERR_JSON_READ_FAILED"
+	ERR_GROUP_NOT_FOUND  = "ERR_GROUP_NOT_FOUND"
+	ERR_INVALID_RULES    = "ERR_INVALID_RULES"
+	ERR_INVALID_IP       = "ERR_INVALID_IP"
+	ERR_IP_NOT_FOUND     = "ERR_IP_NOT_FOUND"
+
+	ERR_INVALID_REPUTATIONS = "ERR_INVALID_REPUTATIONS"
+	ERR_UNKNOWN_EVENT       = "ERR_UNKNOWN_EVENT"
+	ERR_STREAM_UNSUPPORTED  = "ERR_STREAM_UNSUPPORTED"
 )
 
 type API_REQUEST struct {
 	Domain string `json:"domain"`
 	Action string `json:"action"`
+	Hours  int    `json:"hours"` // time frame of statistics, defaults to all that are kept
+	Group  string `json:"group"` // rule group of ENABLE_RULE_GROUP and DISABLE_RULE_GROUP
+
+	Rules []domains.JsonRule `json:"rules"` // rules of IMPORT_RULES, e.g. the rules of an EXPORT_RULES response
+
+	// Reputation actions
+	IP    string   `json:"ip"`    // ip of GET_REPUTATION, SET_REPUTATION and RESET_REPUTATION
+	IPs   []string `json:"ips"`   // ips of CLEAR_REPUTATIONS
+	Score int      `json:"score"` // score of SET_REPUTATION
+	Limit int      `json:"limit"` // amount of ips GET_LOWEST_REPUTATIONS returns, defaults to 50
+
+	Reputations []firewall.ReputationData `json:"reputations"` // reputations of IMPORT_REPUTATIONS, e.g. those of an EXPORT_REPUTATIONS response
+	Strategy    string                    `json:"strategy"`    // merge strategy of IMPORT_REPUTATIONS: "replace", "keep" or "lowest"
+	Format      string                    `json:"format"`      // "json" or "csv" export of EXPORT_REPUTATIONS
 }
 
 type API_RESPONSE struct {
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var (
+	// Github being unreachable shouldn't hang startup or a refresh
+	fingerprintClient = &http.Client{Timeout: 10 * time.Second}
+
+	// known, bot and malicious lists in this repository
+	fingerprintURLs = [...]string{
+		"https://raw.githubusercontent.com/41Baloo/balooProxy/main/global/fingerprints/known_fingerprints.json",
+		"https://raw.githubusercontent.com/41Baloo/balooProxy/main/global/fingerprints/bot_fingerprints.json",
+		"https://raw.githubusercontent.com/41Baloo/balooProxy/main/global/fingerprints/malicious_fingerprints.json",
+	}
+
+	// Index into the lists built by LoadFingerprints, by the name used in config.json
+	fingerprintListNames = map[string]int{
+		"known":     0,
+		"bot":       1,
+		"malicious": 2,
+	}
+
+	// url -> last list fetched from it successfully, so a failed refresh doesn't drop its fingerprints.
+	// Only accessed by LoadFingerprints, which never runs concurrently
+	remoteFingerprints = map[string]map[string]string{}
+)
+
+// LoadFingerprints builds the fingerprint lists from the compiled in ones, github and the local files configured in config.json,
+// then swaps them in. Failing to fetch a remote list isn't fatal, failing to load a configured file is and leaves the current lists untouched
+func LoadFingerprints() error {
+
+	known, bot, forbidden := firewall.BuiltinFingerprints()
+	lists := [...]map[string]string{known, bot, forbidden}
+
+	// Fetching takes a while, a config reload shouldn't wait for it
+	domains.ConfigLock.RLock()
+	settings := copyFingerprintSettings(domains.Config.Proxy.Fingerprints)
+	domains.ConfigLock.RUnlock()
+
+	if !settings.DisableRemote {
+		for list, url := range fingerprintURLs {
+			mergeRemoteFingerprints(url, nil, lists[list])
+		}
+	}
+
+	for _, feed := range settings.Feeds {
+		list, ok := fingerprintListNames[feed.List]
+		if !ok {
+			return errors.New("fingerprint feed " + feed.URL + " has unknown list \"" + feed.List + "\"")
+		}
+		mergeRemoteFingerprints(feed.URL, feed.Headers, lists[list])
+	}
+
+	for list, paths := range [...][]string{settings.Files.Known, settings.Files.Bot, settings.Files.Malicious} {
+		for _, path := range paths {
+			if err := LoadFingerprintFile(path, &lists[list]); err != nil {
+				return err
+			}
+		}
+	}
+
+	firewall.SetFingerprints(known, bot, forbidden)
+	return nil
+}
+
+// copyFingerprintSettings copies the slices and maps of settings, a reload decodes into the ones of the config
+func copyFingerprintSettings(settings domains.FingerprintSettings) domains.FingerprintSettings {
+	settings.Files = domains.FingerprintFiles{
+		Known:     append([]string{}, settings.Files.Known...),
+		Bot:       append([]string{}, settings.Files.Bot...),
+		Malicious: append([]string{}, settings.Files.Malicious...),
+	}
+	feeds := make([]domains.FingerprintFeed, len(settings.Feeds))
+	for i, feed := range settings.Feeds {
+		headers := make(map[string]string, len(feed.Headers))
+		for name, value := range feed.Headers {
+			headers[name] = value
+		}
+		feed.Headers = headers
+		feeds[i] = feed
+	}
+	settings.Feeds = feeds
+	return settings
+}
+
+// mergeRemoteFingerprints fetches a remote list and merges it into target, falling back to the last version fetched successfully
+func mergeRemoteFingerprints(url string, headers map[string]string, target map[string]string) {
+
+	fetched := map[string]string{}
+	if err := GetFingerprints(url, headers, &fetched); err != nil {
+		logger.Warn("Failed to fetch fingerprints", logger.F("url", url), logger.Err(err))
+		cached, ok := remoteFingerprints[url]
+		if !ok {
+			return
+		}
+		fetched = cached
+	} else {
+		remoteFingerprints[url] = fetched
+	}
+
+	for fingerprint, name := range fetched {
+		target[fingerprint] = name
+	}
+}
+
+// LoadFingerprintFile merges the fingerprints of a local json file into target
+func LoadFingerprintFile(path string, target *map[string]string) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New("failed to load fingerprints: " + err.Error())
+	}
+
+	err = json.Unmarshal(body, target)
+	if err != nil {
+		return errors.New("failed to load fingerprints from " + path + ": " + err.Error())
+	}
+	return nil
+}
+
+// StartFingerprintRefreshRoutine reloads the fingerprint lists every refreshInterval seconds, picking up fingerprints published since startup
+func StartFingerprintRefreshRoutine() {
+	go func() {
+		defer pnc.PanicHndl()
+		for {
+			domains.ConfigLock.RLock()
+			interval := domains.Config.Proxy.Fingerprints.RefreshInterval
+			domains.ConfigLock.RUnlock()
+			if interval <= 0 {
+				// Refreshing might get enabled by a config reload
+				time.Sleep(1 * time.Minute)
+				continue
+			}
+			time.Sleep(time.Duration(interval) * time.Second)
+
+			if err := LoadFingerprints(); err != nil {
+				logger.Warn("Failed to refresh fingerprints, keeping the current ones", logger.Err(err))
+			}
+		}
+	}()
+}
@@ -99,13 +99,26 @@ func AddDomain() {
 	}
 }
 
-func GetFingerprints(url string, target *map[string]string) error {
-	resp, err := http.Get(url)
+// GetFingerprints fetches a json list of fingerprints from url, sending headers along (for example to authenticate with a private feed)
+func GetFingerprints(url string, headers map[string]string, target *map[string]string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return errors.New("failed to fetch fingerprints: " + err.Error())
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := fingerprintClient.Do(req)
 	if err != nil {
 		return errors.New("failed to fetch fingerprints: " + err.Error())
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("failed to fetch fingerprints from " + url + ": " + resp.Status)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return errors.New("failed to fetch fingerprints: " + err.Error())
@@ -1,25 +1,28 @@
 package config
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"goProxy/core/crowdsec"
 	"goProxy/core/domains"
+	"goProxy/core/events"
+	"goProxy/core/feeds"
 	"goProxy/core/firewall"
+	"goProxy/core/kernel"
+	"goProxy/core/logger"
+	"goProxy/core/plugins"
+	"goProxy/core/profiling"
 	"goProxy/core/proxy"
 	"goProxy/core/server"
+	"goProxy/core/shipping"
+	"goProxy/core/tracing"
 	"goProxy/core/utils"
 	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-	"strconv"
 	"strings"
 	"time"
-
-	"github.com/kor44/gofilter"
 )
 
 func Load() {
@@ -37,6 +40,10 @@ func Load() {
 
 	proxy.Cloudflare = domains.Config.Proxy.Cloudflare
 
+	if err := firewall.SetTrustedProxies(domains.Config.Proxy.TrustedProxies, proxy.Cloudflare); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+	}
+
 	proxy.CookieSecret = domains.Config.Proxy.Secrets["cookie"]
 	if strings.Contains(proxy.CookieSecret, "CHANGE_ME") {
 		panic("[ " + utils.PrimaryColor("!") + " ] [ Cookie Secret Contains 'CHANGE_ME', Refusing To Load ]")
@@ -89,6 +96,10 @@ func Load() {
 		utils.SetColor(domains.Config.Proxy.Colors)
 	}
 
+	if err := logger.Configure(domains.Config.Proxy.Logging); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
 	if domains.Config.Proxy.RatelimitWindow < 10 {
 		domains.Config.Proxy.RatelimitWindow = 10
 	}
@@ -99,6 +110,111 @@ func Load() {
 	proxy.FailChallengeRatelimit = domains.Config.Proxy.Ratelimits["challengeFailures"]
 	proxy.FailRequestRatelimit = domains.Config.Proxy.Ratelimits["noRequestsSent"]
 
+	proxy.MaxBodySize = domains.Config.Proxy.MaxBodySize
+
+	if err := utils.ConfigureAttackReports(domains.Config.Proxy.AttackReports); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	utils.ConfigureWebhooks(domains.Config.Proxy.Webhooks)
+	utils.StartWebhookDispatcher()
+
+	if err := events.Configure(domains.Config.Proxy.EventSinks); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	if err := plugins.Configure(domains.Config.Proxy.Plugins); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	if err := shipping.Configure(domains.Config.Proxy.LogShipping); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	if err := tracing.Configure(domains.Config.Proxy.Tracing); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	if err := profiling.Configure(domains.Config.Proxy.Profiling); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	if domains.Config.Proxy.HeaderLimits.MaxCount != 0 {
+		firewall.MaxHeaderCount = domains.Config.Proxy.HeaderLimits.MaxCount
+	}
+	if domains.Config.Proxy.HeaderLimits.MaxHeaderSize != 0 {
+		firewall.MaxHeaderSize = domains.Config.Proxy.HeaderLimits.MaxHeaderSize
+	}
+	if domains.Config.Proxy.HeaderLimits.MaxTotalSize != 0 {
+		firewall.MaxTotalHeaderBytes = domains.Config.Proxy.HeaderLimits.MaxTotalSize
+	}
+
+	firewall.SlowReadEnabled = domains.Config.Proxy.SlowRead.Enabled
+	if domains.Config.Proxy.SlowRead.MinRate > 0 {
+		firewall.SlowReadMinRate = domains.Config.Proxy.SlowRead.MinRate
+	}
+	if domains.Config.Proxy.SlowRead.GracePeriod > 0 {
+		firewall.SlowReadGracePeriod = time.Duration(domains.Config.Proxy.SlowRead.GracePeriod) * time.Second
+	}
+	if domains.Config.Proxy.SlowRead.MaxOffenses != 0 {
+		firewall.MaxSlowConnsPerIP = domains.Config.Proxy.SlowRead.MaxOffenses
+	}
+
+	if domains.Config.Proxy.Tarpit.MaxConnections != 0 {
+		firewall.TarpitMaxConnections = domains.Config.Proxy.Tarpit.MaxConnections
+	}
+	if domains.Config.Proxy.Tarpit.Interval > 0 {
+		firewall.TarpitInterval = time.Duration(domains.Config.Proxy.Tarpit.Interval) * time.Second
+	}
+	if domains.Config.Proxy.Tarpit.Duration > 0 {
+		firewall.TarpitDuration = time.Duration(domains.Config.Proxy.Tarpit.Duration) * time.Second
+	}
+	firewall.TarpitRepeatOffenders = domains.Config.Proxy.Tarpit.RepeatOffenders
+
+	if err := firewall.ConfigureBackendProtection(domains.Config.Proxy.BackendProtection); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	firewall.LoadJA4Fingerprints(domains.Config.Proxy.JA4Fingerprints.Known, domains.Config.Proxy.JA4Fingerprints.Bot, domains.Config.Proxy.JA4Fingerprints.Malicious)
+
+	if domains.Config.Proxy.FingerprintStatsRetention > 0 {
+		firewall.FingerprintStatsRetention = domains.Config.Proxy.FingerprintStatsRetention
+	}
+
+	if domains.Config.Proxy.CookieBinding.IPv4Prefix != 0 {
+		firewall.CookieBindIPv4Prefix = domains.Config.Proxy.CookieBinding.IPv4Prefix
+	}
+	if domains.Config.Proxy.CookieBinding.IPv6Prefix != 0 {
+		firewall.CookieBindIPv6Prefix = domains.Config.Proxy.CookieBinding.IPv6Prefix
+	}
+	firewall.CookieBindJA4 = domains.Config.Proxy.CookieBinding.JA4
+	firewall.CookieBindHTTP2 = domains.Config.Proxy.CookieBinding.HTTP2
+
+	firewall.EscalationEnabled = domains.Config.Proxy.Escalation.Enabled
+	if domains.Config.Proxy.Escalation.Failures > 0 {
+		firewall.EscalationFailures = domains.Config.Proxy.Escalation.Failures
+	}
+	if domains.Config.Proxy.Escalation.Window > 0 {
+		firewall.EscalationWindow = time.Duration(domains.Config.Proxy.Escalation.Window) * time.Second
+	}
+	if domains.Config.Proxy.Escalation.BanTime > 0 {
+		firewall.EscalationBanTime = time.Duration(domains.Config.Proxy.Escalation.BanTime) * time.Second
+	}
+	if domains.Config.Proxy.Escalation.JSScore > 0 {
+		firewall.EscalationJSScore = domains.Config.Proxy.Escalation.JSScore
+	}
+	if domains.Config.Proxy.Escalation.CaptchaScore > 0 {
+		firewall.EscalationCaptchaScore = domains.Config.Proxy.Escalation.CaptchaScore
+	}
+
+	firewall.ClearanceTokensEnabled = domains.Config.Proxy.ClearanceTokens.Enabled
+	if firewall.ClearanceTokensEnabled {
+		tokens := domains.Config.Proxy.ClearanceTokens
+		if err := firewall.ConfigureClearanceTokens(tokens.Algorithm, tokens.Secret, tokens.PrivateKey, tokens.PublicKeys); err != nil {
+			panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+		}
+	}
+
 	// Load connection limits from config
 	if domains.Config.Proxy.ConnectionLimits.MaxConcurrentPerIP > 0 {
 		firewall.MaxConcurrentConnPerIP = domains.Config.Proxy.ConnectionLimits.MaxConcurrentPerIP
@@ -113,6 +229,24 @@ func Load() {
 
 	// Start connection tracker cleanup routine
 	firewall.ConnectionTracker.StartCleanupRoutine()
+	firewall.StartSlowReadRoutine()
+
+	if err := firewall.SetScoreWeights(domains.Config.Proxy.Reputation.Weights); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+	if err := firewall.SetReputationTiers(domains.Config.Proxy.Reputation.Tiers); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	classification := domains.Config.Proxy.IPClassification
+	firewall.IPClassificationEnabled = classification.Enabled
+	firewall.SetClassifiedASNs(classification.DatacenterASNs, classification.VPNASNs)
+	if classification.DifficultyAdjustment != 0 {
+		firewall.ClassificationDifficulty = classification.DifficultyAdjustment
+	}
+	if classification.RatelimitFactor > 0 {
+		firewall.ClassificationRatelimitFactor = classification.RatelimitFactor
+	}
 
 	// Initialize reputation system
 	if domains.Config.Proxy.Reputation.Enabled {
@@ -124,10 +258,64 @@ func Load() {
 		if domains.Config.Proxy.Reputation.DecayInterval > 0 {
 			firewall.ReputationDecayInterval = domains.Config.Proxy.Reputation.DecayInterval
 		}
+		if domains.Config.Proxy.Reputation.FlushInterval > 0 {
+			firewall.ReputationFlushInterval = time.Duration(domains.Config.Proxy.Reputation.FlushInterval) * time.Second
+		}
+		if domains.Config.Proxy.Reputation.MaxEntries != 0 {
+			firewall.ReputationMaxEntries = domains.Config.Proxy.Reputation.MaxEntries
+		}
+		if domains.Config.Proxy.Reputation.TTL > 0 {
+			firewall.ReputationTTL = time.Duration(domains.Config.Proxy.Reputation.TTL) * time.Hour
+		}
+		if domains.Config.Proxy.Reputation.Compaction > 0 {
+			firewall.ReputationCompactInterval = time.Duration(domains.Config.Proxy.Reputation.Compaction) * time.Hour
+		}
+		if domains.Config.Proxy.Reputation.Storage != "" {
+			firewall.ReputationStorage = domains.Config.Proxy.Reputation.Storage
+		}
+		if domains.Config.Proxy.Reputation.Path != "" {
+			firewall.ReputationDBPath = domains.Config.Proxy.Reputation.Path
+		}
+		redis := domains.Config.Proxy.Reputation.Redis
+		if redis.Address != "" {
+			firewall.ReputationRedisAddress = redis.Address
+		}
+		if redis.Key != "" {
+			firewall.ReputationRedisKey = redis.Key
+		}
+		firewall.ReputationRedisPassword = redis.Password
+		firewall.ReputationRedisDatabase = redis.Database
+
+		subnets := domains.Config.Proxy.Reputation.Subnets
+		firewall.SubnetReputationEnabled = subnets.Enabled
+		if subnets.IPv4Prefix > 0 && subnets.IPv4Prefix <= 32 {
+			firewall.SubnetIPv4Prefix = subnets.IPv4Prefix
+		}
+		if subnets.IPv6Prefix > 0 && subnets.IPv6Prefix <= 128 {
+			firewall.SubnetIPv6Prefix = subnets.IPv6Prefix
+		}
+		if firewall.SubnetReputationEnabled {
+			firewall.StartSubnetReputationRoutine()
+		}
+
+		asn := domains.Config.Proxy.Reputation.ASN
+		firewall.ASNReputationEnabled = asn.Enabled
+		if asn.Window > 0 {
+			firewall.ASNReputationWindow = time.Duration(asn.Window) * time.Second
+		}
+		if asn.MinRequests > 0 {
+			firewall.ASNReputationMinRequests = asn.MinRequests
+		}
 		
+		if firewall.ReputationPersistToDB {
+			if err := firewall.CheckStorage(firewall.ReputationStorage); err != nil {
+				panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+			}
+		}
 		if err := firewall.InitReputationDB(); err != nil {
-			fmt.Println("[ " + utils.PrimaryColor("!") + " ] [ Failed to initialize reputation DB: " + err.Error() + " ]")
+			logger.Error("Failed to initialize reputation DB", logger.Err(err))
 		}
+		firewall.StartReputationMaintenanceRoutine()
 	}
 
 	// Initialize adaptive rate limiting
@@ -159,28 +347,149 @@ func Load() {
 		firewall.MaxDifficulty = domains.Config.Proxy.Challenge.MaxDifficulty
 	}
 
-	// Initialize geo/ASN filtering
-	if domains.Config.Proxy.GeoFiltering.Enabled {
+	// Initialize geo/ASN lookups, the policies are set up per domain
+	geoFiltering := domains.Config.Proxy.GeoFiltering.Enabled
+	for _, domain := range domains.Config.Domains {
+		if domain.GeoFiltering != nil && domain.GeoFiltering.Enabled || len(domain.CountryRatelimits) != 0 {
+			geoFiltering = true
+		}
+	}
+	if geoFiltering {
 		firewall.GeoFilteringEnabled = true
-		firewall.GeoFilterMode = domains.Config.Proxy.GeoFiltering.Mode
-		if firewall.GeoFilterMode == "" {
-			firewall.GeoFilterMode = "blacklist"
-		}
-		firewall.AllowedCountries = domains.Config.Proxy.GeoFiltering.AllowedCountries
-		firewall.BlockedCountries = domains.Config.Proxy.GeoFiltering.BlockedCountries
-		firewall.BlockedASN = domains.Config.Proxy.GeoFiltering.BlockedASN
-		firewall.ChallengeUnknown = domains.Config.Proxy.GeoFiltering.ChallengeUnknown
+
+		geoSettings := domains.Config.Proxy.GeoFiltering
+		if len(geoSettings.Providers) == 0 {
+			provider, err := firewall.NewGeoProvider(geoSettings.Provider, "", geoSettings.Database, geoSettings.ASNDatabase)
+			if err != nil {
+				panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+			}
+			firewall.SetGeoProvider(provider)
+		} else {
+			// Fall back to the next provider when one fails or is rate limited
+			failover := firewall.NewFailoverProvider()
+			for _, providerSettings := range geoSettings.Providers {
+				provider, err := firewall.NewGeoProvider(providerSettings.Provider, providerSettings.Endpoint, providerSettings.Database, providerSettings.ASNDatabase)
+				if err != nil {
+					panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+				}
+				name := providerSettings.Name
+				if name == "" {
+					name = providerSettings.Provider
+				}
+				if name == "" {
+					name = "ipiz"
+				}
+				failover.Add(name, provider, providerSettings.Rate)
+			}
+			firewall.SetGeoProvider(failover)
+		}
+
+		// Look ips up in the background instead of making their requests wait
+		geoAsync := domains.Config.Proxy.GeoFiltering.Async
+		if geoAsync.Enabled {
+			switch geoAsync.Provisional {
+			case "":
+			case "allow", "challenge":
+				firewall.GeoProvisional = geoAsync.Provisional
+			default:
+				panic("[ " + utils.PrimaryColor("!") + " ] [ Unknown Provisional Geo Decision: " + geoAsync.Provisional + " ]")
+			}
+			if geoAsync.Workers > 0 {
+				firewall.GeoLookupWorkers = geoAsync.Workers
+			}
+			if geoAsync.Queue > 0 {
+				firewall.GeoLookupQueueSize = geoAsync.Queue
+			}
+			firewall.GeoAsyncLookups = true
+			firewall.StartGeoLookupWorkers()
+		}
+
+		// Keep lookups across restarts, in the same kind of storage as the reputations unless configured otherwise
+		geoCache := domains.Config.Proxy.GeoFiltering.Cache
+		if geoCache.Persist {
+			firewall.GeoCachePersist = true
+			firewall.GeoCacheStorage = domains.Config.Proxy.Reputation.Storage
+			if geoCache.Storage != "" {
+				firewall.GeoCacheStorage = geoCache.Storage
+			}
+			if geoCache.Path != "" {
+				firewall.GeoCachePath = geoCache.Path
+			}
+			redis := geoCache.Redis
+			if redis.Address == "" {
+				redis = domains.Config.Proxy.Reputation.Redis
+				redis.Key = geoCache.Redis.Key
+			}
+			if redis.Address != "" {
+				firewall.GeoCacheRedisAddress = redis.Address
+			}
+			if redis.Key != "" {
+				firewall.GeoCacheRedisKey = redis.Key
+			}
+			firewall.GeoCacheRedisPassword = redis.Password
+			firewall.GeoCacheRedisDatabase = redis.Database
+			if err := firewall.CheckStorage(firewall.GeoCacheStorage); err != nil {
+				panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+			}
+			if err := firewall.InitGeoCacheDB(); err != nil {
+				panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+			}
+		}
 		
 		// Start cache cleanup routine
 		firewall.StartGeoCacheCleanupRoutine()
 	}
 
+	// Initialize request capture
+	if domains.Config.Proxy.RequestCapture.Enabled {
+		capture := domains.Config.Proxy.RequestCapture
+		firewall.CaptureEnabled = true
+		if capture.SampleRate != 0 {
+			firewall.CaptureSampleRate = capture.SampleRate
+		}
+		if capture.Directory != "" {
+			firewall.CaptureDirectory = capture.Directory
+		}
+		if capture.Format != "" {
+			firewall.CaptureFormat = strings.ToLower(capture.Format)
+		}
+		if capture.MaxFileSize > 0 {
+			firewall.CaptureMaxFileSize = int64(capture.MaxFileSize) * 1024 * 1024
+		}
+		if capture.MaxFiles > 0 {
+			firewall.CaptureMaxFiles = capture.MaxFiles
+		}
+		if err := firewall.StartRequestCapture(); err != nil {
+			panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+		}
+	}
+
 	// Initialize metrics
 	if domains.Config.Proxy.Monitoring.EnableMetrics {
+		monitoring := domains.Config.Proxy.Monitoring
 		firewall.MetricsEnabled = true
-		if domains.Config.Proxy.Monitoring.MetricsPort > 0 {
-			firewall.MetricsPort = domains.Config.Proxy.Monitoring.MetricsPort
+		if monitoring.MetricsPort > 0 {
+			firewall.MetricsPort = monitoring.MetricsPort
+		}
+		switch monitoring.MetricsListener {
+		case "":
+		case "admin":
+			if monitoring.PrometheusExport && proxy.APISecret == "" {
+				panic("[ " + utils.PrimaryColor("!") + " ] [ Metrics On The Admin Listener Need An apiSecret ]")
+			}
+			firewall.MetricsOnAdmin = monitoring.PrometheusExport
+		default:
+			panic("[ " + utils.PrimaryColor("!") + " ] [ Unknown Metrics Listener " + monitoring.MetricsListener + ", Use admin Or Leave It Empty ]")
+		}
+		if (monitoring.MetricsCert == "") != (monitoring.MetricsKey == "") {
+			panic("[ " + utils.PrimaryColor("!") + " ] [ Metrics Endpoint Needs Both metricsCert And metricsKey ]")
 		}
+		firewall.MetricsAddress = monitoring.MetricsAddress
+		firewall.MetricsToken = monitoring.MetricsToken
+		firewall.MetricsUsername = monitoring.MetricsUsername
+		firewall.MetricsPassword = monitoring.MetricsPassword
+		firewall.MetricsCert = monitoring.MetricsCert
+		firewall.MetricsKey = monitoring.MetricsKey
 		
 		// Initialize global metrics
 		firewall.MetricsData.GlobalMetrics.StartTime = time.Now()
@@ -213,66 +522,50 @@ func Load() {
 
 	fmt.Println("Loading Fingerprints ...")
 
-	GetFingerprints("https://raw.githubusercontent.com/41Baloo/balooProxy/main/global/fingerprints/known_fingerprints.json", &firewall.KnownFingerprints)
-	GetFingerprints("https://raw.githubusercontent.com/41Baloo/balooProxy/main/global/fingerprints/bot_fingerprints.json", &firewall.BotFingerprints)
-	GetFingerprints("https://raw.githubusercontent.com/41Baloo/balooProxy/main/global/fingerprints/malicious_fingerprints.json", &firewall.ForbiddenFingerprints)
-
-	for i, domain := range domains.Config.Domains {
-		domains.Domains = append(domains.Domains, domain.Name)
-
-		firewallRules := []domains.Rule{}
-		rawFirewallRules := domains.Config.Domains[i].FirewallRules
-		for index, fwRule := range domains.Config.Domains[i].FirewallRules {
-
-			rule, err := gofilter.NewFilter(fwRule.Expression)
-			if err != nil {
-				panic("[ " + utils.PrimaryColor("!") + " ] [ Error Loading Custom Firewall Rules For " + domain.Name + " ( Rule " + strconv.Itoa(index) + " ) : " + utils.PrimaryColor(err.Error()) + " ]")
-			}
+	if err := LoadFingerprints(); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+	StartFingerprintRefreshRoutine()
+	firewall.StartCaptchaCleanupRoutine()
+	firewall.StartRuleRatelimitCleanupRoutine()
+	firewall.StartTokenBucketCleanupRoutine()
+	firewall.StartEscalationCleanupRoutine()
+	firewall.StartChallengeStatsRoutine()
 
-			firewallRules = append(firewallRules, domains.Rule{
-				Filter: rule,
-				Action: fwRule.Action,
-			})
+	if cluster := domains.Config.Proxy.Cluster; cluster.Enabled {
+		if cluster.Node == "" {
+			cluster.Node, _ = os.Hostname()
 		}
+		firewall.ClusterShareReputation = cluster.ShareReputation
+		if cluster.ReputationRate > 0 {
+			firewall.ClusterReputationRate = cluster.ReputationRate
+		}
+		if err := firewall.StartCluster(cluster.Node, cluster.Listen, cluster.Peers, cluster.Secret); err != nil {
+			panic("[ " + utils.PrimaryColor("!") + " ] [ Error Starting Cluster: " + err.Error() + " ]")
+		}
+	}
 
-		dProxy := httputil.NewSingleHostReverseProxy(&url.URL{
-			Scheme: domain.Scheme,
-			Host:   domain.Backend,
-		})
-		dProxy.Transport = &server.RoundTripper{}
+	if err := feeds.Start(append(feeds.BuiltIn(domains.Config.Proxy), domains.Config.Proxy.ThreatFeeds...)); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+	if err := crowdsec.Start(domains.Config.Proxy.CrowdSec); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+	if err := kernel.Start(domains.Config.Proxy.KernelBans); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+	if err := kernel.StartXDP(domains.Config.Proxy.XDP); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
 
-		var cert tls.Certificate = tls.Certificate{}
-		if !proxy.Cloudflare {
-			var certErr error
-			cert, certErr = tls.LoadX509KeyPair(domain.Certificate, domain.Key)
-			if certErr != nil {
-				panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor("Error Loading Certificates: "+certErr.Error()) + " ]")
-			}
-		}
+	for _, domain := range domains.Config.Domains {
+		domains.Domains = append(domains.Domains, domain.Name)
 
-		domains.DomainsMap.Store(domain.Name, domains.DomainSettings{
-			Name: domain.Name,
-
-			CustomRules:    firewallRules,
-			RawCustomRules: rawFirewallRules,
-
-			DomainProxy:        dProxy,
-			DomainCertificates: cert,
-			DomainWebhooks: domains.WebhookSettings{
-				URL:            domain.Webhook.URL,
-				Name:           domain.Webhook.Name,
-				Avatar:         domain.Webhook.Avatar,
-				AttackStartMsg: domain.Webhook.AttackStartMsg,
-				AttackStopMsg:  domain.Webhook.AttackStopMsg,
-			},
-
-			BypassStage1:        domain.BypassStage1,
-			BypassStage2:        domain.BypassStage2,
-			DisableBypassStage3: domain.DisableBypassStage3,
-			DisableRawStage3:    domain.DisableRawStage3,
-			DisableBypassStage2: domain.DisableBypassStage2,
-			DisableRawStage2:    domain.DisableRawStage2,
-		})
+		domainSettings, err := server.InitDomain(domain)
+		if err != nil {
+			panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+		}
+		domains.DomainsMap.Store(domain.Name, domainSettings)
 
 		firewall.Mutex.Lock()
 
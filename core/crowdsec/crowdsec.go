@@ -0,0 +1,249 @@
+package crowdsec
+
+import (
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/feeds"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Lists decisions are enforced through, see feeds.Set
+	BanList     = "crowdsec_ban"
+	CaptchaList = "crowdsec_captcha"
+
+	userAgent = "balooProxy-bouncer/v1"
+)
+
+var (
+	DefaultInterval = 10 // seconds between polls of the decision stream
+
+	client = &http.Client{Timeout: 30 * time.Second}
+
+	// id -> active decision of the local api
+	decisions      = map[int64]activeDecision{}
+	decisionsMutex = &sync.Mutex{}
+
+	running   chan struct{}
+	reporting bool // whether bans are reported to the local api
+	current   domains.CrowdSecSettings
+)
+
+// Decision is a decision of the local api, as the decision stream returns it
+type Decision struct {
+	ID       int64  `json:"id"`
+	Origin   string `json:"origin"`
+	Type     string `json:"type"`  // "ban" or "captcha", other remediations aren't enforced
+	Scope    string `json:"scope"` // "Ip" or "Range", other scopes aren't enforced
+	Value    string `json:"value"`
+	Duration string `json:"duration"` // time left, e.g. "3h59m52.5s"
+	Scenario string `json:"scenario"`
+}
+
+type decisionStream struct {
+	New     []Decision `json:"new"`
+	Deleted []Decision `json:"deleted"`
+}
+
+type activeDecision struct {
+	kind    string
+	prefix  *net.IPNet
+	expires time.Time
+}
+
+// Start connects the proxy to a crowdsec local api as a bouncer, replacing a previous connection. Decisions are polled
+// from the decision stream and enforced like threat feeds. If settings.Report is set, bans of the proxy are sent back as alerts
+func Start(settings domains.CrowdSecSettings) error {
+
+	// Reconnecting would lift the decisions until the first poll, so reloads that don't change anything keep the connection
+	decisionsMutex.Lock()
+	unchanged := running != nil && settings == current
+	decisionsMutex.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	Stop()
+	if !settings.Enabled {
+		return nil
+	}
+	if settings.URL == "" || settings.APIKey == "" {
+		return errors.New("crowdsec needs the url of the local api and a bouncer apiKey")
+	}
+	if settings.Report && (settings.MachineID == "" || settings.Password == "") {
+		return errors.New("reporting to crowdsec needs the machineId and password of a watcher")
+	}
+
+	interval := DefaultInterval
+	if settings.Interval > 0 {
+		interval = settings.Interval
+	}
+
+	decisionsMutex.Lock()
+	running = make(chan struct{})
+	reporting = settings.Report
+	current = settings
+	stop := running
+	decisionsMutex.Unlock()
+
+	go poll(strings.TrimRight(settings.URL, "/"), settings.APIKey, time.Duration(interval)*time.Second, stop)
+	if settings.Report {
+		startReporting()
+		go report(strings.TrimRight(settings.URL, "/"), settings.MachineID, settings.Password, time.Duration(interval)*time.Second, stop)
+	}
+	return nil
+}
+
+// Stop disconnects from the local api and lifts its decisions
+func Stop() {
+	decisionsMutex.Lock()
+	if running != nil {
+		close(running)
+		running = nil
+	}
+	reporting = false
+	decisions = map[int64]activeDecision{}
+	feeds.Remove(BanList)
+	feeds.Remove(CaptchaList)
+	decisionsMutex.Unlock()
+}
+
+func poll(url string, apiKey string, interval time.Duration, stop chan struct{}) {
+
+	defer pnc.PanicHndl()
+
+	// The first request of a bouncer returns every active decision, the following ones only what changed since
+	startup := true
+	for {
+		stream, err := fetchDecisions(url, apiKey, startup)
+		if err == nil {
+			apply(stream, startup, stop)
+			startup = false
+		} else {
+			// Keep enforcing the decisions we know of, they expire by themselves
+			logger.Warn("CrowdSec decision stream failed", logger.Err(err))
+		}
+		expire(stop)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func fetchDecisions(url string, apiKey string, startup bool) (decisionStream, error) {
+
+	stream := decisionStream{}
+
+	startupParam := "false"
+	if startup {
+		startupParam = "true"
+	}
+	request, err := http.NewRequest(http.MethodGet, url+"/v1/decisions/stream?startup="+startupParam, nil)
+	if err != nil {
+		return stream, err
+	}
+	request.Header.Set("X-Api-Key", apiKey)
+	request.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return stream, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return stream, errors.New("unexpected status " + resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 256*1024*1024)).Decode(&stream)
+	return stream, err
+}
+
+// apply adds the new decisions of a stream and removes the deleted ones. A startup stream replaces all decisions
+func apply(stream decisionStream, startup bool, stop chan struct{}) {
+
+	now := time.Now()
+
+	decisionsMutex.Lock()
+	defer decisionsMutex.Unlock()
+
+	// The connection was stopped while the stream was fetched
+	if running != stop {
+		return
+	}
+	if startup {
+		decisions = map[int64]activeDecision{}
+	}
+	for _, decision := range stream.Deleted {
+		delete(decisions, decision.ID)
+	}
+	for _, decision := range stream.New {
+		kind := strings.ToLower(decision.Type)
+		if kind != "ban" && kind != "captcha" {
+			continue
+		}
+		var prefix *net.IPNet
+		switch strings.ToLower(decision.Scope) {
+		case "ip", "range":
+			prefix = feeds.ParsePrefix(decision.Value)
+		}
+		duration, err := time.ParseDuration(decision.Duration)
+		if prefix == nil || err != nil || duration <= 0 {
+			continue
+		}
+		decisions[decision.ID] = activeDecision{
+			kind:    kind,
+			prefix:  prefix,
+			expires: now.Add(duration),
+		}
+	}
+	enforce()
+}
+
+// expire drops decisions whose duration ran out before the local api told us to delete them
+func expire(stop chan struct{}) {
+	now := time.Now()
+	expired := false
+
+	decisionsMutex.Lock()
+	defer decisionsMutex.Unlock()
+
+	if running != stop {
+		return
+	}
+	for id, decision := range decisions {
+		if now.After(decision.expires) {
+			delete(decisions, id)
+			expired = true
+		}
+	}
+	if expired {
+		enforce()
+	}
+}
+
+// enforce hands the active decisions to the threat feeds. Has to be called with decisionsMutex locked
+func enforce() {
+	bans, captchas := []*net.IPNet{}, []*net.IPNet{}
+
+	for _, decision := range decisions {
+		if decision.kind == "ban" {
+			bans = append(bans, decision.prefix)
+		} else {
+			captchas = append(captchas, decision.prefix)
+		}
+	}
+
+	feeds.Set(BanList, "block", bans)
+	feeds.Set(CaptchaList, "captcha", captchas)
+}
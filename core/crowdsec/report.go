@@ -0,0 +1,273 @@
+package crowdsec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	Scenario = "balooproxy/escalation-ban" // scenario bans of the proxy are reported as
+	Origin   = "balooproxy"
+
+	maxQueuedBans = 10000
+)
+
+var (
+	// Bans waiting to be reported, reported in batches so an attack doesn't turn into as many requests to the local api
+	queuedBans      = []queuedBan{}
+	queuedBansMutex = &sync.Mutex{}
+
+	registerOnce = &sync.Once{}
+)
+
+type queuedBan struct {
+	ip     string
+	at     time.Time
+	until  time.Time
+	reason string
+}
+
+type alert struct {
+	Scenario        string          `json:"scenario"`
+	ScenarioHash    string          `json:"scenario_hash"`
+	ScenarioVersion string          `json:"scenario_version"`
+	Message         string          `json:"message"`
+	EventsCount     int             `json:"events_count"`
+	StartAt         string          `json:"start_at"`
+	StopAt          string          `json:"stop_at"`
+	Capacity        int             `json:"capacity"`
+	Leakspeed       string          `json:"leakspeed"`
+	Simulated       bool            `json:"simulated"`
+	Events          []alertEvent    `json:"events"`
+	Source          alertSource     `json:"source"`
+	Decisions       []alertDecision `json:"decisions"`
+}
+
+type alertEvent struct {
+	Timestamp string      `json:"timestamp"`
+	Meta      []alertMeta `json:"meta"`
+}
+
+type alertMeta struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type alertSource struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+	IP    string `json:"ip"`
+}
+
+type alertDecision struct {
+	Duration string `json:"duration"`
+	Origin   string `json:"origin"`
+	Scenario string `json:"scenario"`
+	Scope    string `json:"scope"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+}
+
+// report logs into the local api as a watcher and sends the bans of the proxy to it as alerts
+func report(url string, machineID string, password string, interval time.Duration, stop chan struct{}) {
+
+	defer pnc.PanicHndl()
+
+	token := ""
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		queuedBansMutex.Lock()
+		bans := queuedBans
+		queuedBans = []queuedBan{}
+		queuedBansMutex.Unlock()
+		if len(bans) == 0 {
+			continue
+		}
+
+		var err error
+		if token == "" {
+			token, err = login(url, machineID, password)
+		}
+		if err == nil {
+			err = sendAlerts(url, token, bans)
+			if err == errUnauthorized {
+				// The token expired
+				token, err = login(url, machineID, password)
+				if err == nil {
+					err = sendAlerts(url, token, bans)
+				}
+			}
+		}
+		if err != nil {
+			logger.Warn("Reporting to CrowdSec failed", logger.Err(err))
+			requeueBans(bans)
+		}
+	}
+}
+
+var errUnauthorized = errors.New("unauthorized")
+
+// startReporting registers for the bans of the proxy. Only bans that happen while reporting is running are sent
+func startReporting() {
+	registerOnce.Do(func() {
+		firewall.OnBan(queueBan)
+	})
+
+	queuedBansMutex.Lock()
+	queuedBans = []queuedBan{}
+	queuedBansMutex.Unlock()
+}
+
+// queueBan is registered with firewall.OnBan. Bans of other nodes of the cluster are reported by those nodes
+func queueBan(ip string, until time.Time, reason string) {
+	if reason == "cluster" || net.ParseIP(ip) == nil {
+		return
+	}
+
+	decisionsMutex.Lock()
+	report := reporting
+	decisionsMutex.Unlock()
+	if !report {
+		return
+	}
+
+	queuedBansMutex.Lock()
+	if len(queuedBans) < maxQueuedBans {
+		queuedBans = append(queuedBans, queuedBan{ip: ip, at: time.Now(), until: until, reason: reason})
+	}
+	queuedBansMutex.Unlock()
+}
+
+func requeueBans(bans []queuedBan) {
+	now := time.Now()
+
+	queuedBansMutex.Lock()
+	for _, ban := range bans {
+		if len(queuedBans) >= maxQueuedBans {
+			break
+		}
+		// Bans that already ended aren't worth reporting anymore
+		if ban.until.After(now) {
+			queuedBans = append(queuedBans, ban)
+		}
+	}
+	queuedBansMutex.Unlock()
+}
+
+func login(url string, machineID string, password string) (string, error) {
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"machine_id": machineID,
+		"password":   password,
+		"scenarios":  []string{Scenario},
+	})
+	request, err := http.NewRequest(http.MethodPost, url+"/v1/watchers/login", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("login failed with status " + resp.Status)
+	}
+	result := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Token == "" {
+		return "", errors.New("login returned no token")
+	}
+	return result.Token, nil
+}
+
+func sendAlerts(url string, token string, bans []queuedBan) error {
+
+	now := time.Now()
+	alerts := []alert{}
+	for _, ban := range bans {
+		duration := ban.until.Sub(now).Round(time.Second)
+		if duration <= 0 {
+			continue
+		}
+		at := ban.at.UTC().Format(time.RFC3339)
+		alerts = append(alerts, alert{
+			Scenario:        Scenario,
+			ScenarioHash:    "",
+			ScenarioVersion: "1",
+			Message:         "Ip " + ban.ip + " banned by balooProxy (" + ban.reason + ")",
+			EventsCount:     1,
+			StartAt:         at,
+			StopAt:          at,
+			Leakspeed:       "0",
+			Events: []alertEvent{{
+				Timestamp: at,
+				Meta: []alertMeta{
+					{Key: "source_ip", Value: ban.ip},
+					{Key: "reason", Value: ban.reason},
+				},
+			}},
+			Source: alertSource{
+				Scope: "Ip",
+				Value: ban.ip,
+				IP:    ban.ip,
+			},
+			Decisions: []alertDecision{{
+				Duration: duration.String(),
+				Origin:   Origin,
+				Scenario: Scenario,
+				Scope:    "Ip",
+				Type:     "ban",
+				Value:    ban.ip,
+			}},
+		})
+	}
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	body, _ := json.Marshal(alerts)
+	request, err := http.NewRequest(http.MethodPost, url+"/v1/alerts", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusUnauthorized:
+		return errUnauthorized
+	}
+	return errors.New("sending " + strconv.Itoa(len(alerts)) + " alerts failed with status " + resp.Status)
+}
@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultMinTTL = 5   // seconds
+	DefaultMaxTTL = 300 // seconds
+
+	// discovery routines per domain, so a config reload can stop the old ones
+	running      = map[string]chan struct{}{}
+	runningMutex = &sync.Mutex{}
+)
+
+// resolveFunc returns the currently available backends along with how long that answer stays valid.
+// Sources without a TTL (docker, kubernetes) return 0 and get polled every minTTL seconds
+type resolveFunc func() ([]string, time.Duration, error)
+
+// Validate checks the discovery mode of a domain, so typos fail the config instead of silently disabling discovery
+func Validate(settings domains.BackendDiscovery) error {
+	switch settings.Mode {
+	case "", "dns", "srv", "docker", "kubernetes":
+		return nil
+	}
+	return errors.New("unknown mode " + settings.Mode + ", use dns, srv, docker or kubernetes")
+}
+
+// Start begins backend discovery for a domain, replacing any discovery routine previously started for it.
+// Does nothing (apart from stopping the old routine) if no discovery mode is configured
+func Start(domainName string, backend string, settings domains.BackendDiscovery, pool *domains.BackendPool) {
+
+	Stop(domainName)
+
+	var resolve resolveFunc
+	switch settings.Mode {
+	case "dns":
+		resolve = dnsResolver(backend, settings)
+	case "srv":
+		resolve = srvResolver(backend, settings)
+	case "docker":
+		resolve = dockerResolver(domainName, settings)
+	case "kubernetes":
+		var err error
+		resolve, err = kubernetesResolver(settings)
+		if err != nil {
+			logger.Error("Backend discovery disabled", logger.Domain(domainName), logger.Err(err))
+			return
+		}
+	default:
+		return
+	}
+
+	stop := make(chan struct{})
+	runningMutex.Lock()
+	running[domainName] = stop
+	runningMutex.Unlock()
+
+	go run(domainName, settings, resolve, pool, stop)
+}
+
+// Stop ends backend discovery for a domain
+func Stop(domainName string) {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+
+	if stop, ok := running[domainName]; ok {
+		close(stop)
+		delete(running, domainName)
+	}
+}
+
+func run(domainName string, settings domains.BackendDiscovery, resolve resolveFunc, pool *domains.BackendPool, stop chan struct{}) {
+
+	defer pnc.PanicHndl()
+
+	minTTL, maxTTL := ttlBounds(settings)
+
+	for {
+		backends, ttl, err := resolve()
+		if err != nil {
+			// Keep the last known backends, a failing resolver shouldn't take the domain down
+			logger.Warn("Backend discovery failed", logger.Domain(domainName), logger.Err(err))
+			ttl = minTTL
+		} else if len(backends) == 0 {
+			// The pool ignores empty answers, a scaled down service shouldn't leave the domain without backends
+			logger.Warn("Backend discovery found no backends, keeping the last known ones", logger.Domain(domainName))
+		} else {
+			pool.Set(backends)
+		}
+
+		if ttl < minTTL {
+			ttl = minTTL
+		}
+		if ttl > maxTTL {
+			ttl = maxTTL
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(ttl):
+		}
+	}
+}
+
+func ttlBounds(settings domains.BackendDiscovery) (time.Duration, time.Duration) {
+	minTTL, maxTTL := DefaultMinTTL, DefaultMaxTTL
+	if settings.MinTTL > 0 {
+		minTTL = settings.MinTTL
+	}
+	if settings.MaxTTL > 0 {
+		maxTTL = settings.MaxTTL
+	}
+	if maxTTL < minTTL {
+		maxTTL = minTTL
+	}
+	return time.Duration(minTTL) * time.Second, time.Duration(maxTTL) * time.Second
+}
+
+// splitBackend splits a configured backend into host and port. The port is empty if none was specified
+func splitBackend(backend string) (string, string) {
+	host, port, err := net.SplitHostPort(backend)
+	if err != nil {
+		return backend, ""
+	}
+	return host, port
+}
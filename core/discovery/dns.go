@@ -0,0 +1,305 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"goProxy/core/domains"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	DNSTimeout     = 2 * time.Second
+	ResolvConfPath = "/etc/resolv.conf"
+
+	// Used when the system resolver had to be used, since it doesn't expose TTLs
+	FallbackTTL = 30 * time.Second
+
+	errTruncated = errors.New("dns response truncated")
+)
+
+// dnsResolver resolves all A/AAAA records of a hostname into backends
+func dnsResolver(backend string, settings domains.BackendDiscovery) resolveFunc {
+
+	host, port := splitBackend(backend)
+	host = strings.Trim(host, "[]")
+	if settings.Name != "" {
+		host = settings.Name
+	}
+	if settings.Port != 0 {
+		port = strconv.Itoa(settings.Port)
+	}
+
+	return func() ([]string, time.Duration, error) {
+		ips, ttl, err := lookupIPs(host)
+		if err != nil {
+			return nil, 0, err
+		}
+		return joinBackends(ips, port), ttl, nil
+	}
+}
+
+// srvResolver resolves the targets of the highest priority SRV records into backends, using the ports the records announce
+func srvResolver(backend string, settings domains.BackendDiscovery) resolveFunc {
+
+	name := settings.Name
+	if name == "" {
+		host, _ := splitBackend(backend)
+		name = host
+	}
+
+	return func() ([]string, time.Duration, error) {
+		resp, err := query(name, dnsmessage.TypeSRV)
+		if err != nil {
+			return srvFallback(name)
+		}
+
+		records := []dnsmessage.SRVResource{}
+		ttl := uint32(0)
+		for _, answer := range resp.Answers {
+			srv, ok := answer.Body.(*dnsmessage.SRVResource)
+			if !ok {
+				continue
+			}
+			records = append(records, *srv)
+			ttl = minTTL(ttl, answer.Header.TTL)
+		}
+		if len(records) == 0 {
+			return nil, 0, errors.New("no srv records found for " + name)
+		}
+
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].Priority < records[j].Priority
+		})
+
+		// Resolvers usually include the addresses of the targets, saving us another lookup
+		additional := map[string][]net.IP{}
+		for _, extra := range resp.Additionals {
+			switch body := extra.Body.(type) {
+			case *dnsmessage.AResource:
+				additional[extra.Header.Name.String()] = append(additional[extra.Header.Name.String()], net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				additional[extra.Header.Name.String()] = append(additional[extra.Header.Name.String()], net.IP(body.AAAA[:]))
+			}
+		}
+
+		backends := []string{}
+		for _, record := range records {
+			if record.Priority != records[0].Priority {
+				break
+			}
+			target := record.Target.String()
+			ips, found := additional[target]
+			if !found {
+				var targetTTL time.Duration
+				ips, targetTTL, err = lookupIPs(target)
+				if err != nil {
+					continue
+				}
+				ttl = minTTL(ttl, uint32(targetTTL.Seconds()))
+			}
+			backends = append(backends, joinBackends(ips, strconv.Itoa(int(record.Port)))...)
+		}
+
+		if len(backends) == 0 {
+			return nil, 0, errors.New("no srv target of " + name + " could be resolved")
+		}
+		return backends, time.Duration(ttl) * time.Second, nil
+	}
+}
+
+func srvFallback(name string) ([]string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DNSTimeout)
+	defer cancel()
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	backends := []string{}
+	for _, record := range records {
+		if record.Priority != records[0].Priority {
+			break
+		}
+		backends = append(backends, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+	}
+	return backends, FallbackTTL, nil
+}
+
+// lookupIPs resolves A and AAAA records of host, returning the lowest TTL among them
+func lookupIPs(host string) ([]net.IP, time.Duration, error) {
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, time.Duration(DefaultMaxTTL) * time.Second, nil
+	}
+
+	ips := []net.IP{}
+	ttl := uint32(0)
+	var lastErr error
+
+	for _, qType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		resp, err := query(host, qType)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, answer := range resp.Answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(body.A[:]))
+				ttl = minTTL(ttl, answer.Header.TTL)
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(body.AAAA[:]))
+				ttl = minTTL(ttl, answer.Header.TTL)
+			}
+		}
+	}
+
+	if len(ips) != 0 {
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+
+	if lastErr != nil {
+		// Our own client failed (truncated response, no resolv.conf, ...). Use the system resolver instead
+		ctx, cancel := context.WithTimeout(context.Background(), DNSTimeout)
+		defer cancel()
+
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+		return ips, FallbackTTL, nil
+	}
+
+	return nil, 0, errors.New("no records found for " + host)
+}
+
+// query sends a single dns question to the configured nameservers, returning the first valid response
+func query(name string, qType dnsmessage.Type) (*dnsmessage.Message, error) {
+
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(rand.Intn(65536))
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qName, Type: qType, Class: dnsmessage.ClassINET},
+		},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	servers, err := nameservers()
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := errors.New("no nameserver answered")
+	for _, server := range servers {
+		resp, err := exchange(server, packed, id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func exchange(server string, packed []byte, id uint16) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout("udp", server, DNSTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(DNSTimeout))
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := &dnsmessage.Message{}
+		if err := resp.Unpack(buf[:n]); err != nil || resp.ID != id {
+			// Not our answer, keep waiting until the deadline
+			continue
+		}
+		if resp.Truncated {
+			return nil, errTruncated
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess {
+			return nil, errors.New("dns query failed: " + resp.RCode.String())
+		}
+		return resp, nil
+	}
+}
+
+func nameservers() ([]string, error) {
+	file, err := os.Open(ResolvConfPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	servers := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no nameservers found in " + ResolvConfPath)
+	}
+	return servers, nil
+}
+
+func joinBackends(ips []net.IP, port string) []string {
+	backends := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if port == "" {
+			if ip.To4() == nil {
+				backends = append(backends, "["+ip.String()+"]")
+			} else {
+				backends = append(backends, ip.String())
+			}
+			continue
+		}
+		backends = append(backends, net.JoinHostPort(ip.String(), port))
+	}
+	return backends
+}
+
+func minTTL(current uint32, ttl uint32) uint32 {
+	if current == 0 || ttl < current {
+		return ttl
+	}
+	return current
+}
@@ -0,0 +1,141 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	DefaultDockerEndpoint = "unix:///var/run/docker.sock"
+	DefaultDockerLabel    = "balooproxy.domain"
+
+	// Containers can override the port balooProxy connects to with this label
+	DockerPortLabel = "balooproxy.port"
+)
+
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		PrivatePort int    `json:"PrivatePort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerResolver discovers running containers labeled with the domain (balooproxy.domain=example.com by default)
+func dockerResolver(domainName string, settings domains.BackendDiscovery) resolveFunc {
+
+	endpoint := settings.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultDockerEndpoint
+	}
+	label := settings.Label
+	if label == "" {
+		label = DefaultDockerLabel
+	}
+	value := settings.Name
+	if value == "" {
+		value = domainName
+	}
+
+	client, baseURL := dockerClient(endpoint)
+
+	filters, _ := json.Marshal(map[string][]string{
+		"label":  {label + "=" + value},
+		"status": {"running"},
+	})
+	listURL := baseURL + "/containers/json?filters=" + url.QueryEscape(string(filters))
+
+	return func() ([]string, time.Duration, error) {
+		resp, err := client.Get(listURL)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, 0, errors.New("docker api returned status " + strconv.Itoa(resp.StatusCode))
+		}
+
+		containers := []dockerContainer{}
+		if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+			return nil, 0, err
+		}
+
+		backends := []string{}
+		for _, container := range containers {
+			port := containerPort(container, settings.Port)
+			if port == 0 {
+				continue
+			}
+			// Maps are iterated in random order, containers in multiple networks would change their address every refresh
+			networkNames := make([]string, 0, len(container.NetworkSettings.Networks))
+			for networkName := range container.NetworkSettings.Networks {
+				networkNames = append(networkNames, networkName)
+			}
+			sort.Strings(networkNames)
+			for _, networkName := range networkNames {
+				network := container.NetworkSettings.Networks[networkName]
+				if network.IPAddress == "" || (settings.Network != "" && networkName != settings.Network) {
+					continue
+				}
+				backends = append(backends, net.JoinHostPort(network.IPAddress, strconv.Itoa(port)))
+				break
+			}
+		}
+		if len(backends) == 0 {
+			return nil, 0, errors.New("no running containers labeled " + label + "=" + value)
+		}
+
+		// Keep a stable order, so round-robin doesn't jump around between refreshes
+		sort.Strings(backends)
+		return backends, 0, nil
+	}
+}
+
+func containerPort(container dockerContainer, configuredPort int) int {
+	if portLabel, ok := container.Labels[DockerPortLabel]; ok {
+		if port, err := strconv.Atoi(portLabel); err == nil {
+			return port
+		}
+	}
+	if configuredPort != 0 {
+		return configuredPort
+	}
+	for _, port := range container.Ports {
+		if port.Type == "tcp" {
+			return port.PrivatePort
+		}
+	}
+	return 0
+}
+
+// dockerClient returns a http client for the docker api along with the base url requests should use
+func dockerClient(endpoint string) (*http.Client, string) {
+	if strings.HasPrefix(endpoint, "unix://") {
+		socket := strings.TrimPrefix(endpoint, "unix://")
+		return &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		}, "http://docker"
+	}
+	return &http.Client{Timeout: 5 * time.Second}, strings.Replace(strings.TrimSuffix(endpoint, "/"), "tcp://", "http://", 1)
+}
@@ -0,0 +1,125 @@
+package discovery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	KubernetesServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+type kubernetesEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name     string `json:"name"`
+			Port     int    `json:"port"`
+			Protocol string `json:"protocol"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// kubernetesResolver discovers the ready endpoints of a kubernetes service. Uses the in-cluster service account unless an api endpoint is configured
+func kubernetesResolver(settings domains.BackendDiscovery) (resolveFunc, error) {
+
+	service := settings.Name
+	if service == "" {
+		return nil, errors.New("kubernetes discovery requires the service name to be set")
+	}
+
+	namespace := settings.Namespace
+	if namespace == "" {
+		if ns, err := os.ReadFile(KubernetesServiceAccountPath + "/namespace"); err == nil {
+			namespace = strings.TrimSpace(string(ns))
+		} else {
+			namespace = "default"
+		}
+	}
+
+	apiServer := settings.Endpoint
+	if apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, errors.New("not running inside kubernetes and no api endpoint configured")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+
+	tlsConfig := &tls.Config{}
+	if ca, err := os.ReadFile(KubernetesServiceAccountPath + "/ca.crt"); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		tlsConfig.RootCAs = pool
+	}
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	endpointsURL := strings.TrimSuffix(apiServer, "/") + "/api/v1/namespaces/" + namespace + "/endpoints/" + service
+
+	return func() ([]string, time.Duration, error) {
+		req, err := http.NewRequest("GET", endpointsURL, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		// The token gets rotated by kubernetes, so read it every time
+		if token, err := os.ReadFile(KubernetesServiceAccountPath + "/token"); err == nil {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, 0, errors.New("kubernetes api returned status " + strconv.Itoa(resp.StatusCode) + " for " + namespace + "/" + service)
+		}
+
+		endpoints := kubernetesEndpoints{}
+		if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+			return nil, 0, err
+		}
+
+		backends := []string{}
+		for _, subset := range endpoints.Subsets {
+			port := 0
+			for _, subsetPort := range subset.Ports {
+				if subsetPort.Protocol != "" && subsetPort.Protocol != "TCP" {
+					continue
+				}
+				if settings.Port == 0 || subsetPort.Port == settings.Port {
+					port = subsetPort.Port
+					break
+				}
+			}
+			if port == 0 {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				backends = append(backends, net.JoinHostPort(address.IP, strconv.Itoa(port)))
+			}
+		}
+		if len(backends) == 0 {
+			return nil, 0, errors.New("service " + namespace + "/" + service + " has no ready endpoints")
+		}
+
+		sort.Strings(backends)
+		return backends, 0, nil
+	}, nil
+}
@@ -0,0 +1,52 @@
+package domains
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// BackendPool holds the currently active backends of a domain. It's shared between the reverse proxy and backend discovery
+type BackendPool struct {
+	mutex    *sync.RWMutex
+	backends []string
+	next     uint32
+}
+
+func NewBackendPool(backends ...string) *BackendPool {
+	return &BackendPool{
+		mutex:    &sync.RWMutex{},
+		backends: backends,
+	}
+}
+
+// Next returns the next backend in round-robin order
+func (pool *BackendPool) Next() string {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	if len(pool.backends) == 0 {
+		return ""
+	}
+	index := atomic.AddUint32(&pool.next, 1)
+	return pool.backends[int(index)%len(pool.backends)]
+}
+
+// Set replaces the active backends. Empty updates are ignored, as a pool without backends can't serve anything
+func (pool *BackendPool) Set(backends []string) {
+	if len(backends) == 0 {
+		return
+	}
+	pool.mutex.Lock()
+	pool.backends = backends
+	pool.mutex.Unlock()
+}
+
+// List returns a copy of the active backends
+func (pool *BackendPool) List() []string {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	backends := make([]string, len(pool.backends))
+	copy(backends, pool.backends)
+	return backends
+}
@@ -2,6 +2,7 @@ package domains
 
 import (
 	"crypto/tls"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"sync"
@@ -15,6 +16,9 @@ var (
 	DomainsMap  sync.Map
 	DomainsData = map[string]DomainData{}
 	Config      *Configuration
+
+	// Held by ReloadConfig while it replaces Config. Routines reading Config outside of it take a read lock
+	ConfigLock = &sync.RWMutex{}
 )
 
 type Configuration struct {
@@ -23,20 +27,259 @@ type Configuration struct {
 }
 
 type Domain struct {
-	Name                string          `json:"name"`
-	Backend             string          `json:"backend"`
-	Scheme              string          `json:"scheme"`
-	Certificate         string          `json:"certificate"`
-	Key                 string          `json:"key"`
-	Webhook             WebhookSettings `json:"webhook"`
-	FirewallRules       []JsonRule      `json:"firewallRules"`
-	BypassStage1        int             `json:"bypassStage1"`
-	BypassStage2        int             `json:"bypassStage2"`
-	Stage2Difficulty    int             `json:"stage2Difficulty"`
-	DisableBypassStage3 int             `json:"disableBypassStage3"`
-	DisableRawStage3    int             `json:"disableRawStage3"`
-	DisableBypassStage2 int             `json:"disableBypassStage2"`
-	DisableRawStage2    int             `json:"disableRawStage2"`
+	Name                string                  `json:"name"`
+	Backend             string                  `json:"backend"`
+	Scheme              string                  `json:"scheme"`
+	Certificate         string                  `json:"certificate"`
+	Key                 string                  `json:"key"`
+	Webhook             WebhookSettings         `json:"webhook"`
+	FirewallRules       []JsonRule              `json:"firewallRules"`
+	ShadowRules         bool                    `json:"shadowRules"` // count and log matches of all firewall rules without enforcing them
+	RemoteRulesets      []RemoteRuleset         `json:"remoteRulesets"`
+	BypassStage1        int                     `json:"bypassStage1"`
+	BypassStage2        int                     `json:"bypassStage2"`
+	Stage2Difficulty    int                     `json:"stage2Difficulty"`
+	DisableBypassStage3 int                     `json:"disableBypassStage3"`
+	DisableRawStage3    int                     `json:"disableRawStage3"`
+	DisableBypassStage2 int                     `json:"disableBypassStage2"`
+	DisableRawStage2    int                     `json:"disableRawStage2"`
+	ProxyProtocol       int                     `json:"proxyProtocol"`
+	BackendDiscovery    BackendDiscovery        `json:"backendDiscovery"`
+	UpstreamPool        UpstreamPoolSettings    `json:"upstreamPool"`
+	Retry               RetrySettings           `json:"retry"`
+	UpstreamTimeout     UpstreamTimeoutSettings `json:"upstreamTimeout"`
+	MaxBodySize         int64                   `json:"maxBodySize"`
+	BodyLimits          []PathBodyLimit         `json:"bodyLimits"`
+	PathRatelimits      []PathRatelimit         `json:"pathRatelimits"`
+	WindowLimits        WindowLimits            `json:"windowLimits"`
+	CountryRatelimits   []CountryRatelimit      `json:"countryRatelimits"`
+	Ratelimit           RatelimitSettings       `json:"ratelimit"`
+	Concurrency         ConcurrencySettings     `json:"concurrency"`
+	BodyInspection      BodyInspectionSettings  `json:"bodyInspection"`
+	WAF                 WAFSettings             `json:"waf"`
+	Captcha             CaptchaSettings         `json:"captcha"`
+	Templates           TemplateSettings        `json:"templates"`
+	Exemptions          []ChallengeExemption    `json:"exemptions"`
+	ForcedChallenges    []ForcedChallenge       `json:"forcedChallenges"`
+	Clearance           ClearanceSettings       `json:"clearance"`
+	Fallback            FallbackSettings        `json:"fallback"`
+	BrowserSignals      BrowserSignalSettings   `json:"browserSignals"`
+	ReputationWeights   map[string]int          `json:"reputationWeights"` // event -> weight, overrides the weights of the proxy
+	HoneypotPaths       []string                `json:"honeypotPaths"`     // path prefixes nothing links to, requesting them costs reputation and gets blocked
+	TorPolicy           string                  `json:"torPolicy"`         // "allow", "challenge", "captcha" or "block" tor exit nodes
+	GeoFiltering        *GeoFilterPolicy        `json:"geoFiltering"`      // overrides the geo filter policy of the proxy
+	Script              ScriptSettings          `json:"script"`
+	ForwardAuth         ForwardAuthSettings     `json:"forwardAuth"`
+	PathProtections     []PathProtection        `json:"pathProtections"`
+	AccessLog           AccessLogSettings       `json:"accessLog"`
+}
+
+// AccessLogSettings write every request to the domain to a file, along with what the firewall did with it
+type AccessLogSettings struct {
+	File     string `json:"file"`     // no access log is written if empty
+	Format   string `json:"format"`   // "combined" or "json", defaults to "combined"
+	MaxSize  int    `json:"maxSize"`  // megabytes the file may grow to before it's rotated, defaults to 100
+	Rotate   string `json:"rotate"`   // "hourly" or "daily" additionally rotates the file every hour or day
+	MaxFiles int    `json:"maxFiles"` // rotated files that are kept, defaults to 10
+	Compress bool   `json:"compress"` // gzip rotated files
+
+	// What is logged, for the file as well as for log shipping
+	Actions    []string `json:"actions"`    // "allow", "challenge", "block", "tarpit" and/or "other", all if empty
+	SampleRate int      `json:"sampleRate"` // only 1 in sampleRate allowed requests is logged, challenged and blocked ones always are
+	Redact     []string `json:"redact"`     // "query" (of the uri and referer), "cookies" (their values) and/or "ip" (its last bits)
+	Headers    []string `json:"headers"`    // request headers that are logged
+}
+
+// PathProtection restricts paths to some networks and/or users, without having to touch the backend
+type PathProtection struct {
+	Paths   []string          `json:"paths"`   // path prefixes
+	CIDRs   []string          `json:"cidrs"`   // source ips or cidrs
+	Users   map[string]string `json:"users"`   // user -> bcrypt hash (or plain password) for basic auth
+	Satisfy string            `json:"satisfy"` // "all" (default) has to be in a network and log in, "any" either
+	Realm   string            `json:"realm"`   // shown by browsers when asking to log in, defaults to "Restricted"
+
+	Networks []*net.IPNet `json:"-"` // parsed CIDRs
+}
+
+// ForwardAuthSettings ask an external service (oauth2-proxy, authelia, ...) whether a request may reach the backend
+type ForwardAuthSettings struct {
+	URL             string   `json:"url"`
+	RequestHeaders  []string `json:"requestHeaders"`  // headers of the request passed to the service, all if empty
+	ResponseHeaders []string `json:"responseHeaders"` // headers of the answer of the service passed to the backend, e.g. Remote-User
+	Exclude         []string `json:"exclude"`         // path prefixes that don't need authentication
+	Timeout         int      `json:"timeout"`         // seconds, defaults to 5
+
+	Client *http.Client `json:"-"`
+}
+
+// ScriptSettings load a lua script whose hooks are called for the requests of the domain
+type ScriptSettings struct {
+	File    string `json:"file"`
+	Timeout int    `json:"timeout"` // milliseconds a hook may take, defaults to 10
+}
+
+// RemoteRuleset is a signed ruleset the domain is subscribed to. Its rules are checked after the local rules
+type RemoteRuleset struct {
+	URL       string `json:"url"`
+	PublicKey string `json:"publicKey"` // base64 encoded ed25519 key the ruleset is signed with
+	Interval  int    `json:"interval"`  // seconds between updates
+}
+
+type BrowserSignalSettings struct {
+	Enabled            bool `json:"enabled"`            // verify browser signals before handing out the clearance of the js challenge
+	MaxInconsistencies int  `json:"maxInconsistencies"` // signals that may not add up. 0 uses 1, -1 tolerates none
+}
+
+type FallbackSettings struct {
+	NoScript   bool `json:"noscript"`   // let clients without javascript answer a question instead of solving the js challenge
+	Accessible bool `json:"accessible"` // ignored, the question is too easy for bots to replace the captcha
+}
+
+type ClearanceSettings struct {
+	Lifetime       int      `json:"lifetime"`       // seconds a clearance is valid for
+	AttackLifetime int      `json:"attackLifetime"` // lifetime while the domain is under attack. 0 uses lifetime
+	Renew          bool     `json:"renew"`          // renew clearances of returning clients instead of challenging them again
+	Scope          string   `json:"scope"`          // "domain", "subdomains" or "path"
+	CookieDomain   string   `json:"cookieDomain"`   // "subdomains" only: domain the clearance is shared on
+	Paths          []string `json:"paths"`          // "path" only: path prefixes that need their own clearance
+}
+
+// ForcedChallenge challenges requests to sensitive paths with at least Stage, no matter which stage the domain is in
+type ForcedChallenge struct {
+	Paths   []string `json:"paths"` // path prefixes
+	Methods []string `json:"methods"`
+	Stage   int      `json:"stage"` // 2 (js challenge) or 3 (captcha)
+}
+
+// ChallengeExemption skips challenges for requests that match all of its (non-empty) conditions
+type ChallengeExemption struct {
+	Paths   []string          `json:"paths"` // path prefixes
+	Methods []string          `json:"methods"`
+	Headers map[string]string `json:"headers"` // header -> exact value
+	CIDRs   []string          `json:"cidrs"`   // source ips or cidrs
+
+	Networks []*net.IPNet `json:"-"` // parsed CIDRs
+}
+
+type TemplateSettings struct {
+	Stage2          string                       `json:"stage2"` // path to the html template of the js challenge
+	Stage3          string                       `json:"stage3"` // path to the html template of the captcha
+	Brand           string                       `json:"brand"`
+	Logo            string                       `json:"logo"`
+	DefaultLanguage string                       `json:"defaultLanguage"`
+	Texts           map[string]map[string]string `json:"texts"` // language -> key -> text, filled in for {{text.<key>}}
+}
+
+// ChallengeTemplates are the loaded TemplateSettings of a domain
+type ChallengeTemplates struct {
+	Stage2 []string // split at its placeholders, every odd element is the name of a placeholder. nil serves the built-in page
+	Stage3 []string
+
+	Brand           string
+	Logo            string
+	DefaultLanguage string
+	Texts           map[string]map[string]string
+}
+
+type CaptchaSettings struct {
+	Provider    string `json:"provider"` // "hcaptcha", "turnstile" or "recaptcha" (v3). Empty uses the built-in captcha
+	SiteKey     string `json:"siteKey"`
+	Secret      string `json:"secret"`
+	Appearance  string `json:"appearance"`  // turnstile only: "always", "execute" or "interaction-only"
+	MaxFailures int    `json:"maxFailures"` // failed verifications per ip within 10 minutes before it's blocked. -1 disables the limit
+
+	// reCAPTCHA v3 only
+	ScoreWeight float64 `json:"scoreWeight"` // share of the recaptcha score in the combined score, the rest is the reputation of the ip
+	AllowScore  int     `json:"allowScore"`  // combined score (0-100) from which clients pass
+	BlockScore  int     `json:"blockScore"`  // combined score below which clients are blocked. Clients in between solve the built-in captcha
+}
+
+type PathBodyLimit struct {
+	Path        string `json:"path"`        // path prefix, the longest matching prefix wins
+	MaxBodySize int64  `json:"maxBodySize"` // bytes. -1 disables the limit for this path
+}
+
+// RatelimitSettings select how the IPRatelimit of a domain is enforced
+type RatelimitSettings struct {
+	Mode  string  `json:"mode"`  // "window" counts requests per ratelimit window, "tokenBucket" refills rate tokens per second up to burst
+	Rate  float64 `json:"rate"`  // tokenBucket only: requests per second
+	Burst int     `json:"burst"` // tokenBucket only: requests an ip can send at once
+}
+
+// WindowLimits are the requests every ip can send to a domain within each window of the multi-window tracking. 0 disables the limit of a window
+type WindowLimits struct {
+	Burst  int `json:"burst"`
+	Short  int `json:"short"`
+	Medium int `json:"medium"`
+	Long   int `json:"long"`
+}
+
+type ConcurrencySettings struct {
+	MaxInFlight  int `json:"maxInFlight"`  // requests proxied at once. 0 disables the limit
+	QueueTimeout int `json:"queueTimeout"` // milliseconds requests above the limit wait before they are rejected
+}
+
+// PathRatelimit limits the requests every ip can send to a path prefix, on top of the global ratelimit
+type PathRatelimit struct {
+	Path     string `json:"path"`     // path prefix, the longest matching prefix wins
+	Requests int    `json:"requests"` // requests per window before the ip is ratelimited
+	Window   string `json:"window"`   // "burst", "short", "medium" or "long" window of the multi-window tracking
+}
+
+// CountryRatelimit caps the requests all ips of a country together can send to a domain, every country is counted separately
+type CountryRatelimit struct {
+	Countries []string `json:"countries"` // country codes, "*" for every country no other limit lists
+	Requests  int      `json:"requests"`  // requests per window before the country is ratelimited. 0 doesn't limit the countries
+	Window    string   `json:"window"`    // "burst", "short", "medium" or "long" window of the multi-window tracking
+}
+
+type BodyInspectionSettings struct {
+	Enabled bool `json:"enabled"` // let firewall rules match the beginning of request bodies
+	MaxSize int  `json:"maxSize"` // kilobytes that are buffered and inspected
+}
+
+type WAFSettings struct {
+	Enabled bool     `json:"enabled"`
+	Action  string   `json:"action"`  // "block", "challenge" or "log"
+	Classes []string `json:"classes"` // attack classes to detect. Empty detects all
+	Exclude []string `json:"exclude"` // ids of signatures to skip
+
+	CRS              []string `json:"crs"`              // OWASP CRS .conf files or their converted json form
+	ParanoiaLevel    int      `json:"paranoiaLevel"`    // highest crs paranoia level (1-4) whose rules are loaded
+	AnomalyThreshold int      `json:"anomalyThreshold"` // crs anomaly score requests are blocked at. 0 uses 5
+}
+
+type UpstreamTimeoutSettings struct {
+	Dial           int `json:"dial"`           // seconds
+	ResponseHeader int `json:"responseHeader"` // seconds
+	Total          int `json:"total"`          // seconds, including retries
+}
+
+type RetrySettings struct {
+	Attempts      int   `json:"attempts"`      // retries after the first attempt. 0 disables retrying
+	Backoff       int   `json:"backoff"`       // milliseconds, doubled after every retry
+	NonIdempotent bool  `json:"nonIdempotent"` // also retry methods like POST
+	StatusCodes   []int `json:"statusCodes"`   // defaults to 502 and 503
+}
+
+type UpstreamPoolSettings struct {
+	MaxIdleConns        int `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int `json:"maxConnsPerHost"`
+	IdleConnTimeout     int `json:"idleConnTimeout"`     // seconds
+	TLSHandshakeTimeout int `json:"tlsHandshakeTimeout"` // seconds
+}
+
+type BackendDiscovery struct {
+	Mode      string `json:"mode"`      // "dns", "srv", "docker" or "kubernetes". Empty disables discovery
+	Name      string `json:"name"`      // hostname/srv record to resolve, docker label value or kubernetes service
+	Port      int    `json:"port"`      // port to connect to. Defaults to the port of backend (dns) or the first exposed port (docker/kubernetes)
+	MinTTL    int    `json:"minTTL"`    // seconds
+	MaxTTL    int    `json:"maxTTL"`    // seconds
+	Endpoint  string `json:"endpoint"`  // docker socket/url or kubernetes api server. Defaults to the local socket/in-cluster api
+	Label     string `json:"label"`     // docker label key. Defaults to "balooproxy.domain"
+	Network   string `json:"network"`   // docker network to use the container ip of. Defaults to the first network by name
+	Namespace string `json:"namespace"` // kubernetes namespace. Defaults to the namespace balooProxy runs in
 }
 
 type DomainSettings struct {
@@ -44,11 +287,43 @@ type DomainSettings struct {
 
 	CustomRules    []Rule
 	RawCustomRules []JsonRule
+	RemoteRules    *RemoteRules
 
 	DomainProxy        *httputil.ReverseProxy
+	Backends           *BackendPool
 	DomainCertificates tls.Certificate
 	DomainWebhooks     WebhookSettings
 
+	ProxyProtocol int
+	MaxBodySize   int64
+	BodyLimits    []PathBodyLimit
+	Captcha       CaptchaSettings
+	Templates     ChallengeTemplates
+	Exemptions    []ChallengeExemption
+
+	BodyInspection    BodyInspectionSettings
+	WAF               WAFSettings
+	PathRatelimits    []PathRatelimit
+	WindowLimits      WindowLimits
+	CountryRatelimits []CountryRatelimit
+	Ratelimit         RatelimitSettings
+	Concurrency       ConcurrencySettings
+
+	ForcedChallenges []ForcedChallenge
+
+	Clearance      ClearanceSettings
+	ClearanceScope string // name clearances are issued under, shared by all domains with the same cookieDomain
+
+	Fallback       FallbackSettings
+	BrowserSignals BrowserSignalSettings
+
+	ReputationWeights map[string]int
+	HoneypotPaths     []string
+	TorPolicy         string
+	GeoFiltering      GeoFilterPolicy
+	ForwardAuth       ForwardAuthSettings
+	PathProtections   []PathProtection
+
 	BypassStage1        int
 	BypassStage2        int
 	DisableBypassStage3 int
@@ -63,8 +338,16 @@ type DomainLog struct {
 	BrowserFP string
 	BotFP     string
 	TLSFP     string
+	JA3       string
+	JA4       string
+	JA4H      string
+	HTTP2     string
+	HeaderFP  string
 	Useragent string
 	Path      string
+
+	LoggedRules []int  // log-only rules the request matched
+	WAF         string // signature the request matched, if the waf only logs
 }
 
 type DomainData struct {
@@ -107,13 +390,337 @@ type Proxy struct {
 	Challenge       ChallengeSettings `json:"challenge"`
 	GeoFiltering    GeoFilteringSettings `json:"geoFiltering"`
 	Monitoring      MonitoringSettings `json:"monitoring"`
+	TrustedProxies  TrustedProxySettings `json:"trustedProxies"`
+	MaxBodySize     int64             `json:"maxBodySize"`
+	HeaderLimits    HeaderLimitSettings `json:"headerLimits"`
+	SlowRead        SlowReadSettings  `json:"slowRead"`
+	Tarpit          TarpitSettings    `json:"tarpit"`
+	JA4Fingerprints JA4FingerprintLists `json:"ja4Fingerprints"`
+	Fingerprints    FingerprintSettings `json:"fingerprints"`
+	FingerprintStatsRetention int `json:"fingerprintStatsRetention"` // hours
+	CookieBinding   CookieBindingSettings `json:"cookieBinding"`
+	Escalation      EscalationSettings    `json:"escalation"`
+	ClearanceTokens ClearanceTokenSettings `json:"clearanceTokens"`
+	BackendProtection BackendProtectionSettings `json:"backendProtection"`
+	Cluster         ClusterSettings       `json:"cluster"`
+	ThreatFeeds     []ThreatFeed          `json:"threatFeeds"`
+	CrowdSec        CrowdSecSettings      `json:"crowdsec"`
+	KernelBans      KernelBanSettings     `json:"kernelBans"`
+	XDP             XDPSettings           `json:"xdp"`
+	Spamhaus        SpamhausSettings      `json:"spamhaus"`
+	Tor             TorSettings           `json:"tor"`
+	IPClassification IPClassificationSettings `json:"ipClassification"`
+	AttackReports   AttackReportSettings  `json:"attackReports"`
+	RequestCapture  RequestCaptureSettings `json:"requestCapture"`
+	Webhooks        WebhookQueueSettings  `json:"webhooks"`
+	EventSinks      []EventSinkSettings   `json:"eventSinks"`
+	Plugins         PluginSettings        `json:"plugins"`
+	Logging         LogSettings           `json:"logging"`
+	LogShipping     []LogShipperSettings  `json:"logShipping"`
+	Tracing         TracingSettings       `json:"tracing"`
+	Profiling       ProfilingSettings     `json:"profiling"`
 }
 
-type ReputationSettings struct {
+// ProfilingSettings serve pprof profiles, goroutine dumps and gc statistics on a listener of their own, never on the domains
+type ProfilingSettings struct {
+	Enabled bool   `json:"enabled"`
+	Address string `json:"address"` // defaults to 127.0.0.1:6060
+}
+
+// TracingSettings export spans of the requests the proxy handles to an OpenTelemetry collector over OTLP
+type TracingSettings struct {
+	Endpoint    string            `json:"endpoint"`    // e.g. http://otel-collector:4318 (http) or http://otel-collector:4317 (grpc), https for tls. Tracing is off if empty
+	Protocol    string            `json:"protocol"`    // "http" or "grpc", defaults to "http"
+	Headers     map[string]string `json:"headers"`     // e.g. an api key of the tracing backend
+	SampleRatio float64           `json:"sampleRatio"` // share of the traces started by the proxy that are exported, defaults to 1. Traces of clients keep their decision
+	ServiceName string            `json:"serviceName"` // defaults to "balooproxy"
+}
+
+// LogShipperSettings push access logs and events to a log store in batches, without a log shipper next to the proxy
+type LogShipperSettings struct {
+	Type          string            `json:"type"`          // "loki", "elasticsearch" (elasticsearch and opensearch), "syslog", "kafka" or "nats"
+	URL           string            `json:"url"`           // e.g. http://loki:3100, https://elasticsearch:9200, udp://siem:514 (udp, tcp, tls or unix) or nats://nats:4222
+	Brokers       []string          `json:"brokers"`       // kafka, e.g. ["kafka-1:9092", "kafka-2:9092"]
+	Topic         string            `json:"topic"`         // kafka and nats, {source} and {type} are replaced. Defaults to "balooproxy.{source}"
+	TLS           bool              `json:"tls"`           // kafka
+	Headers       map[string]string `json:"headers"`       // e.g. an authorization header
+	Username      string            `json:"username"`      // basic auth, sasl/plain for kafka and user credentials for nats
+	Password      string            `json:"password"`
+	Logs          []string          `json:"logs"`          // "access" and/or "events", both if empty
+	Events        []string          `json:"events"`        // types of events, all if empty
+	Labels        map[string]string `json:"labels"`        // loki, added to the source and domain of every entry
+	Index         string            `json:"index"`         // elasticsearch, {date} is replaced with the day. Defaults to "balooproxy-{date}"
+	Facility      string            `json:"facility"`      // syslog, e.g. "daemon" or "local0". Defaults to "local0"
+	BatchSize     int               `json:"batchSize"`     // entries per push, defaults to 500
+	FlushInterval int               `json:"flushInterval"` // seconds entries wait for a batch to fill up, defaults to 5
+	QueueSize     int               `json:"queueSize"`     // entries that can wait to be pushed, more are dropped. Defaults to 10000
+	Timeout       int               `json:"timeout"`       // seconds a push may take, defaults to 10
+}
+
+// LogSettings configure the log errors and other things the proxy runs into are written to
+type LogSettings struct {
+	Level  string `json:"level"`  // "debug", "info", "warn" or "error", defaults to "info"
+	Format string `json:"format"` // "console" or "json", defaults to "console"
+	Output string `json:"output"` // "stdout", "stderr" or a file, defaults to "proxy.log"
+}
+
+// PluginSettings load wasm filters that decide about requests from a directory
+type PluginSettings struct {
+	Directory string `json:"directory"` // no plugins are loaded if empty
+	Timeout   int    `json:"timeout"`   // milliseconds a plugin may take per request, defaults to 10
+	MaxMemory int    `json:"maxMemory"` // megabytes of memory per plugin instance, defaults to 16
+	Instances int    `json:"instances"` // instances per plugin, requests wait for a free one. Defaults to the number of cpus
+}
+
+// EventSinkSettings pass the events of the proxy (blocked requests, stage changes, bans, ...) on to a webhook, a log file or a script
+type EventSinkSettings struct {
+	Type    string            `json:"type"`    // "webhook", "log" or "script"
+	Events  []string          `json:"events"`  // types of events, all if empty
+	URL     string            `json:"url"`     // webhook
+	Headers map[string]string `json:"headers"` // webhook
+	Path    string            `json:"path"`    // log, defaults to "events.log"
+	Command string            `json:"command"` // script, gets the event as json on stdin
+	Args    []string          `json:"args"`    // script
+	Timeout int               `json:"timeout"` // seconds the webhook or script may take, defaults to 10
+}
+
+// WebhookQueueSettings configure how the webhooks of all domains are delivered
+type WebhookQueueSettings struct {
+	QueueSize         int    `json:"queueSize"`         // alerts waiting to be sent, defaults to 256
+	Retries           int    `json:"retries"`           // defaults to 5, -1 doesn't retry
+	Backoff           int    `json:"backoff"`           // seconds before the first retry, doubles with every retry. Defaults to 2
+	MaxBackoff        int    `json:"maxBackoff"`        // seconds, defaults to 60
+	MinAttackDuration int    `json:"minAttackDuration"` // seconds an attack has to last to be notified about
+	DeadLetterFile    string `json:"deadLetterFile"`    // alerts that couldn't be delivered, defaults to "webhooks.failed.log"
+}
+
+// RequestCaptureSettings sample requests to domains under attack into rotating files, for offline analysis
+type RequestCaptureSettings struct {
+	Enabled     bool   `json:"enabled"`
+	SampleRate  int    `json:"sampleRate"`  // 1 in sampleRate requests is captured, defaults to 1000
+	Directory   string `json:"directory"`   // defaults to "captures"
+	Format      string `json:"format"`      // "jsonl" or "har", defaults to jsonl
+	MaxFileSize int    `json:"maxFileSize"` // megabytes per file, defaults to 10
+	MaxFiles    int    `json:"maxFiles"`    // files kept, defaults to 10
+}
+
+// AttackReportSettings write a report of every attack to disk once it's over
+type AttackReportSettings struct {
+	Enabled        bool     `json:"enabled"`
+	Directory      string   `json:"directory"`      // defaults to "reports"
+	Formats        []string `json:"formats"`        // "json" and/or "html", defaults to both
+	WebhookSummary bool     `json:"webhookSummary"` // adds the top ips, countries and paths to the attack end webhook
+}
+
+// IPClassificationSettings tell datacenter and vpn ips apart from residential ones, by their ASN and by prefix lists
+type IPClassificationSettings struct {
+	Enabled    bool     `json:"enabled"`
+	Datacenter []string `json:"datacenter"` // urls or files of prefix lists, defaults to a public list if missing
+	VPN        []string `json:"vpn"`
+	Interval   int      `json:"interval"` // seconds between downloads
+
+	DatacenterASNs []int `json:"datacenterAsns"` // added to the built-in ASNs
+	VPNASNs        []int `json:"vpnAsns"`
+
+	DifficultyAdjustment int     `json:"difficultyAdjustment"` // added to the dynamic difficulty of classified ips
+	RatelimitFactor      float64 `json:"ratelimitFactor"`      // adaptive ratelimits of classified ips are scaled by this
+}
+
+// TorSettings download the list of tor exit nodes, for the torPolicy of domains and rules
+type TorSettings struct {
+	Enabled  bool `json:"enabled"`
+	Interval int  `json:"interval"` // seconds between downloads
+}
+
+// SpamhausSettings subscribe to the Spamhaus DROP lists as threat feeds
+type SpamhausSettings struct {
+	Enabled  bool   `json:"enabled"`
+	Interval int    `json:"interval"` // seconds between downloads
+	Action   string `json:"action"`   // see ThreatFeed, defaults to "block"
+}
+
+// XDPSettings attach an xdp program that drops packets of banned ips and prefixes in the driver
+type XDPSettings struct {
+	Enabled    bool     `json:"enabled"`
+	Interfaces []string `json:"interfaces"`
+	Mode       string   `json:"mode"`    // "native" (in the driver) or "generic" (for drivers without xdp support)
+	SynRate    int      `json:"synRate"` // syns an ip may send per second, 0 to not limit them
+}
+
+// KernelBanSettings push bans into an nftables set or ipset, so the kernel drops packets of banned ips
+type KernelBanSettings struct {
+	Enabled bool   `json:"enabled"`
+	Driver  string `json:"driver"` // "nftables" or "ipset"
+	Table   string `json:"table"`  // nftables table, prefix of the ipsets
+	Set     string `json:"set"`    // bans go into <set>_v4 and <set>_v6
+	Setup   bool   `json:"setup"`  // create the sets and the rules that drop their ips
+}
+
+// CrowdSecSettings connect the proxy to a crowdsec local api, as a bouncer and optionally as a watcher that reports bans
+type CrowdSecSettings struct {
+	Enabled  bool   `json:"enabled"`
+	URL      string `json:"url"`      // e.g. http://127.0.0.1:8080
+	APIKey   string `json:"apiKey"`   // of a bouncer, see cscli bouncers add
+	Interval int    `json:"interval"` // seconds between polls of the decision stream
+
+	Report    bool   `json:"report"`    // send bans of the proxy to the local api as alerts
+	MachineID string `json:"machineId"` // login of a watcher, see cscli machines add
+	Password  string `json:"password"`
+}
+
+// ThreatFeed is a list of ips and prefixes that's downloaded periodically, e.g. a FireHOL netset or the AbuseIPDB blacklist
+type ThreatFeed struct {
+	Name     string            `json:"name"`
+	URL      string            `json:"url"`
+	Interval int               `json:"interval"` // seconds between downloads
+	Action   string            `json:"action"`   // "block", "captcha", "js", "cookie" or "" to only use the list in rules
+	Headers  map[string]string `json:"headers"`  // e.g. the Key of AbuseIPDB
+}
+
+type ClusterSettings struct {
+	Enabled bool     `json:"enabled"`
+	Node    string   `json:"node"`   // name of this node, unique within the cluster. Defaults to the hostname
+	Listen  string   `json:"listen"` // udp address peers send their events to
+	Peers   []string `json:"peers"`  // udp addresses of the other nodes
+	Secret  string   `json:"secret"` // signs every message, has to be the same on every node
+
+	ShareReputation bool `json:"shareReputation"` // send decreases of reputations to peers and apply theirs
+	ReputationRate  int  `json:"reputationRate"`  // reputation changes sent per second, and accepted from every peer
+}
+
+// BackendProtectionSettings cap the requests forwarded to every backend, no matter how legitimate they look
+type BackendProtectionSettings struct {
+	MaxRequestsPerSecond int    `json:"maxRequestsPerSecond"` // 0 disables the limit
+	MaxConcurrent        int    `json:"maxConcurrent"`        // requests in flight at once. 0 disables the limit
+	QueueTimeout         int    `json:"queueTimeout"`         // milliseconds requests wait for capacity before they are rejected
+	Action               string `json:"action"`               // "unavailable" rejects requests that waited too long, "challenge" also challenges new clients while every backend is saturated
+	PriorityReputation   int    `json:"priorityReputation"`   // reputation from which clients are let through first, here and for the concurrency limit of domains
+}
+
+type ClearanceTokenSettings struct {
+	Enabled    bool     `json:"enabled"`
+	Algorithm  string   `json:"algorithm"`  // "hmac" or "ed25519"
+	Secret     string   `json:"secret"`     // hmac only, shared by all nodes
+	PrivateKey string   `json:"privateKey"` // ed25519 only, base64 seed this node signs with
+	PublicKeys []string `json:"publicKeys"` // ed25519 only, base64 keys of the other nodes
+}
+
+type EscalationSettings struct {
 	Enabled      bool `json:"enabled"`
-	MinScore     int  `json:"minScore"`
-	PersistToDB  bool `json:"persistToDB"`
-	DecayInterval int `json:"decayInterval"`
+	Failures     int  `json:"failures"`     // failed challenges before an ip is escalated to the next level
+	Window       int  `json:"window"`       // seconds without failed challenges after which an ip starts over
+	BanTime      int  `json:"banTime"`      // seconds ips that kept failing the captcha are banned for
+	JSScore      int  `json:"jsScore"`      // reputation below which ips start at the js challenge
+	CaptchaScore int  `json:"captchaScore"` // reputation below which ips start at the captcha
+}
+
+type CookieBindingSettings struct {
+	IPv4Prefix int  `json:"ipv4Prefix"` // 0 binds to the full ip, -1 doesn't bind to the ip at all
+	IPv6Prefix int  `json:"ipv6Prefix"` // 0 binds to the full ip, -1 doesn't bind to the ip at all
+	JA4        bool `json:"ja4"`
+	HTTP2      bool `json:"http2"`
+}
+
+type FingerprintSettings struct {
+	DisableRemote   bool              `json:"disableRemote"` // don't fetch the lists from github
+	Files           FingerprintFiles  `json:"files"`
+	Feeds           []FingerprintFeed `json:"feeds"`
+	RefreshInterval int               `json:"refreshInterval"` // seconds. 0 only loads the lists at startup
+}
+
+// Additional remote list, for example a private threat-intel feed. Merged into the lists after the ones on github
+type FingerprintFeed struct {
+	URL     string            `json:"url"`
+	List    string            `json:"list"`    // "known", "bot" or "malicious"
+	Headers map[string]string `json:"headers"` // sent along with the request, for example for authentication
+}
+
+// Paths of local json files, in the same format as the lists on github. Loaded after the remote lists, so they take precedence
+type FingerprintFiles struct {
+	Known     []string `json:"known"`
+	Bot       []string `json:"bot"`
+	Malicious []string `json:"malicious"`
+}
+
+type JA4FingerprintLists struct {
+	Known     map[string]string `json:"known"`     // fingerprint -> browser
+	Bot       map[string]string `json:"bot"`       // fingerprint -> bot
+	Malicious map[string]string `json:"malicious"` // fingerprint -> tool
+}
+
+type TarpitSettings struct {
+	MaxConnections  int  `json:"maxConnections"`
+	Interval        int  `json:"interval"` // seconds between two bytes
+	Duration        int  `json:"duration"` // seconds
+	RepeatOffenders bool `json:"repeatOffenders"`
+}
+
+type SlowReadSettings struct {
+	Enabled     bool `json:"enabled"`
+	MinRate     int  `json:"minRate"`     // bytes per second
+	GracePeriod int  `json:"gracePeriod"` // seconds
+	MaxOffenses int  `json:"maxOffenses"` // killed connections per minute before an ip is refused
+}
+
+type HeaderLimitSettings struct {
+	MaxCount      int `json:"maxCount"`
+	MaxHeaderSize int `json:"maxHeaderSize"` // bytes
+	MaxTotalSize  int `json:"maxTotalSize"`  // bytes
+}
+
+type TrustedProxySettings struct {
+	Enabled bool           `json:"enabled"`
+	CIDRs   []string       `json:"cidrs"`
+	Headers []RealIPHeader `json:"headers"`
+}
+
+type RealIPHeader struct {
+	Name  string `json:"name"`
+	Depth int    `json:"depth"` // position counted from the right for list headers like X-Forwarded-For. 0 uses the rightmost entry that isn't a trusted proxy
+}
+
+type ReputationSettings struct {
+	Enabled       bool                     `json:"enabled"`
+	MinScore      int                      `json:"minScore"`
+	PersistToDB   bool                     `json:"persistToDB"`
+	DecayInterval int                      `json:"decayInterval"`
+	FlushInterval int                      `json:"flushInterval"` // seconds between writes of changed reputations to the storage
+	MaxEntries    int                      `json:"maxEntries"`    // ips kept in memory, the least recently seen ones are evicted first. -1 keeps every ip
+	TTL           int                      `json:"ttl"`           // hours after which reputations that weren't updated are forgotten
+	Compaction    int                      `json:"compaction"`    // hours between compactions of the storage
+	Weights       map[string]int           `json:"weights"`       // event -> weight the reputation of an ip changes by
+	Storage       string                   `json:"storage"`       // "bolt", "sqlite" or "redis"
+	Path          string                   `json:"path"`          // database file of bolt and sqlite
+	Redis         RedisSettings            `json:"redis"`
+	Subnets       SubnetReputationSettings `json:"subnets"`
+	ASN           ASNReputationSettings    `json:"asn"`
+	Tiers         []ReputationTier         `json:"tiers"`
+}
+
+// ReputationTier applies action to ips with a reputation from Min to Max
+type ReputationTier struct {
+	Min    int    `json:"min"`
+	Max    int    `json:"max"`
+	Action string `json:"action"` // "block", "captcha", "js", "cookie" or "allow"
+}
+
+type ASNReputationSettings struct {
+	Enabled     bool `json:"enabled"`     // track the share of abusive requests per asn
+	Window      int  `json:"window"`      // seconds the share is calculated over, default: 3600
+	MinRequests int  `json:"minRequests"` // requests an asn needs within the window before it's scored, default: 100
+}
+
+type SubnetReputationSettings struct {
+	Enabled    bool `json:"enabled"`    // aggregate the reputation of ips per prefix
+	IPv4Prefix int  `json:"ipv4Prefix"` // default: 24
+	IPv6Prefix int  `json:"ipv6Prefix"` // default: 48
+}
+
+type RedisSettings struct {
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	Database int    `json:"database"`
+	Key      string `json:"key"` // hash the reputations are stored in
 }
 
 type AdaptiveRateLimitSettings struct {
@@ -138,19 +745,77 @@ type RatelimitWindows struct {
 	Long   int `json:"long"`
 }
 
+// GeoFilteringSettings configure geo lookups. The policy applies to every domain that doesn't have its own
 type GeoFilteringSettings struct {
+	GeoFilterPolicy
+	Provider    string           `json:"provider"`    // "ipiz" (http api) or "maxmind" (local mmdb files)
+	Database    string           `json:"database"`    // maxmind City or Country database
+	ASNDatabase string           `json:"asnDatabase"` // maxmind ASN database
+	Cache       GeoCacheSettings `json:"cache"`
+	Async       GeoAsyncSettings `json:"async"`
+
+	Providers []GeoProviderSettings `json:"providers"` // asked in order, replace provider if set
+}
+
+type GeoProviderSettings struct {
+	Name        string  `json:"name"`     // shown in logs and the api, defaults to the provider
+	Provider    string  `json:"provider"` // "ipiz" or "maxmind"
+	Endpoint    string  `json:"endpoint"` // api of ipiz
+	Database    string  `json:"database"`
+	ASNDatabase string  `json:"asnDatabase"`
+	Rate        float64 `json:"rate"` // lookups per second, 0 doesn't limit them
+}
+
+// GeoAsyncSettings move lookups off the request path, ips get a provisional decision until theirs is done
+type GeoAsyncSettings struct {
+	Enabled     bool   `json:"enabled"`
+	Workers     int    `json:"workers"`     // lookups running at the same time
+	Queue       int    `json:"queue"`       // lookups waiting for a worker, more are dropped
+	Provisional string `json:"provisional"` // "allow" or "challenge"
+}
+
+type GeoCacheSettings struct {
+	Persist bool          `json:"persist"` // keep looked up ips across restarts
+	Storage string        `json:"storage"` // "bolt", "sqlite" or "redis". Defaults to the storage of the reputations
+	Path    string        `json:"path"`    // database file of bolt and sqlite
+	Redis   RedisSettings `json:"redis"`   // defaults to the redis of the reputations
+}
+
+// GeoFilterPolicy decides which countries and ASNs may access a domain
+type GeoFilterPolicy struct {
 	Enabled          bool     `json:"enabled"`
 	Mode             string   `json:"mode"` // "whitelist" or "blacklist"
 	AllowedCountries []string `json:"allowedCountries"`
 	BlockedCountries []string `json:"blockedCountries"`
 	BlockedASN       []int    `json:"blockedASN"`
 	ChallengeUnknown bool     `json:"challengeUnknown"`
+
+	AllowedContinents    []string `json:"allowedContinents"` // continent codes (AF, AN, AS, EU, NA, OC, SA) on top of the country lists
+	BlockedContinents    []string `json:"blockedContinents"`
+	ChallengedContinents []string `json:"challengedContinents"`
+	CaptchaContinents    []string `json:"captchaContinents"`
+
+	ChallengedCountries []string `json:"challengedCountries"` // have to solve at least the js challenge
+	ChallengedASN       []int    `json:"challengedASN"`
+	CaptchaCountries    []string `json:"captchaCountries"` // have to solve at least the captcha
+	CaptchaASN          []int    `json:"captchaASN"`
+
+	ASNMode    string `json:"asnMode"` // "whitelist" only lets the AllowedASN in, "bypass" lets them skip challenges
+	AllowedASN []int  `json:"allowedASN"`
 }
 
 type MonitoringSettings struct {
 	EnableMetrics    bool `json:"enableMetrics"`
 	MetricsPort      int  `json:"metricsPort"`
 	PrometheusExport bool `json:"prometheusExport"`
+
+	MetricsAddress  string `json:"metricsAddress"`  // interface the endpoint listens on, e.g. "127.0.0.1". Every interface if empty
+	MetricsListener string `json:"metricsListener"` // "admin" serves the metrics on the admin api instead of their own port
+	MetricsToken    string `json:"metricsToken"`    // bearer token scrapers have to send
+	MetricsUsername string `json:"metricsUsername"` // basic auth credentials scrapers have to send instead
+	MetricsPassword string `json:"metricsPassword"`
+	MetricsCert     string `json:"metricsCert"` // serves the endpoint over https with this certificate and key
+	MetricsKey      string `json:"metricsKey"`
 }
 
 type ConnectionLimits struct {
@@ -168,21 +833,43 @@ type TimeoutSettings struct {
 }
 
 type WebhookSettings struct {
-	URL            string `json:"url"`
-	Name           string `json:"name"`
-	Avatar         string `json:"avatar"`
-	AttackStartMsg string `json:"attack_start_msg"`
-	AttackStopMsg  string `json:"attack_stop_msg"`
+	Type           string            `json:"type"` // "discord" (default), "slack", "telegram" or "generic"
+	URL            string            `json:"url"`
+	Name           string            `json:"name"`
+	Avatar         string            `json:"avatar"`
+	AttackStartMsg string            `json:"attack_start_msg"`
+	AttackStopMsg  string            `json:"attack_stop_msg"`
+	Token          string            `json:"token"`    // telegram bot token, used if url is empty
+	ChatID         string            `json:"chat_id"`  // telegram chat the alerts are sent to
+	Template       string            `json:"template"` // json body of generic webhooks
+	Headers        map[string]string `json:"headers"`  // sent along with generic webhooks
 }
 
 type JsonRule struct {
 	Expression string `json:"expression"`
 	Action     string `json:"action"`
+	Priority   int    `json:"priority,omitempty"` // rules with a lower priority are checked first, rules with the same one in order
+	Group      string `json:"group,omitempty"`    // rules of a group can be disabled together through the api
+	Enabled    *bool  `json:"enabled,omitempty"`  // defaults to true
+	Shadow     bool   `json:"shadow,omitempty"`   // count and log matches without enforcing the action
 }
 
 type Rule struct {
 	Filter *gofilter.Filter
 	Action string
+
+	Index    int // position of the rule in the config
+	Priority int
+	Group    string
+	Shadow   bool
+
+	Redirect   string // "redirect <url>" only
+	Difficulty int    // "difficulty <n>" only
+
+	// "ratelimit <requests>/<seconds> [ip|ip+path]" only
+	RatelimitRequests int
+	RatelimitWindow   int
+	RatelimitPath     bool // limit every path separately
 }
 
 type RequestLog struct {
@@ -190,6 +877,7 @@ type RequestLog struct {
 	Allowed  int
 	Total    int
 	CpuUsage string
+	Stage    int
 }
 
 type CacheResponse struct {
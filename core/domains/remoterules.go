@@ -0,0 +1,49 @@
+package domains
+
+import "sync"
+
+// RemoteRules holds the rules fetched from the remote rulesets a domain is subscribed to. It's shared between the firewall and the ruleset fetchers
+type RemoteRules struct {
+	mutex *sync.RWMutex
+	sets  [][]Rule // rules of every subscription, in the order of the config
+	rules []Rule   // all sets after each other
+}
+
+func NewRemoteRules(subscriptions int) *RemoteRules {
+	return &RemoteRules{
+		mutex: &sync.RWMutex{},
+		sets:  make([][]Rule, subscriptions),
+	}
+}
+
+// Set replaces the rules of a subscription
+func (remote *RemoteRules) Set(subscription int, rules []Rule) {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	if subscription < 0 || subscription >= len(remote.sets) {
+		return
+	}
+	remote.sets[subscription] = rules
+
+	merged := []Rule{}
+	for _, set := range remote.sets {
+		merged = append(merged, set...)
+	}
+	remote.rules = merged
+}
+
+// Rules returns the rules of all subscriptions. The result must not be modified
+func (remote *RemoteRules) Rules() []Rule {
+	if remote == nil {
+		return nil
+	}
+	remote.mutex.RLock()
+	defer remote.mutex.RUnlock()
+	return remote.rules
+}
+
+// Len returns how many remote rules are active
+func (remote *RemoteRules) Len() int {
+	return len(remote.Rules())
+}
@@ -0,0 +1,166 @@
+package events
+
+import (
+	"fmt"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"io"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of events that are published
+const (
+	RequestBlocked = "request_blocked"
+	StageChanged   = "stage_changed"
+	IPBanned       = "ip_banned"
+	CertRenewed    = "cert_renewed"
+	BackendDown    = "backend_down"
+	AttackStarted  = "attack_started"
+	AttackEnded    = "attack_ended"
+)
+
+var (
+	Types = []string{RequestBlocked, StageChanged, IPBanned, CertRenewed, BackendDown, AttackStarted, AttackEnded}
+
+	SubscriptionQueueSize = 1024 // events a sink can lag behind, more are dropped
+
+	subscriptions      = []*subscription{}
+	subscriptionsMutex = &sync.RWMutex{}
+
+	// type -> number of subscriptions that want it, so publishers can skip building events nobody listens to
+	wanted = map[string]*int32{}
+)
+
+func init() {
+	for _, eventType := range Types {
+		wanted[eventType] = new(int32)
+	}
+}
+
+// Event is something that happened in the proxy. Data holds what's specific to its type
+type Event struct {
+	Type   string                 `json:"type"`
+	Time   time.Time              `json:"time"`
+	Domain string                 `json:"domain,omitempty"`
+	IP     string                 `json:"ip,omitempty"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+// Sink handles the events it subscribed to, one at a time. Sinks that are an io.Closer are closed once they are unsubscribed
+type Sink interface {
+	Handle(event Event) error
+}
+
+type subscription struct {
+	types map[string]bool // empty gets every type
+	queue chan Event
+	done  chan struct{}
+}
+
+// Subscribed tells publishers whether anyone wants events of eventType
+func Subscribed(eventType string) bool {
+	count, ok := wanted[eventType]
+	return ok && atomic.LoadInt32(count) > 0
+}
+
+// Publish hands event to every subscription that wants it. It never blocks, sinks that lag behind miss events
+func Publish(event Event) {
+	if !Subscribed(event.Type) {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	subscriptionsMutex.RLock()
+	defer subscriptionsMutex.RUnlock()
+	for _, sub := range subscriptions {
+		if len(sub.types) != 0 && !sub.types[event.Type] {
+			continue
+		}
+		select {
+		case sub.queue <- event:
+		default:
+		}
+	}
+}
+
+// deliver passes event to sink. A sink that panics on an event, e.g. because of an invalid header of a webhook, is logged
+// and keeps getting the next ones instead of taking the proxy down
+func deliver(sink Sink, event Event, onError func(error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Event sink panicked", logger.F("type", event.Type), logger.F("panic", fmt.Sprint(r)), logger.F("stack", string(debug.Stack())))
+		}
+	}()
+
+	if err := sink.Handle(event); err != nil && onError != nil {
+		onError(err)
+	}
+}
+
+// Subscribe passes the events of types (all if empty) to sink in its own goroutine, until unsubscribe is called
+func Subscribe(types []string, sink Sink, onError func(error)) (unsubscribe func()) {
+	sub := &subscription{
+		types: map[string]bool{},
+		queue: make(chan Event, SubscriptionQueueSize),
+		done:  make(chan struct{}),
+	}
+	for _, eventType := range types {
+		sub.types[eventType] = true
+	}
+
+	go func() {
+		defer pnc.PanicHndl()
+
+		for {
+			select {
+			case event := <-sub.queue:
+				deliver(sink, event, onError)
+			case <-sub.done:
+				if closer, ok := sink.(io.Closer); ok {
+					closer.Close()
+				}
+				return
+			}
+		}
+	}()
+
+	subscriptionsMutex.Lock()
+	subscriptions = append(subscriptions, sub)
+	sub.count(1)
+	subscriptionsMutex.Unlock()
+
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			subscriptionsMutex.Lock()
+			for i, other := range subscriptions {
+				if other == sub {
+					subscriptions = append(subscriptions[:i], subscriptions[i+1:]...)
+					break
+				}
+			}
+			sub.count(-1)
+			subscriptionsMutex.Unlock()
+			close(sub.done)
+		})
+	}
+}
+
+func (sub *subscription) count(delta int32) {
+	for eventType, count := range wanted {
+		if len(sub.types) == 0 || sub.types[eventType] {
+			atomic.AddInt32(count, delta)
+		}
+	}
+}
+
+// Known returns whether eventType is a type of event that is published
+func Known(eventType string) bool {
+	_, ok := wanted[eventType]
+	return ok
+}
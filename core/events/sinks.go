@@ -0,0 +1,191 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var (
+	// unsubscribe functions of the sinks of the config, replaced on reload
+	configuredSinks      = []func(){}
+	configuredSinksMutex = &sync.Mutex{}
+)
+
+// Configure replaces the sinks of the config with settings
+func Configure(settings []domains.EventSinkSettings) error {
+
+	sinks := []Sink{}
+	for _, sinkSettings := range settings {
+		for _, eventType := range sinkSettings.Events {
+			if !Known(eventType) {
+				return errors.New("unknown event " + eventType)
+			}
+		}
+		sink, err := NewSink(sinkSettings)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	configuredSinksMutex.Lock()
+	defer configuredSinksMutex.Unlock()
+	for _, unsubscribe := range configuredSinks {
+		unsubscribe()
+	}
+	configuredSinks = []func(){}
+	for i, sink := range sinks {
+		sinkType := settings[i].Type
+		configuredSinks = append(configuredSinks, Subscribe(settings[i].Events, sink, func(err error) {
+			logger.Warn("Event sink failed", logger.F("sink", sinkType), logger.Err(err))
+		}))
+	}
+	return nil
+}
+
+// NewSink creates the sink settings describe
+func NewSink(settings domains.EventSinkSettings) (Sink, error) {
+	timeout := 10 * time.Second
+	if settings.Timeout > 0 {
+		timeout = time.Duration(settings.Timeout) * time.Second
+	}
+
+	switch settings.Type {
+	case "webhook":
+		if settings.URL == "" {
+			return nil, errors.New("webhook event sinks need an url")
+		}
+		return &WebhookSink{URL: settings.URL, Headers: settings.Headers, client: &http.Client{Timeout: timeout}}, nil
+	case "log":
+		path := settings.Path
+		if path == "" {
+			path = "events.log"
+		}
+		return &LogSink{Path: path}, nil
+	case "script":
+		if settings.Command == "" {
+			return nil, errors.New("script event sinks need a command")
+		}
+		return &ScriptSink{Command: settings.Command, Args: settings.Args, Timeout: timeout}, nil
+	}
+	return nil, errors.New("unknown event sink " + settings.Type + ", use webhook, log or script")
+}
+
+// WebhookSink posts every event as json
+type WebhookSink struct {
+	URL     string
+	Headers map[string]string
+	client  *http.Client
+}
+
+func (sink *WebhookSink) Handle(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", sink.URL, bytes.NewReader(payload))
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range sink.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// withoutURL strips the url from errors of the http client, webhook urls often contain a token
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return errors.New(urlErr.Op + ": " + urlErr.Err.Error())
+	}
+	return err
+}
+
+// LogSink appends every event to a file as json, one per line
+type LogSink struct {
+	Path string
+	file *os.File
+}
+
+func (sink *LogSink) Handle(event Event) error {
+	if sink.file == nil {
+		file, err := os.OpenFile(sink.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		sink.file = file
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = sink.file.Write(append(line, '\n'))
+	return err
+}
+
+func (sink *LogSink) Close() error {
+	if sink.file == nil {
+		return nil
+	}
+	return sink.file.Close()
+}
+
+// ScriptSink runs a command for every event. It gets the event as json on stdin and its type, domain and ip
+// in BALOO_EVENT_TYPE, BALOO_EVENT_DOMAIN and BALOO_EVENT_IP
+type ScriptSink struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+func (sink *ScriptSink) Handle(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sink.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, sink.Command, sink.Args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "BALOO_EVENT_TYPE="+event.Type, "BALOO_EVENT_DOMAIN="+event.Domain, "BALOO_EVENT_IP="+event.IP)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if len(output) > 256 {
+			output = output[:256]
+		}
+		return errors.New(err.Error() + ": " + string(bytes.TrimSpace(output)))
+	}
+	return nil
+}
+
+// ChannelSink passes events to a channel, e.g. for the event stream of the api. Events are dropped if the channel is full
+type ChannelSink chan Event
+
+func (sink ChannelSink) Handle(event Event) error {
+	select {
+	case sink <- event:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package feeds
+
+import (
+	"goProxy/core/domains"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The Spamhaus DROP lists, EDROP has been merged into them
+	SpamhausDROPv4 = "https://www.spamhaus.org/drop/drop_v4.json"
+	SpamhausDROPv6 = "https://www.spamhaus.org/drop/drop_v6.json"
+
+	TorList     = "tor"
+	TorExitList = "https://check.torproject.org/torbulkexitlist"
+
+	// Lists that classify ips, see Classify
+	DatacenterList = "datacenter"
+	VPNList        = "vpn"
+)
+
+var (
+	SpamhausInterval       = 43200 // seconds, the lists change only a few times a day
+	TorInterval            = 1800  // seconds
+	ClassificationInterval = 86400 // seconds
+
+	// Used if no sources are configured
+	DefaultDatacenterSources = []string{"https://raw.githubusercontent.com/X4BNet/lists_vpn/main/output/datacenter/ipv4.txt"}
+	DefaultVPNSources        = []string{"https://raw.githubusercontent.com/X4BNet/lists_vpn/main/output/vpn/ipv4.txt"}
+)
+
+// BuiltIn returns the feeds balooProxy ships with that are enabled in proxy, to start them along with the configured ones
+func BuiltIn(proxy domains.Proxy) []domains.ThreatFeed {
+
+	builtIn := []domains.ThreatFeed{}
+
+	if spamhaus := proxy.Spamhaus; spamhaus.Enabled {
+		interval := SpamhausInterval
+		if spamhaus.Interval > 0 {
+			interval = spamhaus.Interval
+		}
+		action := "block"
+		if spamhaus.Action != "" {
+			action = spamhaus.Action
+		}
+		builtIn = append(builtIn,
+			domains.ThreatFeed{Name: "spamhaus_drop", URL: SpamhausDROPv4, Interval: interval, Action: action},
+			domains.ThreatFeed{Name: "spamhaus_dropv6", URL: SpamhausDROPv6, Interval: interval, Action: action},
+		)
+	}
+
+	// Tor exits aren't treated as threats by themselves, domains decide what happens to them with their torPolicy
+	if tor := proxy.Tor; tor.Enabled {
+		interval := TorInterval
+		if tor.Interval > 0 {
+			interval = tor.Interval
+		}
+		builtIn = append(builtIn, domains.ThreatFeed{Name: TorList, URL: TorExitList, Interval: interval})
+	}
+
+	if classification := proxy.IPClassification; classification.Enabled {
+		interval := ClassificationInterval
+		if classification.Interval > 0 {
+			interval = classification.Interval
+		}
+		datacenter, vpn := classification.Datacenter, classification.VPN
+		if datacenter == nil {
+			datacenter = DefaultDatacenterSources
+		}
+		if vpn == nil {
+			vpn = DefaultVPNSources
+		}
+		builtIn = append(builtIn, classificationFeeds(DatacenterList, datacenter, interval)...)
+		builtIn = append(builtIn, classificationFeeds(VPNList, vpn, interval)...)
+	}
+
+	return builtIn
+}
+
+// classificationFeeds turns the sources of a classification into feeds named list, list_2, list_3, ...
+func classificationFeeds(list string, sources []string, interval int) []domains.ThreatFeed {
+	classified := []domains.ThreatFeed{}
+	for i, source := range sources {
+		name := list
+		if i > 0 {
+			name += "_" + strconv.Itoa(i+1)
+		}
+		classified = append(classified, domains.ThreatFeed{Name: name, URL: source, Interval: interval})
+	}
+	return classified
+}
+
+// Classify checks whether ip is on one of the datacenter or vpn lists
+func Classify(ip string) (datacenter bool, vpn bool) {
+	for _, listed := range Lookup(ip) {
+		switch {
+		case listed == DatacenterList || strings.HasPrefix(listed, DatacenterList+"_"):
+			datacenter = true
+		case listed == VPNList || strings.HasPrefix(listed, VPNList+"_"):
+			vpn = true
+		}
+	}
+	return datacenter, vpn
+}
+
+// TorPolicies map the torPolicy of a domain to the level of the challenge tor exits have to solve at least, -1 blocks them
+var TorPolicies = map[string]int{
+	"":          0,
+	"allow":     0,
+	"challenge": 2,
+	"captcha":   3,
+	"block":     -1,
+}
+
+// Listed checks whether ip is on the list name
+func Listed(ip string, name string) bool {
+	for _, listed := range Lookup(ip) {
+		if listed == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+package feeds
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxFeedSize = 32 * 1024 * 1024
+
+var (
+	DefaultInterval = 3600 // seconds
+	MinInterval     = 300  // seconds
+
+	// Actions lists can enforce -> challenge level, -1 blocks. Lists without an action are only visible to rules
+	Actions = map[string]int{
+		"block":   -1,
+		"captcha": 3,
+		"js":      2,
+		"cookie":  1,
+		"":        0,
+	}
+
+	feedClient = &http.Client{Timeout: 60 * time.Second}
+
+	// name -> list, lists are replaced as a whole whenever they are updated
+	lists      = map[string]*List{}
+	order      = []string{} // names in the order they were configured, so lookups return them in that order
+	tree       = NewTree()
+	listsMutex = &sync.RWMutex{}
+
+	running chan struct{}
+	started = map[string]bool{} // names of the lists downloaded by feeds
+)
+
+// List is a set of prefixes along with what happens to ips within them
+type List struct {
+	Name     string
+	Action   string
+	Prefixes []*net.IPNet
+	Updated  time.Time
+}
+
+// Start begins downloading feeds, replacing the ones previously started. Lists of feeds that are still configured
+// are kept until they are downloaded again, lists of feeds that aren't are removed
+func Start(feeds []domains.ThreatFeed) error {
+
+	for _, feed := range feeds {
+		if feed.Name == "" || feed.URL == "" {
+			return errors.New("threat feeds need a name and url")
+		}
+		if _, ok := Actions[feed.Action]; !ok {
+			return errors.New("unknown action for threat feed " + feed.Name + ": " + feed.Action + ", use block, captcha, js, cookie or none")
+		}
+	}
+
+	listsMutex.Lock()
+	if running != nil {
+		close(running)
+	}
+	running = make(chan struct{})
+	stop := running
+
+	configured := map[string]bool{}
+	names := []string{}
+	for _, feed := range feeds {
+		configured[feed.Name] = true
+		names = append(names, feed.Name)
+	}
+	for name := range started {
+		if !configured[name] {
+			delete(lists, name)
+		}
+	}
+	started = configured
+	// Lists that were set by something else than a feed come after the feeds
+	for _, name := range order {
+		if _, ok := lists[name]; ok && !configured[name] {
+			names = append(names, name)
+		}
+	}
+	order = names
+	rebuild()
+	listsMutex.Unlock()
+
+	for _, feed := range feeds {
+		go run(feed, stop)
+	}
+	return nil
+}
+
+func run(feed domains.ThreatFeed, stop chan struct{}) {
+
+	defer pnc.PanicHndl()
+
+	interval := DefaultInterval
+	if feed.Interval > 0 {
+		interval = feed.Interval
+	}
+	if interval < MinInterval {
+		interval = MinInterval
+	}
+
+	for {
+		prefixes, err := Fetch(feed.URL, feed.Headers)
+		if err == nil {
+			Set(feed.Name, feed.Action, prefixes)
+		} else {
+			// Keep the last good list, an unreachable feed shouldn't lift blocks that are already active
+			logger.Warn("Threat feed failed", logger.F("feed", feed.Name), logger.Err(err))
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+		}
+	}
+}
+
+// Fetch downloads a list of ips and prefixes, one per line. Urls without a scheme (or file://) are read from disk
+func Fetch(url string, headers map[string]string) ([]*net.IPNet, error) {
+
+	if path := strings.TrimPrefix(url, "file://"); !strings.Contains(path, "://") {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return Parse(io.LimitReader(file, maxFeedSize))
+	}
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "text/plain")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	resp, err := feedClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status " + resp.Status)
+	}
+	return Parse(io.LimitReader(resp.Body, maxFeedSize))
+}
+
+// Parse reads ips and prefixes, one per line, like FireHOL netsets or the AbuseIPDB blacklist. Everything after the
+// first field, as well as lines starting with # or ;, is ignored. Lines can also be json objects with a cidr, like
+// the Spamhaus DROP lists, objects without one are ignored. Fails if a feed doesn't contain a single valid entry, an
+// empty download (like a truncated response or an error page) shouldn't wipe the list
+func Parse(reader io.Reader) ([]*net.IPNet, error) {
+
+	prefixes := []*net.IPNet{}
+	invalid := 0
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '{' {
+			entry := struct {
+				CIDR string `json:"cidr"`
+			}{}
+			if json.Unmarshal([]byte(line), &entry) != nil {
+				invalid++
+				continue
+			}
+			if entry.CIDR == "" {
+				continue
+			}
+			line = entry.CIDR
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			line = fields[0]
+		}
+
+		if prefix := ParsePrefix(line); prefix != nil {
+			prefixes = append(prefixes, prefix)
+		} else {
+			invalid++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("no valid entries, " + strconv.Itoa(invalid) + " invalid ones")
+	}
+	return prefixes, nil
+}
+
+// ParsePrefix parses a cidr or a single ip. Returns nil if entry is neither
+func ParsePrefix(entry string) *net.IPNet {
+	if _, prefix, err := net.ParseCIDR(entry); err == nil {
+		return prefix
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Set replaces the prefixes of a list, creating it if needed. Lists that aren't downloaded by a feed can be set this way aswell
+func Set(name string, action string, prefixes []*net.IPNet) {
+
+	listsMutex.Lock()
+	defer listsMutex.Unlock()
+
+	known := false
+	for _, ordered := range order {
+		known = known || ordered == name
+	}
+	if !known {
+		order = append(order, name)
+	}
+	lists[name] = &List{
+		Name:     name,
+		Action:   action,
+		Prefixes: prefixes,
+		Updated:  time.Now(),
+	}
+	rebuild()
+}
+
+// Remove deletes a list that was set with Set
+func Remove(name string) {
+
+	listsMutex.Lock()
+	defer listsMutex.Unlock()
+
+	if _, ok := lists[name]; !ok {
+		return
+	}
+	delete(lists, name)
+	names := []string{}
+	for _, ordered := range order {
+		if ordered != name {
+			names = append(names, ordered)
+		}
+	}
+	order = names
+	rebuild()
+}
+
+// rebuild compiles every list into a new tree. Has to be called with listsMutex locked
+func rebuild() {
+	rebuilt := NewTree()
+	for id, name := range order {
+		if list, ok := lists[name]; ok {
+			for _, prefix := range list.Prefixes {
+				rebuilt.Insert(prefix, id)
+			}
+		}
+	}
+	tree = rebuilt
+}
+
+// Lookup returns the names of the lists ip is listed on, in the order the feeds are configured
+func Lookup(ip string) []string {
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+
+	listsMutex.RLock()
+	defer listsMutex.RUnlock()
+
+	ids := tree.Lookup(parsed)
+	names := make([]string, 0, len(ids))
+	for id := range order {
+		if contains(ids, id) {
+			names = append(names, order[id])
+		}
+	}
+	return names
+}
+
+// Action returns the strictest action of the lists ip is listed on, "" if none of them enforces any
+func Action(ip string) string {
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	listsMutex.RLock()
+	defer listsMutex.RUnlock()
+
+	strictest := ""
+	for _, id := range tree.Lookup(parsed) {
+		list, ok := lists[order[id]]
+		if !ok {
+			continue
+		}
+		if Actions[list.Action] < 0 {
+			return list.Action
+		}
+		if Actions[list.Action] > Actions[strictest] {
+			strictest = list.Action
+		}
+	}
+	return strictest
+}
+
+// Level returns the challenge level action enforces, 0 for actions that don't challenge
+func Level(action string) int {
+	if level := Actions[action]; level > 0 {
+		return level
+	}
+	return 0
+}
+
+// Lists returns the currently loaded lists
+func Lists() []List {
+
+	listsMutex.RLock()
+	defer listsMutex.RUnlock()
+
+	loaded := []List{}
+	for _, name := range order {
+		if list, ok := lists[name]; ok {
+			loaded = append(loaded, *list)
+		}
+	}
+	return loaded
+}
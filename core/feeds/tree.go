@@ -0,0 +1,86 @@
+package feeds
+
+import "net"
+
+// Tree is a binary radix tree of ip prefixes. Every prefix carries the ids of the lists it's part of,
+// a lookup collects the ids of all prefixes that contain an ip in a single walk of at most 32 (128) nodes
+type Tree struct {
+	v4 *node
+	v6 *node
+}
+
+type node struct {
+	children [2]*node
+	lists    []int
+}
+
+func NewTree() *Tree {
+	return &Tree{v4: &node{}, v6: &node{}}
+}
+
+// Insert adds prefix to the list id
+func (tree *Tree) Insert(prefix *net.IPNet, id int) {
+
+	root, ip := tree.v6, prefix.IP.To16()
+	if v4 := prefix.IP.To4(); v4 != nil {
+		root, ip = tree.v4, v4
+	}
+	if ip == nil {
+		return
+	}
+	ones, bits := prefix.Mask.Size()
+	if bits != len(ip)*8 {
+		return
+	}
+
+	current := root
+	for bit := 0; bit < ones; bit++ {
+		branch := ip[bit/8] >> (7 - bit%8) & 1
+		if current.children[branch] == nil {
+			current.children[branch] = &node{}
+		}
+		current = current.children[branch]
+	}
+	for _, list := range current.lists {
+		if list == id {
+			return
+		}
+	}
+	current.lists = append(current.lists, id)
+}
+
+// Lookup returns the ids of every list with a prefix that contains ip, each id once
+func (tree *Tree) Lookup(ip net.IP) []int {
+
+	root, addr := tree.v6, ip.To16()
+	if v4 := ip.To4(); v4 != nil {
+		root, addr = tree.v4, v4
+	}
+	if addr == nil {
+		return nil
+	}
+
+	var lists []int
+	current := root
+	for bit := 0; current != nil; bit++ {
+		for _, list := range current.lists {
+			if !contains(lists, list) {
+				lists = append(lists, list)
+			}
+		}
+		if bit == len(addr)*8 {
+			break
+		}
+		current = current.children[addr[bit/8]>>(7-bit%8)&1]
+	}
+	return lists
+}
+
+func contains(lists []int, id int) bool {
+	for _, list := range lists {
+		if list == id {
+			return true
+		}
+	}
+	return false
+}
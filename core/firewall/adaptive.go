@@ -2,7 +2,6 @@ package firewall
 
 import (
 	"goProxy/core/domains"
-	"goProxy/core/proxy"
 	"sync"
 	"time"
 )
@@ -38,14 +37,14 @@ func GetAdaptiveMultiplier(domainName string) float64 {
 	}
 	
 	AdaptiveMutex.RLock()
-	defer AdaptiveMutex.RUnlock()
-	
 	multiplier, exists := AdaptiveMultipliers[domainName]
+	AdaptiveMutex.RUnlock()
 	if !exists {
-		return AdaptiveBaseMultiplier
+		multiplier = AdaptiveBaseMultiplier
 	}
 	
-	return multiplier
+	// Nodes of a cluster limit as strictly as the node that is hit the hardest
+	return clusterMultiplier(domainName, multiplier)
 }
 
 // UpdateAdaptiveMultiplier updates the adaptive multiplier based on attack status
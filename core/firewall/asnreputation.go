@@ -0,0 +1,120 @@
+package firewall
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	ASNReputationEnabled     = false
+	ASNReputationWindow      = time.Hour
+	ASNReputationMinRequests = 100 // requests an asn needs within the window before its abuse ratio counts
+
+	// asn -> abuse of its ips
+	asnReputations = map[int]*asnReputation{}
+	asnMutex       = &sync.Mutex{}
+)
+
+// asnReputation counts requests and abuse (challenge failures, blocks, ...) of an asn in the current and the previous window,
+// the previous one fades out like the windows of multiwindow.go
+type asnReputation struct {
+	windowStart      time.Time
+	requests         int
+	abuse            int
+	previousRequests int
+	previousAbuse    int
+}
+
+// roll moves to the window now belongs to
+func (data *asnReputation) roll(now time.Time) {
+	elapsed := now.Sub(data.windowStart)
+	if elapsed < ASNReputationWindow {
+		return
+	}
+	if elapsed < 2*ASNReputationWindow {
+		data.previousRequests, data.previousAbuse = data.requests, data.abuse
+	} else {
+		data.previousRequests, data.previousAbuse = 0, 0
+	}
+	data.requests, data.abuse = 0, 0
+	data.windowStart = now.Truncate(ASNReputationWindow)
+}
+
+// cachedIPASN returns the asn of ip if it was looked up already. Recording abuse shouldn't wait for the geo api
+func cachedIPASN(ip string) int {
+	GeoCacheMutex.RLock()
+	defer GeoCacheMutex.RUnlock()
+	if geoData, ok := GeoCache[ip]; ok {
+		return geoData.ASN
+	}
+	return 0
+}
+
+func recordASN(ip string, abusive bool) {
+	if !ASNReputationEnabled {
+		return
+	}
+	asn := cachedIPASN(ip)
+	if asn == 0 {
+		return
+	}
+	now := time.Now()
+
+	asnMutex.Lock()
+	defer asnMutex.Unlock()
+
+	data, exists := asnReputations[asn]
+	if !exists {
+		data = &asnReputation{windowStart: now.Truncate(ASNReputationWindow)}
+		asnReputations[asn] = data
+	}
+	data.roll(now)
+	if abusive {
+		data.abuse++
+	} else {
+		data.requests++
+	}
+}
+
+// RecordASNRequest counts a request towards the asn of ip
+func RecordASNRequest(ip string) {
+	recordASN(ip, false)
+}
+
+// RecordASNAbuse counts a failed challenge or blocked request towards the asn of ip
+func RecordASNAbuse(ip string) {
+	recordASN(ip, true)
+}
+
+// GetASNReputationScore returns 100 minus the percentage of abusive requests of asn, 100 until it made ASNReputationMinRequests requests
+func GetASNReputationScore(asn int) int {
+	if !ASNReputationEnabled || asn == 0 {
+		return MaxReputationScore
+	}
+	now := time.Now()
+
+	asnMutex.Lock()
+	defer asnMutex.Unlock()
+
+	data, exists := asnReputations[asn]
+	if !exists {
+		return MaxReputationScore
+	}
+	data.roll(now)
+
+	weight := 1 - float64(now.Sub(data.windowStart))/float64(ASNReputationWindow)
+	requests := float64(data.requests) + float64(data.previousRequests)*weight
+	abuse := float64(data.abuse) + float64(data.previousAbuse)*weight
+	if requests < float64(ASNReputationMinRequests) {
+		return MaxReputationScore
+	}
+	if abuse > requests {
+		abuse = requests
+	}
+	return MaxReputationScore - int(abuse/requests*float64(MaxReputationScore))
+}
+
+// GetIPASNReputationScore returns the reputation score of the asn of ip, as far as it's known already
+func GetIPASNReputationScore(ip string) int {
+	return GetASNReputationScore(cachedIPASN(ip))
+}
@@ -0,0 +1,156 @@
+package firewall
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	AttackSessionMaxKeys = 10000 // distinct ips, paths, ... a session counts, more are left out so random paths can't exhaust memory
+
+	// domain -> *attackSession of the ongoing attack
+	attackSessions sync.Map
+)
+
+// attackSession collects what happens on a domain while it's under attack
+type attackSession struct {
+	mutex    *sync.Mutex
+	start    time.Time
+	timeline []AttackSample
+
+	ips          map[string]int
+	countries    map[string]int
+	asns         map[int]int
+	paths        map[string]int
+	fingerprints map[string]int
+}
+
+// AttackSample is the state of a domain in one second of an attack
+type AttackSample struct {
+	Time              time.Time `json:"time"`
+	RequestsPerSecond int       `json:"requestsPerSecond"`
+	BypassedPerSecond int       `json:"bypassedPerSecond"`
+	Stage             int       `json:"stage"`
+	CpuUsage          string    `json:"cpuUsage"`
+}
+
+// AttackReport summarizes an attack once it's over
+type AttackReport struct {
+	Domain                string         `json:"domain"`
+	Start                 time.Time      `json:"start"`
+	End                   time.Time      `json:"end"`
+	PeakRequestsPerSecond int            `json:"peakRequestsPerSecond"`
+	PeakBypassedPerSecond int            `json:"peakBypassedPerSecond"`
+	TotalRequests         int            `json:"totalRequests"`
+	BypassedRequests      int            `json:"bypassedRequests"`
+	HighestStage          int            `json:"highestStage"`
+	Timeline              []AttackSample `json:"timeline"`
+	TopIPs                []SourceCount  `json:"topIps"`       // most abuse
+	TopCountries          []SourceCount  `json:"topCountries"` // most abuse
+	TopASNs               []ASNCount     `json:"topAsns"`      // most abuse
+	TopPaths              []SourceCount  `json:"topPaths"`     // most requests
+	TopFingerprints       []SourceCount  `json:"topFingerprints"`
+}
+
+// StartAttackSession starts recording an attack on a domain. An ongoing recording is kept
+func StartAttackSession(domainName string) {
+	attackSessions.LoadOrStore(domainName, &attackSession{
+		mutex:        &sync.Mutex{},
+		start:        time.Now(),
+		ips:          map[string]int{},
+		countries:    map[string]int{},
+		asns:         map[int]int{},
+		paths:        map[string]int{},
+		fingerprints: map[string]int{},
+	})
+}
+
+// RecordAttackSample adds a second to the timeline of the attack on a domain
+func RecordAttackSample(domainName string, sample AttackSample) {
+	if session, ok := loadAttackSession(domainName); ok {
+		session.mutex.Lock()
+		session.timeline = append(session.timeline, sample)
+		session.mutex.Unlock()
+	}
+}
+
+// RecordAttackRequest counts the path and fingerprint of a request to a domain that is under attack
+func RecordAttackRequest(domainName string, path string, fingerprint string) {
+	if session, ok := loadAttackSession(domainName); ok {
+		session.mutex.Lock()
+		countKey(session.paths, path)
+		countKey(session.fingerprints, fingerprint)
+		session.mutex.Unlock()
+	}
+}
+
+// recordSessionAbuse counts the abuse of ip for the attack on a domain, see RecordAttack
+func recordSessionAbuse(domainName string, ip string, country string, asn int) {
+	if session, ok := loadAttackSession(domainName); ok {
+		session.mutex.Lock()
+		countKey(session.ips, ip)
+		if country != "" {
+			countKey(session.countries, country)
+		}
+		if asn != 0 && (len(session.asns) < AttackSessionMaxKeys || session.asns[asn] != 0) {
+			session.asns[asn]++
+		}
+		session.mutex.Unlock()
+	}
+}
+
+// EndAttackSession stops recording the attack on a domain and returns its report, false if it wasn't recorded
+func EndAttackSession(domainName string) (AttackReport, bool) {
+
+	value, ok := attackSessions.LoadAndDelete(domainName)
+	if !ok {
+		return AttackReport{}, false
+	}
+	session := value.(*attackSession)
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	report := AttackReport{
+		Domain:          domainName,
+		Start:           session.start,
+		End:             time.Now(),
+		Timeline:        session.timeline,
+		TopIPs:          topSources(session.ips, 25),
+		TopCountries:    topSources(session.countries, 25),
+		TopASNs:         topASNs(session.asns, 25),
+		TopPaths:        topSources(session.paths, 25),
+		TopFingerprints: topSources(session.fingerprints, 25),
+	}
+	if report.Timeline == nil {
+		report.Timeline = []AttackSample{}
+	}
+	for _, sample := range session.timeline {
+		report.TotalRequests += sample.RequestsPerSecond
+		report.BypassedRequests += sample.BypassedPerSecond
+		if sample.RequestsPerSecond > report.PeakRequestsPerSecond {
+			report.PeakRequestsPerSecond = sample.RequestsPerSecond
+		}
+		if sample.BypassedPerSecond > report.PeakBypassedPerSecond {
+			report.PeakBypassedPerSecond = sample.BypassedPerSecond
+		}
+		if sample.Stage > report.HighestStage {
+			report.HighestStage = sample.Stage
+		}
+	}
+	return report, true
+}
+
+func loadAttackSession(domainName string) (*attackSession, bool) {
+	value, ok := attackSessions.Load(domainName)
+	if !ok {
+		return nil, false
+	}
+	return value.(*attackSession), true
+}
+
+func countKey(counts map[string]int, key string) {
+	if len(counts) < AttackSessionMaxKeys || counts[key] != 0 {
+		counts[key]++
+	}
+}
@@ -0,0 +1,203 @@
+package firewall
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackendQueueTimeout   = 500 * time.Millisecond
+	defaultBackendOverloadAction = "unavailable"
+	defaultPriorityReputation    = 80
+)
+
+var (
+	// Default settings (will be overridden by config)
+	BackendMaxRequestsPerSecond = 0 // 0 disables the limit
+	BackendMaxConcurrent        = 0 // 0 disables the limit
+	BackendQueueTimeout         = defaultBackendQueueTimeout
+	BackendOverloadAction       = defaultBackendOverloadAction
+	PriorityReputation          = defaultPriorityReputation // reputation from which clients skip ahead of unknown traffic
+
+	// backend -> requests forwarded to it
+	backendLimiters      = map[string]*capacityLimiter{}
+	backendLimitersMutex = &sync.Mutex{}
+)
+
+// capacityLimiter limits how many requests are in flight at once and how many are started per second.
+// Requests above the limits wait until capacity frees up or their timeout runs out. Prioritized requests get freed up capacity first
+type capacityLimiter struct {
+	mutex    sync.Mutex
+	inFlight int
+	second   int64 // unix timestamp requests are counted for
+	requests int
+	released chan struct{} // closed and replaced whenever a request finishes
+
+	priorityWaiting int // prioritized requests waiting for capacity
+}
+
+// ConfigureBackendProtection applies the backend protection settings of the config. Every setting is applied, so
+// limits removed from the config are lifted on a reload. Invalid settings are rejected as a whole, the current ones stay in place
+func ConfigureBackendProtection(settings domains.BackendProtectionSettings) error {
+
+	if settings.MaxRequestsPerSecond < 0 || settings.MaxConcurrent < 0 {
+		return errors.New("backendProtection limits can't be negative, use 0 to disable them")
+	}
+	if settings.QueueTimeout < 0 {
+		return errors.New("backendProtection queueTimeout can't be negative")
+	}
+
+	queueTimeout := defaultBackendQueueTimeout
+	if settings.QueueTimeout > 0 {
+		queueTimeout = time.Duration(settings.QueueTimeout) * time.Millisecond
+	}
+
+	action := settings.Action
+	switch action {
+	case "":
+		action = defaultBackendOverloadAction
+	case "unavailable", "challenge":
+	default:
+		return errors.New("unknown backendProtection action " + action + ", use unavailable or challenge")
+	}
+
+	priorityReputation := defaultPriorityReputation
+	if settings.PriorityReputation != 0 {
+		priorityReputation = settings.PriorityReputation
+	}
+
+	BackendMaxRequestsPerSecond = settings.MaxRequestsPerSecond
+	BackendMaxConcurrent = settings.MaxConcurrent
+	BackendQueueTimeout = queueTimeout
+	BackendOverloadAction = action
+	PriorityReputation = priorityReputation
+	return nil
+}
+
+func newCapacityLimiter() *capacityLimiter {
+	return &capacityLimiter{released: make(chan struct{})}
+}
+
+// free checks whether another request fits into the limits. Has to be called with the mutex locked
+func (limiter *capacityLimiter) free(maxConcurrent int, maxRate int, now time.Time) bool {
+	if now.Unix() != limiter.second {
+		limiter.second = now.Unix()
+		limiter.requests = 0
+	}
+	return (maxConcurrent <= 0 || limiter.inFlight < maxConcurrent) && (maxRate <= 0 || limiter.requests < maxRate)
+}
+
+// acquire waits up to timeout for capacity. Every successful acquire has to be released once the request finished
+func (limiter *capacityLimiter) acquire(maxConcurrent int, maxRate int, timeout time.Duration, priority bool) bool {
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	defer func() {
+		if waiting {
+			limiter.mutex.Lock()
+			limiter.priorityWaiting--
+			limiter.mutex.Unlock()
+		}
+	}()
+
+	for {
+		limiter.mutex.Lock()
+		now := time.Now()
+		if limiter.free(maxConcurrent, maxRate, now) && (priority || limiter.priorityWaiting == 0) {
+			limiter.inFlight++
+			limiter.requests++
+			limiter.mutex.Unlock()
+			return true
+		}
+		// Unprioritized requests only get capacity nobody prioritized is waiting for
+		if priority && !waiting {
+			waiting = true
+			limiter.priorityWaiting++
+		}
+		released := limiter.released
+		limiter.mutex.Unlock()
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false
+		}
+		// The rate frees up with the next second, without any request finishing
+		if next := time.Until(time.Unix(now.Unix()+1, 0)); maxRate > 0 && next < wait {
+			wait = next
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-released:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (limiter *capacityLimiter) release() {
+	limiter.mutex.Lock()
+	limiter.inFlight--
+	close(limiter.released)
+	limiter.released = make(chan struct{})
+	limiter.mutex.Unlock()
+}
+
+func (limiter *capacityLimiter) saturated(maxConcurrent int, maxRate int) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return !limiter.free(maxConcurrent, maxRate, time.Now())
+}
+
+func backendLimiter(backend string) *capacityLimiter {
+	backendLimitersMutex.Lock()
+	defer backendLimitersMutex.Unlock()
+
+	limiter, ok := backendLimiters[backend]
+	if !ok {
+		limiter = newCapacityLimiter()
+		backendLimiters[backend] = limiter
+	}
+	return limiter
+}
+
+// BackendProtectionEnabled checks whether requests to backends are limited at all
+func BackendProtectionEnabled() bool {
+	return BackendMaxRequestsPerSecond > 0 || BackendMaxConcurrent > 0
+}
+
+// AcquireBackend waits up to BackendQueueTimeout until a request can be forwarded to backend without exceeding its limits.
+// Prioritized requests are let through before every other waiting request. Every successful acquire has to be followed by ReleaseBackend once the response was sent
+func AcquireBackend(backend string, priority bool) bool {
+	return backendLimiter(backend).acquire(BackendMaxConcurrent, BackendMaxRequestsPerSecond, BackendQueueTimeout, priority)
+}
+
+// TryAcquireBackend reserves capacity of backend like AcquireBackend, without waiting for it
+func TryAcquireBackend(backend string, priority bool) bool {
+	return backendLimiter(backend).acquire(BackendMaxConcurrent, BackendMaxRequestsPerSecond, 0, priority)
+}
+
+func ReleaseBackend(backend string) {
+	backendLimiter(backend).release()
+}
+
+// Prioritized checks whether a client is trusted enough to skip ahead of unknown traffic while capacity is short: whitelisted ips,
+// ips with a reputation of at least PriorityReputation and clients that presented a valid clearance. Fingerprints are
+// chosen by the client, a known bot fingerprint alone doesn't make it trusted
+func Prioritized(ip string, cleared bool) bool {
+	return cleared || CheckWhitelist(ip) || GetReputationScore(ip) >= PriorityReputation
+}
+
+// BackendsSaturated checks whether all of backends are at their limits, so new requests would have to wait
+func BackendsSaturated(backends []string) bool {
+	if !BackendProtectionEnabled() || len(backends) == 0 {
+		return false
+	}
+	for _, backend := range backends {
+		if !backendLimiter(backend).saturated(BackendMaxConcurrent, BackendMaxRequestsPerSecond) {
+			return false
+		}
+	}
+	return true
+}
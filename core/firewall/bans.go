@@ -0,0 +1,33 @@
+package firewall
+
+import (
+	"goProxy/core/events"
+	"sync"
+	"time"
+)
+
+// BanHandler is told about every ip this node bans, along with when the ban ends and why ("escalation", or "cluster" for bans
+// of other nodes). Handlers are called while the ban is recorded and must not block, e.g. only queue the ban
+type BanHandler func(ip string, until time.Time, reason string)
+
+var (
+	banHandlers      = []BanHandler{}
+	banHandlersMutex = &sync.RWMutex{}
+)
+
+// OnBan registers handler to be told about bans, e.g. to enforce them outside of the proxy aswell
+func OnBan(handler BanHandler) {
+	banHandlersMutex.Lock()
+	banHandlers = append(banHandlers, handler)
+	banHandlersMutex.Unlock()
+}
+
+func notifyBan(ip string, until time.Time, reason string) {
+	events.Publish(events.Event{Type: events.IPBanned, IP: ip, Data: map[string]interface{}{"until": until, "reason": reason}})
+
+	banHandlersMutex.RLock()
+	defer banHandlersMutex.RUnlock()
+	for _, handler := range banHandlers {
+		handler(ip, until, reason)
+	}
+}
@@ -0,0 +1,163 @@
+package firewall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+const (
+	DefaultBodyInspectionSize = 8  // kilobytes
+	MaxBodyInspectionSize     = 64 // kilobytes
+
+	// Keys and values collected per body, so a body full of tiny fields can't blow up rule evaluation
+	maxBodyFields = 256
+)
+
+// InspectedBody is the part of a request body firewall rules are checked against
+type InspectedBody struct {
+	Raw       []byte
+	Keys      []string // form fields or json keys, nested json keys are joined with dots like user.name
+	Values    []string // string, number and bool values of those fields
+	Truncated bool     // the body is larger than what was inspected
+}
+
+// InspectBody reads up to maxSize bytes of body and parses them according to contentType. As much as possible of truncated
+// or broken json is parsed. The returned reader yields the whole body again, including the part that was inspected
+func InspectBody(body io.Reader, maxSize int, contentType string) (InspectedBody, io.Reader, error) {
+
+	inspected := InspectedBody{}
+
+	buf := make([]byte, maxSize+1)
+	read, err := io.ReadFull(body, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return inspected, nil, err
+	}
+	rest := io.MultiReader(bytes.NewReader(buf[:read]), body)
+	if read > maxSize {
+		read = maxSize
+		inspected.Truncated = true
+	}
+	inspected.Raw = buf[:read]
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		inspected.Keys, inspected.Values = formFields(inspected.Raw, inspected.Truncated)
+	case mediaType == "multipart/form-data":
+		inspected.Keys, inspected.Values = multipartFields(inspected.Raw, params["boundary"])
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		inspected.Keys, inspected.Values = jsonFields(inspected.Raw)
+	}
+	return inspected, rest, nil
+}
+
+func formFields(raw []byte, truncated bool) (keys []string, values []string) {
+	pairs := strings.Split(string(raw), "&")
+	if truncated && len(pairs) > 1 {
+		// The last pair was cut off
+		pairs = pairs[:len(pairs)-1]
+	}
+	for _, pair := range pairs {
+		if len(keys) >= maxBodyFields {
+			break
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil || key == "" {
+			continue
+		}
+		value, _ = url.QueryUnescape(value)
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return keys, values
+}
+
+func multipartFields(raw []byte, boundary string) (keys []string, values []string) {
+	if boundary == "" {
+		return nil, nil
+	}
+	reader := multipart.NewReader(bytes.NewReader(raw), boundary)
+	for len(keys) < maxBodyFields {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		keys = append(keys, part.FormName())
+		// File contents aren't inspected, only the names of the fields they're uploaded as
+		if part.FileName() == "" {
+			value, _ := io.ReadAll(io.LimitReader(part, 4*1024))
+			values = append(values, string(value))
+		}
+	}
+	return keys, values
+}
+
+// jsonFields walks the tokens of a json document, so keys before the point where a truncated document was cut off are still found
+func jsonFields(raw []byte) (keys []string, values []string) {
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	// path of the current value. Arrays don't add to the path, every element shares the key of the array
+	type level struct {
+		object    bool
+		expectKey bool
+		key       string
+	}
+	stack := []level{}
+
+	path := func() string {
+		names := []string{}
+		for _, l := range stack {
+			if l.object && l.key != "" {
+				names = append(names, l.key)
+			}
+		}
+		return strings.Join(names, ".")
+	}
+	valueDone := func() {
+		if len(stack) != 0 && stack[len(stack)-1].object {
+			stack[len(stack)-1].expectKey = true
+		}
+	}
+
+	for len(keys) < maxBodyFields && len(values) < maxBodyFields {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch token := token.(type) {
+		case json.Delim:
+			switch token {
+			case '{':
+				stack = append(stack, level{object: true, expectKey: true})
+			case '[':
+				stack = append(stack, level{})
+			case '}', ']':
+				if len(stack) != 0 {
+					stack = stack[:len(stack)-1]
+				}
+				valueDone()
+			}
+		default:
+			if len(stack) != 0 && stack[len(stack)-1].object && stack[len(stack)-1].expectKey {
+				stack[len(stack)-1].key = fmt.Sprint(token)
+				stack[len(stack)-1].expectKey = false
+				keys = append(keys, path())
+				continue
+			}
+			if token != nil {
+				values = append(values, fmt.Sprint(token))
+			}
+			valueDone()
+		}
+	}
+	return keys, values
+}
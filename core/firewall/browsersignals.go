@@ -0,0 +1,142 @@
+package firewall
+
+import (
+	"strings"
+	"time"
+)
+
+var (
+	ScoreBrowserSignalMismatch = -10
+
+	// Renderers of browsers without a gpu, which is what headless browsers usually run with
+	softwareRenderers = []string{"swiftshader", "llvmpipe", "softpipe", "mesa offscreen"}
+
+	// Region of a language tag -> area of the time zones used there
+	regionTimezones = map[string]string{
+		"US": "America", "CA": "America", "MX": "America", "BR": "America", "AR": "America", "CL": "America", "CO": "America", "PE": "America", "VE": "America",
+		"GB": "Europe", "IE": "Europe", "DE": "Europe", "AT": "Europe", "CH": "Europe", "FR": "Europe", "BE": "Europe", "NL": "Europe", "LU": "Europe",
+		"ES": "Europe", "PT": "Europe", "IT": "Europe", "PL": "Europe", "CZ": "Europe", "SK": "Europe", "HU": "Europe", "RO": "Europe", "BG": "Europe",
+		"GR": "Europe", "SE": "Europe", "NO": "Europe", "DK": "Europe", "FI": "Europe", "UA": "Europe", "RU": "Europe", "TR": "Europe",
+		"CN": "Asia", "JP": "Asia", "KR": "Asia", "IN": "Asia", "ID": "Asia", "TH": "Asia", "VN": "Asia", "SG": "Asia", "HK": "Asia", "TW": "Asia",
+		"PH": "Asia", "MY": "Asia", "PK": "Asia", "IL": "Asia", "AE": "Asia", "SA": "Asia",
+		"ZA": "Africa", "EG": "Africa", "NG": "Africa", "KE": "Africa", "MA": "Africa",
+		"AU": "Australia",
+	}
+)
+
+// BrowserSignals are collected by the js challenge once it's solved
+type BrowserSignals struct {
+	Solution  string   `json:"solution"`
+	Webdriver bool     `json:"webdriver"`
+	UserAgent string   `json:"userAgent"`
+	Platform  string   `json:"platform"`
+	Languages []string `json:"languages"`
+	Timezone  string   `json:"timezone"`
+	Offset    int      `json:"offset"`   // minutes the local time is behind utc, like Date.getTimezoneOffset()
+	Canvas    string   `json:"canvas"`   // sha256 of a rendered canvas
+	WebGL     string   `json:"webgl"`    // sha256 of the webgl renderer, vendor and limits
+	Renderer  string   `json:"renderer"` // (unmasked) webgl renderer
+}
+
+// CheckBrowserSignals compares the signals of a browser with each other and with the headers it sent.
+// automated is true if the browser admits being automated or lies about its user agent. Otherwise the signals
+// that don't add up are returned, a few of them can happen in real browsers (privacy extensions, travelling, ...)
+func CheckBrowserSignals(signals BrowserSignals, userAgent string, acceptLanguage string) (automated bool, inconsistencies []string) {
+
+	if signals.Webdriver || signals.UserAgent != userAgent {
+		return true, nil
+	}
+
+	if !sha256Hex(signals.Canvas) {
+		inconsistencies = append(inconsistencies, "canvas")
+	}
+	if !sha256Hex(signals.WebGL) {
+		inconsistencies = append(inconsistencies, "webgl")
+	} else {
+		renderer := strings.ToLower(signals.Renderer)
+		for _, software := range softwareRenderers {
+			if strings.Contains(renderer, software) {
+				inconsistencies = append(inconsistencies, "renderer")
+				break
+			}
+		}
+	}
+
+	if !platformMatches(userAgent, signals.Platform) {
+		inconsistencies = append(inconsistencies, "platform")
+	}
+
+	language, _, _ := strings.Cut(acceptLanguage, ",")
+	language, _, _ = strings.Cut(strings.TrimSpace(language), ";")
+	if len(signals.Languages) == 0 || !strings.EqualFold(primaryLanguage(signals.Languages[0]), primaryLanguage(language)) {
+		inconsistencies = append(inconsistencies, "languages")
+	}
+
+	if !timezoneMatches(signals.Timezone, signals.Offset, language) {
+		inconsistencies = append(inconsistencies, "timezone")
+	}
+
+	return false, inconsistencies
+}
+
+func sha256Hex(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, char := range hash {
+		if !strings.ContainsRune("0123456789abcdef", char) {
+			return false
+		}
+	}
+	return true
+}
+
+// platformMatches checks whether navigator.platform fits the operating system of the user agent. Unknown systems always match
+func platformMatches(userAgent string, platform string) bool {
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		return strings.HasPrefix(platform, "iP") || platform == "MacIntel"
+	case strings.Contains(userAgent, "Windows"):
+		return strings.HasPrefix(platform, "Win")
+	case strings.Contains(userAgent, "Macintosh"):
+		return strings.HasPrefix(platform, "Mac")
+	case strings.Contains(userAgent, "Android"):
+		return strings.HasPrefix(platform, "Linux") || strings.HasPrefix(platform, "Android")
+	case strings.Contains(userAgent, "Linux"), strings.Contains(userAgent, "X11"), strings.Contains(userAgent, "CrOS"):
+		return strings.HasPrefix(platform, "Linux") || strings.HasPrefix(platform, "X11")
+	}
+	return true
+}
+
+func primaryLanguage(tag string) string {
+	primary, _, _ := strings.Cut(tag, "-")
+	return primary
+}
+
+// timezoneMatches checks whether the time zone of a browser fits the region of its preferred language, e.g. no en-US on Asia/Tokyo,
+// and whether it reports the offset its time zone actually has
+func timezoneMatches(timezone string, offset int, language string) bool {
+
+	if timezone == "" {
+		return false
+	}
+
+	if location, err := time.LoadLocation(timezone); err == nil {
+		_, zoneOffset := time.Now().In(location).Zone()
+		if -zoneOffset/60 != offset {
+			return false
+		}
+	}
+
+	_, region, found := strings.Cut(language, "-")
+	area, known := regionTimezones[strings.ToUpper(region)]
+	if !found || !known {
+		return true
+	}
+	if timezone == "UTC" || strings.HasPrefix(timezone, "Etc/") {
+		// Default of most headless setups, barely used by real browsers
+		return false
+	}
+	zoneArea, _, _ := strings.Cut(timezone, "/")
+	return zoneArea == area
+}
@@ -0,0 +1,181 @@
+package firewall
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	// Verification endpoints of the supported captcha providers
+	CaptchaProviders = map[string]string{
+		"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+		"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+	}
+
+	captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+	// Default settings (will be overridden by config)
+	CaptchaMaxFailures   = 5
+	CaptchaFailureWindow = 10 * time.Minute
+	CaptchaFallbackTime  = 10 * time.Minute
+
+	// ip -> times of failed captcha verifications within CaptchaFailureWindow
+	captchaFailures      = map[string][]time.Time{}
+	captchaFailuresMutex = &sync.Mutex{}
+
+	// ip -> until when it has to solve the built-in captcha, because its score based captcha was inconclusive
+	captchaFallbacks = map[string]time.Time{}
+)
+
+// Decisions of a score based captcha
+const (
+	CaptchaAllow = iota
+	CaptchaChallenge
+	CaptchaBlock
+)
+
+// CaptchaResult is the part of a siteverify response that's shared by all providers
+type CaptchaResult struct {
+	Success    bool     `json:"success"`
+	Score      float64  `json:"score"`  // reCAPTCHA v3 only, 0.0 (bot) to 1.0 (human)
+	Action     string   `json:"action"` // reCAPTCHA v3 only
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// ScoreCaptcha combines the score of a score based captcha with the reputation of ip. weight is the share of the captcha score (0 to 1),
+// the combined score (0 to 100) is compared against allowScore and blockScore
+func ScoreCaptcha(result CaptchaResult, ip string, weight float64, allowScore int, blockScore int) int {
+
+	if !result.Success {
+		return CaptchaBlock
+	}
+
+	combined := int(weight*result.Score*100 + (1-weight)*float64(GetReputationScore(ip)))
+	switch {
+	case combined >= allowScore:
+		return CaptchaAllow
+	case combined < blockScore:
+		return CaptchaBlock
+	}
+	return CaptchaChallenge
+}
+
+// RequireInteractiveCaptcha makes ip solve the built-in captcha for CaptchaFallbackTime instead of the score based one
+func RequireInteractiveCaptcha(ip string) {
+	captchaFailuresMutex.Lock()
+	captchaFallbacks[ip] = time.Now().Add(CaptchaFallbackTime)
+	captchaFailuresMutex.Unlock()
+}
+
+// InteractiveCaptchaRequired checks whether ip has to solve the built-in captcha
+func InteractiveCaptchaRequired(ip string) bool {
+	captchaFailuresMutex.Lock()
+	defer captchaFailuresMutex.Unlock()
+	until, ok := captchaFallbacks[ip]
+	return ok && time.Now().Before(until)
+}
+
+// RecordCaptchaFailure remembers a failed captcha verification of ip
+func RecordCaptchaFailure(ip string) {
+	captchaFailuresMutex.Lock()
+	captchaFailures[ip] = append(recentCaptchaFailures(ip, time.Now()), time.Now())
+	captchaFailuresMutex.Unlock()
+}
+
+// CaptchaFailures returns how many captchas ip failed within CaptchaFailureWindow
+func CaptchaFailures(ip string) int {
+	captchaFailuresMutex.Lock()
+	defer captchaFailuresMutex.Unlock()
+	return len(recentCaptchaFailures(ip, time.Now()))
+}
+
+// CaptchaFailureLimited checks whether ip failed maxFailures captchas within CaptchaFailureWindow.
+// maxFailures 0 uses CaptchaMaxFailures, -1 never limits
+func CaptchaFailureLimited(ip string, maxFailures int) bool {
+	if maxFailures == 0 {
+		maxFailures = CaptchaMaxFailures
+	}
+	if maxFailures < 0 {
+		return false
+	}
+
+	captchaFailuresMutex.Lock()
+	defer captchaFailuresMutex.Unlock()
+	failures := recentCaptchaFailures(ip, time.Now())
+	if len(failures) == 0 {
+		delete(captchaFailures, ip)
+	} else {
+		captchaFailures[ip] = failures
+	}
+	return len(failures) >= maxFailures
+}
+
+// recentCaptchaFailures drops failures that left the window. captchaFailuresMutex has to be held
+func recentCaptchaFailures(ip string, now time.Time) []time.Time {
+	failures := captchaFailures[ip]
+	for len(failures) != 0 && now.Sub(failures[0]) > CaptchaFailureWindow {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+// StartCaptchaCleanupRoutine forgets ips whose failed captchas all left the window and expired fallbacks
+func StartCaptchaCleanupRoutine() {
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+
+			now := time.Now()
+			captchaFailuresMutex.Lock()
+			for ip := range captchaFailures {
+				if len(recentCaptchaFailures(ip, now)) == 0 {
+					delete(captchaFailures, ip)
+				}
+			}
+			for ip, until := range captchaFallbacks {
+				if now.After(until) {
+					delete(captchaFallbacks, ip)
+				}
+			}
+			captchaFailuresMutex.Unlock()
+		}
+	}()
+}
+
+// VerifyCaptcha checks a token solved by the client with the captcha provider.
+// An error means the provider couldn't be asked, not that the token is invalid
+func VerifyCaptcha(provider string, secret string, token string, ip string) (CaptchaResult, error) {
+
+	result := CaptchaResult{}
+
+	endpoint, ok := CaptchaProviders[provider]
+	if !ok {
+		return result, errors.New("unknown captcha provider " + provider)
+	}
+	if token == "" {
+		return result, nil
+	}
+
+	resp, err := captchaClient.PostForm(endpoint, url.Values{
+		"secret":   {secret},
+		"response": {token},
+		"remoteip": {ip},
+	})
+	if err != nil {
+		return result, errors.New("failed to verify captcha: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return result, errors.New("failed to verify captcha: " + resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, errors.New("failed to verify captcha: " + err.Error())
+	}
+	return result, nil
+}
@@ -17,8 +17,11 @@ func CalculateDynamicDifficulty(ip string, domainName string, baseDifficulty int
 		return baseDifficulty
 	}
 	
-	// Get reputation score
+	// Get reputation score, fresh ips of a burned prefix don't start with a clean slate
 	reputationScore := GetReputationScore(ip)
+	if subnetScore := GetSubnetReputationScore(ip); subnetScore < reputationScore {
+		reputationScore = subnetScore
+	}
 	
 	// Get domain attack status
 	Mutex.RLock()
@@ -42,6 +45,22 @@ func CalculateDynamicDifficulty(ip string, domainName string, baseDifficulty int
 		reputationAdjustment = -1 // Good reputation, slightly easier
 	}
 	
+	// Whole networks that mostly send abuse (bulletproof hosting, ...) face harder challenges
+	asnAdjustment := 0
+	if asnScore := GetIPASNReputationScore(ip); asnScore < 50 {
+		asnAdjustment = +2
+	} else if asnScore < 80 {
+		asnAdjustment = +1
+	}
+	
+	// Floods mostly come from rented servers, residential visitors don't pay for them
+	classificationAdjustment := 0
+	if IPClassificationEnabled {
+		if datacenter, vpn := ClassifyIP(ip); datacenter || vpn {
+			classificationAdjustment = ClassificationDifficulty
+		}
+	}
+	
 	// Calculate difficulty adjustment based on attack intensity
 	attackAdjustment := 0
 	if domainData.BypassAttack {
@@ -63,7 +82,7 @@ func CalculateDynamicDifficulty(ip string, domainName string, baseDifficulty int
 	}
 	
 	// Calculate final difficulty
-	finalDifficulty := baseDifficulty + reputationAdjustment + attackAdjustment + stageAdjustment
+	finalDifficulty := baseDifficulty + reputationAdjustment + asnAdjustment + classificationAdjustment + attackAdjustment + stageAdjustment
 	
 	// Clamp to min/max range
 	if finalDifficulty < MinDifficulty {
@@ -0,0 +1,215 @@
+package firewall
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxChallengeSolveSamples = 1000 // solve times kept per statistic to calculate the median from
+
+var (
+	// Default settings (will be overridden by config)
+	ChallengeAbandonTime = 10 * time.Minute // challenges that weren't solved within this count as abandoned
+
+	// clearance -> challenge that was issued for it and not solved yet
+	pendingChallenges = map[string]*pendingChallenge{}
+
+	challengeStats      = map[ChallengeStatKey]*challengeStat{}
+	challengeStatsMutex = &sync.RWMutex{}
+)
+
+type pendingChallenge struct {
+	key    ChallengeStatKey
+	ip     string
+	issued time.Time
+}
+
+type ChallengeStatKey struct {
+	Domain     string
+	Level      int // 1 (cookie), 2 (js) or 3 (captcha)
+	Difficulty int // difficulty of the js challenge, 0 for other levels
+	Country    string
+}
+
+type challengeStat struct {
+	issued     int
+	solved     int
+	failed     int
+	abandoned  int
+	solveTimes []time.Duration
+}
+
+// ChallengeStats summarizes the challenges issued for a ChallengeStatKey
+type ChallengeStats struct {
+	ChallengeStatKey
+	Issued    int
+	Solved    int
+	Failed    int // times the challenge was served again, because the client came back without solving it
+	Abandoned int
+	Median    time.Duration // median solve time
+}
+
+// RecordChallengeIssued counts a challenge served for clearance. Serving the same challenge again before it's solved counts as a failed attempt
+func RecordChallengeIssued(clearance string, domainName string, level int, difficulty int, ip string) {
+
+	challengeStatsMutex.Lock()
+	defer challengeStatsMutex.Unlock()
+
+	if pending, ok := pendingChallenges[clearance]; ok {
+		challengeStatLocked(pending.key).failed++
+		return
+	}
+
+	key := ChallengeStatKey{
+		Domain:     domainName,
+		Level:      level,
+		Difficulty: difficulty,
+		Country:    cachedIPCountry(ip),
+	}
+	pendingChallenges[clearance] = &pendingChallenge{key: key, ip: ip, issued: time.Now()}
+	challengeStatLocked(key).issued++
+}
+
+// RecordChallengeSolved counts the challenge of clearance as solved, if one was issued for it
+func RecordChallengeSolved(clearance string) {
+
+	// Called for every request that passed its challenge, most of them solved it long ago
+	challengeStatsMutex.RLock()
+	_, ok := pendingChallenges[clearance]
+	challengeStatsMutex.RUnlock()
+	if !ok {
+		return
+	}
+
+	challengeStatsMutex.Lock()
+	defer challengeStatsMutex.Unlock()
+
+	pending, ok := pendingChallenges[clearance]
+	if !ok {
+		// Solved by another request in the meantime
+		return
+	}
+	delete(pendingChallenges, clearance)
+
+	solveTime := time.Since(pending.issued)
+	stat := challengeStatLocked(pending.key)
+	stat.solved++
+	stat.solveTimes = append(stat.solveTimes, solveTime)
+	observeChallengeSolved(pending.key, solveTime)
+	if len(stat.solveTimes) > maxChallengeSolveSamples {
+		stat.solveTimes = stat.solveTimes[len(stat.solveTimes)-maxChallengeSolveSamples:]
+	}
+}
+
+// challengeStatLocked returns the statistic of key, creating it if needed. challengeStatsMutex has to be held
+func challengeStatLocked(key ChallengeStatKey) *challengeStat {
+	stat, ok := challengeStats[key]
+	if !ok {
+		stat = &challengeStat{}
+		challengeStats[key] = stat
+	}
+	return stat
+}
+
+// cachedIPCountry returns the country of ip if it was looked up already. Statistics shouldn't wait for the geo api
+func cachedIPCountry(ip string) string {
+	GeoCacheMutex.RLock()
+	defer GeoCacheMutex.RUnlock()
+	if geoData, ok := GeoCache[ip]; ok && geoData.CountryCode != "" {
+		return geoData.CountryCode
+	}
+	return "unknown"
+}
+
+// GetChallengeStats returns the challenge statistics of domainName, or of every domain if it's empty.
+// groupBy "level" merges the statistics of all countries, "country" the ones of all levels. Anything else keeps them apart
+func GetChallengeStats(domainName string, groupBy string) []ChallengeStats {
+
+	type merged struct {
+		stats      ChallengeStats
+		solveTimes []time.Duration
+	}
+	groups := map[ChallengeStatKey]*merged{}
+
+	challengeStatsMutex.Lock()
+	for key, stat := range challengeStats {
+		if domainName != "" && key.Domain != domainName {
+			continue
+		}
+		switch groupBy {
+		case "level":
+			key.Country = ""
+		case "country":
+			key.Level = 0
+			key.Difficulty = 0
+		}
+		group, ok := groups[key]
+		if !ok {
+			group = &merged{stats: ChallengeStats{ChallengeStatKey: key}}
+			groups[key] = group
+		}
+		group.stats.Issued += stat.issued
+		group.stats.Solved += stat.solved
+		group.stats.Failed += stat.failed
+		group.stats.Abandoned += stat.abandoned
+		group.solveTimes = append(group.solveTimes, stat.solveTimes...)
+	}
+	challengeStatsMutex.Unlock()
+
+	result := make([]ChallengeStats, 0, len(groups))
+	for _, group := range groups {
+		group.stats.Median = medianDuration(group.solveTimes)
+		result = append(result, group.stats)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Level != result[j].Level {
+			return result[i].Level < result[j].Level
+		}
+		if result[i].Difficulty != result[j].Difficulty {
+			return result[i].Difficulty < result[j].Difficulty
+		}
+		return result[i].Issued > result[j].Issued
+	})
+	return result
+}
+
+func medianDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted[len(sorted)/2]
+}
+
+// StartChallengeStatsRoutine counts challenges that weren't solved within ChallengeAbandonTime as abandoned. With
+// escalation enabled they count as failed challenges of their ip aswell
+func StartChallengeStatsRoutine() {
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+
+			now := time.Now()
+			abandoned := []*pendingChallenge{}
+			challengeStatsMutex.Lock()
+			for clearance, pending := range pendingChallenges {
+				if now.Sub(pending.issued) > ChallengeAbandonTime {
+					challengeStatLocked(pending.key).abandoned++
+					delete(pendingChallenges, clearance)
+					abandoned = append(abandoned, pending)
+				}
+			}
+			challengeStatsMutex.Unlock()
+
+			if EscalationEnabled {
+				for _, pending := range abandoned {
+					RecordEscalationFailure(pending.ip, pending.key.Level)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package firewall
+
+import (
+	"encoding/json"
+	"goProxy/core/logger"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// Generations are kept here, so clearances (and clearance tokens) that were invalidated stay invalid after a restart
+	ClearanceStatePath = "clearances.json"
+
+	// clearance scope -> generation, the unix timestamp its clearances were invalidated at last
+	clearanceGenerations      map[string]int64
+	clearanceGenerationsOnce  = &sync.Once{}
+	clearanceGenerationsMutex = &sync.RWMutex{}
+)
+
+// ClearanceGeneration returns the current generation of a clearance scope. It's part of every clearance,
+// so bumping it invalidates all clearances that were issued for the scope before
+func ClearanceGeneration(scope string) string {
+	clearanceGenerationsOnce.Do(loadClearanceGenerations)
+
+	clearanceGenerationsMutex.RLock()
+	defer clearanceGenerationsMutex.RUnlock()
+	return strconv.FormatInt(clearanceGenerations[scope], 10)
+}
+
+// InvalidateClearances makes every client of a clearance scope solve its challenge again, on every node of the cluster
+func InvalidateClearances(scope string) {
+	clearanceGenerationsOnce.Do(loadClearanceGenerations)
+
+	clearanceGenerationsMutex.Lock()
+	generation := time.Now().Unix()
+	if generation <= clearanceGenerations[scope] {
+		generation = clearanceGenerations[scope] + 1
+	}
+	clearanceGenerations[scope] = generation
+	saveClearanceGenerations()
+	clearanceGenerationsMutex.Unlock()
+
+	Broadcast(ClusterEvent{
+		Type:       "invalidate",
+		Scope:      scope,
+		Generation: generation,
+	})
+}
+
+// applyClearanceGeneration moves a clearance scope to the generation another node of the cluster invalidated it with.
+// Nodes keep the highest generation, so they agree no matter in which order invalidations arrive
+func applyClearanceGeneration(scope string, generation int64) {
+	clearanceGenerationsOnce.Do(loadClearanceGenerations)
+
+	clearanceGenerationsMutex.Lock()
+	defer clearanceGenerationsMutex.Unlock()
+	if generation > clearanceGenerations[scope] {
+		clearanceGenerations[scope] = generation
+		saveClearanceGenerations()
+	}
+}
+
+func loadClearanceGenerations() {
+	clearanceGenerations = map[string]int64{}
+	if content, err := ioutil.ReadFile(ClearanceStatePath); err == nil {
+		json.Unmarshal(content, &clearanceGenerations)
+	}
+}
+
+// saveClearanceGenerations replaces ClearanceStatePath at once. Has to be called with clearanceGenerationsMutex locked
+func saveClearanceGenerations() {
+	jsonGenerations, err := json.MarshalIndent(clearanceGenerations, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(ClearanceStatePath+".tmp", jsonGenerations, 0644)
+	}
+	if err == nil {
+		err = os.Rename(ClearanceStatePath+".tmp", ClearanceStatePath)
+	}
+	if err != nil {
+		logger.Error("Failed to save invalidated clearances, they become valid again after a restart", logger.Err(err))
+	}
+}
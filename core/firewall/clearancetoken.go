@@ -0,0 +1,167 @@
+package firewall
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	ClearanceTokensEnabled = false
+
+	clearanceTokenAlgorithm  = "hmac"
+	clearanceTokenSecret     []byte
+	clearanceTokenKey        ed25519.PrivateKey  // nil if this node only verifies tokens
+	clearanceTokenPublicKeys []ed25519.PublicKey // keys of every node whose tokens are accepted
+	clearanceTokenMutex      = &sync.RWMutex{}
+)
+
+// ClearanceToken is a clearance that carries everything needed to verify it, so every node that shares the secret
+// (or trusts the public key) of the node that issued it accepts it, without knowing about the challenge it was issued for
+type ClearanceToken struct {
+	Level       int    `json:"l"`
+	Scope       string `json:"s"` // clearance scope and path it's valid for
+	Generation  string `json:"g"` // generation of the scope it was issued in, see ClearanceGeneration
+	IPPrefix    string `json:"p"`
+	Fingerprint string `json:"f"` // hash of the binding of the client, see CookieBinding
+	Expiry      int64  `json:"e"`
+	Difficulty  int    `json:"d"` // difficulty of the js challenge that was solved
+}
+
+// ConfigureClearanceTokens sets how clearance tokens are signed. hmac signs and verifies using secret, ed25519 signs using
+// privateKey (a base64 seed, optional on nodes that only verify) and verifies using the base64 publicKeys and the own key.
+// Invalid settings are rejected as a whole, the current ones stay in place
+func ConfigureClearanceTokens(algorithm string, secret string, privateKey string, publicKeys []string) error {
+
+	var (
+		tokenSecret     []byte
+		tokenKey        ed25519.PrivateKey
+		tokenPublicKeys []ed25519.PublicKey
+	)
+
+	switch algorithm {
+	case "", "hmac":
+		if len(secret) < 32 {
+			return errors.New("clearance token secret has to be at least 32 characters long")
+		}
+		algorithm = "hmac"
+		tokenSecret = []byte(secret)
+	case "ed25519":
+		if privateKey != "" {
+			seed, err := base64.StdEncoding.DecodeString(privateKey)
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return errors.New("clearance token privateKey has to be a base64 encoded 32 byte seed")
+			}
+			tokenKey = ed25519.NewKeyFromSeed(seed)
+			tokenPublicKeys = append(tokenPublicKeys, tokenKey.Public().(ed25519.PublicKey))
+		}
+		for _, publicKey := range publicKeys {
+			key, err := base64.StdEncoding.DecodeString(publicKey)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				return errors.New("invalid clearance token public key " + publicKey)
+			}
+			tokenPublicKeys = append(tokenPublicKeys, ed25519.PublicKey(key))
+		}
+		if len(tokenPublicKeys) == 0 {
+			return errors.New("clearance tokens need a privateKey or publicKeys")
+		}
+	default:
+		return errors.New("unknown clearance token algorithm " + algorithm)
+	}
+
+	clearanceTokenMutex.Lock()
+	clearanceTokenAlgorithm = algorithm
+	clearanceTokenSecret = tokenSecret
+	clearanceTokenKey = tokenKey
+	clearanceTokenPublicKeys = tokenPublicKeys
+	clearanceTokenMutex.Unlock()
+	return nil
+}
+
+// CanIssueClearanceTokens checks whether this node has the key to sign clearance tokens
+func CanIssueClearanceTokens() bool {
+	clearanceTokenMutex.RLock()
+	defer clearanceTokenMutex.RUnlock()
+	return ClearanceTokensEnabled && (clearanceTokenAlgorithm == "hmac" || clearanceTokenKey != nil)
+}
+
+// ClearanceTokenPrefix returns the ip prefix clearance tokens of ip are bound to
+func ClearanceTokenPrefix(ip string) string {
+	return bindingPrefix(ip)
+}
+
+// ClearanceTokenFingerprint hashes the binding of a client, so tokens don't carry its fingerprints in plain text
+func ClearanceTokenFingerprint(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// IssueClearanceToken signs token. The result only contains characters that are allowed in cookies
+func IssueClearanceToken(token ClearanceToken) string {
+
+	payload, _ := json.Marshal(token)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	clearanceTokenMutex.RLock()
+	defer clearanceTokenMutex.RUnlock()
+
+	switch clearanceTokenAlgorithm {
+	case "ed25519":
+		if clearanceTokenKey == nil {
+			return ""
+		}
+		return encoded + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(clearanceTokenKey, []byte(encoded)))
+	default:
+		mac := hmac.New(sha256.New, clearanceTokenSecret)
+		mac.Write([]byte(encoded))
+		return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+}
+
+// VerifyClearanceToken checks the signature and expiry of a token and returns what it carries
+func VerifyClearanceToken(value string) (ClearanceToken, bool) {
+
+	token := ClearanceToken{}
+
+	encoded, signature, found := strings.Cut(value, ".")
+	if !found {
+		return token, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return token, false
+	}
+
+	clearanceTokenMutex.RLock()
+	valid := false
+	switch clearanceTokenAlgorithm {
+	case "ed25519":
+		for _, key := range clearanceTokenPublicKeys {
+			if ed25519.Verify(key, []byte(encoded), sig) {
+				valid = true
+				break
+			}
+		}
+	default:
+		mac := hmac.New(sha256.New, clearanceTokenSecret)
+		mac.Write([]byte(encoded))
+		valid = len(clearanceTokenSecret) != 0 && hmac.Equal(sig, mac.Sum(nil))
+	}
+	clearanceTokenMutex.RUnlock()
+	if !valid {
+		return token, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &token) != nil {
+		return token, false
+	}
+	return token, time.Now().Unix() < token.Expiry
+}
@@ -0,0 +1,211 @@
+package firewall
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// A ClientHello has to fit into a single TLS record for us to fingerprint it
+	maxHelloRecord = 5 + 16384
+)
+
+// helloConn keeps a copy of the first TLS record a client sends, since crypto/tls doesn't expose the raw ClientHello.
+// The copy is handed to Fingerprint, which uses it to compute JA3 and JA4
+type helloConn struct {
+	net.Conn
+	record   []byte
+	complete bool
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.complete && n > 0 {
+		c.record = append(c.record, b[:n]...)
+		if len(c.record) >= 5 {
+			recordLen := 5 + int(binary.BigEndian.Uint16(c.record[3:5]))
+			if len(c.record) >= recordLen || len(c.record) >= maxHelloRecord {
+				c.complete = true
+				if recordLen <= len(c.record) {
+					c.record = c.record[:recordLen]
+				}
+			}
+		}
+	}
+	return n, err
+}
+
+type helloListener struct {
+	net.Listener
+}
+
+func (l *helloListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &helloConn{Conn: conn}, nil
+}
+
+// CaptureClientHello wraps a listener, so Fingerprint can read the raw ClientHello of its connections
+func CaptureClientHello(listener net.Listener) net.Listener {
+	return &helloListener{Listener: listener}
+}
+
+// clientHello holds the ClientHello fields fingerprints are computed from, in the order the client sent them
+type clientHello struct {
+	Version      uint16
+	CipherSuites []uint16
+	Extensions   []uint16
+	Curves       []uint16
+	Points       []uint8
+
+	ServerName          bool
+	ALPN                string // first protocol the client offered
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+}
+
+// parseClientHello parses a TLS record containing a ClientHello. Returns false if the record is malformed or incomplete
+func parseClientHello(record []byte) (clientHello, bool) {
+
+	hello := clientHello{}
+
+	// Record header: type, version, length. Handshake header: type, 3 byte length
+	if len(record) < 9 || record[0] != 0x16 || record[5] != 0x01 {
+		return hello, false
+	}
+	data := record[9:]
+
+	reader := helloReader{data: data}
+	hello.Version = reader.uint16()
+	reader.skip(32) // random
+	reader.skip(int(reader.uint8()))
+
+	cipherSuites := reader.bytes(int(reader.uint16()))
+	for i := 0; i+1 < len(cipherSuites); i += 2 {
+		hello.CipherSuites = append(hello.CipherSuites, binary.BigEndian.Uint16(cipherSuites[i:]))
+	}
+	reader.skip(int(reader.uint8())) // compression methods
+
+	if reader.failed {
+		return hello, false
+	}
+	if reader.empty() {
+		// No extensions at all, very old clients do this
+		return hello, true
+	}
+
+	extensions := helloReader{data: reader.bytes(int(reader.uint16()))}
+	for !extensions.empty() && !extensions.failed {
+		extType := extensions.uint16()
+		extData := helloReader{data: extensions.bytes(int(extensions.uint16()))}
+		hello.Extensions = append(hello.Extensions, extType)
+
+		switch extType {
+		case 10: // supported_groups
+			groups := extData.bytes(int(extData.uint16()))
+			for i := 0; i+1 < len(groups); i += 2 {
+				hello.Curves = append(hello.Curves, binary.BigEndian.Uint16(groups[i:]))
+			}
+		case 11: // ec_point_formats
+			hello.Points = append(hello.Points, extData.bytes(int(extData.uint8()))...)
+		case 0: // server_name
+			hello.ServerName = true
+		case 16: // application_layer_protocol_negotiation
+			protocols := helloReader{data: extData.bytes(int(extData.uint16()))}
+			hello.ALPN = string(protocols.bytes(int(protocols.uint8())))
+		case 13: // signature_algorithms
+			algorithms := extData.bytes(int(extData.uint16()))
+			for i := 0; i+1 < len(algorithms); i += 2 {
+				hello.SignatureAlgorithms = append(hello.SignatureAlgorithms, binary.BigEndian.Uint16(algorithms[i:]))
+			}
+		case 43: // supported_versions
+			versions := extData.bytes(int(extData.uint8()))
+			for i := 0; i+1 < len(versions); i += 2 {
+				hello.SupportedVersions = append(hello.SupportedVersions, binary.BigEndian.Uint16(versions[i:]))
+			}
+		}
+	}
+
+	return hello, !reader.failed && !extensions.failed
+}
+
+// JA3 returns the JA3 string of the ClientHello along with its md5 hash
+func (hello clientHello) JA3() (string, string) {
+
+	ja3 := strconv.Itoa(int(hello.Version)) + "," +
+		joinUint16(hello.CipherSuites) + "," +
+		joinUint16(hello.Extensions) + "," +
+		joinUint16(hello.Curves) + ","
+
+	points := make([]string, 0, len(hello.Points))
+	for _, point := range hello.Points {
+		points = append(points, strconv.Itoa(int(point)))
+	}
+	ja3 += strings.Join(points, "-")
+
+	hash := md5.Sum([]byte(ja3))
+	return ja3, hex.EncodeToString(hash[:])
+}
+
+// joinUint16 joins values with "-", leaving out GREASE values browsers randomly add
+func joinUint16(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		if isGrease(value) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(value)))
+	}
+	return strings.Join(parts, "-")
+}
+
+// isGrease checks for the reserved values of RFC 8701 (0x0a0a, 0x1a1a, ..., 0xfafa)
+func isGrease(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// helloReader reads big endian values, remembering if it ever ran out of data instead of panicking
+type helloReader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.failed || n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+	out := r.data[:n]
+	r.data = r.data[n:]
+	return out
+}
+
+func (r *helloReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *helloReader) uint8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *helloReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *helloReader) empty() bool {
+	return len(r.data) == 0
+}
@@ -0,0 +1,358 @@
+package firewall
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	clusterMaxMessage = 8 * 1024
+	clusterMaxAge     = 30 * time.Second // older messages are rejected, so they can't be replayed later
+	clusterMaxSeen    = 256 * 1024       // signatures of messages that are remembered until they're too old to be replayed
+)
+
+var (
+	// Default settings (will be overridden by config)
+	ClusterEnabled  = false
+	ClusterNode     = ""
+	ClusterInterval = 2 * time.Second // how often nodes repeat the state of domains under attack
+
+	clusterSecret []byte
+	clusterPeers  []*net.UDPAddr
+	clusterConn   *net.UDPConn
+	clusterOutbox = make(chan ClusterEvent, 1024)
+
+	// domain -> node -> state the node shared last
+	clusterStates = map[string]map[string]clusterState{}
+	// domain -> state this node shared last
+	clusterShared = map[string]clusterState{}
+	clusterMutex  = &sync.RWMutex{}
+
+	ClusterShareReputation = false
+	ClusterReputationRate  = 100 // reputation changes sent per second, and accepted per second from every node
+	ClusterMaxReputation   = 20  // largest decrease of a shared reputation change that is applied
+
+	reputationSent     = clusterRate{}
+	reputationReceived = map[string]*clusterRate{} // node -> changes it shared
+
+	// signature -> unix nanoseconds the message stops being accepted at. Only used by clusterReceiver
+	clusterSeen      = map[[sha256.Size]byte]int64{}
+	clusterSeenPurge = time.Time{}
+)
+
+// ClusterEvent is a change of the state of a node, gossiped to every peer
+type ClusterEvent struct {
+	Node string `json:"node"`
+	Type string `json:"type"` // "stage", "ban", "reputation" or "invalidate"
+	Time int64  `json:"time"` // unix nanoseconds the event was sent at
+
+	// "stage" only
+	Domain     string  `json:"domain,omitempty"`
+	Stage      int     `json:"stage,omitempty"`
+	Multiplier float64 `json:"multiplier,omitempty"` // adaptive ratelimit multiplier of the domain
+
+	// "ban" and "reputation" only
+	IP    string `json:"ip,omitempty"`
+	Until int64  `json:"until,omitempty"` // "ban" only: unix timestamp
+
+	// "reputation" only
+	Delta  int    `json:"delta,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// "invalidate" only: clearance scope and its new generation, see InvalidateClearances
+	Scope      string `json:"scope,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+}
+
+// clusterRate counts events per second. Has to be used with clusterMutex locked
+type clusterRate struct {
+	second int64
+	events int
+}
+
+func (rate *clusterRate) allow(limit int) bool {
+	now := time.Now().Unix()
+	if now != rate.second {
+		rate.second = now
+		rate.events = 0
+	}
+	rate.events++
+	return rate.events <= limit
+}
+
+type clusterState struct {
+	stage      int
+	multiplier float64
+	expires    time.Time
+}
+
+// StartCluster listens for events of peers on listen and starts gossiping the state of this node to peers.
+// Every message is signed with secret, which has to be the same on every node
+func StartCluster(node string, listen string, peers []string, secret string) error {
+
+	if len(secret) < 32 {
+		return errors.New("cluster secret has to be at least 32 characters long")
+	}
+	if node == "" {
+		return errors.New("cluster node needs a name")
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return errors.New("invalid cluster listen address " + listen)
+	}
+	for _, peer := range peers {
+		peerAddr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return errors.New("invalid cluster peer " + peer)
+		}
+		clusterPeers = append(clusterPeers, peerAddr)
+	}
+
+	clusterConn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	ClusterNode = node
+	clusterSecret = []byte(secret)
+	ClusterEnabled = true
+
+	go clusterSender()
+	go clusterReceiver()
+	return nil
+}
+
+// Broadcast queues an event for every peer. Events are dropped if the queue is full, the state of domains is repeated anyway
+func Broadcast(event ClusterEvent) {
+	if !ClusterEnabled {
+		return
+	}
+	event.Node = ClusterNode
+	select {
+	case clusterOutbox <- event:
+	default:
+	}
+}
+
+func clusterSender() {
+	defer pnc.PanicHndl()
+
+	for event := range clusterOutbox {
+		event.Time = time.Now().UnixNano()
+		payload, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		mac := hmac.New(sha256.New, clusterSecret)
+		mac.Write(payload)
+		message := append(mac.Sum(nil), payload...)
+		for _, peer := range clusterPeers {
+			clusterConn.WriteToUDP(message, peer)
+		}
+	}
+}
+
+func clusterReceiver() {
+	defer pnc.PanicHndl()
+
+	buffer := make([]byte, clusterMaxMessage)
+	for {
+		n, _, err := clusterConn.ReadFromUDP(buffer)
+		if err != nil {
+			logger.Error("Cluster stopped receiving", logger.Err(err))
+			return
+		}
+		if n <= sha256.Size {
+			continue
+		}
+
+		signature, payload := buffer[:sha256.Size], buffer[sha256.Size:n]
+		mac := hmac.New(sha256.New, clusterSecret)
+		mac.Write(payload)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			continue
+		}
+
+		event := ClusterEvent{}
+		if json.Unmarshal(payload, &event) != nil || event.Node == ClusterNode {
+			continue
+		}
+		if age := time.Since(time.Unix(0, event.Time)); age > clusterMaxAge || age < -clusterMaxAge {
+			continue
+		}
+		if !firstSeen(signature, event.Time) {
+			continue
+		}
+		applyClusterEvent(event)
+	}
+}
+
+// firstSeen returns whether a message with signature wasn't received yet, so captured messages can't be replayed while
+// they're young enough to be accepted. Every message carries the time it was sent at, two messages never share a signature
+func firstSeen(signature []byte, sent int64) bool {
+	key := [sha256.Size]byte{}
+	copy(key[:], signature)
+	if _, seen := clusterSeen[key]; seen {
+		return false
+	}
+
+	now := time.Now()
+	if since := now.Sub(clusterSeenPurge); since > clusterMaxAge || (len(clusterSeen) >= clusterMaxSeen && since > time.Second) {
+		clusterSeenPurge = now
+		for seenKey, expires := range clusterSeen {
+			if expires < now.UnixNano() {
+				delete(clusterSeen, seenKey)
+			}
+		}
+	}
+	// Peers send less than that within clusterMaxAge, a message that can't be remembered isn't applied either
+	if len(clusterSeen) >= clusterMaxSeen {
+		return false
+	}
+
+	// A message is accepted until clusterMaxAge after it was sent
+	clusterSeen[key] = sent + int64(clusterMaxAge)
+	return true
+}
+
+func applyClusterEvent(event ClusterEvent) {
+	switch event.Type {
+	case "stage":
+		clusterMutex.Lock()
+		if clusterStates[event.Domain] == nil {
+			clusterStates[event.Domain] = map[string]clusterState{}
+		}
+		if event.Stage <= 1 {
+			delete(clusterStates[event.Domain], event.Node)
+		} else {
+			clusterStates[event.Domain][event.Node] = clusterState{
+				stage:      event.Stage,
+				multiplier: event.Multiplier,
+				expires:    time.Now().Add(3 * ClusterInterval),
+			}
+		}
+		clusterMutex.Unlock()
+	case "ban":
+		applyEscalationBan(event.IP, time.Unix(event.Until, 0))
+	case "reputation":
+		if !ClusterShareReputation || !ReputationEnabled || event.Delta >= 0 || event.IP == "" {
+			return
+		}
+		clusterMutex.Lock()
+		rate, ok := reputationReceived[event.Node]
+		if !ok {
+			rate = &clusterRate{}
+			reputationReceived[event.Node] = rate
+		}
+		allowed := rate.allow(ClusterReputationRate)
+		clusterMutex.Unlock()
+		if !allowed {
+			return
+		}
+		if event.Delta < -ClusterMaxReputation {
+			event.Delta = -ClusterMaxReputation
+		}
+		applyReputation(event.IP, event.Delta, event.Reason, false)
+	case "invalidate":
+		if event.Scope != "" {
+			applyClearanceGeneration(event.Scope, event.Generation)
+		}
+	}
+}
+
+// ShareReputation sends a decrease of the reputation of ip to every peer. Changes above ClusterReputationRate per second are dropped
+func ShareReputation(ip string, delta int, reason string) {
+	if !ClusterEnabled || !ClusterShareReputation {
+		return
+	}
+
+	clusterMutex.Lock()
+	allowed := reputationSent.allow(ClusterReputationRate)
+	clusterMutex.Unlock()
+	if !allowed {
+		return
+	}
+
+	Broadcast(ClusterEvent{
+		Type:   "reputation",
+		IP:     ip,
+		Delta:  delta,
+		Reason: reason,
+	})
+}
+
+// ShareDomainState tells peers about the stage of a domain whenever it changed, and repeats it every ClusterInterval while
+// the domain is under attack. Peers forget the state of a node that stopped repeating it
+func ShareDomainState(domainName string, domainData domains.DomainData) {
+	if !ClusterEnabled {
+		return
+	}
+
+	state := clusterState{
+		stage:      domainData.Stage,
+		multiplier: GetAdaptiveMultiplier(domainName),
+	}
+
+	clusterMutex.Lock()
+	shared, ok := clusterShared[domainName]
+	changed := !ok || shared.stage != state.stage || shared.multiplier != state.multiplier
+	if !changed && (state.stage <= 1 || time.Now().Before(shared.expires)) {
+		clusterMutex.Unlock()
+		return
+	}
+	state.expires = time.Now().Add(ClusterInterval)
+	clusterShared[domainName] = state
+	clusterMutex.Unlock()
+
+	Broadcast(ClusterEvent{
+		Type:       "stage",
+		Domain:     domainName,
+		Stage:      state.stage,
+		Multiplier: state.multiplier,
+	})
+}
+
+// ClusterStage returns the highest stage any node currently has for a domain, at least stage
+func ClusterStage(domainName string, stage int) int {
+	if !ClusterEnabled {
+		return stage
+	}
+
+	now := time.Now()
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+
+	for _, state := range clusterStates[domainName] {
+		if now.Before(state.expires) && state.stage > stage {
+			stage = state.stage
+		}
+	}
+	return stage
+}
+
+// clusterMultiplier returns the lowest adaptive multiplier any other node currently has for a domain, at most multiplier
+func clusterMultiplier(domainName string, multiplier float64) float64 {
+	if !ClusterEnabled {
+		return multiplier
+	}
+
+	now := time.Now()
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+
+	for _, state := range clusterStates[domainName] {
+		if now.Before(state.expires) && state.multiplier > 0 && state.multiplier < multiplier {
+			multiplier = state.multiplier
+		}
+	}
+	return multiplier
+}
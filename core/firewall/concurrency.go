@@ -0,0 +1,34 @@
+package firewall
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// domain -> requests proxied for it
+	domainLimiters      = map[string]*capacityLimiter{}
+	domainLimitersMutex = &sync.Mutex{}
+)
+
+func domainLimiter(domainName string) *capacityLimiter {
+	domainLimitersMutex.Lock()
+	defer domainLimitersMutex.Unlock()
+
+	limiter, ok := domainLimiters[domainName]
+	if !ok {
+		limiter = newCapacityLimiter()
+		domainLimiters[domainName] = limiter
+	}
+	return limiter
+}
+
+// AcquireDomain waits up to timeout until less than maxInFlight requests of a domain are being proxied. Prioritized requests
+// are let through before every other waiting request. Every successful acquire has to be followed by ReleaseDomain once the response was sent
+func AcquireDomain(domainName string, maxInFlight int, timeout time.Duration, priority bool) bool {
+	return domainLimiter(domainName).acquire(maxInFlight, 0, timeout, priority)
+}
+
+func ReleaseDomain(domainName string) {
+	domainLimiter(domainName).release()
+}
@@ -11,6 +11,7 @@ var (
 		ActiveConnections:   make(map[string]int),
 		ConnectionRate:      make(map[string][]time.Time),
 		HalfOpenConnections: make(map[string]int),
+		SlowConnections:     make(map[string][]time.Time),
 		LastCleanup:        time.Now(),
 		mutex:              &sync.RWMutex{},
 	}
@@ -28,6 +29,7 @@ type ConnectionLimiter struct {
 	ActiveConnections   map[string]int       // IP -> count
 	ConnectionRate      map[string][]time.Time // IP -> timestamps (sliding window)
 	HalfOpenConnections map[string]int       // IP -> count
+	SlowConnections     map[string][]time.Time // IP -> timestamps of killed slow connections
 	LastCleanup         time.Time
 	mutex               *sync.RWMutex
 }
@@ -61,6 +63,19 @@ func (cl *ConnectionLimiter) CheckConnectionLimit(ip string) bool {
 		return false
 	}
 
+	// Refuse IPs that keep opening connections they drip-feed
+	if MaxSlowConnsPerIP > 0 {
+		slowCount := 0
+		for _, ts := range cl.SlowConnections[ip] {
+			if now.Sub(ts) < SlowConnWindow {
+				slowCount++
+			}
+		}
+		if slowCount >= MaxSlowConnsPerIP {
+			return false
+		}
+	}
+
 	// Check half-open connections (SYN flood protection)
 	if EnableSynFloodProtection {
 		if cl.HalfOpenConnections[ip] >= MaxHalfOpenPerIP {
@@ -116,6 +131,13 @@ func (cl *ConnectionLimiter) DecrementHalfOpen(ip string) {
 	}
 }
 
+// RecordSlowConnection records a connection of IP that was killed for sending too slowly
+func (cl *ConnectionLimiter) RecordSlowConnection(ip string) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.SlowConnections[ip] = append(cl.SlowConnections[ip], time.Now())
+}
+
 // GetConnectionCount returns current active connection count for IP
 func (cl *ConnectionLimiter) GetConnectionCount(ip string) int {
 	cl.mutex.RLock()
@@ -145,6 +167,20 @@ func (cl *ConnectionLimiter) CleanupOldEntries() {
 		}
 	}
 
+	for ip, timestamps := range cl.SlowConnections {
+		validTimestamps := []time.Time{}
+		for _, ts := range timestamps {
+			if now.Sub(ts) < SlowConnWindow {
+				validTimestamps = append(validTimestamps, ts)
+			}
+		}
+		if len(validTimestamps) == 0 {
+			delete(cl.SlowConnections, ip)
+		} else {
+			cl.SlowConnections[ip] = validTimestamps
+		}
+	}
+
 	// Cleanup half-open connections (they should timeout naturally, but cleanup stale entries)
 	// Half-open connections are cleaned up when connection state changes
 }
@@ -0,0 +1,77 @@
+package firewall
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	CookieBindIPv4Prefix = 32  // -1 doesn't bind clearances to the ip
+	CookieBindIPv6Prefix = 128 // -1 doesn't bind clearances to the ip
+	CookieBindJA4        = false
+	CookieBindHTTP2      = false
+
+	ScoreCookieSharing = -10
+
+	// clearance -> binding it was issued for. Cleared along with CacheIps
+	IssuedClearances = sync.Map{}
+)
+
+// CookieBinding returns what a clearance cookie is bound to: the tls fingerprint of the client, its ip (prefix)
+// and optionally its JA4 and HTTP/2 fingerprint. A cookie solved by one client is worthless to clients with a different binding
+func CookieBinding(ip string, tlsFp string, ja4 string, http2Fp string) string {
+
+	binding := bindingPrefix(ip) + tlsFp
+	if CookieBindJA4 {
+		binding += "|" + ja4
+	}
+	if CookieBindHTTP2 {
+		binding += "|" + http2Fp
+	}
+	return binding
+}
+
+func bindingPrefix(ip string) string {
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	prefix, bits := CookieBindIPv6Prefix, 128
+	if v4 := parsed.To4(); v4 != nil {
+		parsed = v4
+		prefix, bits = CookieBindIPv4Prefix, 32
+	}
+	if prefix < 0 {
+		return ""
+	}
+	if prefix >= bits {
+		return ip
+	}
+	return parsed.Mask(net.CIDRMask(prefix, bits)).String() + "/" + strconv.Itoa(prefix)
+}
+
+// RecordClearance remembers which binding a clearance was issued for
+func RecordClearance(clearance string, binding string) {
+	IssuedClearances.Store(clearance, binding)
+}
+
+// SharedClearance checks whether the cookies of a request contain a clearance that was issued for a different binding,
+// which means it was solved by someone else and passed on
+func SharedClearance(cookies string, binding string) bool {
+	for _, cookie := range strings.Split(cookies, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(cookie), "=")
+		if !found || !strings.HasSuffix(name, "__bProxy_v") {
+			continue
+		}
+		issuedFor, ok := IssuedClearances.Load(value)
+		if ok && issuedFor.(string) != binding {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,513 @@
+package firewall
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	CRSAnomalyThreshold = 5 // like the inbound_anomaly_score_threshold of crs
+
+	// domain -> rules loaded from its crs files
+	crsRules      = map[string]crsRuleSet{}
+	crsRulesMutex = &sync.RWMutex{}
+
+	crsParanoiaTag = regexp.MustCompile(`^'?paranoia-level/(\d)'?$`)
+
+	// Anomaly scores of the severities crs rules add, see crs-setup.conf
+	crsSeverityScores = map[string]int{
+		"%{tx.critical_anomaly_score}": 5,
+		"%{tx.error_anomaly_score}":    4,
+		"%{tx.warning_anomaly_score}":  3,
+		"%{tx.notice_anomaly_score}":   2,
+	}
+)
+
+type crsRuleSet struct {
+	rules     []CRSRule
+	threshold int
+}
+
+// CRSRequest holds everything of a request crs rules can check
+type CRSRequest struct {
+	Method      string
+	URI         string // path and query as sent by the client
+	Path        string
+	QueryString string
+	Args        [][2]string // name and value of query parameters
+	BodyKeys    []string    // inspected body fields, see InspectBody. They don't pair up with the values for json bodies
+	BodyValues  []string
+	Headers     map[string][]string // canonical header name -> values
+	Cookies     map[string]string
+	Body        string
+}
+
+// CRSRule is a rule of the OWASP Core Rule Set, or a rule written in its converted json form.
+// A chained rule only matches if every rule of its chain matches aswell
+type CRSRule struct {
+	ID              int       `json:"id"`
+	ParanoiaLevel   int       `json:"paranoiaLevel"`
+	Msg             string    `json:"msg"`
+	Variables       []string  `json:"variables"` // like ARGS, ARGS_NAMES, REQUEST_HEADERS:User-Agent or !ARGS:password
+	Operator        string    `json:"operator"`  // like @rx, @pm or @streq. Defaults to @rx
+	Argument        string    `json:"argument"`
+	Negate          bool      `json:"negate"`
+	Transformations []string  `json:"transformations"` // like lowercase or urlDecodeUni
+	Chain           []CRSRule `json:"chain"`
+	Score           int       `json:"score"` // anomaly score the rule adds, rules without one block on their own
+
+	match func(value string) bool
+}
+
+// LoadCRS loads the rules of crs files (SecRule .conf files or their converted json form) up to paranoiaLevel for a domain.
+// Requests are blocked once the scores of the rules they match add up to threshold (CRSAnomalyThreshold if 0).
+// Rules that use features balooProxy doesn't support are skipped and counted
+func LoadCRS(domainName string, files []string, paranoiaLevel int, threshold int) (loaded int, skipped int, err error) {
+
+	if threshold <= 0 {
+		threshold = CRSAnomalyThreshold
+	}
+
+	rules := []CRSRule{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var parsed []CRSRule
+		if strings.HasSuffix(file, ".json") {
+			if err := json.Unmarshal(content, &parsed); err != nil {
+				return 0, 0, errors.New(file + ": " + err.Error())
+			}
+		} else {
+			var unsupported int
+			parsed, unsupported = parseSecRules(string(content))
+			skipped += unsupported
+		}
+
+		for _, rule := range parsed {
+			if rule.ParanoiaLevel == 0 {
+				rule.ParanoiaLevel = 1
+			}
+			if rule.ParanoiaLevel > paranoiaLevel {
+				continue
+			}
+			if !compileCRSRule(&rule) {
+				skipped++
+				continue
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	crsRulesMutex.Lock()
+	if len(rules) == 0 {
+		delete(crsRules, domainName)
+	} else {
+		crsRules[domainName] = crsRuleSet{rules: rules, threshold: threshold}
+	}
+	crsRulesMutex.Unlock()
+
+	return len(rules), skipped, nil
+}
+
+// HasCRSRules checks whether crs rules are loaded for a domain
+func HasCRSRules(domainName string) bool {
+	crsRulesMutex.RLock()
+	defer crsRulesMutex.RUnlock()
+	return len(crsRules[domainName].rules) != 0
+}
+
+// CheckCRS returns the crs rule of a domain that made the request reach the anomaly threshold, or the first matching rule
+// that blocks on its own, as a signature with the id crs-<rule id>. Rules whose id (or crs-<id>) is excluded are skipped
+func CheckCRS(domainName string, request CRSRequest, exclude []string) (WAFSignature, bool) {
+
+	crsRulesMutex.RLock()
+	ruleSet := crsRules[domainName]
+	crsRulesMutex.RUnlock()
+
+	score := 0
+	for _, rule := range ruleSet.rules {
+		id := strconv.Itoa(rule.ID)
+		excluded := false
+		for _, excludedID := range exclude {
+			if excludedID == id || excludedID == "crs-"+id {
+				excluded = true
+				break
+			}
+		}
+		if excluded || !rule.matches(request) {
+			continue
+		}
+		score += rule.Score
+		if rule.Score == 0 || score >= ruleSet.threshold {
+			return WAFSignature{ID: "crs-" + id, Class: "crs"}, true
+		}
+	}
+	return WAFSignature{}, false
+}
+
+func (rule CRSRule) matches(request CRSRequest) bool {
+	matched := false
+	for _, value := range crsValues(rule.Variables, request) {
+		if rule.match(crsTransform(value, rule.Transformations)) {
+			matched = true
+			break
+		}
+	}
+	if matched == rule.Negate {
+		return false
+	}
+	for _, chained := range rule.Chain {
+		if !chained.matches(request) {
+			return false
+		}
+	}
+	return true
+}
+
+// compileCRSRule builds the matcher of a rule and its chain. Returns false if any of them uses an unsupported operator or variable
+func compileCRSRule(rule *CRSRule) bool {
+
+	for _, variable := range rule.Variables {
+		name, _, _ := strings.Cut(strings.TrimPrefix(variable, "!"), ":")
+		if !crsVariableSupported(name) {
+			return false
+		}
+	}
+	if len(rule.Variables) == 0 {
+		return false
+	}
+
+	argument := rule.Argument
+	switch rule.Operator {
+	case "", "@rx":
+		pattern, err := regexp.Compile(argument)
+		if err != nil {
+			// Lookarounds and backreferences aren't supported by go regexes
+			return false
+		}
+		rule.match = pattern.MatchString
+	case "@pm":
+		phrases := strings.Fields(strings.ToLower(argument))
+		rule.match = func(value string) bool {
+			value = strings.ToLower(value)
+			for _, phrase := range phrases {
+				if strings.Contains(value, phrase) {
+					return true
+				}
+			}
+			return false
+		}
+	case "@contains":
+		rule.match = func(value string) bool { return strings.Contains(value, argument) }
+	case "@streq":
+		rule.match = func(value string) bool { return value == argument }
+	case "@beginsWith":
+		rule.match = func(value string) bool { return strings.HasPrefix(value, argument) }
+	case "@endsWith":
+		rule.match = func(value string) bool { return strings.HasSuffix(value, argument) }
+	case "@within":
+		rule.match = func(value string) bool { return value != "" && strings.Contains(argument, value) }
+	case "@detectSQLi", "@detectXSS":
+		// Approximated with the built-in signatures of the same class
+		class := "xss"
+		if rule.Operator == "@detectSQLi" {
+			class = "sqli"
+		}
+		rule.match = func(value string) bool {
+			_, matched := CheckWAF(WAFRequest{Body: []string{value}}, []string{class}, nil)
+			return matched
+		}
+	default:
+		return false
+	}
+
+	for i := range rule.Chain {
+		if !compileCRSRule(&rule.Chain[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func crsVariableSupported(name string) bool {
+	switch name {
+	case "ARGS", "ARGS_GET", "ARGS_POST", "ARGS_NAMES", "ARGS_GET_NAMES", "ARGS_POST_NAMES",
+		"REQUEST_URI", "REQUEST_URI_RAW", "REQUEST_FILENAME", "REQUEST_BASENAME", "QUERY_STRING", "REQUEST_METHOD",
+		"REQUEST_HEADERS", "REQUEST_HEADERS_NAMES", "REQUEST_COOKIES", "REQUEST_COOKIES_NAMES", "REQUEST_BODY":
+		return true
+	}
+	return false
+}
+
+// crsValues collects the values of the variables of a rule. Excluded keys (!VARIABLE:key) are left out
+func crsValues(variables []string, request CRSRequest) []string {
+
+	excluded := map[string]bool{}
+	for _, variable := range variables {
+		if strings.HasPrefix(variable, "!") {
+			excluded[strings.ToLower(variable[1:])] = true
+		}
+	}
+
+	values := []string{}
+	for _, variable := range variables {
+		if strings.HasPrefix(variable, "!") {
+			continue
+		}
+		name, key, _ := strings.Cut(variable, ":")
+		key = strings.ToLower(key)
+
+		collection := func(pairs [][2]string, names bool) {
+			for _, pair := range pairs {
+				lowerName := strings.ToLower(pair[0])
+				if (key != "" && lowerName != key) || excluded[strings.ToLower(name)+":"+lowerName] {
+					continue
+				}
+				if names {
+					values = append(values, pair[0])
+				} else {
+					values = append(values, pair[1])
+				}
+			}
+		}
+
+		switch name {
+		case "ARGS", "ARGS_GET", "ARGS_POST":
+			if name != "ARGS_POST" {
+				collection(request.Args, false)
+			}
+			if name != "ARGS_GET" && key == "" {
+				values = append(values, request.BodyValues...)
+			}
+		case "ARGS_NAMES", "ARGS_GET_NAMES", "ARGS_POST_NAMES":
+			if name != "ARGS_POST_NAMES" {
+				collection(request.Args, true)
+			}
+			if name != "ARGS_GET_NAMES" {
+				values = append(values, request.BodyKeys...)
+			}
+		case "REQUEST_HEADERS", "REQUEST_HEADERS_NAMES":
+			pairs := [][2]string{}
+			for header, headerValues := range request.Headers {
+				for _, value := range headerValues {
+					pairs = append(pairs, [2]string{header, value})
+				}
+			}
+			collection(pairs, name == "REQUEST_HEADERS_NAMES")
+		case "REQUEST_COOKIES", "REQUEST_COOKIES_NAMES":
+			pairs := [][2]string{}
+			for cookie, value := range request.Cookies {
+				pairs = append(pairs, [2]string{cookie, value})
+			}
+			collection(pairs, name == "REQUEST_COOKIES_NAMES")
+		case "REQUEST_URI", "REQUEST_URI_RAW":
+			values = append(values, request.URI)
+		case "REQUEST_FILENAME":
+			values = append(values, request.Path)
+		case "REQUEST_BASENAME":
+			values = append(values, request.Path[strings.LastIndex(request.Path, "/")+1:])
+		case "QUERY_STRING":
+			values = append(values, request.QueryString)
+		case "REQUEST_METHOD":
+			values = append(values, request.Method)
+		case "REQUEST_BODY":
+			values = append(values, request.Body)
+		}
+	}
+	return values
+}
+
+// crsTransform applies the transformations of a rule. Unknown transformations are ignored
+func crsTransform(value string, transformations []string) string {
+	for _, transformation := range transformations {
+		switch transformation {
+		case "lowercase":
+			value = strings.ToLower(value)
+		case "urlDecode", "urlDecodeUni":
+			if decoded, err := url.QueryUnescape(value); err == nil {
+				value = decoded
+			}
+		case "htmlEntityDecode":
+			value = html.UnescapeString(value)
+		case "compressWhitespace":
+			value = strings.Join(strings.Fields(value), " ")
+		case "removeWhitespace":
+			value = strings.Join(strings.Fields(value), "")
+		case "removeNulls":
+			value = strings.ReplaceAll(value, "\x00", "")
+		case "trim":
+			value = strings.TrimSpace(value)
+		}
+	}
+	return value
+}
+
+// parseSecRules parses the SecRule directives of a crs .conf file. Rules that don't block (flow control, the evaluation of the
+// anomaly score, ...) are left out, rules that can't be parsed are counted as unsupported. Rules that add to the anomaly
+// score keep what they add as their Score
+func parseSecRules(content string) (rules []CRSRule, unsupported int) {
+
+	// Join continued lines
+	content = strings.ReplaceAll(strings.ReplaceAll(content, "\r\n", "\n"), "\\\n", " ")
+
+	var chainParent *CRSRule
+	chainBlocks := false
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "SecRule ") {
+			continue
+		}
+
+		args := splitSecRule(line[len("SecRule "):])
+		if len(args) < 2 {
+			unsupported++
+			continue
+		}
+		actions := ""
+		if len(args) > 2 {
+			actions = args[2]
+		}
+
+		rule := CRSRule{Variables: strings.Split(args[0], "|")}
+		operator := args[1]
+		if strings.HasPrefix(operator, "!") {
+			rule.Negate = true
+			operator = operator[1:]
+		}
+		if strings.HasPrefix(operator, "@") {
+			name, argument, _ := strings.Cut(operator, " ")
+			rule.Operator = name
+			rule.Argument = argument
+		} else {
+			rule.Argument = operator
+		}
+
+		chained, blocks := false, false
+		for _, action := range splitSecActions(actions) {
+			name, value, _ := strings.Cut(action, ":")
+			value = strings.Trim(value, "'")
+			switch name {
+			case "id":
+				rule.ID, _ = strconv.Atoi(value)
+			case "msg":
+				rule.Msg = value
+			case "tag":
+				if match := crsParanoiaTag.FindStringSubmatch(value); match != nil {
+					rule.ParanoiaLevel, _ = strconv.Atoi(match[1])
+				}
+			case "t":
+				if value != "none" {
+					rule.Transformations = append(rule.Transformations, value)
+				}
+			case "block", "deny", "drop":
+				blocks = true
+			case "chain":
+				chained = true
+			case "setvar":
+				if score, ok := crsAnomalyScore(value); ok && rule.Score == 0 {
+					rule.Score = score
+				}
+			}
+		}
+
+		if chainParent != nil {
+			// Rules of a chain only carry the transformations and the chain action, everything else belongs to its first rule
+			if chainParent.Score == 0 {
+				chainParent.Score = rule.Score
+			}
+			rule.Score = 0
+			chainParent.Chain = append(chainParent.Chain, rule)
+			if !chained {
+				if chainBlocks {
+					rules = append(rules, *chainParent)
+				}
+				chainParent = nil
+			}
+			continue
+		}
+
+		if chained {
+			parent := rule
+			chainParent = &parent
+			chainBlocks = blocks
+			continue
+		}
+		if blocks {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, unsupported
+}
+
+// crsAnomalyScore returns what a setvar action adds to the inbound anomaly score, like
+// tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score}
+func crsAnomalyScore(setvar string) (int, bool) {
+	name, increment, found := strings.Cut(setvar, "=+")
+	if !found || !strings.Contains(strings.ToLower(name), "anomaly_score") || strings.Contains(strings.ToLower(name), "outbound") {
+		return 0, false
+	}
+	if score, ok := crsSeverityScores[strings.ToLower(increment)]; ok {
+		return score, true
+	}
+	score, err := strconv.Atoi(increment)
+	return score, err == nil && score > 0
+}
+
+// splitSecRule splits the arguments of a SecRule directive at spaces outside of double quotes
+func splitSecRule(line string) []string {
+	args := []string{}
+	current := strings.Builder{}
+	quoted, escaped := false, false
+	for _, char := range line {
+		switch {
+		case escaped:
+			if char != '"' {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(char)
+			escaped = false
+		case char == '\\' && quoted:
+			escaped = true
+		case char == '"':
+			quoted = !quoted
+		case (char == ' ' || char == '\t') && !quoted:
+			if current.Len() != 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(char)
+		}
+	}
+	if current.Len() != 0 {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// splitSecActions splits the actions of a SecRule directive at commas outside of single quotes
+func splitSecActions(actions string) []string {
+	split := []string{}
+	start, quoted := 0, false
+	for i, char := range actions {
+		switch {
+		case char == '\'':
+			quoted = !quoted
+		case char == ',' && !quoted:
+			split = append(split, strings.TrimSpace(actions[start:i]))
+			start = i + 1
+		}
+	}
+	return append(split, strings.TrimSpace(actions[start:]))
+}
@@ -0,0 +1,148 @@
+package firewall
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	EscalationEnabled      = false
+	EscalationFailures     = 3                // challenges an ip may fail on a level before it's escalated to the next one
+	EscalationWindow       = 10 * time.Minute // ips without failed challenges for this long start over at the cookie check
+	EscalationBanTime      = 15 * time.Minute // how long ips that kept failing the captcha are banned
+	EscalationJSScore      = 40               // reputation below which ips start at the js challenge
+	EscalationCaptchaScore = 30               // reputation below which ips start at the captcha
+
+	escalations     = map[string]*escalationState{}
+	escalationMutex = &sync.Mutex{}
+)
+
+type escalationState struct {
+	level       int
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// EscalationLevel returns the challenge level of ip: 1 (cookie), 2 (js) or 3 (captcha), depending on how many challenges it failed
+// recently and its reputation. banned is true if it failed the captcha aswell
+func EscalationLevel(ip string) (level int, banned bool) {
+
+	level = 1
+	score := GetReputationScore(ip)
+	if score < EscalationCaptchaScore {
+		level = 3
+	} else if score < EscalationJSScore {
+		level = 2
+	}
+
+	now := time.Now()
+	escalationMutex.Lock()
+	defer escalationMutex.Unlock()
+
+	state, ok := escalations[ip]
+	if !ok {
+		return level, false
+	}
+	if now.Before(state.bannedUntil) {
+		return level, true
+	}
+	if now.Sub(state.lastFailure) > EscalationWindow {
+		delete(escalations, ip)
+		return level, false
+	}
+	if state.level > level {
+		level = state.level
+	}
+	return level, false
+}
+
+// RecordEscalationFailure counts a challenge of level ip was served without passing it. Once it failed a level
+// EscalationFailures times it's escalated to the next level, failing the captcha bans it for EscalationBanTime
+func RecordEscalationFailure(ip string, level int) {
+
+	now := time.Now()
+	escalationMutex.Lock()
+	defer escalationMutex.Unlock()
+
+	state, ok := escalations[ip]
+	if !ok || now.Sub(state.lastFailure) > EscalationWindow {
+		state = &escalationState{level: 1}
+		escalations[ip] = state
+	}
+	if level > state.level {
+		// Reputation already put the ip on a higher level
+		state.level = level
+		state.failures = 0
+	}
+
+	state.lastFailure = now
+	state.failures++
+	if state.failures < EscalationFailures {
+		return
+	}
+
+	state.failures = 0
+	if state.level < 3 {
+		state.level++
+		return
+	}
+	state.bannedUntil = now.Add(EscalationBanTime)
+	Broadcast(ClusterEvent{
+		Type:  "ban",
+		IP:    ip,
+		Until: state.bannedUntil.Unix(),
+	})
+	notifyBan(ip, state.bannedUntil, "escalation")
+}
+
+// applyEscalationBan bans ip until a time, after it was banned by another node of the cluster
+func applyEscalationBan(ip string, until time.Time) {
+
+	now := time.Now()
+	if until.After(now.Add(EscalationBanTime)) {
+		until = now.Add(EscalationBanTime)
+	}
+
+	escalationMutex.Lock()
+	defer escalationMutex.Unlock()
+
+	state, ok := escalations[ip]
+	if !ok {
+		state = &escalationState{level: 3}
+		escalations[ip] = state
+	}
+	state.lastFailure = now
+	if until.After(state.bannedUntil) {
+		state.bannedUntil = until
+		notifyBan(ip, until, "cluster")
+	}
+}
+
+// RecordEscalationPass resets the failed challenges of ip on its current level, after it passed a challenge
+func RecordEscalationPass(ip string) {
+	escalationMutex.Lock()
+	if state, ok := escalations[ip]; ok {
+		state.failures = 0
+	}
+	escalationMutex.Unlock()
+}
+
+// StartEscalationCleanupRoutine forgets ips that stopped failing challenges and aren't banned anymore
+func StartEscalationCleanupRoutine() {
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+
+			now := time.Now()
+			escalationMutex.Lock()
+			for ip, state := range escalations {
+				if now.Sub(state.lastFailure) > EscalationWindow && now.After(state.bannedUntil) {
+					delete(escalations, ip)
+				}
+			}
+			escalationMutex.Unlock()
+		}
+	}()
+}
@@ -3,44 +3,97 @@ package firewall
 import (
 	"fmt"
 	"goProxy/core/domains"
+	"goProxy/core/logger"
 
 	"github.com/kor44/gofilter"
 )
 
-func EvalFirewallRule(currDomain domains.DomainSettings, variables gofilter.Message, susLv int) int {
-	result := susLv
-	for index, rule := range currDomain.CustomRules {
-		if rule.Filter.Apply(variables) {
-			//Check if we want to statically set susLv or add to it
-			switch rule.Action[:1] {
-			case "+":
-				var actionInt int
-				_, err := fmt.Sscan(rule.Action[1:], &actionInt)
-				if err != nil {
-					fmt.Printf("[ ! ] [ Error Evaluating Rule %d : %s ]\n", index, err.Error())
-					//Dont change anything on error. We dont want issues in production
-				} else {
-					result = result + actionInt
-					//fmt.Println("[" + PrimaryColor("+") + "] [ Matched Rule ] > " + fmt.Sprint(result))
-				}
-			case "-":
-				var actionInt int
-				_, err := fmt.Sscan(rule.Action[1:], &actionInt)
-				if err != nil {
-					fmt.Println("[ ! ] [ Error Evaluating Rule %d : %s ]\n", index, err.Error())
-					//Dont change anything on error. We dont want issues in production
-				} else {
-					result = result - actionInt
-					//fmt.Println("[" + PrimaryColor("+") + "] [ Matched Rule ] > " + fmt.Sprint(result))
+// RuleResult is what the custom rules of a domain decided for a request
+type RuleResult struct {
+	SusLv      int
+	Redirect   string // url the request is redirected to instead of being challenged or blocked
+	Difficulty int    // difficulty of the js challenge, 0 uses the dynamic difficulty
+	Logged     []int  // indexes of the matching log-only and shadowed rules
+	Ratelimit  int    // index of the ratelimit rule the request exceeded, -1 if none
+}
+
+func EvalFirewallRule(currDomain domains.DomainSettings, variables gofilter.Message, susLv int) RuleResult {
+	result := RuleResult{SusLv: susLv, Ratelimit: -1}
+	disabledGroups := DisabledRuleGroups(currDomain.Name)
+	//Remote rules are checked after all local rules, so local rules can always override them
+	for _, rules := range [][]domains.Rule{currDomain.CustomRules, currDomain.RemoteRules.Rules()} {
+		for _, rule := range rules {
+			if rule.Group != "" && disabledGroups[rule.Group] {
+				continue
+			}
+			index := rule.Index
+			if rule.Filter.Apply(variables) {
+				RecordRuleMatch(currDomain.Name, index, rule.Action, rule.Shadow, variables)
+				if logger.Enabled(logger.DebugLevel) {
+					logger.Debug("Rule matched", logger.Domain(currDomain.Name), logger.IP(fmt.Sprint(variables["ip.src"])), logger.Rule(index), logger.Action(rule.Action), logger.F("shadow", rule.Shadow))
 				}
-			default:
-				var actionInt int
-				_, err := fmt.Sscan(rule.Action, &actionInt)
-				if err != nil {
-					fmt.Printf("[ ! ] [ Error Evaluating Rule %d : %s ]\n", index, err.Error())
-				} else {
-					result = actionInt
+
+				//Actions with a parameter were already parsed when the rule was loaded
+				switch {
+				case rule.Action == "log", rule.Shadow:
+					//Only remember the match, so rules can be tested without affecting anyone
+					result.Logged = append(result.Logged, index)
+					continue
+				case rule.Redirect != "":
+					result.Redirect = rule.Redirect
+					return result
+				case rule.Difficulty != 0:
+					result.SusLv = 2
+					result.Difficulty = rule.Difficulty
 					return result
+				case rule.RatelimitRequests != 0:
+					//Requests below the limit are checked against the remaining rules as if this one didn't match
+					client := fmt.Sprint(variables["ip.src"])
+					if rule.RatelimitPath {
+						client += fmt.Sprint(variables["http.path"])
+					}
+					if RuleRatelimited(currDomain.Name, index, client, rule.RatelimitRequests, rule.RatelimitWindow) {
+						result.Ratelimit = index
+						return result
+					}
+					continue
+				}
+
+				//Check if we want to statically set susLv or add to it
+				switch rule.Action[:1] {
+				case "+":
+					var actionInt int
+					_, err := fmt.Sscan(rule.Action[1:], &actionInt)
+					if err != nil {
+						logger.Error("Error evaluating rule", logger.Domain(currDomain.Name), logger.Rule(index), logger.Action(rule.Action), logger.Err(err))
+						//Dont change anything on error. We dont want issues in production
+					} else {
+						result.SusLv = result.SusLv + actionInt
+						//fmt.Println("[" + PrimaryColor("+") + "] [ Matched Rule ] > " + fmt.Sprint(result))
+					}
+				case "-":
+					var actionInt int
+					_, err := fmt.Sscan(rule.Action[1:], &actionInt)
+					if err != nil {
+						logger.Error("Error evaluating rule", logger.Domain(currDomain.Name), logger.Rule(index), logger.Action(rule.Action), logger.Err(err))
+						//Dont change anything on error. We dont want issues in production
+					} else {
+						result.SusLv = result.SusLv - actionInt
+						//fmt.Println("[" + PrimaryColor("+") + "] [ Matched Rule ] > " + fmt.Sprint(result))
+					}
+				default:
+					if rule.Action == "tarpit" {
+						result.SusLv = SusLvTarpit
+						return result
+					}
+					var actionInt int
+					_, err := fmt.Sscan(rule.Action, &actionInt)
+					if err != nil {
+						logger.Error("Error evaluating rule", logger.Domain(currDomain.Name), logger.Rule(index), logger.Action(rule.Action), logger.Err(err))
+					} else {
+						result.SusLv = actionInt
+						return result
+					}
 				}
 			}
 		}
@@ -1,18 +1,66 @@
 package firewall
 
-import "github.com/kor44/gofilter"
+import (
+	"regexp"
+	"sync"
+
+	"github.com/kor44/gofilter"
+)
+
+// ASNs of well known cloud and hosting providers
+var DatacenterASNs = map[int]bool{
+	16509: true, 14618: true, // Amazon AWS
+	15169: true, 396982: true, // Google Cloud
+	8075:   true, // Microsoft Azure
+	31898:  true, // Oracle Cloud
+	14061:  true, // DigitalOcean
+	16276:  true, // OVH
+	24940:  true, // Hetzner
+	63949:  true, // Linode
+	20473:  true, // Vultr
+	51167:  true, // Contabo
+	12876:  true, // Scaleway
+	60781:  true, // Leaseweb
+	45102:  true, // Alibaba Cloud
+	132203: true, // Tencent Cloud
+	9009:   true, // M247
+}
+
+var (
+	// Headers referenced as http.header.<name> by any rule. Copied on write, so requests can read it without locking
+	ruleHeaders      = []string{}
+	headerFieldUsage = regexp.MustCompile(`http\.header\.([0-9A-Za-z_\-]+)`)
+
+	// gofilter's field registry isn't safe for concurrent use, filters are only compiled while holding the read lock
+	filterMutex = &sync.RWMutex{}
+)
 
 func init() {
 	gofilter.RegisterField("ip.src", gofilter.FT_IP)
 	gofilter.RegisterField("ip.country", gofilter.FT_STRING)
 	gofilter.RegisterField("ip.asn", gofilter.FT_INT)
+	gofilter.RegisterField("ip.reputation", gofilter.FT_INT)
+	gofilter.RegisterField("ip.subnet_reputation", gofilter.FT_INT)
+	gofilter.RegisterField("ip.datacenter", gofilter.FT_BOOL)
+	gofilter.RegisterField("ip.is_datacenter", gofilter.FT_BOOL)
+	gofilter.RegisterField("ip.is_vpn", gofilter.FT_BOOL)
+	gofilter.RegisterField("asn.reputation", gofilter.FT_INT)
+	gofilter.RegisterField("ip.threat_feeds", gofilter.FT_STRING)
+	gofilter.RegisterField("ip.tor", gofilter.FT_BOOL)
 	gofilter.RegisterField("ip.engine", gofilter.FT_STRING)
 	gofilter.RegisterField("ip.bot", gofilter.FT_STRING)
 	gofilter.RegisterField("ip.fingerprint", gofilter.FT_STRING)
+	gofilter.RegisterField("ip.ja3", gofilter.FT_STRING)
+	gofilter.RegisterField("ip.ja4", gofilter.FT_STRING)
+	gofilter.RegisterField("ip.ja4h", gofilter.FT_STRING)
+	gofilter.RegisterField("ip.http2_fingerprint", gofilter.FT_STRING)
 	gofilter.RegisterField("ip.requests", gofilter.FT_INT)
 	gofilter.RegisterField("ip.http_requests", gofilter.FT_INT)
 	gofilter.RegisterField("ip.challenge_requests", gofilter.FT_INT)
 
+	gofilter.RegisterField("tls.ja3", gofilter.FT_STRING)
+	gofilter.RegisterField("tls.ja4", gofilter.FT_STRING)
+
 	gofilter.RegisterField("http.host", gofilter.FT_STRING)
 	gofilter.RegisterField("http.version", gofilter.FT_STRING)
 	gofilter.RegisterField("http.method", gofilter.FT_STRING)
@@ -21,8 +69,13 @@ func init() {
 	gofilter.RegisterField("http.path", gofilter.FT_STRING)
 	gofilter.RegisterField("http.user_agent", gofilter.FT_STRING)
 	gofilter.RegisterField("http.cookie", gofilter.FT_STRING)
+	gofilter.RegisterField("http.header_order", gofilter.FT_STRING)
+	gofilter.RegisterField("http.header_order_hash", gofilter.FT_STRING)
 	gofilter.RegisterField("http.headers", gofilter.FT_STRING)
 	gofilter.RegisterField("http.body", gofilter.FT_STRING)
+	gofilter.RegisterField("http.body.keys", gofilter.FT_STRING)
+	gofilter.RegisterField("http.body.values", gofilter.FT_STRING)
+	gofilter.RegisterField("http.body.truncated", gofilter.FT_BOOL)
 
 	gofilter.RegisterField("proxy.stage", gofilter.FT_INT)
 	gofilter.RegisterField("proxy.cloudflare", gofilter.FT_BOOL)
@@ -33,6 +86,25 @@ func init() {
 	gofilter.RegisterField("proxy.rps_allowed", gofilter.FT_INT)
 }
 
+// registerHeaderFields registers the http.header.<name> fields an expression uses, so any header can be matched by name
+func registerHeaderFields(expression string) {
+	filterMutex.Lock()
+	defer filterMutex.Unlock()
+
+	for _, usage := range headerFieldUsage.FindAllStringSubmatch(expression, -1) {
+		if gofilter.RegisterField("http.header."+usage[1], gofilter.FT_STRING) == nil {
+			ruleHeaders = append(append([]string{}, ruleHeaders...), usage[1])
+		}
+	}
+}
+
+// RuleHeaders returns the names of the headers referenced by rules. The result must not be modified
+func RuleHeaders() []string {
+	filterMutex.RLock()
+	defer filterMutex.RUnlock()
+	return ruleHeaders
+}
+
 // GetIPCountryForFilter returns country code for firewall rules
 func GetIPCountryForFilter(ip string) string {
 	return GetIPCountry(ip)
@@ -42,3 +114,10 @@ func GetIPCountryForFilter(ip string) string {
 func GetIPASNForFilter(ip string) int {
 	return GetIPASN(ip)
 }
+
+// IsDatacenterASN checks whether an ASN belongs to a cloud or hosting provider, real visitors rarely browse from there
+func IsDatacenterASN(asn int) bool {
+	classifiedASNsMutex.RLock()
+	defer classifiedASNsMutex.RUnlock()
+	return datacenterASNs[asn]
+}
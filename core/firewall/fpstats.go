@@ -0,0 +1,158 @@
+package firewall
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxFingerprintStatIPs = 1000 // distinct ips tracked per fingerprint and hour, further ips only count towards the totals
+	topFingerprintStatIPs = 10
+
+	// Fingerprint requests of fingerprints that didn't fit into FingerprintStatsMaxKeys are counted under
+	otherFingerprints = "other"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	FingerprintStatsRetention = 24    // hours
+	FingerprintStatsMaxKeys   = 10000 // distinct fingerprints counted per hour, so random fingerprints can't exhaust memory
+
+	// hour -> fingerprint -> statistics
+	fingerprintStats      = map[int64]map[string]*fingerprintStat{}
+	fingerprintStatsFull  = int64(0) // hour that can't make room for new fingerprints anymore
+	fingerprintStatsMutex = &sync.Mutex{}
+)
+
+type fingerprintStat struct {
+	name     string
+	requests int
+	blocked  int
+	ips      map[string]int
+}
+
+// FingerprintStats summarizes the requests of a fingerprint over the last hours
+type FingerprintStats struct {
+	Fingerprint string    `json:"fingerprint"`
+	Name        string    `json:"name"` // browser/bot the fingerprint belongs to, if it's known
+	Requests    int       `json:"requests"`
+	Blocked     int       `json:"blocked"`
+	TopIPs      []IPCount `json:"topIps"`
+}
+
+type IPCount struct {
+	IP       string `json:"ip"`
+	Requests int    `json:"requests"`
+}
+
+// RecordFingerprintRequest counts a request of fingerprint, sent by ip. blocked is true if the request was neither challenged nor let through
+func RecordFingerprintRequest(fingerprint string, name string, ip string, blocked bool) {
+
+	hour := time.Now().Unix() / 3600
+
+	fingerprintStatsMutex.Lock()
+	defer fingerprintStatsMutex.Unlock()
+
+	stats, ok := fingerprintStats[hour]
+	if !ok {
+		stats = map[string]*fingerprintStat{}
+		fingerprintStats[hour] = stats
+
+		// A new hour started, drop the ones that fell out of retention
+		for bucket := range fingerprintStats {
+			if bucket <= hour-int64(FingerprintStatsRetention) {
+				delete(fingerprintStats, bucket)
+			}
+		}
+	}
+
+	stat, ok := stats[fingerprint]
+	if !ok && len(stats) >= FingerprintStatsMaxKeys {
+		// Fingerprints that were only seen once make room first, they are what random fingerprints leave behind.
+		// If that doesn't free a tenth of the hour it stays full, so it isn't scanned again for every new fingerprint
+		if fingerprintStatsFull != hour {
+			for seen, seenStat := range stats {
+				if seenStat.requests <= 1 && seen != otherFingerprints {
+					delete(stats, seen)
+				}
+			}
+			if len(stats) > FingerprintStatsMaxKeys-FingerprintStatsMaxKeys/10 {
+				fingerprintStatsFull = hour
+			}
+		}
+		if len(stats) >= FingerprintStatsMaxKeys {
+			fingerprint, name = otherFingerprints, ""
+			stat, ok = stats[fingerprint]
+		}
+	}
+	if !ok {
+		stat = &fingerprintStat{ips: map[string]int{}}
+		stats[fingerprint] = stat
+	}
+	stat.name = name
+	stat.requests++
+	if blocked {
+		stat.blocked++
+	}
+	if _, tracked := stat.ips[ip]; tracked || len(stat.ips) < maxFingerprintStatIPs {
+		stat.ips[ip]++
+	}
+}
+
+// GetFingerprintStats returns the statistics of every fingerprint seen in the last hours (including the current one), most requests first
+func GetFingerprintStats(hours int) []FingerprintStats {
+
+	if hours <= 0 || hours > FingerprintStatsRetention {
+		hours = FingerprintStatsRetention
+	}
+	since := time.Now().Unix()/3600 - int64(hours) + 1
+
+	type merged struct {
+		stats FingerprintStats
+		ips   map[string]int
+	}
+	fingerprints := map[string]*merged{}
+
+	fingerprintStatsMutex.Lock()
+	for hour, stats := range fingerprintStats {
+		if hour < since {
+			continue
+		}
+		for fingerprint, stat := range stats {
+			total, ok := fingerprints[fingerprint]
+			if !ok {
+				total = &merged{stats: FingerprintStats{Fingerprint: fingerprint}, ips: map[string]int{}}
+				fingerprints[fingerprint] = total
+			}
+			total.stats.Name = stat.name
+			total.stats.Requests += stat.requests
+			total.stats.Blocked += stat.blocked
+			for ip, count := range stat.ips {
+				total.ips[ip] += count
+			}
+		}
+	}
+	fingerprintStatsMutex.Unlock()
+
+	result := make([]FingerprintStats, 0, len(fingerprints))
+	for _, total := range fingerprints {
+		topIPs := make([]IPCount, 0, len(total.ips))
+		for ip, count := range total.ips {
+			topIPs = append(topIPs, IPCount{IP: ip, Requests: count})
+		}
+		sort.Slice(topIPs, func(i, j int) bool {
+			return topIPs[i].Requests > topIPs[j].Requests
+		})
+		if len(topIPs) > topFingerprintStatIPs {
+			topIPs = topIPs[:topFingerprintStatIPs]
+		}
+		total.stats.TopIPs = topIPs
+		result = append(result, total.stats)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Requests > result[j].Requests
+	})
+	return result
+}
@@ -34,6 +34,9 @@ var (
 	CacheImgs = sync.Map{}
 
 	Connections = map[string]string{}
+	//JA3 hashes/JA4 fingerprints of connections, same keys as Connections
+	ConnectionsJA3 = map[string]string{}
+	ConnectionsJA4 = map[string]string{}
 )
 
 func OnStateChange(conn net.Conn, state http.ConnState) {
@@ -56,6 +59,10 @@ func OnStateChange(conn net.Conn, state http.ConnState) {
 	case http.StateActive:
 		// Connection established, decrement half-open
 		ConnectionTracker.DecrementHalfOpen(ip)
+		slowReadStateChange(remoteAddr, true)
+
+	case http.StateIdle:
+		slowReadStateChange(remoteAddr, false)
 		
 	case http.StateHijacked, http.StateClosed:
 		// Connection closed, cleanup
@@ -64,6 +71,8 @@ func OnStateChange(conn net.Conn, state http.ConnState) {
 		//Remove connection from list of fingerprints as it's no longer needed
 		Mutex.Lock()
 		delete(Connections, remoteAddr)
+		delete(ConnectionsJA3, remoteAddr)
+		delete(ConnectionsJA4, remoteAddr)
 		Mutex.Unlock()
 	}
 }
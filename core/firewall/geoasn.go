@@ -1,10 +1,8 @@
 package firewall
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
+	"goProxy/core/domains"
 	"strings"
 	"sync"
 	"time"
@@ -12,12 +10,6 @@ import (
 
 var (
 	GeoFilteringEnabled = false
-	GeoFilterMode       = "blacklist" // "whitelist" or "blacklist"
-	AllowedCountries   = []string{}
-	BlockedCountries   = []string{}
-	BlockedASN         = []int{}
-	ChallengeUnknown   = false
-	
 	// Cache for geo data
 	GeoCache      = make(map[string]*GeoData)
 	GeoCacheMutex = &sync.RWMutex{}
@@ -62,111 +54,150 @@ func GetGeoData(ip string) (*GeoData, error) {
 		return cached, nil
 	}
 	
-	// Fetch from API
-	url := fmt.Sprintf("%s/%s", GeoAPIEndpoint, ip)
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch geo data: %w", err)
-	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("geo API returned status %d", resp.StatusCode)
-	}
-	
-	body, err := io.ReadAll(resp.Body)
+	// Look up with the configured provider
+	geoData, err := currentGeoProvider().Lookup(ip)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
-	}
-	
-	var geoData GeoData
-	if err := json.Unmarshal(body, &geoData); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
-	}
-	
-	if geoData.Status != "ok" {
-		return nil, fmt.Errorf("geo API returned error status")
+		return nil, err
 	}
 	
 	// Cache the result
 	geoData.CachedAt = time.Now()
 	GeoCacheMutex.Lock()
-	GeoCache[ip] = &geoData
+	GeoCache[ip] = geoData
 	GeoCacheMutex.Unlock()
+	queueGeoData(ip, false)
 	
-	return &geoData, nil
+	return geoData, nil
 }
 
-// CheckGeoFilter checks if IP should be blocked based on geo/ASN filtering
-func CheckGeoFilter(ip string) (bool, string) {
-	if !GeoFilteringEnabled {
-		return false, ""
+// CheckGeoFilter decides what happens to an ip based on the geo/ASN filter policy of a domain: "" lets it through,
+// "block" blocks it for reason, "challenge" or "captcha" make it solve at least that challenge, see GeoActionLevels,
+// and "bypass" lets it skip challenges
+func CheckGeoFilter(ip string, policy domains.GeoFilterPolicy) (string, string) {
+	if !GeoFilteringEnabled || !policy.Enabled {
+		return "", ""
+	}
+	
+	geoData, pending, err := lookupGeoData(ip)
+	if pending {
+		// Whitelisted domains can't let anyone in before they know the network and country
+		if policy.ASNMode != "whitelist" && policy.Mode != "whitelist" {
+			if GeoProvisional == "challenge" {
+				return "challenge", ""
+			}
+			return "", ""
+		}
+		geoData, err = GetGeoData(ip)
 	}
-	
-	geoData, err := GetGeoData(ip)
 	if err != nil {
+		// Only networks that are known to be allowed get into ASN whitelisted domains
+		if policy.ASNMode == "whitelist" {
+			return "block", "ASN could not be looked up"
+		}
 		// If API fails and ChallengeUnknown is enabled, challenge instead of blocking
-		if ChallengeUnknown {
-			return true, "challenge" // Challenge unknown IPs
+		if policy.ChallengeUnknown {
+			return "captcha", "" // Challenge unknown IPs
 		}
 		// If API fails and ChallengeUnknown is false, allow (fail open)
-		return false, ""
+		return "", ""
 	}
 	
 	// Check ASN blocking
-	for _, blockedASN := range BlockedASN {
+	for _, blockedASN := range policy.BlockedASN {
 		if geoData.ASN == blockedASN {
-			return true, fmt.Sprintf("ASN %d is blocked", blockedASN)
+			return "block", fmt.Sprintf("ASN %d is blocked", blockedASN)
 		}
 	}
 	
+	// Check ASN whitelisting
+	if policy.ASNMode == "whitelist" && !geoListed(geoData, nil, nil, policy.AllowedASN) {
+		return "block", fmt.Sprintf("ASN %d is not whitelisted", geoData.ASN)
+	}
+	
 	// Check country filtering
-	if GeoFilterMode == "whitelist" {
-		// Whitelist mode: only allow specified countries
-		allowed := false
-		for _, allowedCountry := range AllowedCountries {
-			if strings.EqualFold(geoData.CountryCode, allowedCountry) {
-				allowed = true
-				break
-			}
-		}
-		if !allowed {
-			return true, fmt.Sprintf("Country %s (%s) is not whitelisted", geoData.Country, geoData.CountryCode)
+	if policy.Mode == "whitelist" {
+		// Whitelist mode: only allow specified countries and continents
+		if !geoListed(geoData, policy.AllowedCountries, policy.AllowedContinents, nil) {
+			return "block", fmt.Sprintf("Country %s (%s) is not whitelisted", geoData.Country, geoData.CountryCode)
 		}
 	} else {
-		// Blacklist mode: block specified countries
-		for _, blockedCountry := range BlockedCountries {
+		// Blacklist mode: block specified countries and continents
+		for _, blockedCountry := range policy.BlockedCountries {
 			if strings.EqualFold(geoData.CountryCode, blockedCountry) {
-				return true, fmt.Sprintf("Country %s (%s) is blocked", geoData.Country, geoData.CountryCode)
+				return "block", fmt.Sprintf("Country %s (%s) is blocked", geoData.Country, geoData.CountryCode)
 			}
 		}
+		for _, blockedContinent := range policy.BlockedContinents {
+			if strings.EqualFold(geoData.ContinentCode, blockedContinent) {
+				return "block", fmt.Sprintf("Continent %s (%s) is blocked", geoData.Continent, geoData.ContinentCode)
+			}
+		}
+	}
+	
+	// Trusted networks skip challenges, but are still ratelimited
+	if policy.ASNMode == "bypass" && geoListed(geoData, nil, nil, policy.AllowedASN) {
+		return "bypass", ""
+	}
+	
+	// Risky regions get friction instead of a wall, the captcha wins over the js challenge
+	if geoListed(geoData, policy.CaptchaCountries, policy.CaptchaContinents, policy.CaptchaASN) {
+		return "captcha", ""
+	}
+	if geoListed(geoData, policy.ChallengedCountries, policy.ChallengedContinents, policy.ChallengedASN) {
+		return "challenge", ""
 	}
 	
-	return false, ""
+	return "", ""
 }
 
-// GetIPCountry returns country code for an IP (cached)
+// GeoActionLevels map the challenge actions of the geo filter to the level of the challenge
+var GeoActionLevels = map[string]int{
+	"challenge": 2,
+	"captcha":   3,
+}
+
+// geoListed checks whether the country, continent or ASN of geoData is on one of the lists
+func geoListed(geoData *GeoData, countries []string, continents []string, asns []int) bool {
+	for _, country := range countries {
+		if strings.EqualFold(geoData.CountryCode, country) {
+			return true
+		}
+	}
+	for _, continent := range continents {
+		if strings.EqualFold(geoData.ContinentCode, continent) {
+			return true
+		}
+	}
+	for _, asn := range asns {
+		if geoData.ASN == asn {
+			return true
+		}
+	}
+	return false
+}
+
+// GetIPCountry returns country code for an IP (cached). "" while the ip is looked up, see GeoAsyncLookups
 func GetIPCountry(ip string) string {
 	if !GeoFilteringEnabled {
 		return ""
 	}
 	
-	geoData, err := GetGeoData(ip)
-	if err != nil {
+	geoData, pending, err := lookupGeoData(ip)
+	if pending || err != nil {
 		return ""
 	}
 	
 	return geoData.CountryCode
 }
 
-// GetIPASN returns ASN for an IP (cached)
+// GetIPASN returns ASN for an IP (cached). 0 while the ip is looked up
 func GetIPASN(ip string) int {
 	if !GeoFilteringEnabled {
 		return 0
 	}
 	
-	geoData, err := GetGeoData(ip)
-	if err != nil {
+	geoData, pending, err := lookupGeoData(ip)
+	if pending || err != nil {
 		return 0
 	}
 	
@@ -182,6 +213,7 @@ func CleanupGeoCache() {
 	for ip, data := range GeoCache {
 		if now.Sub(data.CachedAt) > GeoCacheTTL*2 {
 			delete(GeoCache, ip)
+			queueGeoData(ip, true)
 		}
 	}
 }
@@ -0,0 +1,102 @@
+package firewall
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	GeoAsyncLookups    = false
+	GeoLookupWorkers   = 16
+	GeoLookupQueueSize = 4096
+	GeoProvisional     = "challenge" // what happens to ips while they are looked up, "allow" or "challenge"
+	GeoLookupRetry     = 1 * time.Minute
+
+	geoLookupQueue chan string
+
+	// ip -> queued, and ip -> when its lookup failed
+	geoLookupsPending = map[string]bool{}
+	geoLookupsFailed  = map[string]time.Time{}
+	geoLookupMutex    = &sync.Mutex{}
+
+	errGeoLookupFailed = errors.New("geo lookup failed")
+)
+
+// StartGeoLookupWorkers starts the workers that look up ips off the request path
+func StartGeoLookupWorkers() {
+	geoLookupQueue = make(chan string, GeoLookupQueueSize)
+	for i := 0; i < GeoLookupWorkers; i++ {
+		go func() {
+			for ip := range geoLookupQueue {
+				_, err := GetGeoData(ip)
+
+				geoLookupMutex.Lock()
+				delete(geoLookupsPending, ip)
+				if err != nil {
+					geoLookupsFailed[ip] = time.Now()
+				}
+				geoLookupMutex.Unlock()
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			time.Sleep(GeoLookupRetry)
+			geoLookupMutex.Lock()
+			for ip, failed := range geoLookupsFailed {
+				if time.Since(failed) >= GeoLookupRetry {
+					delete(geoLookupsFailed, ip)
+				}
+			}
+			geoLookupMutex.Unlock()
+		}
+	}()
+}
+
+// cachedGeoData returns the geo data of ip if it was looked up recently enough
+func cachedGeoData(ip string) *GeoData {
+	GeoCacheMutex.RLock()
+	defer GeoCacheMutex.RUnlock()
+	if cached, exists := GeoCache[ip]; exists && time.Since(cached.CachedAt) < GeoCacheTTL {
+		return cached
+	}
+	return nil
+}
+
+// lookupGeoData returns the geo data of ip without waiting for a lookup. Uncached ips are queued to be looked up
+// by the workers and pending is true until their lookup is done. With GeoAsyncLookups disabled, or once the queue is
+// full, it looks ip up right away
+func lookupGeoData(ip string) (geoData *GeoData, pending bool, err error) {
+	if !GeoAsyncLookups {
+		geoData, err = GetGeoData(ip)
+		return geoData, false, err
+	}
+	if geoData := cachedGeoData(ip); geoData != nil {
+		return geoData, false, nil
+	}
+
+	geoLookupMutex.Lock()
+	if _, failed := geoLookupsFailed[ip]; failed {
+		geoLookupMutex.Unlock()
+		return nil, false, errGeoLookupFailed
+	}
+	if geoLookupsPending[ip] {
+		geoLookupMutex.Unlock()
+		return nil, true, nil
+	}
+	select {
+	case geoLookupQueue <- ip:
+		geoLookupsPending[ip] = true
+		geoLookupMutex.Unlock()
+		return nil, true, nil
+	default:
+	}
+	geoLookupMutex.Unlock()
+
+	// Flooding the queue shouldn't get ips the provisional decision for as long as it stays full
+	geoData, err = GetGeoData(ip)
+	return geoData, false, err
+}
@@ -0,0 +1,352 @@
+package firewall
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// GeoCacheStore persists the GeoCache, so a restart during an attack doesn't look up every attacking ip again
+type GeoCacheStore interface {
+	Load() (map[string]*GeoData, error)
+	Save(entries map[string]*GeoData) error
+	Delete(ips []string) error
+	Close() error
+}
+
+var (
+	GeoCachePersist       = false
+	GeoCacheStorage       = "bolt" // "bolt", "sqlite" or "redis"
+	GeoCachePath          = "geocache.db"
+	GeoCacheFlushInterval = 10 * time.Second
+
+	GeoCacheRedisAddress  = "127.0.0.1:6379"
+	GeoCacheRedisPassword = ""
+	GeoCacheRedisDatabase = 0
+	GeoCacheRedisKey      = "balooProxy:geo"
+
+	geoCacheDB GeoCacheStore
+
+	// ip -> whether it has to be deleted from the store instead of saved
+	pendingGeoData  = map[string]bool{}
+	pendingGeoMutex = &sync.Mutex{}
+)
+
+// OpenGeoCacheStore opens the store GeoCacheStorage selects
+func OpenGeoCacheStore() (GeoCacheStore, error) {
+	switch GeoCacheStorage {
+	case "", "bolt":
+		return openBoltGeoCacheStore(GeoCachePath)
+	case "sqlite":
+		return openSQLGeoCacheStore(ReputationSQLDriver, GeoCachePath)
+	case "redis":
+		return openRedisGeoCacheStore(GeoCacheRedisAddress, GeoCacheRedisPassword, GeoCacheRedisDatabase, GeoCacheRedisKey)
+	}
+	return nil, errors.New("unknown geo cache storage " + GeoCacheStorage + ", use bolt, sqlite or redis")
+}
+
+// InitGeoCacheDB opens the geo cache store, loads the entries that haven't expired yet and starts flushing new lookups to it
+func InitGeoCacheDB() error {
+	if !GeoCachePersist {
+		return nil
+	}
+
+	store, err := OpenGeoCacheStore()
+	if err != nil {
+		return err
+	}
+	geoCacheDB = store
+
+	entries, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	expired := []string{}
+	GeoCacheMutex.Lock()
+	for ip, data := range entries {
+		if time.Since(data.CachedAt) >= GeoCacheTTL {
+			expired = append(expired, ip)
+			continue
+		}
+		GeoCache[ip] = data
+	}
+	GeoCacheMutex.Unlock()
+	store.Delete(expired)
+
+	go func() {
+		for {
+			time.Sleep(GeoCacheFlushInterval)
+			FlushGeoCache()
+		}
+	}()
+	return nil
+}
+
+// queueGeoData marks ip to be saved (or deleted) with the next flush
+func queueGeoData(ip string, deleted bool) {
+	if geoCacheDB == nil {
+		return
+	}
+	pendingGeoMutex.Lock()
+	pendingGeoData[ip] = deleted
+	pendingGeoMutex.Unlock()
+}
+
+// FlushGeoCache writes the lookups and expiries since the last flush to the geo cache store, in one batch
+func FlushGeoCache() error {
+	if geoCacheDB == nil {
+		return nil
+	}
+
+	pendingGeoMutex.Lock()
+	pending := pendingGeoData
+	pendingGeoData = map[string]bool{}
+	pendingGeoMutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	saved := map[string]*GeoData{}
+	deleted := []string{}
+	GeoCacheMutex.RLock()
+	for ip, remove := range pending {
+		data, exists := GeoCache[ip]
+		if remove || !exists {
+			deleted = append(deleted, ip)
+			continue
+		}
+		saved[ip] = data
+	}
+	GeoCacheMutex.RUnlock()
+
+	err := geoCacheDB.Save(saved)
+	if err == nil {
+		err = geoCacheDB.Delete(deleted)
+	}
+	if err != nil {
+		// Retry with the next flush, unless the ip was looked up again in the meantime
+		pendingGeoMutex.Lock()
+		for ip, remove := range pending {
+			if _, queued := pendingGeoData[ip]; !queued {
+				pendingGeoData[ip] = remove
+			}
+		}
+		pendingGeoMutex.Unlock()
+	}
+	return err
+}
+
+// boltGeoCacheStore keeps the geo data of every ip as json in a single bucket
+type boltGeoCacheStore struct {
+	db *bolt.DB
+}
+
+var boltGeoCacheBucket = []byte("geo")
+
+func openBoltGeoCacheStore(path string) (GeoCacheStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltGeoCacheBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltGeoCacheStore{db: db}, nil
+}
+
+func (store *boltGeoCacheStore) Load() (map[string]*GeoData, error) {
+	entries := map[string]*GeoData{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltGeoCacheBucket).ForEach(func(k, v []byte) error {
+			var data GeoData
+			if err := json.Unmarshal(v, &data); err == nil {
+				entries[string(k)] = &data
+			}
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (store *boltGeoCacheStore) Save(entries map[string]*GeoData) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltGeoCacheBucket)
+		for ip, data := range entries {
+			jsonData, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(ip), jsonData); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *boltGeoCacheStore) Delete(ips []string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltGeoCacheBucket)
+		for _, ip := range ips {
+			if err := bucket.Delete([]byte(ip)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *boltGeoCacheStore) Close() error {
+	return store.db.Close()
+}
+
+// sqlGeoCacheStore keeps the geo data in a table of a database/sql database, see sqlReputationStore
+type sqlGeoCacheStore struct {
+	db *sql.DB
+}
+
+func openSQLGeoCacheStore(driver string, path string) (GeoCacheStore, error) {
+	db, err := sql.Open(driver, path)
+	if err != nil {
+		return nil, errors.New("failed to open " + driver + " database (is the driver compiled in?): " + err.Error())
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS geo (ip TEXT PRIMARY KEY, data TEXT NOT NULL)"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlGeoCacheStore{db: db}, nil
+}
+
+func (store *sqlGeoCacheStore) Load() (map[string]*GeoData, error) {
+	rows, err := store.db.Query("SELECT ip, data FROM geo")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := map[string]*GeoData{}
+	for rows.Next() {
+		var ip, jsonData string
+		if err := rows.Scan(&ip, &jsonData); err != nil {
+			return nil, err
+		}
+		var data GeoData
+		if err := json.Unmarshal([]byte(jsonData), &data); err == nil {
+			entries[ip] = &data
+		}
+	}
+	return entries, rows.Err()
+}
+
+func (store *sqlGeoCacheStore) Save(entries map[string]*GeoData) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	for ip, data := range entries {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO geo (ip, data) VALUES (?, ?) ON CONFLICT(ip) DO UPDATE SET data = excluded.data", ip, string(jsonData)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *sqlGeoCacheStore) Delete(ips []string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if _, err := tx.Exec("DELETE FROM geo WHERE ip = ?", ip); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *sqlGeoCacheStore) Close() error {
+	return store.db.Close()
+}
+
+// redisGeoCacheStore keeps the geo data as json in a redis hash, using the connection handling of the reputation store
+type redisGeoCacheStore struct {
+	redis *redisReputationStore
+}
+
+func openRedisGeoCacheStore(address string, password string, database int, key string) (GeoCacheStore, error) {
+	redis := &redisReputationStore{
+		mutex:    &sync.Mutex{},
+		address:  address,
+		password: password,
+		database: database,
+		key:      key,
+	}
+	if _, err := redis.do("PING"); err != nil {
+		return nil, err
+	}
+	return &redisGeoCacheStore{redis: redis}, nil
+}
+
+func (store *redisGeoCacheStore) Load() (map[string]*GeoData, error) {
+	reply, err := store.redis.do("HGETALL", store.redis.key)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+
+	entries := map[string]*GeoData{}
+	for i := 0; i+1 < len(items); i += 2 {
+		ip, _ := items[i].(string)
+		jsonData, _ := items[i+1].(string)
+		var data GeoData
+		if err := json.Unmarshal([]byte(jsonData), &data); err == nil {
+			entries[ip] = &data
+		}
+	}
+	return entries, nil
+}
+
+func (store *redisGeoCacheStore) Save(entries map[string]*GeoData) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	args := []string{"HSET", store.redis.key}
+	for ip, data := range entries {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		args = append(args, ip, string(jsonData))
+	}
+	_, err := store.redis.do(args...)
+	return err
+}
+
+func (store *redisGeoCacheStore) Delete(ips []string) error {
+	if len(ips) == 0 {
+		return nil
+	}
+	_, err := store.redis.do(append([]string{"HDEL", store.redis.key}, ips...)...)
+	return err
+}
+
+func (store *redisGeoCacheStore) Close() error {
+	return store.redis.Close()
+}
@@ -0,0 +1,126 @@
+package firewall
+
+import (
+	"errors"
+	"goProxy/core/logger"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	GeoProviderMaxFailures = 3                // failed lookups in a row after which a provider is skipped
+	GeoProviderCooldown    = 30 * time.Second // how long a failing provider is skipped for
+
+	errNoGeoProvider = errors.New("no geo provider is available")
+)
+
+// geoNotFound is returned by providers that work, but don't know an ip. It doesn't count against their health
+type geoNotFound string
+
+func (err geoNotFound) Error() string {
+	return string(err)
+}
+
+// FailoverProvider asks its providers in order and moves on to the next one if a provider fails, is rate limited or doesn't know the ip.
+// Providers that keep failing are skipped for GeoProviderCooldown, so a dead api doesn't slow down every lookup
+type FailoverProvider struct {
+	providers []*failoverEntry
+}
+
+type failoverEntry struct {
+	name     string
+	bucket   string // token bucket of the rate limit
+	provider GeoProvider
+	rate     float64 // lookups per second, 0 doesn't limit them
+
+	mutex     *sync.Mutex
+	failures  int
+	downUntil time.Time
+}
+
+// GeoProviderStatus is the health of a provider of a FailoverProvider
+type GeoProviderStatus struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	DownUntil time.Time `json:"downUntil"`
+}
+
+// NewFailoverProvider creates an empty FailoverProvider, providers are added with Add in the order they are asked in
+func NewFailoverProvider() *FailoverProvider {
+	return &FailoverProvider{}
+}
+
+// Add appends provider, rate limits it to rate lookups per second (0 for no limit)
+func (failover *FailoverProvider) Add(name string, provider GeoProvider, rate float64) {
+	failover.providers = append(failover.providers, &failoverEntry{
+		name:     name,
+		bucket:   strconv.Itoa(len(failover.providers)),
+		provider: provider,
+		rate:     rate,
+		mutex:    &sync.Mutex{},
+	})
+}
+
+func (failover *FailoverProvider) Lookup(ip string) (*GeoData, error) {
+
+	err := errNoGeoProvider
+	for _, entry := range failover.providers {
+
+		entry.mutex.Lock()
+		down := time.Now().Before(entry.downUntil)
+		entry.mutex.Unlock()
+		if down {
+			continue
+		}
+		if entry.rate > 0 && !TakeToken("geo provider", entry.bucket, entry.rate, int(math.Max(1, math.Ceil(entry.rate)))) {
+			continue
+		}
+
+		var geoData *GeoData
+		geoData, err = entry.provider.Lookup(ip)
+
+		entry.mutex.Lock()
+		if _, notFound := err.(geoNotFound); err == nil || notFound {
+			entry.failures = 0
+		} else {
+			entry.failures++
+			if entry.failures >= GeoProviderMaxFailures {
+				entry.downUntil = time.Now().Add(GeoProviderCooldown)
+				entry.failures = 0
+				logger.Warn("Geo provider failed too often, skipping it", logger.F("provider", entry.name), logger.F("failures", GeoProviderMaxFailures), logger.F("cooldown", GeoProviderCooldown.String()), logger.Err(err))
+			}
+		}
+		entry.mutex.Unlock()
+
+		if err == nil {
+			return geoData, nil
+		}
+	}
+	return nil, err
+}
+
+// GeoProviderHealth returns the health of the providers geo data is looked up with, nil without failover
+func GeoProviderHealth() []GeoProviderStatus {
+	if failover, ok := currentGeoProvider().(*FailoverProvider); ok {
+		return failover.Status()
+	}
+	return nil
+}
+
+// Status returns the health of every provider, in the order they are asked in
+func (failover *FailoverProvider) Status() []GeoProviderStatus {
+	status := []GeoProviderStatus{}
+	for _, entry := range failover.providers {
+		entry.mutex.Lock()
+		providerStatus := GeoProviderStatus{Name: entry.name, Healthy: !time.Now().Before(entry.downUntil), Failures: entry.failures}
+		if !providerStatus.Healthy {
+			providerStatus.DownUntil = entry.downUntil
+		}
+		entry.mutex.Unlock()
+		status = append(status, providerStatus)
+	}
+	return status
+}
@@ -0,0 +1,202 @@
+package firewall
+
+import (
+	"errors"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var MMDBReloadInterval = 30 * time.Second // how often database files are checked for changes
+
+type mmdbCity struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Continent struct {
+		Code  string            `maxminddb:"code"`
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"continent"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+		TimeZone  string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+type mmdbASN struct {
+	Number       int    `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// mmdbFile is a database that's reloaded once the file changes
+type mmdbFile struct {
+	path     string
+	reader   *maxminddb.Reader
+	modified time.Time
+	size     int64
+}
+
+// MMDBProvider looks up geo data in local MaxMind databases (GeoLite2/GeoIP2 City or Country and ASN), without sending the ip anywhere
+type MMDBProvider struct {
+	geo   *mmdbFile
+	asn   *mmdbFile
+	mutex *sync.RWMutex
+	stop  chan struct{}
+}
+
+// NewMMDBProvider opens a City or Country database and an ASN database, either can be "". The files are watched and
+// reloaded once they change, e.g. by geoipupdate
+func NewMMDBProvider(geoPath string, asnPath string) (*MMDBProvider, error) {
+
+	if geoPath == "" && asnPath == "" {
+		return nil, errors.New("the maxmind provider needs a database or asnDatabase")
+	}
+
+	provider := &MMDBProvider{mutex: &sync.RWMutex{}, stop: make(chan struct{})}
+	for _, file := range []struct {
+		path   string
+		target **mmdbFile
+	}{{geoPath, &provider.geo}, {asnPath, &provider.asn}} {
+		if file.path == "" {
+			continue
+		}
+		opened, err := openMMDB(file.path)
+		if err != nil {
+			return nil, err
+		}
+		*file.target = opened
+	}
+
+	go provider.watch()
+	return provider, nil
+}
+
+// openMMDB reads a database into memory, so replacing it never pulls it away from lookups that are still running
+func openMMDB(path string) (*mmdbFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(content)
+	if err != nil {
+		return nil, errors.New("invalid maxmind database " + path + ": " + err.Error())
+	}
+	return &mmdbFile{path: path, reader: reader, modified: info.ModTime(), size: info.Size()}, nil
+}
+
+func (provider *MMDBProvider) watch() {
+
+	defer pnc.PanicHndl()
+
+	for {
+		select {
+		case <-provider.stop:
+			return
+		case <-time.After(MMDBReloadInterval):
+		}
+
+		for _, target := range []**mmdbFile{&provider.geo, &provider.asn} {
+			provider.mutex.RLock()
+			current := *target
+			provider.mutex.RUnlock()
+			if current == nil {
+				continue
+			}
+
+			info, err := os.Stat(current.path)
+			if err != nil || (info.ModTime().Equal(current.modified) && info.Size() == current.size) {
+				continue
+			}
+			reloaded, err := openMMDB(current.path)
+			if err != nil {
+				// A file that's still being written is picked up on the next check
+				logger.Warn("Reloading geo database failed", logger.F("file", current.path), logger.Err(err))
+				continue
+			}
+			provider.mutex.Lock()
+			*target = reloaded
+			provider.mutex.Unlock()
+		}
+	}
+}
+
+// Close stops watching the database files
+func (provider *MMDBProvider) Close() {
+	close(provider.stop)
+}
+
+func (provider *MMDBProvider) Lookup(ip string) (*GeoData, error) {
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, errors.New("invalid ip " + ip)
+	}
+
+	provider.mutex.RLock()
+	geo, asn := provider.geo, provider.asn
+	provider.mutex.RUnlock()
+
+	geoData := &GeoData{IP: ip, Status: "ok"}
+	found := false
+
+	if geo != nil {
+		record := mmdbCity{}
+		_, ok, err := geo.reader.LookupNetwork(parsed, &record)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = true
+			geoData.City = record.City.Names["en"]
+			geoData.Continent = record.Continent.Names["en"]
+			geoData.ContinentCode = record.Continent.Code
+			geoData.Country = record.Country.Names["en"]
+			geoData.CountryCode = record.Country.ISOCode
+			geoData.Latitude = record.Location.Latitude
+			geoData.Longitude = record.Location.Longitude
+			geoData.Timezone = record.Location.TimeZone
+			geoData.Postal = record.Postal.Code
+			if len(record.Subdivisions) != 0 {
+				geoData.Region = record.Subdivisions[0].Names["en"]
+			}
+		}
+	}
+
+	if asn != nil {
+		record := mmdbASN{}
+		_, ok, err := asn.reader.LookupNetwork(parsed, &record)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = true
+			geoData.ASN = record.Number
+			geoData.OrgName = record.Organization
+		}
+	}
+
+	if !found {
+		return nil, geoNotFound("ip " + ip + " isn't in the maxmind databases")
+	}
+	return geoData, nil
+}
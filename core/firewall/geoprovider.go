@@ -0,0 +1,90 @@
+package firewall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GeoProvider looks up the geo data of an ip. Results are cached by GetGeoData
+type GeoProvider interface {
+	Lookup(ip string) (*GeoData, error)
+}
+
+var (
+	geoProvider      GeoProvider = IpizProvider{}
+	geoProviderMutex             = &sync.RWMutex{}
+
+	geoHTTPClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// NewGeoProvider creates a provider by its name: "ipiz" (or "") looks ips up with the api at endpoint (default: GeoAPIEndpoint),
+// "maxmind" in the local databases
+func NewGeoProvider(name string, endpoint string, database string, asnDatabase string) (GeoProvider, error) {
+	switch name {
+	case "", "ipiz":
+		return IpizProvider{Endpoint: endpoint}, nil
+	case "maxmind":
+		provider, err := NewMMDBProvider(database, asnDatabase)
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	}
+	return nil, errors.New("unknown geo provider " + name + ", use ipiz or maxmind")
+}
+
+// SetGeoProvider replaces the provider geo data is looked up with
+func SetGeoProvider(provider GeoProvider) {
+	geoProviderMutex.Lock()
+	geoProvider = provider
+	geoProviderMutex.Unlock()
+}
+
+func currentGeoProvider() GeoProvider {
+	geoProviderMutex.RLock()
+	defer geoProviderMutex.RUnlock()
+	return geoProvider
+}
+
+// IpizProvider looks up geo data with the http api at Endpoint, GeoAPIEndpoint if it's empty
+type IpizProvider struct {
+	Endpoint string
+}
+
+func (provider IpizProvider) Lookup(ip string) (*GeoData, error) {
+
+	endpoint := provider.Endpoint
+	if endpoint == "" {
+		endpoint = GeoAPIEndpoint
+	}
+	url := fmt.Sprintf("%s/%s", endpoint, ip)
+	resp, err := geoHTTPClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch geo data: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("geo API returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var geoData GeoData
+	if err := json.Unmarshal(body, &geoData); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	if geoData.Status != "ok" {
+		return nil, geoNotFound("geo API returned error status")
+	}
+	return &geoData, nil
+}
@@ -0,0 +1,44 @@
+package firewall
+
+import (
+	"net/http"
+	"strconv"
+)
+
+var (
+	// Default limits (will be overridden by config). 0 disables a limit
+	MaxHeaderCount      = 100
+	MaxHeaderSize       = 8 * 1024  // bytes of a single header line
+	MaxTotalHeaderBytes = 32 * 1024 // bytes of all headers combined
+
+	ScoreHeaderLimit = -5
+)
+
+// CheckHeaderLimits checks the request headers against the configured limits.
+// Returns an empty string if they are fine, otherwise the limit that was exceeded
+func CheckHeaderLimits(header http.Header) string {
+
+	count := 0
+	total := 0
+	for name, values := range header {
+		for _, value := range values {
+			// "Name: Value\r\n", like it was sent on the wire
+			size := len(name) + len(value) + 4
+
+			count++
+			total += size
+
+			if MaxHeaderSize > 0 && size > MaxHeaderSize {
+				return "Header " + name + " exceeds " + strconv.Itoa(MaxHeaderSize) + " bytes"
+			}
+		}
+	}
+
+	if MaxHeaderCount > 0 && count > MaxHeaderCount {
+		return "More than " + strconv.Itoa(MaxHeaderCount) + " headers"
+	}
+	if MaxTotalHeaderBytes > 0 && total > MaxTotalHeaderBytes {
+		return "Headers exceed " + strconv.Itoa(MaxTotalHeaderBytes) + " bytes"
+	}
+	return ""
+}
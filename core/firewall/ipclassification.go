@@ -0,0 +1,78 @@
+package firewall
+
+import (
+	"goProxy/core/feeds"
+	"sync"
+)
+
+var (
+	IPClassificationEnabled = false
+
+	ClassificationDifficulty      = 1   // added to the dynamic difficulty of datacenter and vpn ips
+	ClassificationRatelimitFactor = 0.5 // adaptive ratelimits of datacenter and vpn ips are scaled by this
+
+	// ASNs of well known vpn providers
+	VPNASNs = map[int]bool{
+		60068:  true, // Datacamp (CDN77)
+		212238: true, // Datacamp
+		136787: true, // TEFINCOM (NordVPN)
+		147049: true, // PacketHub (NordVPN)
+		39351:  true, // 31173 Services (Mullvad)
+	}
+
+	// Built-in ASNs along with the configured ones
+	datacenterASNs      = DatacenterASNs
+	vpnASNs             = VPNASNs
+	classifiedASNsMutex = &sync.RWMutex{}
+)
+
+// SetClassifiedASNs adds ASNs to the built-in datacenter and vpn ASNs, replacing the ones added before
+func SetClassifiedASNs(datacenter []int, vpn []int) {
+	datacenterSet, vpnSet := map[int]bool{}, map[int]bool{}
+	for asn := range DatacenterASNs {
+		datacenterSet[asn] = true
+	}
+	for asn := range VPNASNs {
+		vpnSet[asn] = true
+	}
+	for _, asn := range datacenter {
+		datacenterSet[asn] = true
+	}
+	for _, asn := range vpn {
+		vpnSet[asn] = true
+	}
+
+	classifiedASNsMutex.Lock()
+	datacenterASNs, vpnASNs = datacenterSet, vpnSet
+	classifiedASNsMutex.Unlock()
+}
+
+// IsVPNASN checks whether an ASN belongs to a vpn provider
+func IsVPNASN(asn int) bool {
+	classifiedASNsMutex.RLock()
+	defer classifiedASNsMutex.RUnlock()
+	return vpnASNs[asn]
+}
+
+// ClassifyIP checks whether ip belongs to a datacenter or vpn, by its ASN (if its geo data is known already) and the classification lists
+func ClassifyIP(ip string) (datacenter bool, vpn bool) {
+	asn := cachedIPASN(ip)
+	datacenter, vpn = IsDatacenterASN(asn), IsVPNASN(asn)
+	if IPClassificationEnabled && !(datacenter && vpn) {
+		listedDatacenter, listedVPN := feeds.Classify(ip)
+		datacenter, vpn = datacenter || listedDatacenter, vpn || listedVPN
+	}
+	return datacenter, vpn
+}
+
+// ClassifiedRateLimit scales an adaptive ratelimit for datacenter and vpn ips, real visitors rarely send requests from there
+func ClassifiedRateLimit(limit int, classified bool) int {
+	if !IPClassificationEnabled || !classified {
+		return limit
+	}
+	scaled := int(float64(limit) * ClassificationRatelimitFactor)
+	if scaled < 1 {
+		scaled = 1
+	}
+	return scaled
+}
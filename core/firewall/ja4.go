@@ -0,0 +1,229 @@
+package firewall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	//JA4 and JA4H fingerprints along with what browser/tool/bot/etc they belong to. Both kinds share these lists
+
+	//Swapped by LoadJA4Fingerprints, only read them while holding FingerprintsMutex
+	KnownJA4Fingerprints     = map[string]string{}
+	BotJA4Fingerprints       = map[string]string{}
+	ForbiddenJA4Fingerprints = map[string]string{}
+
+	emptyJA4Hash = "000000000000"
+)
+
+// LoadJA4Fingerprints replaces the JA4 fingerprint lists. nil lists are treated as empty
+func LoadJA4Fingerprints(known map[string]string, bot map[string]string, forbidden map[string]string) {
+	if known == nil {
+		known = map[string]string{}
+	}
+	if bot == nil {
+		bot = map[string]string{}
+	}
+	if forbidden == nil {
+		forbidden = map[string]string{}
+	}
+	FingerprintsMutex.Lock()
+	KnownJA4Fingerprints = known
+	BotJA4Fingerprints = bot
+	ForbiddenJA4Fingerprints = forbidden
+	FingerprintsMutex.Unlock()
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, for example t13d1516h2_8daaf6152771_e5627efa2ab1
+func (hello clientHello) JA4() string {
+
+	// TLS 1.3 clients announce their real version in supported_versions
+	version := hello.Version
+	if len(hello.SupportedVersions) != 0 {
+		version = 0
+		for _, supported := range hello.SupportedVersions {
+			if !isGrease(supported) && supported > version {
+				version = supported
+			}
+		}
+	}
+
+	sni := "i"
+	if hello.ServerName {
+		sni = "d"
+	}
+
+	ciphers := []string{}
+	for _, suite := range hello.CipherSuites {
+		if !isGrease(suite) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", suite))
+		}
+	}
+
+	extensionCount := 0
+	extensions := []string{}
+	for _, extension := range hello.Extensions {
+		if isGrease(extension) {
+			continue
+		}
+		extensionCount++
+		// SNI and ALPN are already part of the first section
+		if extension != 0 && extension != 16 {
+			extensions = append(extensions, fmt.Sprintf("%04x", extension))
+		}
+	}
+
+	algorithms := []string{}
+	for _, algorithm := range hello.SignatureAlgorithms {
+		if !isGrease(algorithm) {
+			algorithms = append(algorithms, fmt.Sprintf("%04x", algorithm))
+		}
+	}
+
+	sort.Strings(ciphers)
+	sort.Strings(extensions)
+
+	cipherHash := emptyJA4Hash
+	if len(ciphers) != 0 {
+		cipherHash = ja4Hash(strings.Join(ciphers, ","))
+	}
+	extensionHash := emptyJA4Hash
+	if len(extensions) != 0 {
+		extensionString := strings.Join(extensions, ",")
+		if len(algorithms) != 0 {
+			extensionString += "_" + strings.Join(algorithms, ",")
+		}
+		extensionHash = ja4Hash(extensionString)
+	}
+
+	return "t" + ja4Version(version) + sni + fmt.Sprintf("%02d%02d", capCount(len(ciphers)), capCount(extensionCount)) + ja4ALPN(hello.ALPN) + "_" + cipherHash + "_" + extensionHash
+}
+
+// JA4H returns the JA4H fingerprint of a request. headerOrder are the header names in the order the client sent them.
+// If it is unknown, the header names are sorted instead
+func JA4H(request *http.Request, headerOrder []string) string {
+
+	method := strings.ToLower(request.Method)
+	if len(method) > 2 {
+		method = method[:2]
+	}
+
+	version := "11"
+	switch request.ProtoMajor {
+	case 1:
+		if request.ProtoMinor == 0 {
+			version = "10"
+		}
+	case 2:
+		version = "20"
+	case 3:
+		version = "30"
+	}
+
+	if headerOrder == nil {
+		for name := range request.Header {
+			headerOrder = append(headerOrder, name)
+		}
+		sort.Strings(headerOrder)
+	}
+
+	cookie := "n"
+	referer := "n"
+	headers := []string{}
+	for _, name := range headerOrder {
+		switch strings.ToLower(name) {
+		case "cookie":
+			cookie = "c"
+		case "referer":
+			referer = "r"
+		default:
+			headers = append(headers, name)
+		}
+	}
+
+	language := strings.ToLower(strings.Split(strings.Split(request.Header.Get("Accept-Language"), ",")[0], ";")[0])
+	language = strings.NewReplacer("-", "", "_", "", " ", "").Replace(language)
+	if len(language) > 4 {
+		language = language[:4]
+	}
+	language += strings.Repeat("0", 4-len(language))
+
+	cookieNames := []string{}
+	cookieFields := []string{}
+	for _, line := range request.Header.Values("Cookie") {
+		for _, field := range strings.Split(line, ";") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			cookieNames = append(cookieNames, strings.SplitN(field, "=", 2)[0])
+			cookieFields = append(cookieFields, field)
+		}
+	}
+	sort.Strings(cookieNames)
+	sort.Strings(cookieFields)
+
+	headerHash := emptyJA4Hash
+	if len(headers) != 0 {
+		headerHash = ja4Hash(strings.Join(headers, ","))
+	}
+	cookieNameHash := emptyJA4Hash
+	cookieFieldHash := emptyJA4Hash
+	if len(cookieNames) != 0 {
+		cookieNameHash = ja4Hash(strings.Join(cookieNames, ","))
+		cookieFieldHash = ja4Hash(strings.Join(cookieFields, ","))
+	}
+
+	return method + version + cookie + referer + fmt.Sprintf("%02d", capCount(len(headers))) + language + "_" + headerHash + "_" + cookieNameHash + "_" + cookieFieldHash
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last character of the protocol, falling back to hex if they aren't alphanumeric
+func ja4ALPN(protocol string) string {
+	if protocol == "" {
+		return "00"
+	}
+	first, last := protocol[0], protocol[len(protocol)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	return fmt.Sprintf("%02x", first)[:1] + fmt.Sprintf("%02x", last)[1:]
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func capCount(count int) int {
+	if count > 99 {
+		return 99
+	}
+	return count
+}
+
+// ja4Hash returns the first 12 characters of the sha256 hex digest, like all JA4 hashes
+func ja4Hash(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])[:12]
+}
@@ -1,9 +1,8 @@
 package firewall
 
 import (
-	"fmt"
 	"goProxy/core/domains"
-	"net/http"
+	"sort"
 	"sync"
 	"time"
 )
@@ -191,6 +190,20 @@ func UpdateDomainMetrics(domainName string) {
 	metrics.CurrentStage = domainData.Stage
 	metrics.IsUnderAttack = domainData.RawAttack || domainData.BypassAttack
 	
+	top := TopAttackers(domainName, 10)
+	metrics.TopAttackingIPs = []string{}
+	for _, source := range top.IPs {
+		metrics.TopAttackingIPs = append(metrics.TopAttackingIPs, source.Source)
+	}
+	metrics.TopCountries = []string{}
+	for _, source := range top.Countries {
+		metrics.TopCountries = append(metrics.TopCountries, source.Source)
+	}
+	metrics.TopASNs = []int{}
+	for _, source := range top.ASNs {
+		metrics.TopASNs = append(metrics.TopASNs, source.ASN)
+	}
+	
 	if metrics.IsUnderAttack && metrics.AttackStartTime == nil {
 		now := time.Now()
 		metrics.AttackStartTime = &now
@@ -241,16 +254,17 @@ func GetTopAttackingIPs(n int) []string {
 	MetricsData.mutex.RLock()
 	defer MetricsData.mutex.RUnlock()
 	
-	// Simple implementation - return IPs with most blocked requests
-	// In production, you might want more sophisticated ranking
+	// IPs with the most blocked requests first
 	ips := make([]string, 0, len(MetricsData.PerIPMetrics))
 	for ip, metrics := range MetricsData.PerIPMetrics {
 		if metrics.BlockedRequests > 0 {
 			ips = append(ips, ip)
 		}
 	}
+	sort.Slice(ips, func(i, j int) bool {
+		return MetricsData.PerIPMetrics[ips[i]].BlockedRequests > MetricsData.PerIPMetrics[ips[j]].BlockedRequests
+	})
 	
-	// Sort by blocked requests (simplified)
 	if len(ips) > n {
 		return ips[:n]
 	}
@@ -311,81 +325,3 @@ func StartMetricsUpdateRoutine() {
 		}
 	}()
 }
-
-// StartPrometheusServer starts HTTP server for Prometheus metrics export
-func StartPrometheusServer() {
-	if !MetricsEnabled {
-		return
-	}
-	
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-		
-		MetricsData.mutex.RLock()
-		defer MetricsData.mutex.RUnlock()
-		
-		// Global metrics
-		fmt.Fprintf(w, "# HELP balooproxy_total_requests Total number of requests\n")
-		fmt.Fprintf(w, "# TYPE balooproxy_total_requests counter\n")
-		fmt.Fprintf(w, "balooproxy_total_requests %d\n", MetricsData.GlobalMetrics.TotalRequests)
-		
-		fmt.Fprintf(w, "# HELP balooproxy_requests_per_second Current requests per second\n")
-		fmt.Fprintf(w, "# TYPE balooproxy_requests_per_second gauge\n")
-		fmt.Fprintf(w, "balooproxy_requests_per_second %.2f\n", MetricsData.GlobalMetrics.RequestsPerSecond)
-		
-		fmt.Fprintf(w, "# HELP balooproxy_active_connections Current active connections\n")
-		fmt.Fprintf(w, "# TYPE balooproxy_active_connections gauge\n")
-		fmt.Fprintf(w, "balooproxy_active_connections %d\n", MetricsData.GlobalMetrics.ActiveConnections)
-		
-		fmt.Fprintf(w, "# HELP balooproxy_uptime_seconds Uptime in seconds\n")
-		fmt.Fprintf(w, "# TYPE balooproxy_uptime_seconds gauge\n")
-		fmt.Fprintf(w, "balooproxy_uptime_seconds %.0f\n", MetricsData.GlobalMetrics.Uptime.Seconds())
-		
-		// Domain metrics
-		for domainName, domainMetrics := range MetricsData.DomainMetrics {
-			fmt.Fprintf(w, "# HELP balooproxy_domain_requests_total Total requests per domain\n")
-			fmt.Fprintf(w, "# TYPE balooproxy_domain_requests_total counter\n")
-			fmt.Fprintf(w, "balooproxy_domain_requests_total{domain=\"%s\"} %d\n", domainName, domainMetrics.TotalRequests)
-			
-			fmt.Fprintf(w, "# HELP balooproxy_domain_bypassed_total Total bypassed requests per domain\n")
-			fmt.Fprintf(w, "# TYPE balooproxy_domain_bypassed_total counter\n")
-			fmt.Fprintf(w, "balooproxy_domain_bypassed_total{domain=\"%s\"} %d\n", domainName, domainMetrics.BypassedRequests)
-			
-			fmt.Fprintf(w, "# HELP balooproxy_domain_stage Current stage per domain\n")
-			fmt.Fprintf(w, "# TYPE balooproxy_domain_stage gauge\n")
-			fmt.Fprintf(w, "balooproxy_domain_stage{domain=\"%s\"} %d\n", domainName, domainMetrics.CurrentStage)
-			
-			fmt.Fprintf(w, "# HELP balooproxy_domain_under_attack Whether domain is under attack\n")
-			fmt.Fprintf(w, "# TYPE balooproxy_domain_under_attack gauge\n")
-			attackValue := 0
-			if domainMetrics.IsUnderAttack {
-				attackValue = 1
-			}
-			fmt.Fprintf(w, "balooproxy_domain_under_attack{domain=\"%s\"} %d\n", domainName, attackValue)
-		}
-		
-		// IP metrics (sample top 100)
-		count := 0
-		for ip, ipMetrics := range MetricsData.PerIPMetrics {
-			if count >= 100 {
-				break
-			}
-			fmt.Fprintf(w, "# HELP balooproxy_ip_total_requests Total requests per IP\n")
-			fmt.Fprintf(w, "# TYPE balooproxy_ip_total_requests counter\n")
-			fmt.Fprintf(w, "balooproxy_ip_total_requests{ip=\"%s\"} %d\n", ip, ipMetrics.TotalRequests)
-			
-			fmt.Fprintf(w, "# HELP balooproxy_ip_reputation_score Reputation score per IP\n")
-			fmt.Fprintf(w, "# TYPE balooproxy_ip_reputation_score gauge\n")
-			fmt.Fprintf(w, "balooproxy_ip_reputation_score{ip=\"%s\"} %d\n", ip, ipMetrics.ReputationScore)
-			count++
-		}
-	})
-	
-	addr := fmt.Sprintf(":%d", MetricsPort)
-	go func() {
-		if err := http.ListenAndServe(addr, nil); err != nil {
-			// Log error but don't crash
-			fmt.Printf("[Metrics] Failed to start Prometheus server: %v\n", err)
-		}
-	}()
-}
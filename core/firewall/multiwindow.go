@@ -1,7 +1,7 @@
 package firewall
 
 import (
-	"goProxy/core/proxy"
+	"goProxy/core/domains"
 	"sync"
 	"time"
 )
@@ -16,7 +16,7 @@ var (
 	LongWindow   = 3600 // 1 hour
 	
 	// Multi-window tracking maps
-	BurstWindowIps  = make(map[int]map[string]int)  // timestamp -> IP -> count
+	BurstWindowIps  = make(map[int]map[string]int)  // timestamp -> domain and IP -> count
 	ShortWindowIps  = make(map[int]map[string]int)
 	MediumWindowIps = make(map[int]map[string]int)
 	LongWindowIps   = make(map[int]map[string]int)
@@ -24,12 +24,13 @@ var (
 	MultiWindowMutex = &sync.RWMutex{}
 )
 
-// RecordRequest records a request in all active windows
-func RecordRequest(ip string) {
+// RecordRequest records a request of ip to a domain in all active windows. Every domain is counted separately
+func RecordRequest(domainName string, ip string) {
 	if !MultiWindowEnabled {
 		return
 	}
 	
+	key := windowKey(domainName, ip)
 	now := time.Now()
 	burstTs := int(now.Unix()) / BurstWindow * BurstWindow
 	shortTs := int(now.Unix()) / ShortWindow * ShortWindow
@@ -43,102 +44,137 @@ func RecordRequest(ip string) {
 	if BurstWindowIps[burstTs] == nil {
 		BurstWindowIps[burstTs] = make(map[string]int)
 	}
-	BurstWindowIps[burstTs][ip]++
+	BurstWindowIps[burstTs][key]++
 	
 	// Short window
 	if ShortWindowIps[shortTs] == nil {
 		ShortWindowIps[shortTs] = make(map[string]int)
 	}
-	ShortWindowIps[shortTs][ip]++
+	ShortWindowIps[shortTs][key]++
 	
 	// Medium window
 	if MediumWindowIps[mediumTs] == nil {
 		MediumWindowIps[mediumTs] = make(map[string]int)
 	}
-	MediumWindowIps[mediumTs][ip]++
+	MediumWindowIps[mediumTs][key]++
 	
 	// Long window
 	if LongWindowIps[longTs] == nil {
 		LongWindowIps[longTs] = make(map[string]int)
 	}
-	LongWindowIps[longTs][ip]++
+	LongWindowIps[longTs][key]++
 }
 
-// GetRequestCount returns request count for IP in specified window
-func GetRequestCount(ip string, window string) int {
+// GetRequestCount returns request count for IP on a domain in specified window.
+// The window slides: requests of the previous bucket are weighted by how much of it still overlaps the window,
+// so bursting right after a bucket boundary doesn't start from zero
+func GetRequestCount(domainName string, ip string, window string) int {
 	if !MultiWindowEnabled {
 		return 0
 	}
 	
 	now := time.Now()
-	var ts int
+	var length int
 	var windowMap map[int]map[string]int
 	
 	switch window {
 	case "burst":
-		ts = int(now.Unix()) / BurstWindow * BurstWindow
+		length = BurstWindow
 		windowMap = BurstWindowIps
 	case "short":
-		ts = int(now.Unix()) / ShortWindow * ShortWindow
+		length = ShortWindow
 		windowMap = ShortWindowIps
 	case "medium":
-		ts = int(now.Unix()) / MediumWindow * MediumWindow
+		length = MediumWindow
 		windowMap = MediumWindowIps
 	case "long":
-		ts = int(now.Unix()) / LongWindow * LongWindow
+		length = LongWindow
 		windowMap = LongWindowIps
 	default:
 		return 0
 	}
 	
+	ts := int(now.Unix()) / length * length
+	elapsed := float64(now.UnixNano()-int64(ts)*int64(time.Second)) / float64(time.Second)
+	previousWeight := 1 - elapsed/float64(length)
+	
 	MultiWindowMutex.RLock()
 	defer MultiWindowMutex.RUnlock()
 	
-	if windowMap[ts] == nil {
-		return 0
+	// Reading missing buckets returns 0
+	key := windowKey(domainName, ip)
+	return windowMap[ts][key] + int(float64(windowMap[ts-length][key])*previousWeight)
+}
+
+func windowKey(domainName string, ip string) string {
+	return domainName + " " + ip
+}
+
+// ValidWindow checks whether window is the name of a window GetRequestCount knows
+func ValidWindow(window string) bool {
+	switch window {
+	case "burst", "short", "medium", "long":
+		return true
 	}
-	
-	return windowMap[ts][ip]
+	return false
+}
+
+// PathWindowKey is the composite key requests of ip to a ratelimited path prefix are recorded under
+func PathWindowKey(ip string, prefix string) string {
+	return ip + " " + prefix
+}
+
+// CountryWindowKey is the key the requests of every ip of a country are recorded under together
+func CountryWindowKey(country string) string {
+	return "country " + country
 }
 
 // CheckBurstLimit checks if IP exceeds burst limit
-func CheckBurstLimit(ip string, limit int) bool {
+func CheckBurstLimit(domainName string, ip string, limit int) bool {
 	if !MultiWindowEnabled {
 		return false
 	}
 	
-	count := GetRequestCount(ip, "burst")
-	return count >= limit
+	count := GetRequestCount(domainName, ip, "burst")
+	return count > limit
 }
 
 // CheckShortTermLimit checks if IP exceeds short-term limit
-func CheckShortTermLimit(ip string, limit int) bool {
+func CheckShortTermLimit(domainName string, ip string, limit int) bool {
 	if !MultiWindowEnabled {
 		return false
 	}
 	
-	count := GetRequestCount(ip, "short")
-	return count >= limit
+	count := GetRequestCount(domainName, ip, "short")
+	return count > limit
 }
 
 // CheckMediumTermLimit checks if IP exceeds medium-term limit
-func CheckMediumTermLimit(ip string, limit int) bool {
+func CheckMediumTermLimit(domainName string, ip string, limit int) bool {
 	if !MultiWindowEnabled {
 		return false
 	}
 	
-	count := GetRequestCount(ip, "medium")
-	return count >= limit
+	count := GetRequestCount(domainName, ip, "medium")
+	return count > limit
 }
 
 // CheckLongTermLimit checks if IP exceeds long-term limit
-func CheckLongTermLimit(ip string, limit int) bool {
+func CheckLongTermLimit(domainName string, ip string, limit int) bool {
 	if !MultiWindowEnabled {
 		return false
 	}
 	
-	count := GetRequestCount(ip, "long")
-	return count >= limit
+	count := GetRequestCount(domainName, ip, "long")
+	return count > limit
+}
+
+// CheckWindowLimits checks if IP exceeds any of the window limits of a domain. Limits of 0 are not checked
+func CheckWindowLimits(domainName string, ip string, limits domains.WindowLimits) bool {
+	return limits.Burst > 0 && CheckBurstLimit(domainName, ip, limits.Burst) ||
+		limits.Short > 0 && CheckShortTermLimit(domainName, ip, limits.Short) ||
+		limits.Medium > 0 && CheckMediumTermLimit(domainName, ip, limits.Medium) ||
+		limits.Long > 0 && CheckLongTermLimit(domainName, ip, limits.Long)
 }
 
 // CleanupOldWindows removes old window entries
@@ -0,0 +1,52 @@
+package firewall
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Key counts the windows are filled with, the cost of a lookup and of recording a request should stay flat across them
+var benchmarkKeyCounts = []int{100, 10000, 100000}
+
+// fillWindows resets the windows and records a request of keys ips, returning the ips
+func fillWindows(keys int) []string {
+	MultiWindowMutex.Lock()
+	BurstWindowIps = make(map[int]map[string]int)
+	ShortWindowIps = make(map[int]map[string]int)
+	MediumWindowIps = make(map[int]map[string]int)
+	LongWindowIps = make(map[int]map[string]int)
+	MultiWindowMutex.Unlock()
+
+	ips := make([]string, keys)
+	for i := range ips {
+		ips[i] = "10." + strconv.Itoa(i>>16&255) + "." + strconv.Itoa(i>>8&255) + "." + strconv.Itoa(i&255)
+		RecordRequest("example.com", ips[i])
+	}
+	return ips
+}
+
+func BenchmarkGetRequestCount(b *testing.B) {
+	for _, keys := range benchmarkKeyCounts {
+		b.Run(strconv.Itoa(keys)+"keys", func(b *testing.B) {
+			ips := fillWindows(keys)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				GetRequestCount("example.com", ips[i%keys], "short")
+			}
+		})
+	}
+}
+
+func BenchmarkRecordRequest(b *testing.B) {
+	for _, keys := range benchmarkKeyCounts {
+		b.Run(strconv.Itoa(keys)+"keys", func(b *testing.B) {
+			ips := fillWindows(keys)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				RecordRequest("example.com", ips[i%keys])
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package firewall
+
+import (
+	"crypto/subtle"
+	"goProxy/core/logger"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	MetricsAddress  = "" // interface the endpoint listens on, every one if empty
+	MetricsOnAdmin  = false
+	MetricsToken    = ""
+	MetricsUsername = ""
+	MetricsPassword = ""
+	MetricsCert     = ""
+	MetricsKey      = ""
+
+	// MetricsRegistry holds every metric the Prometheus endpoint exports
+	MetricsRegistry = prometheus.NewRegistry()
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "balooproxy_request_duration_seconds",
+		Help:    "Time it took to answer requests, including the backend, per domain and action",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"domain", "action"})
+
+	requestsHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "balooproxy_requests_handled_total",
+		Help: "Requests answered per domain, action, country and stage of the domain. Countries are only known for ips that were looked up already",
+	}, []string{"domain", "action", "country", "stage"})
+
+	challengeSolveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "balooproxy_challenge_solve_duration_seconds",
+		Help:    "Time clients took to solve a challenge, per domain and level",
+		Buckets: []float64{0.5, 1, 2, 3, 5, 10, 20, 30, 60, 120, 300, 600},
+	}, []string{"domain", "level"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "balooproxy_upstream_duration_seconds",
+		Help:    "Time backends took to answer with their response headers, per domain and backend",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"domain", "backend"})
+
+	upstreamResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "balooproxy_upstream_responses_total",
+		Help: "Requests sent to backends per domain, backend and status code of the response. Requests the backend couldn't be reached for or didn't answer in time have the code \"error\"",
+	}, []string{"domain", "backend", "code"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		requestDuration,
+		requestsHandled,
+		challengeSolveDuration,
+		upstreamDuration,
+		upstreamResponses,
+		snapshotCollector{},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// ObserveRequest records a request that was answered with action after it took duration
+func ObserveRequest(domainName string, ip string, action string, stage int, duration time.Duration) {
+	if !MetricsEnabled {
+		return
+	}
+	requestDuration.WithLabelValues(domainName, action).Observe(duration.Seconds())
+	requestsHandled.WithLabelValues(domainName, action, cachedIPCountry(ip), strconv.Itoa(stage)).Inc()
+}
+
+// observeChallengeSolved records the solve time of a challenge
+func observeChallengeSolved(key ChallengeStatKey, duration time.Duration) {
+	if !MetricsEnabled {
+		return
+	}
+	challengeSolveDuration.WithLabelValues(key.Domain, strconv.Itoa(key.Level)).Observe(duration.Seconds())
+}
+
+// observeUpstream records a request to and the response of a backend
+func observeUpstream(domainName string, backend string, status int, duration time.Duration, failed bool) {
+	if !MetricsEnabled {
+		return
+	}
+	if failed {
+		upstreamResponses.WithLabelValues(domainName, backend, "error").Inc()
+		return
+	}
+	upstreamDuration.WithLabelValues(domainName, backend).Observe(duration.Seconds())
+	upstreamResponses.WithLabelValues(domainName, backend, strconv.Itoa(status)).Inc()
+}
+
+var (
+	totalRequestsDesc     = prometheus.NewDesc("balooproxy_total_requests", "Total number of requests", nil, nil)
+	requestsPerSecondDesc = prometheus.NewDesc("balooproxy_requests_per_second", "Current requests per second", nil, nil)
+	activeConnectionsDesc = prometheus.NewDesc("balooproxy_active_connections", "Current active connections", nil, nil)
+	uptimeDesc            = prometheus.NewDesc("balooproxy_uptime_seconds", "Uptime in seconds", nil, nil)
+
+	domainRequestsDesc    = prometheus.NewDesc("balooproxy_domain_requests_total", "Total requests per domain", []string{"domain"}, nil)
+	domainBypassedDesc    = prometheus.NewDesc("balooproxy_domain_bypassed_total", "Total bypassed requests per domain", []string{"domain"}, nil)
+	domainStageDesc       = prometheus.NewDesc("balooproxy_domain_stage", "Current stage per domain", []string{"domain"}, nil)
+	domainUnderAttackDesc = prometheus.NewDesc("balooproxy_domain_under_attack", "Whether domain is under attack", []string{"domain"}, nil)
+	// Only one of ip, country and asn is set per source, the others stay empty which Prometheus treats as unset
+	attackSourcesDesc = prometheus.NewDesc("balooproxy_domain_attack_sources", "Recent abuse of the top attacking ips, countries and asns per domain", []string{"domain", "ip", "country", "asn"}, nil)
+
+	challengeLabelNames     = []string{"domain", "level", "difficulty", "country"}
+	challengesIssuedDesc    = prometheus.NewDesc("balooproxy_challenges_issued_total", "Challenges issued per domain, level, difficulty and country", challengeLabelNames, nil)
+	challengesSolvedDesc    = prometheus.NewDesc("balooproxy_challenges_solved_total", "Challenges solved", challengeLabelNames, nil)
+	challengesFailedDesc    = prometheus.NewDesc("balooproxy_challenges_failed_total", "Challenges served again, because the client came back without solving them", challengeLabelNames, nil)
+	challengesAbandonedDesc = prometheus.NewDesc("balooproxy_challenges_abandoned_total", "Challenges that were never solved", challengeLabelNames, nil)
+	challengeMedianDesc     = prometheus.NewDesc("balooproxy_challenge_solve_seconds", "Median time clients took to solve a challenge", challengeLabelNames, nil)
+
+	upstreamLatencyDesc    = prometheus.NewDesc("balooproxy_upstream_latency_p95_seconds", "95th percentile of the time backends took to answer in the last minute", []string{"domain", "backend"}, nil)
+	upstreamErrorRatioDesc = prometheus.NewDesc("balooproxy_upstream_error_ratio", "Share of the requests of the last minute backends didn't answer or answered with a 5xx", []string{"domain", "backend"}, nil)
+
+	ipRequestsDesc   = prometheus.NewDesc("balooproxy_ip_total_requests", "Total requests per IP", []string{"ip"}, nil)
+	ipReputationDesc = prometheus.NewDesc("balooproxy_ip_reputation_score", "Reputation score per IP", []string{"ip"}, nil)
+)
+
+// snapshotCollector exports what MetricsData, the challenge statistics and the attack counters know every time it's scraped
+type snapshotCollector struct{}
+
+func (snapshotCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		totalRequestsDesc, requestsPerSecondDesc, activeConnectionsDesc, uptimeDesc,
+		domainRequestsDesc, domainBypassedDesc, domainStageDesc, domainUnderAttackDesc, attackSourcesDesc,
+		challengesIssuedDesc, challengesSolvedDesc, challengesFailedDesc, challengesAbandonedDesc, challengeMedianDesc,
+		upstreamLatencyDesc, upstreamErrorRatioDesc,
+		ipRequestsDesc, ipReputationDesc,
+	} {
+		descs <- desc
+	}
+}
+
+func (snapshotCollector) Collect(metrics chan<- prometheus.Metric) {
+	MetricsData.mutex.RLock()
+	defer MetricsData.mutex.RUnlock()
+
+	// Global metrics
+	global := MetricsData.GlobalMetrics
+	metrics <- prometheus.MustNewConstMetric(totalRequestsDesc, prometheus.CounterValue, float64(global.TotalRequests))
+	metrics <- prometheus.MustNewConstMetric(requestsPerSecondDesc, prometheus.GaugeValue, global.RequestsPerSecond)
+	metrics <- prometheus.MustNewConstMetric(activeConnectionsDesc, prometheus.GaugeValue, float64(global.ActiveConnections))
+	metrics <- prometheus.MustNewConstMetric(uptimeDesc, prometheus.GaugeValue, global.Uptime.Seconds())
+
+	// Domain metrics, along with where the recent abuse of every domain came from
+	for domainName, domainMetrics := range MetricsData.DomainMetrics {
+		metrics <- prometheus.MustNewConstMetric(domainRequestsDesc, prometheus.CounterValue, float64(domainMetrics.TotalRequests), domainName)
+		metrics <- prometheus.MustNewConstMetric(domainBypassedDesc, prometheus.CounterValue, float64(domainMetrics.BypassedRequests), domainName)
+		metrics <- prometheus.MustNewConstMetric(domainStageDesc, prometheus.GaugeValue, float64(domainMetrics.CurrentStage), domainName)
+		attackValue := 0.0
+		if domainMetrics.IsUnderAttack {
+			attackValue = 1
+		}
+		metrics <- prometheus.MustNewConstMetric(domainUnderAttackDesc, prometheus.GaugeValue, attackValue, domainName)
+
+		top := TopAttackers(domainName, 10)
+		for _, source := range top.IPs {
+			metrics <- prometheus.MustNewConstMetric(attackSourcesDesc, prometheus.GaugeValue, float64(source.Count), domainName, source.Source, "", "")
+		}
+		for _, source := range top.Countries {
+			metrics <- prometheus.MustNewConstMetric(attackSourcesDesc, prometheus.GaugeValue, float64(source.Count), domainName, "", source.Source, "")
+		}
+		for _, source := range top.ASNs {
+			metrics <- prometheus.MustNewConstMetric(attackSourcesDesc, prometheus.GaugeValue, float64(source.Count), domainName, "", "", strconv.Itoa(source.ASN))
+		}
+	}
+
+	// Challenge analytics
+	for _, stat := range GetChallengeStats("", "") {
+		labels := []string{stat.Domain, strconv.Itoa(stat.Level), strconv.Itoa(stat.Difficulty), stat.Country}
+		metrics <- prometheus.MustNewConstMetric(challengesIssuedDesc, prometheus.CounterValue, float64(stat.Issued), labels...)
+		metrics <- prometheus.MustNewConstMetric(challengesSolvedDesc, prometheus.CounterValue, float64(stat.Solved), labels...)
+		metrics <- prometheus.MustNewConstMetric(challengesFailedDesc, prometheus.CounterValue, float64(stat.Failed), labels...)
+		metrics <- prometheus.MustNewConstMetric(challengesAbandonedDesc, prometheus.CounterValue, float64(stat.Abandoned), labels...)
+		metrics <- prometheus.MustNewConstMetric(challengeMedianDesc, prometheus.GaugeValue, stat.Median.Seconds(), labels...)
+	}
+
+	// How the backends answered recently
+	for _, stats := range GetUpstreamStats("") {
+		metrics <- prometheus.MustNewConstMetric(upstreamLatencyDesc, prometheus.GaugeValue, stats.P95.Seconds(), stats.Domain, stats.Backend)
+		metrics <- prometheus.MustNewConstMetric(upstreamErrorRatioDesc, prometheus.GaugeValue, stats.ErrorRatio(), stats.Domain, stats.Backend)
+	}
+
+	// IP metrics (sample top 100)
+	count := 0
+	for ip, ipMetrics := range MetricsData.PerIPMetrics {
+		if count >= 100 {
+			break
+		}
+		metrics <- prometheus.MustNewConstMetric(ipRequestsDesc, prometheus.CounterValue, float64(ipMetrics.TotalRequests), ip)
+		metrics <- prometheus.MustNewConstMetric(ipReputationDesc, prometheus.GaugeValue, float64(ipMetrics.ReputationScore), ip)
+		count++
+	}
+}
+
+// MetricsCredentials returns whether scrapers have to send a token or a username and password
+func MetricsCredentials() bool {
+	return MetricsToken != "" || MetricsUsername != ""
+}
+
+// MetricsAuthorized returns whether request carries the bearer token or the basic auth credentials of the endpoint
+func MetricsAuthorized(request *http.Request) bool {
+	if MetricsToken != "" {
+		token := request.Header.Get("Authorization")
+		if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") && subtle.ConstantTimeCompare([]byte(token[7:]), []byte(MetricsToken)) == 1 {
+			return true
+		}
+	}
+	if MetricsUsername != "" {
+		username, password, ok := request.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(username), []byte(MetricsUsername)) == 1 && subtle.ConstantTimeCompare([]byte(password), []byte(MetricsPassword)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricsHandler serves the metrics in whichever format the scraper asks for
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{})
+}
+
+// StartPrometheusServer starts HTTP server for Prometheus metrics export, unless the metrics are served on the admin api
+func StartPrometheusServer() {
+	if !MetricsEnabled || MetricsOnAdmin {
+		return
+	}
+
+	handler := MetricsHandler()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if MetricsCredentials() && !MetricsAuthorized(r) {
+			if MetricsToken != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="Metrics"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Basic realm="Metrics", charset="UTF-8"`)
+			}
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	addr := net.JoinHostPort(MetricsAddress, strconv.Itoa(MetricsPort))
+	if MetricsAddress == "" && !MetricsCredentials() {
+		logger.Warn("Metrics endpoint can be scraped by everyone, set metricsAddress or metricsToken to restrict it", logger.F("address", addr))
+	}
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		var err error
+		if MetricsCert != "" {
+			err = server.ListenAndServeTLS(MetricsCert, MetricsKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			// Log error but don't crash
+			logger.Error("Failed to start Prometheus server", logger.F("address", addr), logger.Err(err))
+		}
+	}()
+}
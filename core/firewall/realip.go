@@ -0,0 +1,134 @@
+package firewall
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	TrustedProxiesEnabled = false
+
+	// Upstreams allowed to set real-ip headers
+	TrustedProxyNets = []*net.IPNet{}
+
+	// Cloudflare mode without cidrs trusts every upstream, like it did before trusted proxies could be configured
+	trustEveryUpstream = false
+
+	// Headers checked in order to derive the client ip
+	RealIPHeaders = []domains.RealIPHeader{}
+
+	defaultCloudflareHeaders = []domains.RealIPHeader{
+		{Name: "CF-Connecting-IP"},
+	}
+)
+
+// SetTrustedProxies applies the trusted proxy config. Cloudflare mode falls back to CF-Connecting-IP if no headers are configured
+func SetTrustedProxies(settings domains.TrustedProxySettings, cloudflare bool) error {
+
+	nets := []*net.IPNet{}
+	for _, cidr := range settings.CIDRs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.New("invalid trusted proxy cidr " + cidr + ": " + err.Error())
+		}
+		nets = append(nets, ipNet)
+	}
+
+	// Every client could set its own ip otherwise, bans and ratelimits would be useless
+	if settings.Enabled && !cloudflare && len(nets) == 0 {
+		return errors.New("trustedProxies needs the cidrs of the upstreams that are allowed to set the client ip")
+	}
+
+	headers := settings.Headers
+	if len(headers) == 0 && cloudflare {
+		headers = defaultCloudflareHeaders
+	}
+
+	TrustedProxiesEnabled = settings.Enabled || cloudflare
+	TrustedProxyNets = nets
+	trustEveryUpstream = cloudflare && len(nets) == 0
+	RealIPHeaders = headers
+
+	return nil
+}
+
+// IsTrustedProxy checks whether ip belongs to a trusted upstream
+func IsTrustedProxy(ip net.IP) bool {
+	if trustEveryUpstream {
+		return true
+	}
+	for _, ipNet := range TrustedProxyNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveClientIP derives the client ip of a request. Returns the peer ip, unless the peer is a trusted proxy that provided a valid real-ip header
+func ResolveClientIP(remoteAddr string, header http.Header) (string, bool) {
+
+	peer := strings.Split(remoteAddr, ":")[0]
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		peer = host
+	}
+
+	if !TrustedProxiesEnabled {
+		return peer, false
+	}
+
+	if peerIP := net.ParseIP(peer); peerIP == nil || !IsTrustedProxy(peerIP) {
+		return peer, false
+	}
+
+	for _, realIPHeader := range RealIPHeaders {
+		value := header.Get(realIPHeader.Name)
+		if value == "" {
+			continue
+		}
+
+		// List headers like X-Forwarded-For get appended to by every hop, so count from the right
+		entries := strings.Split(value, ",")
+		clientIP := net.IP(nil)
+		if realIPHeader.Depth > 0 {
+			index := len(entries) - realIPHeader.Depth
+			if index < 0 {
+				continue
+			}
+			clientIP = net.ParseIP(strings.TrimSpace(entries[index]))
+		} else {
+			clientIP = rightmostUntrusted(entries)
+		}
+		if clientIP == nil {
+			continue
+		}
+		return clientIP.String(), true
+	}
+
+	return peer, false
+}
+
+// rightmostUntrusted returns the entry the last trusted proxy got the request from, walking from the right and skipping
+// trusted proxies. The entries left of it were sent by the client and can be anything
+func rightmostUntrusted(entries []string) net.IP {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := net.ParseIP(strings.TrimSpace(entries[i]))
+		if entry == nil {
+			return nil
+		}
+		if i == 0 || !IsTrustedProxy(entry) {
+			return entry
+		}
+	}
+	return nil
+}
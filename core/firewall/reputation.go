@@ -2,15 +2,12 @@ package firewall
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"sync"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 var (
-	ReputationDB     *bolt.DB
+	ReputationDB     ReputationStore
 	ReputationScores = make(map[string]*ReputationData)
 	ReputationMutex  = &sync.RWMutex{}
 	
@@ -41,84 +38,70 @@ type ReputationData struct {
 	TotalRequests int       `json:"total_requests"`
 	FailedChallenges int    `json:"failed_challenges"`
 	RateLimitHits int       `json:"rate_limit_hits"`
+	HeaderLimitHits int     `json:"header_limit_hits"`
+	SlowConnections int     `json:"slow_connections"`
+	SharedCookies   int     `json:"shared_cookies"`
 }
 
-// InitReputationDB initializes the BoltDB database for reputation storage
+// InitReputationDB opens the store reputations are persisted to
 func InitReputationDB() error {
 	if !ReputationPersistToDB {
 		return nil
 	}
 	
-	var err error
-	ReputationDB, err = bolt.Open(ReputationDBPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		return err
-	}
-	
-	// Create bucket if it doesn't exist
-	err = ReputationDB.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("reputation"))
-		return err
-	})
-	
+	store, err := OpenReputationStore()
 	if err != nil {
 		return err
 	}
+	ReputationDB = store
 	
 	// Load existing reputation data from DB
 	LoadReputationFromDB()
 	
 	// Start decay routine
 	go ReputationDecayRoutine()
+	go ReputationFlushRoutine()
 	
 	return nil
 }
 
-// LoadReputationFromDB loads reputation scores from BoltDB
+// LoadReputationFromDB loads reputation scores from the reputation store
 func LoadReputationFromDB() {
 	if !ReputationPersistToDB || ReputationDB == nil {
 		return
 	}
 	
+	reputations, err := ReputationDB.Load()
+	if err != nil {
+		return
+	}
+	
 	ReputationMutex.Lock()
 	defer ReputationMutex.Unlock()
 	
-	ReputationDB.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("reputation"))
-		if bucket == nil {
-			return nil
-		}
-		
-		bucket.ForEach(func(k, v []byte) error {
-			var data ReputationData
-			if err := json.Unmarshal(v, &data); err == nil {
-				ReputationScores[string(k)] = &data
-			}
-			return nil
-		})
-		return nil
-	})
+	for ip, data := range reputations {
+		ReputationScores[ip] = data
+	}
 }
 
-// SaveReputationToDB saves reputation score to BoltDB
+// SaveReputationToDB queues the reputation of ip to be saved to the reputation store with the next flush, see FlushReputations
 func SaveReputationToDB(ip string, data *ReputationData) {
 	if !ReputationPersistToDB || ReputationDB == nil {
 		return
 	}
 	
-	ReputationDB.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("reputation"))
-		if bucket == nil {
-			return nil
-		}
-		
-		jsonData, err := json.Marshal(data)
-		if err != nil {
-			return err
-		}
-		
-		return bucket.Put([]byte(ip), jsonData)
-	})
+	queueReputation(ip, false)
+}
+
+// DeleteReputationFromDB queues ips to be deleted from the reputation store with the next flush
+func DeleteReputationFromDB(ips []string) {
+	if !ReputationPersistToDB || ReputationDB == nil {
+		return
+	}
+	
+	for _, ip := range ips {
+		queueReputation(ip, true)
+	}
 }
 
 // GetReputation gets or creates reputation data for an IP
@@ -140,6 +123,7 @@ func GetReputation(ip string) *ReputationData {
 				LastDecay:   time.Now(),
 			}
 			ReputationScores[ip] = data
+			checkReputationSize()
 		}
 		ReputationMutex.Unlock()
 		
@@ -157,10 +141,30 @@ func UpdateReputation(ip string, scoreChange int, reason string) {
 		return
 	}
 	
+	applyReputation(ip, scoreChange, reason, true)
+	
+	// An ip burned on this node starts with a low reputation on every node of the cluster
+	if scoreChange < 0 {
+		ShareReputation(ip, scoreChange, reason)
+	}
+}
+
+// applyReputation changes the score of an IP. Changes shared by other nodes don't count as a request
+func applyReputation(ip string, scoreChange int, reason string, request bool) {
+	
+	// Don't use GetReputation here, it locks ReputationMutex itself
 	ReputationMutex.Lock()
 	defer ReputationMutex.Unlock()
 	
-	data := GetReputation(ip)
+	data, exists := ReputationScores[ip]
+	if !exists {
+		data = &ReputationData{
+			IP:          ip,
+			Score:       DefaultReputationScore,
+			LastUpdated: time.Now(),
+			LastDecay:   time.Now(),
+		}
+	}
 	
 	// Update score
 	oldScore := data.Score
@@ -173,21 +177,36 @@ func UpdateReputation(ip string, scoreChange int, reason string) {
 	if data.Score < MinReputationScore {
 		data.Score = MinReputationScore
 	}
+	applySubnetReputation(ip, data.Score-oldScore)
+	if request && scoreChange < 0 {
+		RecordASNAbuse(ip)
+	}
 	
 	data.LastUpdated = time.Now()
-	data.TotalRequests++
+	if request {
+		data.TotalRequests++
+	}
 	
 	// Track specific events
 	switch reason {
-	case "challenge_failure":
+	case "challenge_failure", "browser_signal_mismatch":
 		data.FailedChallenges++
 	case "rate_limit_hit":
 		data.RateLimitHits++
+	case "header_limit":
+		data.HeaderLimitHits++
+	case "slow_connection":
+		data.SlowConnections++
+	case "cookie_sharing":
+		data.SharedCookies++
 	case "successful_access":
 		// Positive event, no specific tracking needed
 	}
 	
 	ReputationScores[ip] = data
+	if !exists {
+		checkReputationSize()
+	}
 	
 	// Save to DB if enabled
 	if ReputationPersistToDB {
@@ -224,8 +243,7 @@ func IsIPBlocked(ip string) bool {
 		return false
 	}
 	
-	score := GetReputationScore(ip)
-	return score < ReputationMinScore
+	return ReputationAction(ip) == "block"
 }
 
 // ReputationDecayRoutine periodically decays reputation scores to allow recovery
@@ -280,25 +298,23 @@ func CleanupOldReputation(daysOld int) {
 	
 	cutoff := time.Now().AddDate(0, 0, -daysOld)
 	
+	removed := []string{}
 	for ip, data := range ReputationScores {
 		if data.LastUpdated.Before(cutoff) && data.Score == DefaultReputationScore {
 			// Remove entries that are old and at default score
 			delete(ReputationScores, ip)
-			
-			ReputationDB.Update(func(tx *bolt.Tx) error {
-				bucket := tx.Bucket([]byte("reputation"))
-				if bucket != nil {
-					return bucket.Delete([]byte(ip))
-				}
-				return nil
-			})
+			removed = append(removed, ip)
 		}
 	}
+	DeleteReputationFromDB(removed)
 }
 
-// CloseReputationDB closes the BoltDB connection
+// CloseReputationDB flushes pending changes and closes the reputation store
 func CloseReputationDB() error {
 	if ReputationDB != nil {
+		FlushReputations()
+		flushMutex.Lock()
+		defer flushMutex.Unlock()
 		return ReputationDB.Close()
 	}
 	return nil
@@ -0,0 +1,88 @@
+package firewall
+
+import (
+	"sort"
+	"time"
+)
+
+// ReputationOf returns a copy of the reputation data of ip. Returns false if ip has none yet
+func ReputationOf(ip string) (ReputationData, bool) {
+	ReputationMutex.RLock()
+	defer ReputationMutex.RUnlock()
+
+	data, exists := ReputationScores[ip]
+	if !exists {
+		return ReputationData{}, false
+	}
+	return *data, true
+}
+
+// SetReputation overwrites the score of ip, e.g. to correct the reputation of a client that was punished by mistake
+func SetReputation(ip string, score int) ReputationData {
+
+	if score > MaxReputationScore {
+		score = MaxReputationScore
+	}
+	if score < MinReputationScore {
+		score = MinReputationScore
+	}
+
+	ReputationMutex.Lock()
+	defer ReputationMutex.Unlock()
+
+	data, exists := ReputationScores[ip]
+	if !exists {
+		data = &ReputationData{
+			IP:        ip,
+			LastDecay: time.Now(),
+		}
+		ReputationScores[ip] = data
+	}
+	data.Score = score
+	data.LastUpdated = time.Now()
+
+	if ReputationPersistToDB {
+		SaveReputationToDB(ip, data)
+	}
+	return *data
+}
+
+// ResetReputations forgets the reputation of ips, they start over at the default score. Returns how many of them had one
+func ResetReputations(ips []string) int {
+
+	ReputationMutex.Lock()
+	defer ReputationMutex.Unlock()
+
+	reset := 0
+	for _, ip := range ips {
+		if _, exists := ReputationScores[ip]; exists {
+			delete(ReputationScores, ip)
+			reset++
+		}
+	}
+
+	DeleteReputationFromDB(ips)
+	return reset
+}
+
+// LowestReputations returns up to limit ips with the lowest scores, lowest first
+func LowestReputations(limit int) []ReputationData {
+
+	ReputationMutex.RLock()
+	lowest := make([]ReputationData, 0, len(ReputationScores))
+	for _, data := range ReputationScores {
+		lowest = append(lowest, *data)
+	}
+	ReputationMutex.RUnlock()
+
+	sort.Slice(lowest, func(i, j int) bool {
+		if lowest[i].Score != lowest[j].Score {
+			return lowest[i].Score < lowest[j].Score
+		}
+		return lowest[i].IP < lowest[j].IP
+	})
+	if len(lowest) > limit {
+		lowest = lowest[:limit]
+	}
+	return lowest
+}
@@ -0,0 +1,231 @@
+package firewall
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReputationExportVersion is the version of the format reputations are exported in
+const ReputationExportVersion = 1
+
+var (
+	// How imported reputations are merged with the reputation an ip already has
+	ReputationMergeStrategies = []string{"replace", "keep", "lowest"}
+
+	reputationCSVHeader = []string{"ip", "score", "last_updated", "total_requests", "failed_challenges", "rate_limit_hits", "header_limit_hits", "slow_connections", "shared_cookies"}
+)
+
+// ReputationExport is a copy of the reputation store, which can be imported into another proxy
+type ReputationExport struct {
+	Version     int              `json:"version"`
+	Reputations []ReputationData `json:"reputations"`
+}
+
+// ExportReputations returns every reputation that is currently known
+func ExportReputations() ReputationExport {
+
+	ReputationMutex.RLock()
+	defer ReputationMutex.RUnlock()
+
+	export := ReputationExport{
+		Version:     ReputationExportVersion,
+		Reputations: make([]ReputationData, 0, len(ReputationScores)),
+	}
+	for _, data := range ReputationScores {
+		export.Reputations = append(export.Reputations, *data)
+	}
+	return export
+}
+
+// ImportReputations merges reputations into the store. "replace" overwrites known ips, "keep" only adds unknown ones and
+// "lowest" keeps whichever score is lower, e.g. to seed a node with known bad ips. Returns how many reputations were imported and skipped
+func ImportReputations(reputations []ReputationData, strategy string) (imported int, skipped int, err error) {
+
+	if strategy == "" {
+		strategy = "replace"
+	}
+	valid := false
+	for _, known := range ReputationMergeStrategies {
+		valid = valid || strategy == known
+	}
+	if !valid {
+		return 0, 0, errors.New("unknown merge strategy " + strategy + ", use " + strings.Join(ReputationMergeStrategies, ", "))
+	}
+	for _, data := range reputations {
+		if net.ParseIP(data.IP) == nil {
+			return 0, 0, errors.New("invalid ip " + data.IP)
+		}
+	}
+
+	ReputationMutex.Lock()
+	for _, data := range reputations {
+		current, exists := ReputationScores[data.IP]
+		if exists && (strategy == "keep" || strategy == "lowest" && current.Score <= data.Score) {
+			skipped++
+			continue
+		}
+
+		data := data
+		if data.Score > MaxReputationScore {
+			data.Score = MaxReputationScore
+		}
+		if data.Score < MinReputationScore {
+			data.Score = MinReputationScore
+		}
+		if data.LastUpdated.IsZero() {
+			data.LastUpdated = time.Now()
+		}
+		data.LastDecay = time.Now()
+
+		ReputationScores[data.IP] = &data
+		SaveReputationToDB(data.IP, &data)
+		imported++
+	}
+	checkReputationSize()
+	ReputationMutex.Unlock()
+
+	// Imports are rare and large, write them right away instead of waiting for the next flush
+	return imported, skipped, FlushReputations()
+}
+
+// WriteReputationsCSV writes reputations as csv, with a header line
+func WriteReputationsCSV(writer io.Writer, reputations []ReputationData) error {
+
+	csvWriter := csv.NewWriter(writer)
+	csvWriter.Write(reputationCSVHeader)
+	for _, data := range reputations {
+		csvWriter.Write([]string{
+			data.IP,
+			strconv.Itoa(data.Score),
+			data.LastUpdated.UTC().Format(time.RFC3339),
+			strconv.Itoa(data.TotalRequests),
+			strconv.Itoa(data.FailedChallenges),
+			strconv.Itoa(data.RateLimitHits),
+			strconv.Itoa(data.HeaderLimitHits),
+			strconv.Itoa(data.SlowConnections),
+			strconv.Itoa(data.SharedCookies),
+		})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// ReadReputationsCSV reads reputations written by WriteReputationsCSV. Only the ip and score columns are required
+func ReadReputationsCSV(reader io.Reader) ([]ReputationData, error) {
+
+	records, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["ip"]; !ok {
+		return nil, errors.New("csv needs an ip column")
+	}
+	if _, ok := columns["score"]; !ok {
+		return nil, errors.New("csv needs a score column")
+	}
+
+	reputations := make([]ReputationData, 0, len(records)-1)
+	for line, record := range records[1:] {
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(name string) int {
+			value, _ := strconv.Atoi(field(name))
+			return value
+		}
+
+		score, err := strconv.Atoi(field("score"))
+		if err != nil {
+			return nil, errors.New("invalid score in line " + strconv.Itoa(line+2))
+		}
+		lastUpdated, _ := time.Parse(time.RFC3339, field("last_updated"))
+		reputations = append(reputations, ReputationData{
+			IP:               field("ip"),
+			Score:            score,
+			LastUpdated:      lastUpdated,
+			TotalRequests:    number("total_requests"),
+			FailedChallenges: number("failed_challenges"),
+			RateLimitHits:    number("rate_limit_hits"),
+			HeaderLimitHits:  number("header_limit_hits"),
+			SlowConnections:  number("slow_connections"),
+			SharedCookies:    number("shared_cookies"),
+		})
+	}
+	return reputations, nil
+}
+
+// ExportReputationsFile writes every known reputation to a file, as csv if its name ends with .csv and as json otherwise
+func ExportReputationsFile(path string) (int, error) {
+
+	export := ExportReputations()
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		file, err := os.Create(path)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		return len(export.Reputations), WriteReputationsCSV(file, export.Reputations)
+	}
+
+	jsonExport, err := json.MarshalIndent(export, "", "    ")
+	if err != nil {
+		return 0, err
+	}
+	return len(export.Reputations), ioutil.WriteFile(path, jsonExport, 0644)
+}
+
+// ImportReputationsFile imports a file written by ExportReputationsFile (or returned by the api)
+func ImportReputationsFile(path string, strategy string) (imported int, skipped int, err error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	reputations, err := ParseReputations(content, strings.HasSuffix(strings.ToLower(path), ".csv"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return ImportReputations(reputations, strategy)
+}
+
+// ParseReputations reads an export in the json format or as csv
+func ParseReputations(content []byte, isCSV bool) ([]ReputationData, error) {
+
+	if isCSV {
+		reputations, err := ReadReputationsCSV(bytes.NewReader(content))
+		if err != nil {
+			return nil, errors.New("invalid export: " + err.Error())
+		}
+		return reputations, nil
+	}
+
+	export := ReputationExport{}
+	if err := json.Unmarshal(content, &export); err != nil {
+		return nil, errors.New("invalid export: " + err.Error())
+	}
+	if export.Version > ReputationExportVersion {
+		return nil, errors.New("export version " + strconv.Itoa(export.Version) + " is not supported")
+	}
+	return export.Reputations, nil
+}
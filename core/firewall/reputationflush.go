@@ -0,0 +1,79 @@
+package firewall
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	ReputationFlushInterval = 5 * time.Second
+
+	// ip -> whether it has to be deleted from the store instead of saved
+	pendingReputations = map[string]bool{}
+	pendingMutex       = &sync.Mutex{}
+	flushMutex         = &sync.Mutex{}
+)
+
+// queueReputation marks ip to be saved (or deleted) with the next flush. Doesn't touch ReputationMutex, so it can be called while holding it
+func queueReputation(ip string, deleted bool) {
+	pendingMutex.Lock()
+	pendingReputations[ip] = deleted
+	pendingMutex.Unlock()
+}
+
+// FlushReputations writes everything that changed since the last flush to the reputation store, in one batch
+func FlushReputations() error {
+	if !ReputationPersistToDB || ReputationDB == nil {
+		return nil
+	}
+
+	// Flushes have to be written in order, otherwise an older flush could overwrite a newer one
+	flushMutex.Lock()
+	defer flushMutex.Unlock()
+
+	pendingMutex.Lock()
+	pending := pendingReputations
+	pendingReputations = map[string]bool{}
+	pendingMutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	saved := []*ReputationData{}
+	deleted := []string{}
+	ReputationMutex.RLock()
+	for ip, remove := range pending {
+		data, exists := ReputationScores[ip]
+		if remove || !exists {
+			deleted = append(deleted, ip)
+			continue
+		}
+		copied := *data
+		saved = append(saved, &copied)
+	}
+	ReputationMutex.RUnlock()
+
+	err := ReputationDB.Save(saved)
+	if err == nil {
+		err = ReputationDB.Delete(deleted)
+	}
+	if err != nil {
+		// Retry with the next flush, unless the ip changed again in the meantime
+		pendingMutex.Lock()
+		for ip, remove := range pending {
+			if _, queued := pendingReputations[ip]; !queued {
+				pendingReputations[ip] = remove
+			}
+		}
+		pendingMutex.Unlock()
+	}
+	return err
+}
+
+// ReputationFlushRoutine flushes changed reputations every ReputationFlushInterval
+func ReputationFlushRoutine() {
+	for {
+		time.Sleep(ReputationFlushInterval)
+		FlushReputations()
+	}
+}
@@ -0,0 +1,108 @@
+package firewall
+
+import (
+	"sort"
+	"time"
+)
+
+var (
+	ReputationMaxEntries      = 100000 // 0 keeps every ip
+	ReputationTTL             = 7 * 24 * time.Hour
+	ReputationCompactInterval = 24 * time.Hour
+
+	// Signals the maintenance routine that ReputationScores outgrew ReputationMaxEntries
+	reputationOverflow = make(chan struct{}, 1)
+)
+
+// reputationCompactor is implemented by stores whose files don't shrink by themselves when entries are deleted
+type reputationCompactor interface {
+	Compact() error
+}
+
+// checkReputationSize wakes up the maintenance routine if there are too many reputations. Has to be called with ReputationMutex locked
+func checkReputationSize() {
+	if ReputationMaxEntries > 0 && len(ReputationScores) > ReputationMaxEntries {
+		select {
+		case reputationOverflow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ExpireReputations forgets reputations that weren't updated within ReputationTTL and, if there are still more than ReputationMaxEntries,
+// the least recently seen ones (every request updates the reputation of its ip). Makes room for 10% more before evicting again.
+// Returns how many reputations were removed
+func ExpireReputations() int {
+
+	ReputationMutex.Lock()
+
+	removed := []string{}
+	if ReputationTTL > 0 {
+		cutoff := time.Now().Add(-ReputationTTL)
+		for ip, data := range ReputationScores {
+			if data.LastUpdated.Before(cutoff) {
+				delete(ReputationScores, ip)
+				removed = append(removed, ip)
+			}
+		}
+	}
+
+	if ReputationMaxEntries > 0 && len(ReputationScores) > ReputationMaxEntries {
+		type entry struct {
+			ip       string
+			lastSeen time.Time
+		}
+		entries := make([]entry, 0, len(ReputationScores))
+		for ip, data := range ReputationScores {
+			entries = append(entries, entry{ip: ip, lastSeen: data.LastUpdated})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].lastSeen.Before(entries[j].lastSeen)
+		})
+		for _, evicted := range entries[:len(entries)-ReputationMaxEntries*9/10] {
+			delete(ReputationScores, evicted.ip)
+			removed = append(removed, evicted.ip)
+		}
+	}
+
+	ReputationMutex.Unlock()
+
+	DeleteReputationFromDB(removed)
+	return len(removed)
+}
+
+// CompactReputationDB rewrites the reputation store, so deleted reputations stop taking up disk space
+func CompactReputationDB() error {
+	if !ReputationPersistToDB || ReputationDB == nil {
+		return nil
+	}
+	compactor, ok := ReputationDB.(reputationCompactor)
+	if !ok {
+		return nil
+	}
+	FlushReputations()
+
+	// Writes only happen while flushing, nothing can write to the store while it's compacted
+	flushMutex.Lock()
+	defer flushMutex.Unlock()
+	return compactor.Compact()
+}
+
+// StartReputationMaintenanceRoutine expires reputations every minute (or as soon as there are too many) and compacts the store every ReputationCompactInterval
+func StartReputationMaintenanceRoutine() {
+	go func() {
+		lastCompaction := time.Now()
+		for {
+			select {
+			case <-time.After(time.Minute):
+			case <-reputationOverflow:
+			}
+			ExpireReputations()
+
+			if ReputationCompactInterval > 0 && time.Since(lastCompaction) > ReputationCompactInterval {
+				CompactReputationDB()
+				lastCompaction = time.Now()
+			}
+		}
+	}()
+}
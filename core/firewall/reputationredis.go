@@ -0,0 +1,215 @@
+package firewall
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisReputationStore keeps reputations as json in a redis hash, every node that uses the same key shares them
+type redisReputationStore struct {
+	mutex    *sync.Mutex
+	address  string
+	password string
+	database int
+	key      string
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func openRedisReputationStore(address string, password string, database int, key string) (ReputationStore, error) {
+	store := &redisReputationStore{
+		mutex:    &sync.Mutex{},
+		address:  address,
+		password: password,
+		database: database,
+		key:      key,
+	}
+	if _, err := store.do("PING"); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// connect (re)connects to redis, authenticates and selects the database. Has to be called with the mutex locked
+func (store *redisReputationStore) connect() error {
+	conn, err := net.DialTimeout("tcp", store.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	store.conn = conn
+	store.reader = bufio.NewReader(conn)
+
+	if store.password != "" {
+		if _, err := store.command("AUTH", store.password); err != nil {
+			store.disconnect()
+			return err
+		}
+	}
+	if store.database != 0 {
+		if _, err := store.command("SELECT", strconv.Itoa(store.database)); err != nil {
+			store.disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *redisReputationStore) disconnect() {
+	if store.conn != nil {
+		store.conn.Close()
+		store.conn = nil
+	}
+}
+
+// do runs a command, reconnecting once if the connection broke
+func (store *redisReputationStore) do(args ...string) (interface{}, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if store.conn == nil {
+			if err := store.connect(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := store.command(args...)
+		if _, replied := err.(redisError); err == nil || replied {
+			return reply, err
+		}
+		// Anything but an error reply leaves the connection in an unknown state
+		store.disconnect()
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// redisError is an error reply of redis, the connection is still fine after one
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+var errRedisProtocol = errors.New("invalid redis reply")
+
+// command sends args as a resp array and reads the reply
+func (store *redisReputationStore) command(args ...string) (interface{}, error) {
+	request := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		request = append(request, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		request = append(request, arg...)
+		request = append(request, "\r\n"...)
+	}
+	store.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := store.conn.Write(request); err != nil {
+		return nil, err
+	}
+	return store.readReply()
+}
+
+// readReply reads a resp reply. Bulk strings are returned as string, arrays as []interface{} and errors as error
+func (store *redisReputationStore) readReply() (interface{}, error) {
+	line, err := store.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisProtocol
+	}
+	kind, content := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return content, nil
+	case '-':
+		return nil, redisError(content)
+	case ':':
+		return strconv.Atoi(content)
+	case '$':
+		length, err := strconv.Atoi(content)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		buffer := make([]byte, length+2)
+		if _, err := io.ReadFull(store.reader, buffer); err != nil {
+			return nil, err
+		}
+		return string(buffer[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(content)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		items := make([]interface{}, 0, length)
+		for i := 0; i < length; i++ {
+			item, err := store.readReply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, errRedisProtocol
+}
+
+func (store *redisReputationStore) Load() (map[string]*ReputationData, error) {
+	reply, err := store.do("HGETALL", store.key)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+
+	reputations := map[string]*ReputationData{}
+	for i := 0; i+1 < len(items); i += 2 {
+		ip, _ := items[i].(string)
+		jsonData, _ := items[i+1].(string)
+		var data ReputationData
+		if err := json.Unmarshal([]byte(jsonData), &data); err == nil {
+			reputations[ip] = &data
+		}
+	}
+	return reputations, nil
+}
+
+func (store *redisReputationStore) Save(reputations []*ReputationData) error {
+	if len(reputations) == 0 {
+		return nil
+	}
+	args := []string{"HSET", store.key}
+	for _, data := range reputations {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		args = append(args, data.IP, string(jsonData))
+	}
+	_, err := store.do(args...)
+	return err
+}
+
+func (store *redisReputationStore) Delete(ips []string) error {
+	if len(ips) == 0 {
+		return nil
+	}
+	_, err := store.do(append([]string{"HDEL", store.key}, ips...)...)
+	return err
+}
+
+func (store *redisReputationStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.disconnect()
+	return nil
+}
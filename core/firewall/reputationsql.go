@@ -0,0 +1,89 @@
+package firewall
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// sqlReputationStore keeps reputations in a table of a database/sql database. Unlike bolt, sqlite lets other processes
+// read the database while the proxy writes to it. The driver has to be compiled in, see sqlitedriver.go
+type sqlReputationStore struct {
+	db *sql.DB
+}
+
+func openSQLReputationStore(driver string, path string) (ReputationStore, error) {
+	db, err := sql.Open(driver, path)
+	if err != nil {
+		return nil, errors.New("failed to open " + driver + " database (is the driver compiled in?): " + err.Error())
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS reputation (ip TEXT PRIMARY KEY, data TEXT NOT NULL)"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlReputationStore{db: db}, nil
+}
+
+func (store *sqlReputationStore) Load() (map[string]*ReputationData, error) {
+	rows, err := store.db.Query("SELECT ip, data FROM reputation")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reputations := map[string]*ReputationData{}
+	for rows.Next() {
+		var ip, jsonData string
+		if err := rows.Scan(&ip, &jsonData); err != nil {
+			return nil, err
+		}
+		var data ReputationData
+		if err := json.Unmarshal([]byte(jsonData), &data); err == nil {
+			reputations[ip] = &data
+		}
+	}
+	return reputations, rows.Err()
+}
+
+func (store *sqlReputationStore) Save(reputations []*ReputationData) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, data := range reputations {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO reputation (ip, data) VALUES (?, ?) ON CONFLICT(ip) DO UPDATE SET data = excluded.data", data.IP, string(jsonData)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *sqlReputationStore) Delete(ips []string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if _, err := tx.Exec("DELETE FROM reputation WHERE ip = ?", ip); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Compact lets sqlite rebuild the database file without the free pages deletes left behind
+func (store *sqlReputationStore) Compact() error {
+	_, err := store.db.Exec("VACUUM")
+	return err
+}
+
+func (store *sqlReputationStore) Close() error {
+	return store.db.Close()
+}
@@ -0,0 +1,164 @@
+package firewall
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ReputationStore persists reputations, so they survive restarts (and can be shared by nodes that use the same database)
+type ReputationStore interface {
+	Load() (map[string]*ReputationData, error)
+	Save(reputations []*ReputationData) error
+	Delete(ips []string) error
+	Close() error
+}
+
+var (
+	ReputationStorage   = "bolt" // "bolt", "sqlite" or "redis"
+	ReputationSQLDriver = "sqlite3"
+
+	ReputationRedisAddress  = "127.0.0.1:6379"
+	ReputationRedisPassword = ""
+	ReputationRedisDatabase = 0
+	ReputationRedisKey      = "balooProxy:reputation"
+)
+
+// CheckStorage returns an error if this build can't persist to storage. The sqlite driver needs cgo and is only
+// compiled in with -tags sqlite, see sqlitedriver.go
+func CheckStorage(storage string) error {
+	if storage != "sqlite" {
+		return nil
+	}
+	for _, driver := range sql.Drivers() {
+		if driver == ReputationSQLDriver {
+			return nil
+		}
+	}
+	return errors.New("storage sqlite isn't compiled in, build with cgo and -tags sqlite (see the README) or use bolt or redis")
+}
+
+// OpenReputationStore opens the store ReputationStorage selects
+func OpenReputationStore() (ReputationStore, error) {
+	switch ReputationStorage {
+	case "", "bolt":
+		return openBoltReputationStore(ReputationDBPath)
+	case "sqlite":
+		return openSQLReputationStore(ReputationSQLDriver, ReputationDBPath)
+	case "redis":
+		return openRedisReputationStore(ReputationRedisAddress, ReputationRedisPassword, ReputationRedisDatabase, ReputationRedisKey)
+	}
+	return nil, errors.New("unknown reputation storage " + ReputationStorage + ", use bolt, sqlite or redis")
+}
+
+// boltReputationStore keeps every reputation as json in a single bucket
+type boltReputationStore struct {
+	db *bolt.DB
+}
+
+var boltReputationBucket = []byte("reputation")
+
+func openBoltReputationStore(path string) (ReputationStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltReputationBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltReputationStore{db: db}, nil
+}
+
+func (store *boltReputationStore) Load() (map[string]*ReputationData, error) {
+	reputations := map[string]*ReputationData{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltReputationBucket).ForEach(func(k, v []byte) error {
+			var data ReputationData
+			if err := json.Unmarshal(v, &data); err == nil {
+				reputations[string(k)] = &data
+			}
+			return nil
+		})
+	})
+	return reputations, err
+}
+
+func (store *boltReputationStore) Save(reputations []*ReputationData) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltReputationBucket)
+		for _, data := range reputations {
+			jsonData, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(data.IP), jsonData); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *boltReputationStore) Delete(ips []string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltReputationBucket)
+		for _, ip := range ips {
+			if err := bucket.Delete([]byte(ip)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Compact copies the bucket into a fresh file and swaps it in, bolt never gives the pages of deleted keys back to the filesystem
+func (store *boltReputationStore) Compact() error {
+
+	path := store.db.Path()
+	compacted, err := bolt.Open(path+".compact", 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = store.db.View(func(source *bolt.Tx) error {
+		return compacted.Update(func(target *bolt.Tx) error {
+			bucket, err := target.CreateBucketIfNotExists(boltReputationBucket)
+			if err != nil {
+				return err
+			}
+			return source.Bucket(boltReputationBucket).ForEach(func(k, v []byte) error {
+				return bucket.Put(k, v)
+			})
+		})
+	})
+	compacted.Close()
+	if err != nil {
+		os.Remove(path + ".compact")
+		return err
+	}
+
+	if err := store.db.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".compact", path); err != nil {
+		os.Remove(path + ".compact")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	store.db = db
+	return nil
+}
+
+func (store *boltReputationStore) Close() error {
+	return store.db.Close()
+}
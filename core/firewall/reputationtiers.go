@@ -0,0 +1,73 @@
+package firewall
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"strconv"
+	"sync"
+)
+
+var (
+	// Reputation bands and what happens to ips within them. Without any, ips below ReputationMinScore are blocked
+	reputationTiers      = []domains.ReputationTier{}
+	reputationTiersMutex = &sync.RWMutex{}
+
+	// Actions of reputation tiers -> challenge level they enforce, -1 blocks
+	ReputationTierActions = map[string]int{
+		"block":   -1,
+		"captcha": 3,
+		"js":      2,
+		"cookie":  1,
+		"allow":   0,
+	}
+)
+
+// SetReputationTiers validates and replaces the reputation tiers. Tiers are checked in order, the first one a score falls into applies
+func SetReputationTiers(tiers []domains.ReputationTier) error {
+	for _, tier := range tiers {
+		if _, ok := ReputationTierActions[tier.Action]; !ok {
+			return errors.New("unknown reputation tier action " + tier.Action + ", use block, captcha, js, cookie or allow")
+		}
+		if tier.Min > tier.Max || tier.Min < MinReputationScore || tier.Max > MaxReputationScore {
+			return errors.New("invalid reputation tier " + strconv.Itoa(tier.Min) + "-" + strconv.Itoa(tier.Max) + ", min and max have to be between " + strconv.Itoa(MinReputationScore) + " and " + strconv.Itoa(MaxReputationScore))
+		}
+	}
+
+	reputationTiersMutex.Lock()
+	reputationTiers = append([]domains.ReputationTier{}, tiers...)
+	reputationTiersMutex.Unlock()
+	return nil
+}
+
+// ReputationAction returns the action of the tier the reputation of ip falls into
+func ReputationAction(ip string) string {
+	if !ReputationEnabled {
+		return "allow"
+	}
+	score := GetReputationScore(ip)
+
+	reputationTiersMutex.RLock()
+	defer reputationTiersMutex.RUnlock()
+
+	if len(reputationTiers) == 0 {
+		if score < ReputationMinScore {
+			return "block"
+		}
+		return "allow"
+	}
+	for _, tier := range reputationTiers {
+		if score >= tier.Min && score <= tier.Max {
+			return tier.Action
+		}
+	}
+	return "allow"
+}
+
+// ReputationLevel returns the challenge level the reputation tier of ip enforces, 0 if it doesn't enforce any
+func ReputationLevel(ip string) int {
+	level := ReputationTierActions[ReputationAction(ip)]
+	if level < 0 {
+		return 0
+	}
+	return level
+}
@@ -0,0 +1,257 @@
+package firewall
+
+import (
+	"encoding/json"
+	"errors"
+	"goProxy/core/accesslog"
+	"goProxy/core/logger"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	CaptureEnabled     = false
+	CaptureSampleRate  = 1000 // 1 in CaptureSampleRate requests to a domain under attack is captured
+	CaptureDirectory   = "captures"
+	CaptureFormat      = "jsonl" // "jsonl" or "har"
+	CaptureMaxFileSize = int64(10 * 1024 * 1024)
+	CaptureMaxFiles    = 10
+	CaptureQueueSize   = 1024
+
+	// Headers that carry credentials, captures only keep their names
+	captureRedactedHeaders = []string{"Authorization", "Proxy-Authorization"}
+
+	captureCounter uint64
+	captureQueue   chan CapturedRequest
+)
+
+// CapturedRequest is the metadata of a sampled request and what happened to it
+type CapturedRequest struct {
+	Time        time.Time           `json:"time"`
+	Domain      string              `json:"domain"`
+	IP          string              `json:"ip"`
+	Method      string              `json:"method"`
+	URL         string              `json:"url"`
+	Proto       string              `json:"proto"`
+	Headers     map[string][]string `json:"headers"`
+	HeaderOrder []string            `json:"headerOrder"`
+
+	TLSFingerprint   string `json:"tlsFingerprint"`
+	JA3              string `json:"ja3"`
+	JA4              string `json:"ja4"`
+	JA4H             string `json:"ja4h"`
+	HTTP2Fingerprint string `json:"http2Fingerprint"`
+	Browser          string `json:"browser"`
+	Bot              string `json:"bot"`
+
+	Country string `json:"country"`
+	ASN     int    `json:"asn"`
+
+	Stage  int    `json:"stage"`
+	SusLv  int    `json:"susLv"`
+	Action string `json:"action"` // "allow", "challenge", "block", "tarpit" or "other"
+	Reason string `json:"reason"`
+	Status int    `json:"status"`
+}
+
+// ShouldCapture decides whether the current request to a domain under attack is sampled
+func ShouldCapture() bool {
+	return CaptureEnabled && atomic.AddUint64(&captureCounter, 1)%uint64(CaptureSampleRate) == 0
+}
+
+// CaptureRequest queues a sampled request to be written. Requests are dropped if the writer can't keep up.
+// Credentials and cookies, including the clearance of the proxy, are redacted from its headers
+func CaptureRequest(captured CapturedRequest) {
+	captured.Headers = redactCaptureHeaders(captured.Headers)
+	if GeoFilteringEnabled {
+		if geoData := cachedGeoData(captured.IP); geoData != nil {
+			captured.Country, captured.ASN = geoData.CountryCode, geoData.ASN
+		}
+	}
+	select {
+	case captureQueue <- captured:
+	default:
+	}
+}
+
+// redactCaptureHeaders returns a copy of headers without the values of credentials and cookies
+func redactCaptureHeaders(headers map[string][]string) map[string][]string {
+	redacted := http.Header(headers).Clone()
+	for _, name := range captureRedactedHeaders {
+		for i := range redacted[name] {
+			redacted[name][i] = "redacted"
+		}
+	}
+	for i, cookies := range redacted["Cookie"] {
+		redacted["Cookie"][i] = accesslog.RedactCookies(cookies)
+	}
+	return redacted
+}
+
+// StartRequestCapture starts writing captured requests to CaptureDirectory
+func StartRequestCapture() error {
+	if CaptureFormat != "jsonl" && CaptureFormat != "har" {
+		return errors.New("unknown capture format " + CaptureFormat + ", use jsonl or har")
+	}
+	if CaptureSampleRate < 1 {
+		return errors.New("the capture sample rate has to be at least 1")
+	}
+	if err := os.MkdirAll(CaptureDirectory, 0700); err != nil {
+		return err
+	}
+
+	captureQueue = make(chan CapturedRequest, CaptureQueueSize)
+	go func() {
+		writer := &captureWriter{}
+		for captured := range captureQueue {
+			if err := writer.write(captured); err != nil {
+				logger.Error("Failed to write captured request", logger.Err(err))
+			}
+		}
+	}()
+	return nil
+}
+
+// captureWriter appends captured requests to the current file and rotates it once it reaches CaptureMaxFileSize
+type captureWriter struct {
+	file *os.File
+	size int64
+}
+
+func (writer *captureWriter) write(captured CapturedRequest) error {
+	if writer.file == nil || writer.size >= CaptureMaxFileSize {
+		if err := writer.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if CaptureFormat == "har" {
+		entry, err := json.Marshal(harEntry(captured))
+		if err != nil {
+			return err
+		}
+		// Overwrite the closing brackets, so the file is a valid HAR document after every entry
+		separator := ","
+		if writer.size == int64(len(harHeader)+len(harFooter)) {
+			separator = ""
+		}
+		n, err := writer.file.WriteAt([]byte(separator+string(entry)+harFooter), writer.size-int64(len(harFooter)))
+		writer.size += int64(n) - int64(len(harFooter))
+		return err
+	}
+
+	entry, err := json.Marshal(captured)
+	if err != nil {
+		return err
+	}
+	n, err := writer.file.Write(append(entry, '\n'))
+	writer.size += int64(n)
+	return err
+}
+
+// rotate opens a new capture file and deletes the oldest ones above CaptureMaxFiles
+func (writer *captureWriter) rotate() error {
+	if writer.file != nil {
+		writer.file.Close()
+		writer.file = nil
+	}
+
+	// Captures hold the headers and ips of visitors, only the user of the proxy can read them
+	file, err := os.OpenFile(filepath.Join(CaptureDirectory, "capture-"+time.Now().Format("20060102-150405.000")+"."+CaptureFormat), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer.file, writer.size = file, 0
+	if CaptureFormat == "har" {
+		n, err := file.Write([]byte(harHeader + harFooter))
+		writer.size = int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(CaptureDirectory, "capture-*"))
+	sort.Strings(files)
+	for len(files) > CaptureMaxFiles {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	return nil
+}
+
+const (
+	harHeader = `{"log":{"version":"1.2","creator":{"name":"balooProxy","version":"1.5"},"entries":[`
+	harFooter = `]}}`
+)
+
+type harHeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harEntry converts a captured request to a HAR entry, the metadata that doesn't fit into HAR is kept in _balooProxy
+func harEntry(captured CapturedRequest) map[string]interface{} {
+	headers := []harHeaderField{}
+	names := make([]string, 0, len(captured.Headers))
+	for name := range captured.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range captured.Headers[name] {
+			headers = append(headers, harHeaderField{Name: name, Value: value})
+		}
+	}
+
+	return map[string]interface{}{
+		"startedDateTime": captured.Time.Format(time.RFC3339Nano),
+		"time":            0,
+		"request": map[string]interface{}{
+			"method":      captured.Method,
+			"url":         captured.URL,
+			"httpVersion": captured.Proto,
+			"headers":     headers,
+			"queryString": []harHeaderField{},
+			"cookies":     []harHeaderField{},
+			"headersSize": -1,
+			"bodySize":    -1,
+		},
+		"response": map[string]interface{}{
+			"status":      captured.Status,
+			"statusText":  "",
+			"httpVersion": captured.Proto,
+			"headers":     []harHeaderField{},
+			"cookies":     []harHeaderField{},
+			"content":     map[string]interface{}{"size": 0, "mimeType": ""},
+			"redirectURL": "",
+			"headersSize": -1,
+			"bodySize":    -1,
+		},
+		"cache":           map[string]interface{}{},
+		"timings":         map[string]interface{}{"send": 0, "wait": 0, "receive": 0},
+		"serverIPAddress": "",
+		"_balooProxy": map[string]interface{}{
+			"domain":           captured.Domain,
+			"ip":               captured.IP,
+			"headerOrder":      captured.HeaderOrder,
+			"tlsFingerprint":   captured.TLSFingerprint,
+			"ja3":              captured.JA3,
+			"ja4":              captured.JA4,
+			"ja4h":             captured.JA4H,
+			"http2Fingerprint": captured.HTTP2Fingerprint,
+			"browser":          captured.Browser,
+			"bot":              captured.Bot,
+			"country":          captured.Country,
+			"asn":              captured.ASN,
+			"stage":            captured.Stage,
+			"susLv":            captured.SusLv,
+			"action":           captured.Action,
+			"reason":           captured.Reason,
+		},
+	}
+}
@@ -0,0 +1,34 @@
+package firewall
+
+import "sync"
+
+var (
+	// domain -> rule groups that are disabled. Replaced instead of modified, so it can be read without holding the mutex
+	disabledRuleGroups      = map[string]map[string]bool{}
+	disabledRuleGroupsMutex = &sync.RWMutex{}
+)
+
+// SetRuleGroupEnabled enables or disables every custom rule of a domain that belongs to group. It stays that way until the proxy is restarted
+func SetRuleGroupEnabled(domainName string, group string, enabled bool) {
+
+	disabledRuleGroupsMutex.Lock()
+	defer disabledRuleGroupsMutex.Unlock()
+
+	groups := map[string]bool{}
+	for name := range disabledRuleGroups[domainName] {
+		groups[name] = true
+	}
+	if enabled {
+		delete(groups, group)
+	} else {
+		groups[group] = true
+	}
+	disabledRuleGroups[domainName] = groups
+}
+
+// DisabledRuleGroups returns the disabled rule groups of a domain. The result must not be modified
+func DisabledRuleGroups(domainName string) map[string]bool {
+	disabledRuleGroupsMutex.RLock()
+	defer disabledRuleGroupsMutex.RUnlock()
+	return disabledRuleGroups[domainName]
+}
@@ -0,0 +1,56 @@
+package firewall
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// domain, rule and client -> requests within the current window of the rule
+	ruleRatelimits      = map[string]*ruleWindow{}
+	ruleRatelimitsMutex = &sync.Mutex{}
+)
+
+type ruleWindow struct {
+	start    int64 // unix timestamp the window started at
+	length   int64 // seconds
+	requests int
+}
+
+// RuleRatelimited counts a request of client against the limit of a ratelimit rule and checks whether it exceeds limit requests per window seconds.
+// client is the ip (or ip and path) the rule limits by
+func RuleRatelimited(domainName string, index int, client string, limit int, window int) bool {
+
+	now := time.Now().Unix()
+	key := domainName + "|" + strconv.Itoa(index) + "|" + client
+
+	ruleRatelimitsMutex.Lock()
+	defer ruleRatelimitsMutex.Unlock()
+
+	counter, ok := ruleRatelimits[key]
+	if !ok || now-counter.start >= counter.length {
+		counter = &ruleWindow{start: now, length: int64(window)}
+		ruleRatelimits[key] = counter
+	}
+	counter.requests++
+	return counter.requests > limit
+}
+
+// StartRuleRatelimitCleanupRoutine forgets clients whose window of a ratelimit rule ended
+func StartRuleRatelimitCleanupRoutine() {
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+
+			now := time.Now().Unix()
+			ruleRatelimitsMutex.Lock()
+			for key, counter := range ruleRatelimits {
+				if now-counter.start >= counter.length {
+					delete(ruleRatelimits, key)
+				}
+			}
+			ruleRatelimitsMutex.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,80 @@
+package firewall
+
+import (
+	"errors"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+)
+
+var (
+	// Limits of patterns used with the matches operator
+	MaxRegexLength       = 512  // characters of a pattern
+	MaxRegexRepeat       = 100  // highest count of a repetition like {n,m}
+	MaxRegexInstructions = 2000 // size of the compiled pattern
+
+	// Patterns of the matches operator, quoted the way gofilter expects them
+	matchesOperand = regexp.MustCompile(`\bmatches\s+("(?:[^"\\]|\\.)*")`)
+)
+
+// checkRuleRegexes checks every pattern used with the matches operator in a rule expression. Go regexes always run in linear time,
+// but huge or deeply repeated patterns still cost a lot of memory and cpu for every request they're checked against
+func checkRuleRegexes(expression string) error {
+	for _, operand := range matchesOperand.FindAllStringSubmatch(expression, -1) {
+		pattern, err := strconv.Unquote(operand[1])
+		if err != nil {
+			// gofilter reports broken quoting itself
+			continue
+		}
+		if err := checkRegex(pattern); err != nil {
+			return errors.New("regex " + operand[1] + " " + err.Error())
+		}
+	}
+	return nil
+}
+
+func checkRegex(pattern string) error {
+
+	if len(pattern) > MaxRegexLength {
+		return errors.New("is longer than " + strconv.Itoa(MaxRegexLength) + " characters")
+	}
+
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return errors.New("is invalid: " + err.Error())
+	}
+	if repeat := maxRepeat(parsed); repeat > MaxRegexRepeat {
+		return errors.New("repeats up to " + strconv.Itoa(repeat) + " times, at most " + strconv.Itoa(MaxRegexRepeat) + " are allowed")
+	}
+
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return errors.New("is invalid: " + err.Error())
+	}
+	if len(prog.Inst) > MaxRegexInstructions {
+		return errors.New("is too complex")
+	}
+	return nil
+}
+
+// maxRepeat returns the highest count of all repetitions in a pattern, nested repetitions multiply
+func maxRepeat(parsed *syntax.Regexp) int {
+	highest := 0
+	for _, sub := range parsed.Sub {
+		if repeat := maxRepeat(sub); repeat > highest {
+			highest = repeat
+		}
+	}
+	if parsed.Op == syntax.OpRepeat {
+		count := parsed.Max
+		if count < parsed.Min {
+			//{n,} repeats at least n times
+			count = parsed.Min
+		}
+		if highest > 0 {
+			count *= highest
+		}
+		highest = count
+	}
+	return highest
+}
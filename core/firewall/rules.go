@@ -0,0 +1,93 @@
+package firewall
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kor44/gofilter"
+)
+
+// CompileRules compiles the enabled rules of a domain, numbering them from firstIndex, and sorts them by priority.
+// On error the index of the broken rule is returned
+func CompileRules(jsonRules []domains.JsonRule, firstIndex int, shadow bool) ([]domains.Rule, int, error) {
+
+	rules := []domains.Rule{}
+	for index, fwRule := range jsonRules {
+		if fwRule.Enabled != nil && !*fwRule.Enabled {
+			continue
+		}
+
+		if err := checkRuleRegexes(fwRule.Expression); err != nil {
+			return nil, firstIndex + index, err
+		}
+		registerHeaderFields(fwRule.Expression)
+
+		filterMutex.RLock()
+		filter, err := gofilter.NewFilter(fwRule.Expression)
+		filterMutex.RUnlock()
+		if err != nil {
+			return nil, firstIndex + index, err
+		}
+
+		rule, err := parseRuleAction(filter, fwRule.Action)
+		if err != nil {
+			return nil, firstIndex + index, err
+		}
+		rule.Index = firstIndex + index
+		rule.Priority = fwRule.Priority
+		rule.Group = fwRule.Group
+		rule.Shadow = fwRule.Shadow || shadow
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	return rules, 0, nil
+}
+
+// parseRuleAction checks the action of a custom firewall rule and parses the parameter of actions that take one
+func parseRuleAction(filter *gofilter.Filter, action string) (domains.Rule, error) {
+
+	rule := domains.Rule{
+		Filter: filter,
+		Action: action,
+	}
+
+	name, parameter, _ := strings.Cut(action, " ")
+	parameter = strings.TrimSpace(parameter)
+	switch name {
+	case "":
+		return rule, errors.New("missing action")
+	case "redirect":
+		if !strings.HasPrefix(parameter, "https://") && !strings.HasPrefix(parameter, "http://") && (!strings.HasPrefix(parameter, "/") || strings.HasPrefix(parameter, "//")) {
+			return rule, errors.New("redirect needs an absolute url or a path, e.g. redirect https://example.com/blocked")
+		}
+		rule.Redirect = parameter
+	case "difficulty":
+		difficulty, err := strconv.Atoi(parameter)
+		if err != nil || difficulty < 1 || difficulty > MaxDifficulty {
+			return rule, errors.New("difficulty needs a number between 1 and " + strconv.Itoa(MaxDifficulty) + ", e.g. difficulty 7")
+		}
+		rule.Difficulty = difficulty
+	case "ratelimit":
+		limit, key, _ := strings.Cut(parameter, " ")
+		requests, window, _ := strings.Cut(limit, "/")
+		var errRequests, errWindow error
+		rule.RatelimitRequests, errRequests = strconv.Atoi(requests)
+		rule.RatelimitWindow, errWindow = strconv.Atoi(window)
+		if errRequests != nil || errWindow != nil || rule.RatelimitRequests < 1 || rule.RatelimitWindow < 1 {
+			return rule, errors.New("ratelimit needs requests per seconds, e.g. ratelimit 10/60 or ratelimit 10/60 ip+path")
+		}
+		switch strings.TrimSpace(key) {
+		case "", "ip":
+		case "ip+path":
+			rule.RatelimitPath = true
+		default:
+			return rule, errors.New("ratelimit can only limit by ip or ip+path")
+		}
+	}
+	return rule, nil
+}
@@ -0,0 +1,88 @@
+package firewall
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kor44/gofilter"
+)
+
+var (
+	// domain -> rule and action -> matches
+	ruleStats      = map[string]map[RuleStatKey]*ruleStat{}
+	ruleStatsMutex = &sync.Mutex{}
+)
+
+// RuleStatKey identifies a custom rule by its position in the config. Rules whose action or shadow mode changed are counted separately
+type RuleStatKey struct {
+	Index  int    `json:"index"`
+	Action string `json:"action"`
+	Shadow bool   `json:"shadow"` // the action of the rule wasn't enforced
+}
+
+type ruleStat struct {
+	matches   int
+	lastMatch time.Time
+	sample    string
+}
+
+// RuleStats summarizes the requests a custom rule matched since the proxy started
+type RuleStats struct {
+	RuleStatKey
+	Matches   int       `json:"matches"`
+	LastMatch time.Time `json:"lastMatch"`
+	Sample    string    `json:"sample"` // last request the rule matched
+}
+
+// RecordRuleMatch counts a request that matched a rule of domainName
+func RecordRuleMatch(domainName string, index int, action string, shadow bool, variables gofilter.Message) {
+
+	sample := fmt.Sprint(variables["ip.src"], " ", variables["http.method"], " ", variables["http.host"], variables["http.url"], " ", variables["http.user_agent"])
+
+	ruleStatsMutex.Lock()
+	defer ruleStatsMutex.Unlock()
+
+	stats, ok := ruleStats[domainName]
+	if !ok {
+		stats = map[RuleStatKey]*ruleStat{}
+		ruleStats[domainName] = stats
+	}
+	key := RuleStatKey{Index: index, Action: action, Shadow: shadow}
+	stat, ok := stats[key]
+	if !ok {
+		stat = &ruleStat{}
+		stats[key] = stat
+	}
+	stat.matches++
+	stat.lastMatch = time.Now()
+	stat.sample = sample
+}
+
+// GetRuleStats returns the statistics of every rule of domainName that matched at least once, ordered by their position in the config
+func GetRuleStats(domainName string) []RuleStats {
+
+	ruleStatsMutex.Lock()
+	result := make([]RuleStats, 0, len(ruleStats[domainName]))
+	for key, stat := range ruleStats[domainName] {
+		result = append(result, RuleStats{
+			RuleStatKey: key,
+			Matches:     stat.matches,
+			LastMatch:   stat.lastMatch,
+			Sample:      stat.sample,
+		})
+	}
+	ruleStatsMutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Index != result[j].Index {
+			return result[i].Index < result[j].Index
+		}
+		if result[i].Action != result[j].Action {
+			return result[i].Action < result[j].Action
+		}
+		return !result[i].Shadow && result[j].Shadow
+	})
+	return result
+}
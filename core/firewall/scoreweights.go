@@ -0,0 +1,82 @@
+package firewall
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ScoreGeoViolation = -10
+	ScoreHoneypotHit  = -30
+
+	// Events of the scoring model and the weights they default to
+	ScoreEvents = map[string]*int{
+		"challenge_failure":       &ScoreChallengeFailure,
+		"browser_signal_mismatch": &ScoreBrowserSignalMismatch,
+		"rate_limit_hit":          &ScoreRateLimitHit,
+		"fingerprint_mismatch":    &ScoreFingerprintMismatch,
+		"header_limit":            &ScoreHeaderLimit,
+		"slow_connection":         &ScoreSlowConnection,
+		"cookie_sharing":          &ScoreCookieSharing,
+		"waf_match":               &ScoreWAFMatch,
+		"geo_violation":           &ScoreGeoViolation,
+		"honeypot_hit":            &ScoreHoneypotHit,
+		"successful_access":       &ScoreSuccessfulAccess,
+	}
+
+	scoreWeights      = map[string]int{}
+	scoreWeightsMutex = &sync.RWMutex{}
+)
+
+// ValidateScoreWeights checks whether weights only contains events of the scoring model
+func ValidateScoreWeights(weights map[string]int) error {
+	for event := range weights {
+		if _, ok := ScoreEvents[event]; !ok {
+			events := []string{}
+			for known := range ScoreEvents {
+				events = append(events, known)
+			}
+			sort.Strings(events)
+			return errors.New("unknown reputation event " + event + ", use " + strings.Join(events, ", "))
+		}
+	}
+	return nil
+}
+
+// SetScoreWeights replaces the weights events are scored with, events that aren't part of weights use their default again
+func SetScoreWeights(weights map[string]int) error {
+	if err := ValidateScoreWeights(weights); err != nil {
+		return err
+	}
+
+	loaded := map[string]int{}
+	for event, weight := range weights {
+		loaded[event] = weight
+	}
+
+	scoreWeightsMutex.Lock()
+	scoreWeights = loaded
+	scoreWeightsMutex.Unlock()
+	return nil
+}
+
+// ScoreWeight returns the weight of event. overrides are the weights of a domain and take precedence over the configured ones
+func ScoreWeight(event string, overrides map[string]int) int {
+	if weight, ok := overrides[event]; ok {
+		return weight
+	}
+
+	scoreWeightsMutex.RLock()
+	weight, ok := scoreWeights[event]
+	scoreWeightsMutex.RUnlock()
+	if ok {
+		return weight
+	}
+
+	if weight, ok := ScoreEvents[event]; ok {
+		return *weight
+	}
+	return 0
+}
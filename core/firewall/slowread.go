@@ -0,0 +1,210 @@
+package firewall
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	SlowReadEnabled     = false
+	SlowReadMinRate     = 100 // bytes per second
+	SlowReadGracePeriod = 5 * time.Second
+
+	// IPs that had this many connections killed within SlowConnWindow can't open new ones until the window passed
+	MaxSlowConnsPerIP = 3
+	SlowConnWindow    = 60 * time.Second
+
+	ScoreSlowConnection = -5
+
+	// remoteAddr -> tracked connection
+	slowConns      = map[string]*slowConn{}
+	slowConnsMutex = &sync.Mutex{}
+)
+
+// slowConn counts the bytes a client sent over a connection, so the monitor can tell how fast it is sending
+type slowConn struct {
+	net.Conn
+	bytesRead int64 // accessed atomically
+
+	// Guarded by slowConnsMutex. pending counts the headers/bodies the client still owes us
+	pending       int
+	headerPending bool
+	phaseStart    time.Time
+	phaseBytes    int64
+}
+
+func (c *slowConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesRead, int64(n))
+	return n, err
+}
+
+func (c *slowConn) Close() error {
+	slowConnsMutex.Lock()
+	if slowConns[c.RemoteAddr().String()] == c {
+		delete(slowConns, c.RemoteAddr().String())
+	}
+	slowConnsMutex.Unlock()
+	return c.Conn.Close()
+}
+
+// beginPhase starts measuring, unless the client already owes us something. Caller has to hold slowConnsMutex
+func (c *slowConn) beginPhase() {
+	if c.pending == 0 {
+		c.phaseStart = time.Now()
+		c.phaseBytes = atomic.LoadInt64(&c.bytesRead)
+	}
+	c.pending++
+}
+
+// endPhase stops measuring once the client sent everything it owed. Caller has to hold slowConnsMutex
+func (c *slowConn) endPhase() {
+	if c.pending > 0 {
+		c.pending--
+	}
+}
+
+type slowReadListener struct {
+	net.Listener
+}
+
+func (l *slowReadListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &slowConn{Conn: conn}
+	slowConnsMutex.Lock()
+	slowConns[conn.RemoteAddr().String()] = tracked
+	slowConnsMutex.Unlock()
+
+	return tracked, nil
+}
+
+// TrackSlowReads wraps a listener, so the read progress of its connections can be monitored
+func TrackSlowReads(listener net.Listener) net.Listener {
+	return &slowReadListener{Listener: listener}
+}
+
+// slowReadStateChange follows the connection state, measuring headers from the first byte of a request on
+func slowReadStateChange(remoteAddr string, active bool) {
+	slowConnsMutex.Lock()
+	defer slowConnsMutex.Unlock()
+
+	conn, ok := slowConns[remoteAddr]
+	if !ok {
+		return
+	}
+
+	if active {
+		if !conn.headerPending {
+			conn.headerPending = true
+			conn.beginPhase()
+		}
+		return
+	}
+
+	// Idle connections don't owe us anything, the idle timeout takes care of them
+	conn.pending = 0
+	conn.headerPending = false
+}
+
+// SlowReadHeadersDone marks the headers of a request on this connection as fully received
+func SlowReadHeadersDone(remoteAddr string) {
+	slowConnsMutex.Lock()
+	defer slowConnsMutex.Unlock()
+
+	if conn, ok := slowConns[remoteAddr]; ok && conn.headerPending {
+		conn.headerPending = false
+		conn.endPhase()
+	}
+}
+
+// TrackBodyRead measures the connection while the returned body hasn't been read to its end
+func TrackBodyRead(remoteAddr string, body io.ReadCloser) io.ReadCloser {
+	slowConnsMutex.Lock()
+	defer slowConnsMutex.Unlock()
+
+	conn, ok := slowConns[remoteAddr]
+	if !ok {
+		return body
+	}
+	conn.beginPhase()
+
+	return &trackedBody{
+		ReadCloser: body,
+		done: func() {
+			slowConnsMutex.Lock()
+			conn.endPhase()
+			slowConnsMutex.Unlock()
+		},
+	}
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	done     func()
+	doneOnce sync.Once
+}
+
+func (body *trackedBody) Read(b []byte) (int, error) {
+	n, err := body.ReadCloser.Read(b)
+	if err != nil {
+		body.doneOnce.Do(body.done)
+	}
+	return n, err
+}
+
+func (body *trackedBody) Close() error {
+	body.doneOnce.Do(body.done)
+	return body.ReadCloser.Close()
+}
+
+// StartSlowReadRoutine starts background routine to kill connections that send slower than SlowReadMinRate
+func StartSlowReadRoutine() {
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !SlowReadEnabled {
+				continue
+			}
+
+			now := time.Now()
+			offenders := []*slowConn{}
+
+			slowConnsMutex.Lock()
+			for _, conn := range slowConns {
+				if conn.pending == 0 {
+					continue
+				}
+				elapsed := now.Sub(conn.phaseStart)
+				if elapsed < SlowReadGracePeriod {
+					continue
+				}
+				received := atomic.LoadInt64(&conn.bytesRead) - conn.phaseBytes
+				if float64(received)/elapsed.Seconds() < float64(SlowReadMinRate) {
+					offenders = append(offenders, conn)
+				}
+			}
+			slowConnsMutex.Unlock()
+
+			for _, conn := range offenders {
+				ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+				if err != nil {
+					ip = conn.RemoteAddr().String()
+				}
+				// Close the raw connection, the server notices on its next read and cleans up after itself
+				conn.Conn.Close()
+				ConnectionTracker.RecordSlowConnection(ip)
+				UpdateReputation(ip, ScoreWeight("slow_connection", nil), "slow_connection")
+			}
+		}
+	}()
+}
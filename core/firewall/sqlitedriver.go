@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package firewall
+
+// The sqlite reputation storage needs cgo and github.com/mattn/go-sqlite3. Build with
+// go get github.com/mattn/go-sqlite3 && go build -tags sqlite
+import _ "github.com/mattn/go-sqlite3"
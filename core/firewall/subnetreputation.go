@@ -0,0 +1,117 @@
+package firewall
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	SubnetReputationEnabled = false
+	SubnetIPv4Prefix        = 24
+	SubnetIPv6Prefix        = 48
+
+	// prefix -> aggregated reputation of its ips
+	subnetReputations = map[string]*subnetReputation{}
+	subnetMutex       = &sync.RWMutex{}
+)
+
+// subnetReputation sums up the reputation changes of every ip of a prefix. A botnet rotating through the addresses of a provider
+// starts every fresh ip at the default score, but keeps burning the score of the prefix
+type subnetReputation struct {
+	score       int
+	lastUpdated time.Time
+	lastDecay   time.Time
+}
+
+// SubnetOf returns the prefix reputations of ip are aggregated under, e.g. 1.2.3.0/24
+func SubnetOf(ip string) string {
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	prefix, bits := SubnetIPv6Prefix, 128
+	if v4 := parsed.To4(); v4 != nil {
+		parsed = v4
+		prefix, bits = SubnetIPv4Prefix, 32
+	}
+	return parsed.Mask(net.CIDRMask(prefix, bits)).String() + "/" + strconv.Itoa(prefix)
+}
+
+// applySubnetReputation adds the reputation change of an ip to its prefix
+func applySubnetReputation(ip string, scoreChange int) {
+	if !SubnetReputationEnabled || scoreChange == 0 {
+		return
+	}
+
+	subnet := SubnetOf(ip)
+	now := time.Now()
+
+	subnetMutex.Lock()
+	defer subnetMutex.Unlock()
+
+	data, exists := subnetReputations[subnet]
+	if !exists {
+		data = &subnetReputation{
+			score:     DefaultReputationScore,
+			lastDecay: now,
+		}
+		subnetReputations[subnet] = data
+	}
+	data.score += scoreChange
+	if data.score > MaxReputationScore {
+		data.score = MaxReputationScore
+	}
+	if data.score < MinReputationScore {
+		data.score = MinReputationScore
+	}
+	data.lastUpdated = now
+}
+
+// GetSubnetReputationScore returns the aggregated reputation score of the prefix of ip
+func GetSubnetReputationScore(ip string) int {
+	if !ReputationEnabled || !SubnetReputationEnabled {
+		return DefaultReputationScore
+	}
+
+	subnetMutex.RLock()
+	defer subnetMutex.RUnlock()
+
+	data, exists := subnetReputations[SubnetOf(ip)]
+	if !exists {
+		return DefaultReputationScore
+	}
+	return data.score
+}
+
+// StartSubnetReputationRoutine lets prefixes recover towards the default score like ips do and forgets the ones that did
+func StartSubnetReputationRoutine() {
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			interval := time.Duration(ReputationDecayInterval) * time.Second
+			now := time.Now()
+
+			subnetMutex.Lock()
+			for subnet, data := range subnetReputations {
+				if now.Sub(data.lastDecay) < interval {
+					continue
+				}
+				if data.score < DefaultReputationScore {
+					data.score++
+				} else if data.score > DefaultReputationScore {
+					data.score--
+				}
+				data.lastDecay = now
+				if data.score == DefaultReputationScore && now.Sub(data.lastUpdated) > interval {
+					delete(subnetReputations, subnet)
+				}
+			}
+			subnetMutex.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,507 @@
+package firewall
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	maxTapHeaderBlock = 64 * 1024 // header blocks above this aren't fingerprinted
+	maxTapQueue       = 64        // header orders kept per connection until their request is handled
+	http2Preface      = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+)
+
+var (
+	// remoteAddr -> tapped connection
+	tapConns      = map[string]*TapConn{}
+	tapConnsMutex = &sync.Mutex{}
+)
+
+// TapConn passively parses the decrypted stream of a client, recording the headers of every request in the order they were sent.
+// net/http and x/net/http2 put headers into a map, which loses exactly that information
+type TapConn struct {
+	*tls.Conn
+
+	http2 bool
+
+	// HTTP/1
+	state     int
+	buf       []byte
+	remaining int64
+
+	// HTTP/2
+	preface      int
+	frameSkip    int
+	decoder      *hpack.Decoder
+	headerStream uint32
+	decoding     tappedRequest
+
+	// HTTP/2 fingerprint, collected until the first request is decoded
+	settings     []string
+	windowUpdate uint32
+	priorities   []string
+	pseudoOrder  []string
+	settled      bool
+
+	mutex       *sync.Mutex
+	orders      map[string][][]string // "METHOD target" -> header orders of requests that weren't handled yet
+	queued      int
+	fingerprint string
+}
+
+type tappedRequest struct {
+	method  string
+	target  string
+	headers []string
+}
+
+const (
+	tapHeaders = iota
+	tapBody
+	tapChunkSize
+	tapChunkData
+	tapTrailers
+	tapLost
+)
+
+// Tap starts recording the requests a client sends over conn. http2 has to be set if the connection negotiated HTTP/2
+func Tap(conn *tls.Conn, http2 bool) *TapConn {
+
+	tapped := &TapConn{
+		Conn:   conn,
+		http2:  http2,
+		mutex:  &sync.Mutex{},
+		orders: map[string][][]string{},
+	}
+	if http2 {
+		tapped.decoder = hpack.NewDecoder(4096, tapped.onHeaderField)
+		tapped.decoder.SetMaxStringLength(maxTapHeaderBlock)
+	}
+
+	tapConnsMutex.Lock()
+	tapConns[conn.RemoteAddr().String()] = tapped
+	tapConnsMutex.Unlock()
+
+	return tapped
+}
+
+func (c *TapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if c.http2 {
+			c.feedHTTP2(b[:n])
+		} else {
+			c.feedHTTP1(b[:n])
+		}
+	}
+	return n, err
+}
+
+func (c *TapConn) Close() error {
+	tapConnsMutex.Lock()
+	if tapConns[c.RemoteAddr().String()] == c {
+		delete(tapConns, c.RemoteAddr().String())
+	}
+	tapConnsMutex.Unlock()
+	return c.Conn.Close()
+}
+
+// HTTP2Fingerprint returns the Akamai style fingerprint of an HTTP/2 client
+// (SETTINGS|WINDOW_UPDATE|PRIORITY|pseudo header order), "" if the connection isn't HTTP/2 or didn't send a request yet
+func HTTP2Fingerprint(remoteAddr string) string {
+
+	tapConnsMutex.Lock()
+	conn, ok := tapConns[remoteAddr]
+	tapConnsMutex.Unlock()
+	if !ok {
+		return ""
+	}
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.fingerprint
+}
+
+// HeaderOrder returns the header names of a request in the order the client sent them, nil if they weren't recorded
+func HeaderOrder(remoteAddr string, method string, target string) []string {
+
+	tapConnsMutex.Lock()
+	conn, ok := tapConns[remoteAddr]
+	tapConnsMutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	key := method + " " + target
+	queue := conn.orders[key]
+	if len(queue) == 0 {
+		return nil
+	}
+	order := queue[0]
+	if len(queue) == 1 {
+		delete(conn.orders, key)
+	} else {
+		conn.orders[key] = queue[1:]
+	}
+	conn.queued--
+	return order
+}
+
+// HeaderOrderFingerprint joins the header names of a request in their original order and casing, along with a short hash of it.
+// Flood tools often send perfect header values, but in an order no real browser uses
+func HeaderOrderFingerprint(order []string) (string, string) {
+	if len(order) == 0 {
+		return "", ""
+	}
+	joined := strings.Join(order, ",")
+	return joined, ja4Hash(joined)
+}
+
+func (c *TapConn) record(request tappedRequest) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Requests that never reach the middleware (malformed, rejected by net/http) would pile up otherwise
+	if c.queued >= maxTapQueue {
+		c.orders = map[string][][]string{}
+		c.queued = 0
+	}
+	key := request.method + " " + request.target
+	c.orders[key] = append(c.orders[key], request.headers)
+	c.queued++
+}
+
+// feedHTTP1 follows HTTP/1 requests, skipping their bodies, so pipelined and keep-alive requests are recorded aswell
+func (c *TapConn) feedHTTP1(data []byte) {
+
+	for len(data) > 0 {
+		switch c.state {
+		case tapHeaders:
+			c.buf = append(c.buf, data...)
+			data = nil
+
+			// Clients may send empty lines in front of a request
+			c.buf = bytes.TrimLeft(c.buf, "\r\n")
+
+			end := bytes.Index(c.buf, []byte("\r\n\r\n"))
+			if end == -1 {
+				if len(c.buf) > maxTapHeaderBlock {
+					c.lose()
+				}
+				continue
+			}
+
+			data = c.buf[end+4:]
+			c.parseHTTP1(c.buf[:end])
+			c.buf = nil
+
+		case tapBody, tapChunkData:
+			skip := int64(len(data))
+			if skip > c.remaining {
+				skip = c.remaining
+			}
+			data = data[skip:]
+			c.remaining -= skip
+			if c.remaining == 0 {
+				if c.state == tapBody {
+					c.state = tapHeaders
+				} else {
+					c.state = tapChunkSize
+				}
+			}
+
+		case tapChunkSize:
+			c.buf = append(c.buf, data...)
+			data = nil
+
+			end := bytes.IndexByte(c.buf, '\n')
+			if end == -1 {
+				if len(c.buf) > 1024 {
+					c.lose()
+				}
+				continue
+			}
+
+			line := strings.TrimSpace(strings.SplitN(string(c.buf[:end]), ";", 2)[0])
+			data = c.buf[end+1:]
+			c.buf = nil
+
+			size, err := strconv.ParseInt(line, 16, 64)
+			if err != nil || size < 0 {
+				c.lose()
+				return
+			}
+			if size == 0 {
+				c.state = tapTrailers
+			} else {
+				c.state = tapChunkData
+				c.remaining = size + 2 // chunk is followed by CRLF
+			}
+
+		case tapTrailers:
+			c.buf = append(c.buf, data...)
+			data = nil
+
+			if bytes.HasPrefix(c.buf, []byte("\r\n")) {
+				data = c.buf[2:]
+			} else if end := bytes.Index(c.buf, []byte("\r\n\r\n")); end != -1 {
+				data = c.buf[end+4:]
+			} else {
+				if len(c.buf) > maxTapHeaderBlock {
+					c.lose()
+				}
+				continue
+			}
+			c.buf = nil
+			c.state = tapHeaders
+
+		case tapLost:
+			return
+		}
+	}
+}
+
+func (c *TapConn) parseHTTP1(block []byte) {
+
+	lines := strings.Split(string(block), "\r\n")
+	requestLine := strings.Fields(lines[0])
+	if len(requestLine) != 3 {
+		c.lose()
+		return
+	}
+
+	request := tappedRequest{
+		method:  requestLine[0],
+		target:  requestLine[1],
+		headers: make([]string, 0, len(lines)-1),
+	}
+
+	chunked := false
+	var contentLength int64
+	for _, line := range lines[1:] {
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		name := line[:colon]
+		value := strings.TrimSpace(line[colon+1:])
+		request.headers = append(request.headers, name)
+
+		switch strings.ToLower(name) {
+		case "transfer-encoding":
+			chunked = strings.Contains(strings.ToLower(value), "chunked")
+		case "content-length":
+			contentLength, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	c.record(request)
+
+	switch {
+	case chunked:
+		c.state = tapChunkSize
+	case contentLength > 0:
+		c.state = tapBody
+		c.remaining = contentLength
+	default:
+		c.state = tapHeaders
+	}
+}
+
+// feedHTTP2 follows HTTP/2 frames, decoding header blocks with its own hpack decoder.
+// Every header block has to be decoded to keep the dynamic table in sync with the client
+func (c *TapConn) feedHTTP2(data []byte) {
+
+	if c.preface < len(http2Preface) {
+		skip := len(http2Preface) - c.preface
+		if skip > len(data) {
+			skip = len(data)
+		}
+		c.preface += skip
+		data = data[skip:]
+	}
+
+	for len(data) > 0 && c.state != tapLost {
+
+		if c.frameSkip > 0 {
+			skip := c.frameSkip
+			if skip > len(data) {
+				skip = len(data)
+			}
+			c.frameSkip -= skip
+			data = data[skip:]
+			continue
+		}
+
+		c.buf = append(c.buf, data...)
+		data = nil
+
+		for len(c.buf) >= 9 && c.state != tapLost {
+			length := int(c.buf[0])<<16 | int(c.buf[1])<<8 | int(c.buf[2])
+			frameType := c.buf[3]
+
+			// Don't buffer frames we don't look at
+			if !c.interestingFrame(frameType) {
+				if len(c.buf) >= 9+length {
+					c.buf = c.buf[9+length:]
+					continue
+				}
+				c.frameSkip = 9 + length - len(c.buf)
+				c.buf = nil
+				break
+			}
+
+			if length > maxTapHeaderBlock {
+				c.lose()
+				break
+			}
+			if len(c.buf) < 9+length {
+				break
+			}
+
+			flags := c.buf[4]
+			streamID := binary.BigEndian.Uint32(c.buf[5:9]) & 0x7fffffff
+			c.handleFrame(frameType, flags, streamID, c.buf[9:9+length])
+			c.buf = c.buf[9+length:]
+		}
+
+		// Don't keep the remains of a large read around
+		if len(c.buf) == 0 {
+			c.buf = nil
+		}
+	}
+}
+
+// interestingFrame decides whether the payload of a frame is needed
+func (c *TapConn) interestingFrame(frameType byte) bool {
+	switch frameType {
+	case 0x1, 0x9: // HEADERS, CONTINUATION
+		return true
+	case 0x2, 0x4, 0x8: // PRIORITY, SETTINGS, WINDOW_UPDATE
+		return !c.settled
+	}
+	return false
+}
+
+func (c *TapConn) handleFrame(frameType byte, flags byte, streamID uint32, payload []byte) {
+
+	switch frameType {
+	case 0x1: // HEADERS
+		if flags&0x8 != 0 { // PADDED
+			if len(payload) < 1 || int(payload[0]) >= len(payload) {
+				c.lose()
+				return
+			}
+			payload = payload[1 : len(payload)-int(payload[0])]
+		}
+		if flags&0x20 != 0 { // PRIORITY
+			if len(payload) < 5 {
+				c.lose()
+				return
+			}
+			payload = payload[5:]
+		}
+		c.headerStream = streamID
+		c.decoding = tappedRequest{}
+		c.decodeHeaderBlock(payload, flags&0x4 != 0)
+
+	case 0x9: // CONTINUATION
+		if streamID != c.headerStream {
+			c.lose()
+			return
+		}
+		c.decodeHeaderBlock(payload, flags&0x4 != 0)
+
+	case 0x2: // PRIORITY
+		if len(payload) != 5 {
+			return
+		}
+		dependency := binary.BigEndian.Uint32(payload[:4])
+		exclusive := dependency >> 31
+		c.priorities = append(c.priorities, strconv.Itoa(int(streamID))+":"+strconv.Itoa(int(exclusive))+":"+strconv.Itoa(int(dependency&0x7fffffff))+":"+strconv.Itoa(int(payload[4])+1))
+
+	case 0x4: // SETTINGS
+		if flags&0x1 != 0 || len(c.settings) != 0 { // ACK, only the first SETTINGS frame counts
+			return
+		}
+		for i := 0; i+6 <= len(payload); i += 6 {
+			c.settings = append(c.settings, strconv.Itoa(int(binary.BigEndian.Uint16(payload[i:])))+":"+strconv.Itoa(int(binary.BigEndian.Uint32(payload[i+2:]))))
+		}
+
+	case 0x8: // WINDOW_UPDATE
+		if streamID == 0 && len(payload) == 4 && c.windowUpdate == 0 {
+			c.windowUpdate = binary.BigEndian.Uint32(payload) & 0x7fffffff
+		}
+	}
+}
+
+// settle computes the fingerprint once the first request was decoded. Later frames don't change it
+func (c *TapConn) settle() {
+
+	priorities := "0"
+	if len(c.priorities) != 0 {
+		priorities = strings.Join(c.priorities, ",")
+	}
+
+	fingerprint := strings.Join(c.settings, ";") + "|" + strconv.Itoa(int(c.windowUpdate)) + "|" + priorities + "|" + strings.Join(c.pseudoOrder, ",")
+
+	c.mutex.Lock()
+	c.fingerprint = fingerprint
+	c.mutex.Unlock()
+
+	c.settled = true
+	c.settings, c.priorities, c.pseudoOrder = nil, nil, nil
+}
+
+func (c *TapConn) decodeHeaderBlock(fragment []byte, endHeaders bool) {
+	if _, err := c.decoder.Write(fragment); err != nil {
+		c.lose()
+		return
+	}
+	if !endHeaders {
+		return
+	}
+	if err := c.decoder.Close(); err != nil {
+		c.lose()
+		return
+	}
+
+	// Trailers don't carry pseudo headers and don't belong to a new request
+	if c.decoding.method != "" {
+		c.record(c.decoding)
+		if !c.settled {
+			c.settle()
+		}
+	}
+	c.decoding = tappedRequest{}
+}
+
+func (c *TapConn) onHeaderField(field hpack.HeaderField) {
+	if !c.settled && strings.HasPrefix(field.Name, ":") && len(field.Name) > 1 {
+		c.pseudoOrder = append(c.pseudoOrder, field.Name[1:2])
+	}
+	switch field.Name {
+	case ":method":
+		c.decoding.method = field.Value
+	case ":path":
+		c.decoding.target = field.Value
+	default:
+		if !strings.HasPrefix(field.Name, ":") {
+			c.decoding.headers = append(c.decoding.headers, field.Name)
+		}
+	}
+}
+
+// lose stops parsing, since the position in the stream can't be trusted anymore
+func (c *TapConn) lose() {
+	c.state = tapLost
+	c.buf = nil
+}
@@ -0,0 +1,84 @@
+package firewall
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Rules with the action "tarpit" result in this susLv
+	SusLvTarpit = 99
+)
+
+var (
+	// Default settings (will be overridden by config)
+	TarpitMaxConnections  = 1000
+	TarpitInterval        = 10 * time.Second
+	TarpitDuration        = 5 * time.Minute
+	TarpitRepeatOffenders = false
+
+	tarpitConnections int64 // accessed atomically
+)
+
+// Tarpit keeps the connection of a client open, dripping a never ending response as slowly as possible.
+// Returns false without writing anything if the tarpit budget is used up, in which case the request should just be blocked
+func Tarpit(writer http.ResponseWriter, request *http.Request) bool {
+
+	if atomic.AddInt64(&tarpitConnections, 1) > int64(TarpitMaxConnections) {
+		atomic.AddInt64(&tarpitConnections, -1)
+		return false
+	}
+	defer atomic.AddInt64(&tarpitConnections, -1)
+
+	// HTTP/1 connections can be taken over, which frees them from the write timeout of the server
+	if hijacker, ok := writer.(http.Hijacker); ok {
+		conn, bufrw, err := hijacker.Hijack()
+		if err == nil {
+			defer conn.Close()
+			conn.SetDeadline(time.Time{})
+
+			// Keep sending headers, so the client never gets to the body
+			if _, err := bufrw.WriteString("HTTP/1.1 200 OK\r\n"); err != nil || bufrw.Flush() != nil {
+				return true
+			}
+			deadline := time.Now().Add(TarpitDuration)
+			for time.Now().Before(deadline) {
+				time.Sleep(TarpitInterval)
+				conn.SetWriteDeadline(time.Now().Add(TarpitInterval))
+				if _, err := bufrw.WriteString("X-" + strconv.Itoa(rand.Intn(1<<30)) + ": " + strconv.Itoa(rand.Intn(1<<30)) + "\r\n"); err != nil || bufrw.Flush() != nil {
+					return true
+				}
+			}
+			return true
+		}
+	}
+
+	// HTTP/2 can't be hijacked. Drip the body until the client or the write timeout gives up
+	flusher, canFlush := writer.(http.Flusher)
+	writer.Header().Set("Content-Type", "text/html")
+	writer.WriteHeader(http.StatusOK)
+
+	timer := time.NewTimer(TarpitDuration)
+	defer timer.Stop()
+	ticker := time.NewTicker(TarpitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return true
+		case <-timer.C:
+			return true
+		case <-ticker.C:
+			if _, err := writer.Write([]byte{' '}); err != nil {
+				return true
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+	}
+}
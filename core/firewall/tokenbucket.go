@@ -0,0 +1,66 @@
+package firewall
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// domain and ip -> bucket of the ip
+	tokenBuckets      = map[string]*tokenBucket{}
+	tokenBucketsMutex = &sync.Mutex{}
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // last time tokens were refilled
+	full   time.Duration
+}
+
+// TakeToken takes a token from the bucket of ip, which holds up to burst tokens and is refilled with rate tokens per second.
+// Returns false if the bucket is empty
+func TakeToken(domainName string, ip string, rate float64, burst int) bool {
+
+	now := time.Now()
+	key := domainName + " " + ip
+
+	tokenBucketsMutex.Lock()
+	defer tokenBucketsMutex.Unlock()
+
+	bucket, ok := tokenBuckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		tokenBuckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	if bucket.tokens > float64(burst) {
+		bucket.tokens = float64(burst)
+	}
+	bucket.last = now
+	bucket.full = time.Duration(float64(burst) / rate * float64(time.Second))
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// StartTokenBucketCleanupRoutine forgets buckets that refilled completely, since a new bucket starts out full aswell
+func StartTokenBucketCleanupRoutine() {
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+
+			now := time.Now()
+			tokenBucketsMutex.Lock()
+			for key, bucket := range tokenBuckets {
+				if now.Sub(bucket.last) >= bucket.full {
+					delete(tokenBuckets, key)
+				}
+			}
+			tokenBucketsMutex.Unlock()
+		}
+	}()
+}
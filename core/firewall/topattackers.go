@@ -0,0 +1,145 @@
+package firewall
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const attackBuckets = 10
+
+var (
+	AttackBucketLength = 30 // seconds, the top lists count the abuse of the last attackBuckets buckets
+
+	// domain -> abuse counted per ip, country and asn
+	attackCounters      = map[string]*attackCounter{}
+	attackCountersMutex = &sync.Mutex{}
+)
+
+// attackCounter is a ring of buckets, every bucket counts the abuse of one AttackBucketLength
+type attackCounter struct {
+	buckets [attackBuckets]attackBucket
+}
+
+type attackBucket struct {
+	start     int64
+	ips       map[string]int
+	countries map[string]int
+	asns      map[int]int
+}
+
+// AttackSources are where the abuse of a domain came from recently, most abuse first
+type AttackSources struct {
+	IPs       []SourceCount `json:"ips"`
+	Countries []SourceCount `json:"countries"`
+	ASNs      []ASNCount    `json:"asns"`
+}
+
+type SourceCount struct {
+	Source string `json:"source"`
+	Count  int    `json:"count"`
+}
+
+type ASNCount struct {
+	ASN   int `json:"asn"`
+	Count int `json:"count"`
+}
+
+// RecordAttack counts abuse (a block, ratelimit, failed challenge, ...) of ip on a domain. Its country and asn are only
+// counted if they were looked up already, so recording never waits for a lookup
+func RecordAttack(domainName string, ip string) {
+
+	country, asn := "", 0
+	if GeoFilteringEnabled {
+		if geoData := cachedGeoData(ip); geoData != nil {
+			country, asn = geoData.CountryCode, geoData.ASN
+		}
+	}
+
+	start := time.Now().Unix() / int64(AttackBucketLength) * int64(AttackBucketLength)
+
+	attackCountersMutex.Lock()
+	defer attackCountersMutex.Unlock()
+
+	counter, ok := attackCounters[domainName]
+	if !ok {
+		counter = &attackCounter{}
+		attackCounters[domainName] = counter
+	}
+	bucket := &counter.buckets[start/int64(AttackBucketLength)%attackBuckets]
+	if bucket.start != start {
+		*bucket = attackBucket{start: start, ips: map[string]int{}, countries: map[string]int{}, asns: map[int]int{}}
+	}
+
+	bucket.ips[ip]++
+	if country != "" {
+		bucket.countries[country]++
+	}
+	if asn != 0 {
+		bucket.asns[asn]++
+	}
+
+	recordSessionAbuse(domainName, ip, country, asn)
+}
+
+// TopAttackers returns the n ips, countries and asns that caused the most abuse on a domain recently
+func TopAttackers(domainName string, n int) AttackSources {
+
+	ips, countries, asns := map[string]int{}, map[string]int{}, map[int]int{}
+	oldest := time.Now().Unix() - int64(AttackBucketLength*attackBuckets)
+
+	attackCountersMutex.Lock()
+	if counter, ok := attackCounters[domainName]; ok {
+		for _, bucket := range counter.buckets {
+			if bucket.start <= oldest {
+				continue
+			}
+			for ip, count := range bucket.ips {
+				ips[ip] += count
+			}
+			for country, count := range bucket.countries {
+				countries[country] += count
+			}
+			for asn, count := range bucket.asns {
+				asns[asn] += count
+			}
+		}
+	}
+	attackCountersMutex.Unlock()
+
+	return AttackSources{IPs: topSources(ips, n), Countries: topSources(countries, n), ASNs: topASNs(asns, n)}
+}
+
+func topSources(counts map[string]int, n int) []SourceCount {
+	sources := make([]SourceCount, 0, len(counts))
+	for source, count := range counts {
+		sources = append(sources, SourceCount{Source: source, Count: count})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Count != sources[j].Count {
+			return sources[i].Count > sources[j].Count
+		}
+		return sources[i].Source < sources[j].Source
+	})
+	if len(sources) > n {
+		sources = sources[:n]
+	}
+	return sources
+}
+
+func topASNs(counts map[int]int, n int) []ASNCount {
+	asns := make([]ASNCount, 0, len(counts))
+	for asn, count := range counts {
+		asns = append(asns, ASNCount{ASN: asn, Count: count})
+	}
+	sort.Slice(asns, func(i, j int) bool {
+		if asns[i].Count != asns[j].Count {
+			return asns[i].Count > asns[j].Count
+		}
+		return asns[i].ASN < asns[j].ASN
+	})
+	if len(asns) > n {
+		asns = asns[:n]
+	}
+	return asns
+}
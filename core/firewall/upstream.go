@@ -0,0 +1,148 @@
+package firewall
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamBuckets    = 6
+	maxUpstreamSamples = 1000 // latencies kept per bucket to calculate the percentiles from
+)
+
+var (
+	UpstreamBucketLength = 10 // seconds, backend statistics cover the last upstreamBuckets buckets
+
+	// domain -> backend -> how the backend answered
+	upstreamCounters      = map[string]map[string]*upstreamCounter{}
+	upstreamCountersMutex = &sync.Mutex{}
+)
+
+// upstreamCounter is a ring of buckets, every bucket counts the responses of a backend during one UpstreamBucketLength
+type upstreamCounter struct {
+	buckets [upstreamBuckets]upstreamBucket
+}
+
+type upstreamBucket struct {
+	start     int64
+	requests  int
+	errors    int
+	statuses  [6]int // responses per status class, statuses[2] counts the 2xx ones
+	latencies []time.Duration
+}
+
+// UpstreamStats summarize how a backend of a domain answered recently
+type UpstreamStats struct {
+	Domain   string
+	Backend  string
+	Requests int
+	Errors   int    // requests the backend couldn't be reached for or didn't answer in time
+	Statuses [6]int // responses per status class, Statuses[5] counts the 5xx ones
+	Average  time.Duration
+	P95      time.Duration
+}
+
+// ErrorRatio is the share of requests the backend failed, by not answering them or answering with a 5xx
+func (stats UpstreamStats) ErrorRatio() float64 {
+	if stats.Requests == 0 {
+		return 0
+	}
+	return float64(stats.Errors+stats.Statuses[5]) / float64(stats.Requests)
+}
+
+// RecordUpstream records a request to backend that was answered with status after duration, or failed without a response
+func RecordUpstream(domainName string, backend string, status int, duration time.Duration, failed bool) {
+
+	observeUpstream(domainName, backend, status, duration, failed)
+
+	start := time.Now().Unix() / int64(UpstreamBucketLength) * int64(UpstreamBucketLength)
+
+	upstreamCountersMutex.Lock()
+	defer upstreamCountersMutex.Unlock()
+
+	backends, ok := upstreamCounters[domainName]
+	if !ok {
+		backends = map[string]*upstreamCounter{}
+		upstreamCounters[domainName] = backends
+	}
+	counter, ok := backends[backend]
+	if !ok {
+		counter = &upstreamCounter{}
+		backends[backend] = counter
+	}
+	bucket := &counter.buckets[start/int64(UpstreamBucketLength)%upstreamBuckets]
+	if bucket.start != start {
+		*bucket = upstreamBucket{start: start, latencies: bucket.latencies[:0]}
+	}
+
+	bucket.requests++
+	if failed {
+		bucket.errors++
+		return
+	}
+	if class := status / 100; class > 0 && class < len(bucket.statuses) {
+		bucket.statuses[class]++
+	}
+	if len(bucket.latencies) < maxUpstreamSamples {
+		bucket.latencies = append(bucket.latencies, duration)
+	}
+}
+
+// GetUpstreamStats returns how the backends of domainName, or of every domain if it's empty, answered recently
+func GetUpstreamStats(domainName string) []UpstreamStats {
+
+	oldest := time.Now().Unix() - int64(UpstreamBucketLength*upstreamBuckets)
+	result := []UpstreamStats{}
+
+	upstreamCountersMutex.Lock()
+	for name, backends := range upstreamCounters {
+		if domainName != "" && name != domainName {
+			continue
+		}
+		for backend, counter := range backends {
+			stats := UpstreamStats{Domain: name, Backend: backend}
+			latencies := []time.Duration{}
+			for _, bucket := range counter.buckets {
+				if bucket.start <= oldest {
+					continue
+				}
+				stats.Requests += bucket.requests
+				stats.Errors += bucket.errors
+				for class, count := range bucket.statuses {
+					stats.Statuses[class] += count
+				}
+				latencies = append(latencies, bucket.latencies...)
+			}
+			if stats.Requests == 0 {
+				continue
+			}
+			stats.Average, stats.P95 = latencySummary(latencies)
+			result = append(result, stats)
+		}
+	}
+	upstreamCountersMutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Domain != result[j].Domain {
+			return result[i].Domain < result[j].Domain
+		}
+		return result[i].Backend < result[j].Backend
+	})
+	return result
+}
+
+// latencySummary returns the average and the 95th percentile of latencies
+func latencySummary(latencies []time.Duration) (time.Duration, time.Duration) {
+	if len(latencies) == 0 {
+		return 0, 0
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	total := time.Duration(0)
+	for _, latency := range latencies {
+		total += latency
+	}
+	return total / time.Duration(len(latencies)), latencies[len(latencies)*95/100]
+}
@@ -0,0 +1,174 @@
+package firewall
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Parts of a request a signature is checked against
+const (
+	wafPath = 1 << iota
+	wafQuery
+	wafBody
+	wafHeaders
+
+	wafAll = wafPath | wafQuery | wafBody | wafHeaders
+)
+
+var (
+	ScoreWAFMatch = -15
+
+	// Classes of attacks the built-in signatures detect
+	WAFClasses = []string{"sqli", "xss", "traversal", "cmdi"}
+
+	// Curated to catch common exploitation tools and payloads while rarely matching legitimate traffic
+	wafSignatures = []WAFSignature{
+		{ID: "sqli-union", Class: "sqli", targets: wafQuery | wafBody | wafHeaders, pattern: regexp.MustCompile(`(?i)\bunion\b[\s(/*]{1,20}(?:all\b[\s(/*]{1,20})?select\b`)},
+		{ID: "sqli-tautology", Class: "sqli", targets: wafQuery | wafBody | wafHeaders, pattern: regexp.MustCompile(`(?i)['"\x60)]\s*(?:or|and|\|\||&&)\s*['"\x60(]?\s*(\w+)\s*['"\x60]?\s*(?:=|<>|!=|like)\s*['"\x60]?\s*\w+`)},
+		{ID: "sqli-comment", Class: "sqli", targets: wafQuery | wafBody | wafHeaders, pattern: regexp.MustCompile(`(?i)['"\x60)]\s*(?:--[\s-]|/\*|;\s*--)`)},
+		{ID: "sqli-stacked", Class: "sqli", targets: wafQuery | wafBody | wafHeaders, pattern: regexp.MustCompile(`(?i);\s*(?:drop|truncate|delete\s+from|insert\s+into|update\s+\w+\s+set|shutdown|exec(?:ute)?\s)\b`)},
+		{ID: "sqli-functions", Class: "sqli", targets: wafQuery | wafBody | wafHeaders, pattern: regexp.MustCompile(`(?i)\b(?:sleep|benchmark|pg_sleep|load_file|extractvalue|updatexml)\s*\(|\bwaitfor\s+delay\b|\binto\s+(?:out|dump)file\b|\binformation_schema\b`)},
+
+		{ID: "xss-script", Class: "xss", targets: wafAll, pattern: regexp.MustCompile(`(?i)<\s*/?\s*script\b`)},
+		{ID: "xss-handler", Class: "xss", targets: wafAll, pattern: regexp.MustCompile(`(?i)<[^>]*\s(?:on(?:error|load|click|dblclick|mouse\w+|key\w+|focus|blur|submit|toggle|animation\w+|pointer\w+|begin))\s*=`)},
+		{ID: "xss-protocol", Class: "xss", targets: wafAll, pattern: regexp.MustCompile(`(?i)(?:javascript|vbscript)\s*:|data\s*:\s*text/html`)},
+		{ID: "xss-tags", Class: "xss", targets: wafAll, pattern: regexp.MustCompile(`(?i)<\s*(?:iframe|object|embed|svg|math|base|meta|form)\b`)},
+
+		{ID: "traversal-dotdot", Class: "traversal", targets: wafPath, pattern: regexp.MustCompile(`(?:^|[/\\])\.\.(?:[/\\]|$)`)},
+		{ID: "traversal-dotdot-param", Class: "traversal", targets: wafQuery | wafBody, pattern: regexp.MustCompile(`(?:^|=)\.\.[/\\]|(?:^|[/\\])\.\.[/\\]\.\.(?:[/\\]|$)`)},
+		{ID: "traversal-files", Class: "traversal", targets: wafPath | wafQuery | wafBody, pattern: regexp.MustCompile(`(?i)/etc/(?:passwd|shadow|group|hosts)\b|/proc/self/|\b(?:boot|win)\.ini\b|\bweb-inf/web\.xml\b|\.(?:git|svn)/(?:config|head|entries)\b`)},
+		{ID: "traversal-null", Class: "traversal", targets: wafPath | wafQuery, pattern: regexp.MustCompile(`\x00`)},
+
+		{ID: "cmdi-jndi", Class: "cmdi", targets: wafAll, pattern: regexp.MustCompile(`(?i)\$\{\s*(?:jndi|env|sys|lower|upper|::-)`)},
+		{ID: "cmdi-shell", Class: "cmdi", targets: wafQuery | wafBody, pattern: regexp.MustCompile(`(?i)(?:[;|\x60]|&&|\$\()\s*(?:cat|wget|curl|bash|sh|nc|ncat|python\d?|perl|php|id|whoami|uname|chmod)\b`)},
+	}
+)
+
+// WAFSignature detects one kind of injection
+type WAFSignature struct {
+	ID    string
+	Class string
+
+	targets int
+	pattern *regexp.Regexp
+}
+
+// WAFRequest holds the parts of a request that are checked for injections
+type WAFRequest struct {
+	Path    string
+	Query   string   // raw query, as it's decoded here
+	Body    []string // inspected values of the body, see InspectBody
+	Headers []string // values of headers that commonly carry payloads, like the user agent
+}
+
+// CheckWAF returns the first signature of the enabled classes (all if empty) that matches the request, skipping the excluded signature ids
+func CheckWAF(request WAFRequest, classes []string, exclude []string) (WAFSignature, bool) {
+
+	// Both forms are checked, payloads are often url encoded twice, hoping only one layer is decoded before they're
+	// checked. Escapes are decoded one by one, a single invalid one like %zz can't keep the rest encoded
+	queries := wafForms(request.Query, true)
+	paths := wafForms(request.Path, false)
+
+	for _, signature := range wafSignatures {
+		if !wafEnabled(signature, classes, exclude) {
+			continue
+		}
+		if signature.targets&wafPath != 0 && wafMatchesAny(signature, paths) {
+			return signature, true
+		}
+		if signature.targets&wafQuery != 0 && wafMatchesAny(signature, queries) {
+			return signature, true
+		}
+		if signature.targets&wafBody != 0 && wafMatchesAny(signature, request.Body) {
+			return signature, true
+		}
+		if signature.targets&wafHeaders != 0 && wafMatchesAny(signature, request.Headers) {
+			return signature, true
+		}
+	}
+	return WAFSignature{}, false
+}
+
+// ValidWAFClass checks whether class is detected by the built-in signatures
+func ValidWAFClass(class string) bool {
+	for _, known := range WAFClasses {
+		if class == known {
+			return true
+		}
+	}
+	return false
+}
+
+func wafEnabled(signature WAFSignature, classes []string, exclude []string) bool {
+	for _, id := range exclude {
+		if strings.EqualFold(id, signature.ID) {
+			return false
+		}
+	}
+	if len(classes) == 0 {
+		return true
+	}
+	for _, class := range classes {
+		if class == signature.Class {
+			return true
+		}
+	}
+	return false
+}
+
+// wafForms returns value as it was sent and url decoded, if decoding changes it. plus decodes + to a space, like
+// query strings do
+func wafForms(value string, plus bool) []string {
+	if value == "" {
+		return nil
+	}
+	if decoded := lenientUnescape(value, plus); decoded != value {
+		return []string{value, decoded}
+	}
+	return []string{value}
+}
+
+// lenientUnescape decodes every valid escape of value and keeps invalid ones as they are, unlike url.QueryUnescape
+// which fails on the first one
+func lenientUnescape(value string, plus bool) string {
+	if !strings.ContainsAny(value, "%+") {
+		return value
+	}
+
+	decoded := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '%' && i+2 < len(value) && isHex(value[i+1]) && isHex(value[i+2]):
+			decoded = append(decoded, unhex(value[i+1])<<4|unhex(value[i+2]))
+			i += 2
+		case value[i] == '+' && plus:
+			decoded = append(decoded, ' ')
+		default:
+			decoded = append(decoded, value[i])
+		}
+	}
+	return string(decoded)
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+func wafMatchesAny(signature WAFSignature, values []string) bool {
+	for _, value := range values {
+		if signature.pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
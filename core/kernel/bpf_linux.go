@@ -0,0 +1,278 @@
+//go:build linux && (amd64 || arm64)
+
+package kernel
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfMapElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCount   uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func createMap(mapType uint32, keySize uint32, valueSize uint32, maxEntries uint32, flags uint32) (int, error) {
+	attr := bpfMapCreateAttr{
+		mapType:    mapType,
+		keySize:    keySize,
+		valueSize:  valueSize,
+		maxEntries: maxEntries,
+		mapFlags:   flags,
+	}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func updateElement(fd int, key []byte, value []byte) error {
+	attr := bpfMapElemAttr{
+		mapFD: uint32(fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+	}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+func deleteElement(fd int, key []byte) error {
+	attr := bpfMapElemAttr{
+		mapFD: uint32(fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+	}
+	_, err := bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	if err == unix.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// loadProgram loads an xdp program. If the verifier rejects it, its log is returned as the error
+func loadProgram(program []byte) (int, error) {
+	license := []byte("GPL\x00")
+	log := make([]byte, 64*1024)
+	attr := bpfProgLoadAttr{
+		progType:  unix.BPF_PROG_TYPE_XDP,
+		insnCount: uint32(len(program) / 8),
+		insns:     uint64(uintptr(unsafe.Pointer(&program[0]))),
+		license:   uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:  1,
+		logSize:   uint32(len(log)),
+		logBuf:    uint64(uintptr(unsafe.Pointer(&log[0]))),
+	}
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(program)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(log)
+	if err != nil {
+		if verifier := strings.TrimRight(string(log), "\x00\n"); verifier != "" {
+			return -1, errors.New(err.Error() + ": " + verifier)
+		}
+		return -1, err
+	}
+	return fd, nil
+}
+
+// attachProgram attaches the program fd to an interface, or detaches the program of the interface if fd is -1
+func attachProgram(iface string, fd int, flags uint32) error {
+
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	socket, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(socket)
+	if err := unix.Bind(socket, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	xdp := append(netlinkAttribute(unix.IFLA_XDP_FD, uint32(int32(fd))), netlinkAttribute(unix.IFLA_XDP_FLAGS, flags)...)
+	attributes := netlinkNested(unix.IFLA_XDP|unix.NLA_F_NESTED, xdp)
+
+	info := make([]byte, unix.SizeofIfInfomsg)
+	info[0] = unix.AF_UNSPEC
+	binary.LittleEndian.PutUint32(info[4:], uint32(link.Index))
+
+	body := append(info, attributes...)
+	message := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.LittleEndian.PutUint32(message[0:], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.LittleEndian.PutUint16(message[4:], unix.RTM_SETLINK)
+	binary.LittleEndian.PutUint16(message[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.LittleEndian.PutUint32(message[8:], 1)
+	message = append(message, body...)
+
+	if err := unix.Sendto(socket, message, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(socket, reply, 0)
+	if err != nil {
+		return err
+	}
+	if n < unix.SizeofNlMsghdr+4 || binary.LittleEndian.Uint16(reply[4:]) != unix.NLMSG_ERROR {
+		return errors.New("unexpected netlink reply")
+	}
+	if code := int32(binary.LittleEndian.Uint32(reply[unix.SizeofNlMsghdr:])); code != 0 {
+		return unix.Errno(-code)
+	}
+	return nil
+}
+
+func netlinkAttribute(kind uint16, value uint32) []byte {
+	attribute := make([]byte, 8)
+	binary.LittleEndian.PutUint16(attribute[0:], 8)
+	binary.LittleEndian.PutUint16(attribute[2:], kind)
+	binary.LittleEndian.PutUint32(attribute[4:], value)
+	return attribute
+}
+
+func netlinkNested(kind uint16, attributes []byte) []byte {
+	nested := make([]byte, 4, 4+len(attributes))
+	binary.LittleEndian.PutUint16(nested[0:], uint16(4+len(attributes)))
+	binary.LittleEndian.PutUint16(nested[2:], kind)
+	return append(nested, attributes...)
+}
+
+// bpfFilter is the loaded xdp program along with its maps
+type bpfFilter struct {
+	maps       xdpMaps
+	program    int
+	interfaces []string
+	flags      uint32
+}
+
+func loadFilter(interfaces []string, mode string, synRate int, maxPrefixes int) (filter, error) {
+
+	flags := uint32(0)
+	switch mode {
+	case "", "native":
+		flags = unix.XDP_FLAGS_DRV_MODE
+	case "generic":
+		flags = unix.XDP_FLAGS_SKB_MODE
+	default:
+		return nil, errors.New("unknown xdp mode " + mode + ", use native or generic")
+	}
+
+	f := &bpfFilter{interfaces: []string{}, flags: flags, program: -1, maps: xdpMaps{-1, -1, -1, -1}}
+
+	var err error
+	if f.maps.banned4, err = createMap(unix.BPF_MAP_TYPE_LPM_TRIE, 4+4, 1, uint32(maxPrefixes), unix.BPF_F_NO_PREALLOC); err != nil {
+		f.close()
+		return nil, errors.New("creating the ipv4 ban map failed: " + err.Error())
+	}
+	if f.maps.banned6, err = createMap(unix.BPF_MAP_TYPE_LPM_TRIE, 4+16, 1, uint32(maxPrefixes), unix.BPF_F_NO_PREALLOC); err != nil {
+		f.close()
+		return nil, errors.New("creating the ipv6 ban map failed: " + err.Error())
+	}
+	if f.maps.syns4, err = createMap(unix.BPF_MAP_TYPE_LRU_HASH, 4, 16, uint32(XDPSynTrackedIPs), 0); err != nil {
+		f.close()
+		return nil, errors.New("creating the ipv4 syn map failed: " + err.Error())
+	}
+	if f.maps.syns6, err = createMap(unix.BPF_MAP_TYPE_LRU_HASH, 16, 16, uint32(XDPSynTrackedIPs), 0); err != nil {
+		f.close()
+		return nil, errors.New("creating the ipv6 syn map failed: " + err.Error())
+	}
+
+	if f.program, err = loadProgram(xdpProgram(f.maps, synRate)); err != nil {
+		f.close()
+		return nil, errors.New("loading the xdp program failed: " + err.Error())
+	}
+
+	for _, iface := range interfaces {
+		// Programs of other tools (or one a crashed balooProxy left behind) aren't replaced
+		if err := attachProgram(iface, f.program, flags|unix.XDP_FLAGS_UPDATE_IF_NOEXIST); err != nil {
+			f.close()
+			if err == unix.EBUSY {
+				return nil, errors.New("attaching the xdp program to " + iface + " failed: another xdp program is attached already, detach it with ip link set dev " + iface + " xdp off")
+			}
+			return nil, errors.New("attaching the xdp program to " + iface + " failed: " + err.Error())
+		}
+		f.interfaces = append(f.interfaces, iface)
+	}
+	return f, nil
+}
+
+func (f *bpfFilter) update(prefix *net.IPNet) error {
+	fd, key := f.key(prefix)
+	return updateElement(fd, key, []byte{1})
+}
+
+func (f *bpfFilter) remove(prefix *net.IPNet) error {
+	fd, key := f.key(prefix)
+	return deleteElement(fd, key)
+}
+
+// key returns the lpm trie of prefix along with its key
+func (f *bpfFilter) key(prefix *net.IPNet) (int, []byte) {
+	ones, _ := prefix.Mask.Size()
+	address, fd := prefix.IP.To4(), f.maps.banned4
+	if address == nil || len(prefix.Mask) == net.IPv6len {
+		address, fd = prefix.IP.To16(), f.maps.banned6
+	}
+	key := make([]byte, 4+len(address))
+	binary.LittleEndian.PutUint32(key, uint32(ones))
+	copy(key[4:], address)
+	return fd, key
+}
+
+// close detaches the program and releases it along with its maps
+func (f *bpfFilter) close() error {
+	var err error
+	for _, iface := range f.interfaces {
+		if detachErr := attachProgram(iface, -1, f.flags); detachErr != nil && err == nil {
+			err = detachErr
+		}
+	}
+	f.interfaces = nil
+	for _, fd := range []int{f.program, f.maps.banned4, f.maps.banned6, f.maps.syns4, f.maps.syns6} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+	f.program = -1
+	f.maps = xdpMaps{-1, -1, -1, -1}
+	return err
+}
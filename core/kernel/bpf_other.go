@@ -0,0 +1,9 @@
+//go:build !linux || !(amd64 || arm64)
+
+package kernel
+
+import "errors"
+
+func loadFilter(interfaces []string, mode string, synRate int, maxPrefixes int) (filter, error) {
+	return nil, errors.New("xdp is only supported on linux (amd64 and arm64)")
+}
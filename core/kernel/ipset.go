@@ -0,0 +1,69 @@
+package kernel
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ipset adds bans to the ipsets <set>_v4 and <set>_v6, which iptables rules drop packets of
+type ipset struct {
+	set string
+}
+
+// setup creates both sets if they are missing and drops their ips in the raw table, before connection tracking even sees them
+func (i *ipset) setup() error {
+	if err := ipsetRestore("create " + i.set + "_v4 hash:ip family inet timeout 0\n" +
+		"create " + i.set + "_v6 hash:ip family inet6 timeout 0\n"); err != nil {
+		return err
+	}
+	for tables, set := range map[string]string{"iptables": i.set + "_v4", "ip6tables": i.set + "_v6"} {
+		rule := []string{"PREROUTING", "-t", "raw", "-m", "set", "--match-set", set, "src", "-j", "DROP"}
+		if exec.Command(tables, append([]string{"-C"}, rule...)...).Run() == nil {
+			continue
+		}
+		if err := run(tables, append([]string{"-I"}, rule...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *ipset) ban(bans map[string]time.Time) error {
+
+	v4, v6 := split(bans)
+
+	script := strings.Builder{}
+	for set, ips := range map[string]map[string]time.Time{i.set + "_v4": v4, i.set + "_v6": v6} {
+		for ip, until := range ips {
+			script.WriteString("add " + set + " " + ip + " timeout " + strconv.Itoa(timeout(until)) + "\n")
+		}
+	}
+	return ipsetRestore(script.String())
+}
+
+// ipsetRestore applies commands with ipset restore. -exist refreshes the timeout of ips that are already banned
+func ipsetRestore(commands string) error {
+	command := exec.Command("ipset", "restore", "-exist")
+	command.Stdin = strings.NewReader(commands)
+	return runCommand(command)
+}
+
+func run(name string, args ...string) error {
+	return runCommand(exec.Command(name, args...))
+}
+
+func runCommand(command *exec.Cmd) error {
+	output := &bytes.Buffer{}
+	command.Stderr = output
+	if err := command.Run(); err != nil {
+		if output.Len() != 0 {
+			return errors.New(command.Path + ": " + strings.TrimSpace(output.String()))
+		}
+		return err
+	}
+	return nil
+}
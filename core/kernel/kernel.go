@@ -0,0 +1,156 @@
+package kernel
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultTable = "balooproxy"
+	DefaultSet   = "banned"
+
+	flushInterval = time.Second
+	maxQueued     = 100000
+
+	// Bans waiting to be pushed into the kernel. Pushing them in batches keeps a flood of bans from starting as many processes
+	queued      = map[string]time.Time{}
+	queuedMutex = &sync.Mutex{}
+
+	active       driver
+	current      domains.KernelBanSettings
+	running      chan struct{}
+	registerOnce = &sync.Once{}
+)
+
+// driver enforces bans in the kernel. Every ban carries its own timeout, the kernel removes it once it expires
+type driver interface {
+	setup() error
+	ban(bans map[string]time.Time) error
+}
+
+// Start enforces the bans of the proxy in the kernel using the configured driver, so packets of banned ips are dropped
+// before they reach the proxy. Reloads with unchanged settings keep the current driver
+func Start(settings domains.KernelBanSettings) error {
+
+	queuedMutex.Lock()
+	defer queuedMutex.Unlock()
+
+	if running != nil && settings == current {
+		return nil
+	}
+	if running != nil {
+		close(running)
+		running = nil
+		active = nil
+	}
+	if !settings.Enabled {
+		return nil
+	}
+
+	if settings.Table == "" {
+		settings.Table = DefaultTable
+	}
+	if settings.Set == "" {
+		settings.Set = DefaultSet
+	}
+
+	var enforcer driver
+	switch settings.Driver {
+	case "", "nftables":
+		enforcer = &nftables{table: settings.Table, set: settings.Set}
+	case "ipset":
+		enforcer = &ipset{set: settings.Table + "_" + settings.Set}
+	default:
+		return errors.New("unknown kernel ban driver " + settings.Driver + ", use nftables or ipset")
+	}
+	if settings.Setup {
+		if err := enforcer.setup(); err != nil {
+			return errors.New("setting up " + settings.Driver + " failed: " + err.Error())
+		}
+	}
+
+	registerOnce.Do(func() {
+		firewall.OnBan(queueBan)
+	})
+
+	active = enforcer
+	current = settings
+	running = make(chan struct{})
+	queued = map[string]time.Time{}
+	go flush(enforcer, running)
+	return nil
+}
+
+// queueBan is registered with firewall.OnBan. Bans of other nodes are enforced aswell, they apply to this node too
+func queueBan(ip string, until time.Time, reason string) {
+	if net.ParseIP(ip) == nil {
+		return
+	}
+
+	queuedMutex.Lock()
+	if active != nil && len(queued) < maxQueued {
+		if until.After(queued[ip]) {
+			queued[ip] = until
+		}
+	}
+	queuedMutex.Unlock()
+}
+
+func flush(enforcer driver, stop chan struct{}) {
+
+	defer pnc.PanicHndl()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(flushInterval):
+		}
+
+		queuedMutex.Lock()
+		bans := queued
+		queued = map[string]time.Time{}
+		queuedMutex.Unlock()
+
+		// Bans that end within a second aren't worth a process
+		now := time.Now()
+		for ip, until := range bans {
+			if until.Sub(now) < time.Second {
+				delete(bans, ip)
+			}
+		}
+		if len(bans) == 0 {
+			continue
+		}
+
+		if err := enforcer.ban(bans); err != nil {
+			// The proxy still rejects banned ips by itself, they only reach it again
+			logger.Error("Enforcing bans in the kernel failed", logger.F("bans", len(bans)), logger.Err(err))
+		}
+	}
+}
+
+// split sorts bans by address family, since sets only hold one of them
+func split(bans map[string]time.Time) (v4 map[string]time.Time, v6 map[string]time.Time) {
+	v4, v6 = map[string]time.Time{}, map[string]time.Time{}
+	for ip, until := range bans {
+		parsed := net.ParseIP(ip)
+		if parsed.To4() != nil {
+			v4[parsed.To4().String()] = until
+		} else {
+			v6[parsed.String()] = until
+		}
+	}
+	return v4, v6
+}
+
+// timeout is how many whole seconds are left of a ban
+func timeout(until time.Time) int {
+	return int(time.Until(until) / time.Second)
+}
@@ -0,0 +1,60 @@
+package kernel
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nftables adds bans to the sets <set>_v4 and <set>_v6 of the inet table <table>
+type nftables struct {
+	table string
+	set   string
+}
+
+// setup (re)creates the table, with both sets and a chain that drops their ips before connection tracking even sees them
+func (n *nftables) setup() error {
+	return nft("add table inet " + n.table + "\n" +
+		"delete table inet " + n.table + "\n" +
+		"table inet " + n.table + " {\n" +
+		"\tset " + n.set + "_v4 { type ipv4_addr; flags timeout; }\n" +
+		"\tset " + n.set + "_v6 { type ipv6_addr; flags timeout; }\n" +
+		"\tchain prerouting {\n" +
+		"\t\ttype filter hook prerouting priority -300; policy accept;\n" +
+		"\t\tip saddr @" + n.set + "_v4 drop\n" +
+		"\t\tip6 saddr @" + n.set + "_v6 drop\n" +
+		"\t}\n" +
+		"}\n")
+}
+
+func (n *nftables) ban(bans map[string]time.Time) error {
+
+	v4, v6 := split(bans)
+
+	script := strings.Builder{}
+	for set, ips := range map[string]map[string]time.Time{n.set + "_v4": v4, n.set + "_v6": v6} {
+		if len(ips) == 0 {
+			continue
+		}
+		elements, timeouts := []string{}, []string{}
+		for ip, until := range ips {
+			elements = append(elements, ip)
+			timeouts = append(timeouts, ip+" timeout "+strconv.Itoa(timeout(until))+"s")
+		}
+		// Adding an element that's already in the set doesn't refresh its timeout, so it's added, deleted and added again.
+		// The script is applied atomically, the ip isn't unbanned in between
+		element := "element inet " + n.table + " " + set + " { "
+		script.WriteString("add " + element + strings.Join(elements, ", ") + " }\n")
+		script.WriteString("delete " + element + strings.Join(elements, ", ") + " }\n")
+		script.WriteString("add " + element + strings.Join(timeouts, ", ") + " }\n")
+	}
+	return nft(script.String())
+}
+
+// nft applies a script with nft -f
+func nft(script string) error {
+	command := exec.Command("nft", "-f", "-")
+	command.Stdin = strings.NewReader(script)
+	return runCommand(command)
+}
@@ -0,0 +1,219 @@
+package kernel
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/feeds"
+	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	XDPMaxPrefixes   = 1000000 // banned prefixes per address family
+	XDPSynTrackedIPs = 262144  // ips whose syns are counted at once, the least recently seen are forgotten first
+
+	xdpSyncInterval = time.Second
+
+	// ip -> end of its ban. The lpm tries have no timeouts, so bans are removed again by the proxy
+	xdpBans      = map[string]time.Time{}
+	xdpBanning   = false
+	xdpBansMutex = &sync.Mutex{}
+
+	xdpFilter       filter
+	xdpCurrent      domains.XDPSettings
+	xdpRunning      chan struct{}
+	xdpMutex        = &sync.Mutex{}
+	xdpRegisterOnce = &sync.Once{}
+)
+
+// filter is the loaded xdp program, it drops packets of the prefixes it's given
+type filter interface {
+	update(prefix *net.IPNet) error
+	remove(prefix *net.IPNet) error
+	close() error
+}
+
+// StartXDP attaches an xdp program to the configured interfaces that drops packets of banned ips and of block threat feeds
+// in the driver, before the kernel allocates anything for them. Reloads with unchanged settings keep the current program
+func StartXDP(settings domains.XDPSettings) error {
+
+	xdpMutex.Lock()
+	defer xdpMutex.Unlock()
+
+	if xdpRunning != nil && settingsEqual(settings, xdpCurrent) {
+		return nil
+	}
+	stopXDP()
+	if !settings.Enabled {
+		return nil
+	}
+	if len(settings.Interfaces) == 0 {
+		return errors.New("xdp needs at least one interface")
+	}
+	if settings.SynRate < 0 {
+		return errors.New("xdp synRate can't be negative")
+	}
+
+	loaded, err := loadFilter(settings.Interfaces, settings.Mode, settings.SynRate, XDPMaxPrefixes)
+	if err != nil {
+		return err
+	}
+
+	xdpRegisterOnce.Do(func() {
+		firewall.OnBan(xdpBan)
+	})
+
+	xdpBansMutex.Lock()
+	xdpBanning = true
+	xdpBansMutex.Unlock()
+
+	xdpFilter = loaded
+	xdpCurrent = settings
+	xdpRunning = make(chan struct{})
+	go syncXDP(loaded, xdpRunning)
+	return nil
+}
+
+// StopXDP detaches the xdp program
+func StopXDP() {
+	xdpMutex.Lock()
+	stopXDP()
+	xdpMutex.Unlock()
+}
+
+// stopXDP has to be called with xdpMutex locked
+func stopXDP() {
+	if xdpRunning == nil {
+		return
+	}
+	close(xdpRunning)
+	xdpRunning = nil
+
+	xdpBansMutex.Lock()
+	xdpBanning = false
+	xdpBans = map[string]time.Time{}
+	xdpBansMutex.Unlock()
+
+	if err := xdpFilter.close(); err != nil {
+		logger.Error("Detaching the xdp program failed", logger.Err(err))
+	}
+	xdpFilter = nil
+}
+
+func settingsEqual(a domains.XDPSettings, b domains.XDPSettings) bool {
+	if a.Enabled != b.Enabled || a.Mode != b.Mode || a.SynRate != b.SynRate || len(a.Interfaces) != len(b.Interfaces) {
+		return false
+	}
+	for i := range a.Interfaces {
+		if a.Interfaces[i] != b.Interfaces[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// xdpBan is registered with firewall.OnBan
+func xdpBan(ip string, until time.Time, reason string) {
+	if net.ParseIP(ip) == nil {
+		return
+	}
+	xdpBansMutex.Lock()
+	if xdpBanning && until.After(xdpBans[ip]) {
+		xdpBans[ip] = until
+	}
+	xdpBansMutex.Unlock()
+}
+
+// syncXDP keeps the maps of the program in sync with the bans and the block threat feeds
+func syncXDP(loaded filter, stop chan struct{}) {
+
+	defer pnc.PanicHndl()
+
+	installed := map[string]*net.IPNet{}
+	feedPrefixes := map[string]*net.IPNet{}
+	feedVersion := ""
+
+	for {
+		wanted := map[string]*net.IPNet{}
+
+		// Lists are only collected again once one of them changed
+		lists := listsToDrop()
+		version := ""
+		for _, list := range lists {
+			version += list.Name + strconv.FormatInt(list.Updated.UnixNano(), 10) + ","
+		}
+		if version != feedVersion {
+			feedPrefixes = map[string]*net.IPNet{}
+			for _, list := range lists {
+				for _, prefix := range list.Prefixes {
+					feedPrefixes[prefix.String()] = prefix
+				}
+			}
+			feedVersion = version
+		}
+		for key, prefix := range feedPrefixes {
+			wanted[key] = prefix
+		}
+
+		now := time.Now()
+		xdpBansMutex.Lock()
+		for ip, until := range xdpBans {
+			if now.After(until) {
+				delete(xdpBans, ip)
+				continue
+			}
+			if prefix := feeds.ParsePrefix(ip); prefix != nil {
+				wanted[prefix.String()] = prefix
+			}
+		}
+		xdpBansMutex.Unlock()
+
+		failed := 0
+		for key, prefix := range wanted {
+			if _, ok := installed[key]; ok {
+				continue
+			}
+			if err := loaded.update(prefix); err != nil {
+				failed++
+				continue
+			}
+			installed[key] = prefix
+		}
+		for key, prefix := range installed {
+			if _, ok := wanted[key]; ok {
+				continue
+			}
+			if err := loaded.remove(prefix); err != nil {
+				failed++
+				continue
+			}
+			delete(installed, key)
+		}
+		if failed > 0 {
+			// E.g. more prefixes than XDPMaxPrefixes, the proxy still drops them by itself
+			logger.Warn("Syncing prefixes with the xdp program failed", logger.F("prefixes", failed))
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(xdpSyncInterval):
+		}
+	}
+}
+
+// listsToDrop returns the threat feeds whose ips are blocked
+func listsToDrop() []feeds.List {
+	lists := []feeds.List{}
+	for _, list := range feeds.Lists() {
+		if list.Action == "block" {
+			lists = append(lists, list)
+		}
+	}
+	return lists
+}
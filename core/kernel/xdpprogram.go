@@ -0,0 +1,301 @@
+package kernel
+
+import "encoding/binary"
+
+// A tiny assembler for the XDP program, so it can be built at runtime without a compiler or a copy of the kernel headers.
+// Instructions are encoded little endian, like the architectures XDP is supported on
+
+const (
+	bpfLD    = 0x00
+	bpfLDX   = 0x01
+	bpfST    = 0x02
+	bpfSTX   = 0x03
+	bpfJMP   = 0x05
+	bpfALU64 = 0x07
+
+	bpfW  = 0x00
+	bpfH  = 0x08
+	bpfB  = 0x10
+	bpfDW = 0x18
+
+	bpfIMM = 0x00
+	bpfMEM = 0x60
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	bpfADD = 0x00
+	bpfSUB = 0x10
+	bpfAND = 0x50
+	bpfLSH = 0x60
+	bpfMOV = 0xb0
+
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJNE  = 0x50
+	bpfCALL = 0x80
+	bpfEXIT = 0x90
+
+	pseudoMapFD = 1
+
+	helperMapLookup = 1
+	helperMapUpdate = 2
+	helperKtimeGet  = 5
+
+	xdpDrop = 1
+	xdpPass = 2
+
+	// Registers
+	r0  = 0
+	r1  = 1
+	r2  = 2
+	r3  = 3
+	r4  = 4
+	r6  = 6
+	r7  = 7
+	r8  = 8
+	r10 = 10 // frame pointer
+)
+
+type instruction struct {
+	op    uint8
+	dst   uint8
+	src   uint8
+	off   int16
+	imm   int32
+	label string // jump target, resolved by assemble
+}
+
+type assembler struct {
+	instructions []instruction
+	labels       map[string]int
+}
+
+func (a *assembler) emit(instructions ...instruction) {
+	a.instructions = append(a.instructions, instructions...)
+}
+
+func (a *assembler) label(name string) {
+	a.labels[name] = len(a.instructions)
+}
+
+func aluImm(op uint8, dst uint8, imm int32) instruction {
+	return instruction{op: bpfALU64 | op | bpfK, dst: dst, imm: imm}
+}
+
+func aluReg(op uint8, dst uint8, src uint8) instruction {
+	return instruction{op: bpfALU64 | op | bpfX, dst: dst, src: src}
+}
+
+func load(size uint8, dst uint8, src uint8, off int16) instruction {
+	return instruction{op: bpfLDX | size | bpfMEM, dst: dst, src: src, off: off}
+}
+
+func store(size uint8, dst uint8, off int16, src uint8) instruction {
+	return instruction{op: bpfSTX | size | bpfMEM, dst: dst, src: src, off: off}
+}
+
+func storeImm(size uint8, dst uint8, off int16, imm int32) instruction {
+	return instruction{op: bpfST | size | bpfMEM, dst: dst, off: off, imm: imm}
+}
+
+func jumpImm(op uint8, dst uint8, imm int32, label string) instruction {
+	return instruction{op: bpfJMP | op | bpfK, dst: dst, imm: imm, label: label}
+}
+
+func jumpReg(op uint8, dst uint8, src uint8, label string) instruction {
+	return instruction{op: bpfJMP | op | bpfX, dst: dst, src: src, label: label}
+}
+
+func jump(label string) instruction {
+	return instruction{op: bpfJMP | bpfJA, label: label}
+}
+
+func call(helper int32) instruction {
+	return instruction{op: bpfJMP | bpfCALL, imm: helper}
+}
+
+func exit() instruction {
+	return instruction{op: bpfJMP | bpfEXIT}
+}
+
+// loadMap loads the map with file descriptor fd into dst. It takes up two instructions
+func loadMap(dst uint8, fd int) []instruction {
+	return []instruction{
+		{op: bpfLD | bpfDW | bpfIMM, dst: dst, src: pseudoMapFD, imm: int32(fd)},
+		{},
+	}
+}
+
+// assemble resolves the jump labels and encodes the program
+func (a *assembler) assemble() []byte {
+	program := make([]byte, 0, len(a.instructions)*8)
+	for index, instruction := range a.instructions {
+		if instruction.label != "" {
+			instruction.off = int16(a.labels[instruction.label] - index - 1)
+		}
+		encoded := make([]byte, 8)
+		encoded[0] = instruction.op
+		encoded[1] = instruction.src<<4 | instruction.dst
+		binary.LittleEndian.PutUint16(encoded[2:], uint16(instruction.off))
+		binary.LittleEndian.PutUint32(encoded[4:], uint32(instruction.imm))
+		program = append(program, encoded...)
+	}
+	return program
+}
+
+// xdpMaps are the file descriptors of the maps the program uses
+type xdpMaps struct {
+	banned4 int // lpm trie of banned ipv4 prefixes
+	banned6 int // lpm trie of banned ipv6 prefixes
+	syns4   int // lru hash of the syns of ipv4 addresses in the current second
+	syns6   int // lru hash of the syns of ipv6 addresses in the current second
+}
+
+// xdpProgram drops packets from banned prefixes and, if synRate is above 0, syns of ips that sent more than synRate syns within a second.
+// Packets that aren't ipv4 or ipv6 (including vlan tagged ones) and ipv6 packets with extension headers before tcp are passed
+func xdpProgram(maps xdpMaps, synRate int) []byte {
+
+	a := &assembler{labels: map[string]int{}}
+
+	a.emit(
+		load(bpfW, r6, r1, 0), // data
+		load(bpfW, r7, r1, 4), // data_end
+		aluReg(bpfMOV, r2, r6),
+		aluImm(bpfADD, r2, 14),
+		jumpReg(bpfJGT, r2, r7, "pass"),
+		load(bpfH, r3, r6, 12),
+		jumpImm(bpfJEQ, r3, 0x0008, "ipv4"), // 0x0800 in network byte order
+		jumpImm(bpfJEQ, r3, 0xdd86, "ipv6"), // 0x86dd in network byte order
+		jump("pass"),
+	)
+
+	// Keys of the lpm tries are the prefix length followed by the address, keys of the syn counters only the address
+	a.label("ipv4")
+	a.emit(
+		aluReg(bpfMOV, r2, r6),
+		aluImm(bpfADD, r2, 14+20),
+		jumpReg(bpfJGT, r2, r7, "pass"),
+		storeImm(bpfW, r10, -8, 32),
+	)
+	copyAddress(a, 14+12, -4, 4)
+	lookup(a, maps.banned4, -8)
+	a.emit(jumpImm(bpfJNE, r0, 0, "drop"))
+	if synRate > 0 {
+		a.emit(
+			load(bpfB, r3, r6, 14+9),
+			jumpImm(bpfJNE, r3, 6, "pass"),
+			load(bpfB, r3, r6, 14),
+			aluImm(bpfAND, r3, 0x0f),
+			aluImm(bpfLSH, r3, 2),
+			aluReg(bpfMOV, r2, r6),
+			aluReg(bpfADD, r2, r3),
+			aluImm(bpfADD, r2, 14),
+			aluReg(bpfMOV, r4, r2),
+			aluImm(bpfADD, r4, 14),
+			jumpReg(bpfJGT, r4, r7, "pass"),
+			load(bpfB, r3, r2, 13),
+		)
+		countSyn(a, "ipv4", maps.syns4, -4, synRate)
+	} else {
+		a.emit(jump("pass"))
+	}
+
+	a.label("ipv6")
+	a.emit(
+		aluReg(bpfMOV, r2, r6),
+		aluImm(bpfADD, r2, 14+40),
+		jumpReg(bpfJGT, r2, r7, "pass"),
+		storeImm(bpfW, r10, -20, 128),
+	)
+	copyAddress(a, 14+8, -16, 16)
+	lookup(a, maps.banned6, -20)
+	a.emit(jumpImm(bpfJNE, r0, 0, "drop"))
+	if synRate > 0 {
+		a.emit(
+			aluReg(bpfMOV, r2, r6),
+			aluImm(bpfADD, r2, 14+40+20),
+			jumpReg(bpfJGT, r2, r7, "pass"),
+			load(bpfB, r3, r6, 14+6),
+			jumpImm(bpfJNE, r3, 6, "pass"),
+			load(bpfB, r3, r6, 14+40+13),
+		)
+		countSyn(a, "ipv6", maps.syns6, -16, synRate)
+	} else {
+		a.emit(jump("pass"))
+	}
+
+	a.label("drop")
+	a.emit(aluImm(bpfMOV, r0, xdpDrop), exit())
+	a.label("pass")
+	a.emit(aluImm(bpfMOV, r0, xdpPass), exit())
+
+	return a.assemble()
+}
+
+// copyAddress copies an address of the packet onto the stack, two bytes at a time since it's not aligned
+func copyAddress(a *assembler, packetOffset int16, stackOffset int16, length int16) {
+	for i := int16(0); i < length; i += 2 {
+		a.emit(
+			load(bpfH, r3, r6, packetOffset+i),
+			store(bpfH, r10, stackOffset+i, r3),
+		)
+	}
+}
+
+// lookup looks up the key at stackOffset in the map with file descriptor fd, r0 is null if it's missing
+func lookup(a *assembler, fd int, stackOffset int16) {
+	a.emit(loadMap(r1, fd)...)
+	a.emit(
+		aluReg(bpfMOV, r2, r10),
+		aluImm(bpfADD, r2, int32(stackOffset)),
+		call(helperMapLookup),
+	)
+}
+
+// countSyn counts the syn in r3 (the tcp flags) for the address at keyOffset and drops it if the address went over synRate.
+// Counters are {start of the second in ns, syns}. Every path ends in a jump
+func countSyn(a *assembler, family string, fd int, keyOffset int16, synRate int) {
+	a.emit(
+		aluImm(bpfAND, r3, 0x12), // syn and ack
+		jumpImm(bpfJNE, r3, 0x02, "pass"),
+	)
+	lookup(a, fd, keyOffset)
+	a.emit(
+		jumpImm(bpfJEQ, r0, 0, "new"+family),
+		aluReg(bpfMOV, r8, r0),
+		call(helperKtimeGet),
+		load(bpfDW, r3, r8, 0),
+		aluReg(bpfMOV, r4, r0),
+		aluReg(bpfSUB, r4, r3),
+		jumpImm(bpfJGT, r4, 1000000000, "reset"+family),
+		load(bpfDW, r3, r8, 8),
+		aluImm(bpfADD, r3, 1),
+		store(bpfDW, r8, 8, r3),
+		jumpImm(bpfJGT, r3, int32(synRate), "drop"),
+		jump("pass"),
+	)
+	a.label("reset" + family)
+	a.emit(
+		store(bpfDW, r8, 0, r0),
+		storeImm(bpfDW, r8, 8, 1),
+		jump("pass"),
+	)
+	a.label("new" + family)
+	a.emit(
+		call(helperKtimeGet),
+		store(bpfDW, r10, -40, r0),
+		storeImm(bpfDW, r10, -32, 1),
+	)
+	a.emit(loadMap(r1, fd)...)
+	a.emit(
+		aluReg(bpfMOV, r2, r10),
+		aluImm(bpfADD, r2, int32(keyOffset)),
+		aluReg(bpfMOV, r3, r10),
+		aluImm(bpfADD, r3, -40),
+		aluImm(bpfMOV, r4, 0), // BPF_ANY
+		call(helperMapUpdate),
+		jump("pass"),
+	)
+}
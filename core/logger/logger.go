@@ -0,0 +1,203 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goProxy/core/domains"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is how important a log entry is, entries below the configured level are dropped
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var (
+	levelNames = map[Level]string{DebugLevel: "debug", InfoLevel: "info", WarnLevel: "warn", ErrorLevel: "error"}
+
+	// Default settings (will be overridden by config)
+	DefaultOutput = "proxy.log"
+
+	minLevel   = int32(InfoLevel)
+	jsonFormat = false
+
+	output      io.Writer
+	outputFile  *os.File
+	outputPath  string
+	outputMutex = &sync.Mutex{}
+)
+
+// Field is a key and value logged along with a message
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates a field. Domain, IP, Action, Rule, Fingerprint and Err create the common ones, so they are called the same everywhere
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Domain(name string) Field {
+	return Field{Key: "domain", Value: name}
+}
+
+func IP(ip string) Field {
+	return Field{Key: "ip", Value: ip}
+}
+
+func Action(action string) Field {
+	return Field{Key: "action", Value: action}
+}
+
+// Rule is the position of a firewall rule in the config, starting at 0
+func Rule(index int) Field {
+	return Field{Key: "rule", Value: index}
+}
+
+func Fingerprint(fingerprint string) Field {
+	return Field{Key: "fingerprint", Value: fingerprint}
+}
+
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "error", Value: nil}
+	}
+	return Field{Key: "error", Value: err.Error()}
+}
+
+// Configure applies the logging settings of the config. Output is "stdout", "stderr" or a file entries are appended to
+func Configure(settings domains.LogSettings) error {
+	level := InfoLevel
+	if settings.Level != "" {
+		found := false
+		for candidate, name := range levelNames {
+			if strings.EqualFold(settings.Level, name) {
+				level, found = candidate, true
+			}
+		}
+		if !found {
+			return errors.New("unknown log level " + settings.Level + ", use debug, info, warn or error")
+		}
+	}
+
+	switch settings.Format {
+	case "", "console", "json":
+	default:
+		return errors.New("unknown log format " + settings.Format + ", use console or json")
+	}
+
+	path := settings.Output
+	if path == "" {
+		path = DefaultOutput
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	if path != outputPath || output == nil {
+		writer, file, err := open(path)
+		if err != nil {
+			return err
+		}
+		if outputFile != nil {
+			outputFile.Close()
+		}
+		output, outputFile, outputPath = writer, file, path
+	}
+	jsonFormat = settings.Format == "json"
+	atomic.StoreInt32(&minLevel, int32(level))
+	return nil
+}
+
+func open(path string) (io.Writer, *os.File, error) {
+	switch path {
+	case "stdout":
+		return os.Stdout, nil, nil
+	case "stderr":
+		return os.Stderr, nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file, nil
+}
+
+// Enabled returns whether entries of level are logged, to skip building expensive fields
+func Enabled(level Level) bool {
+	return int32(level) >= atomic.LoadInt32(&minLevel)
+}
+
+func Debug(message string, fields ...Field) {
+	write(DebugLevel, message, fields)
+}
+
+func Info(message string, fields ...Field) {
+	write(InfoLevel, message, fields)
+}
+
+func Warn(message string, fields ...Field) {
+	write(WarnLevel, message, fields)
+}
+
+func Error(message string, fields ...Field) {
+	write(ErrorLevel, message, fields)
+}
+
+func write(level Level, message string, fields []Field) {
+	if !Enabled(level) {
+		return
+	}
+	now := time.Now()
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	if output == nil {
+		// Entries logged before the config was loaded
+		writer, file, err := open(DefaultOutput)
+		if err != nil {
+			return
+		}
+		output, outputFile, outputPath = writer, file, DefaultOutput
+	}
+
+	if jsonFormat {
+		entry := make(map[string]interface{}, len(fields)+3)
+		for _, field := range fields {
+			entry[field.Key] = field.Value
+		}
+		entry["time"] = now.Format(time.RFC3339Nano)
+		entry["level"] = levelNames[level]
+		entry["msg"] = message
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		output.Write(append(line, '\n'))
+		return
+	}
+
+	line := &strings.Builder{}
+	line.WriteString("[ " + now.Format("2006-01-02 15:04:05") + " ] " + strings.ToUpper(levelNames[level]) + " " + message)
+	for _, field := range fields {
+		line.WriteString(" " + field.Key + "=")
+		value := fmt.Sprint(field.Value)
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		line.WriteString(value)
+	}
+	line.WriteByte('\n')
+	io.WriteString(output, line.String())
+}
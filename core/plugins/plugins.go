@@ -0,0 +1,352 @@
+package plugins
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Decision is what a plugin returns from baloo_filter
+type Decision int32
+
+const (
+	Continue  Decision = iota // no decision, the next plugin and the rest of the firewall decide
+	Allow                     // skips challenges, the request can still be ratelimited or blocked
+	Challenge                 // at least the js challenge
+	Block
+)
+
+var (
+	// Default settings (will be overridden by config)
+	Timeout   = 10 * time.Millisecond
+	MaxMemory = 16 // megabytes
+	Instances = runtime.NumCPU()
+
+	ErrorLogInterval = 1 * time.Minute // failures of a plugin are logged at most this often
+
+	loaded       = []*Plugin{}
+	loadedCount  int32
+	loadedMutex  = &sync.RWMutex{}
+	loadedEngine wazero.Runtime
+)
+
+// Request is what plugins get to see of a request, as json
+type Request struct {
+	Domain           string              `json:"domain"`
+	IP               string              `json:"ip"`
+	Method           string              `json:"method"`
+	URL              string              `json:"url"`
+	Path             string              `json:"path"`
+	Query            string              `json:"query"`
+	Proto            string              `json:"proto"`
+	UserAgent        string              `json:"userAgent"`
+	Headers          map[string][]string `json:"headers"`
+	Country          string              `json:"country"`
+	ASN              int                 `json:"asn"`
+	Reputation       int                 `json:"reputation"`
+	TLSFingerprint   string              `json:"tlsFingerprint"`
+	JA3              string              `json:"ja3"`
+	JA4              string              `json:"ja4"`
+	JA4H             string              `json:"ja4h"`
+	HTTP2Fingerprint string              `json:"http2Fingerprint"`
+	Browser          string              `json:"browser"`
+	Bot              string              `json:"bot"`
+	Stage            int                 `json:"stage"`
+	SusLv            int                 `json:"susLv"`
+	Attack           bool                `json:"attack"`
+}
+
+// Plugin is a compiled wasm filter along with the instances requests are passed to
+type Plugin struct {
+	Name      string
+	Calls     uint64
+	Failures  uint64
+	compiled  wazero.CompiledModule
+	engine    wazero.Runtime
+	instances chan api.Module // nil entries are instantiated when they are taken
+
+	lastError      time.Time
+	lastErrorMutex sync.Mutex
+}
+
+// callState collects what a plugin passes to the host functions during one call
+type callState struct {
+	plugin string
+	reason string
+}
+
+type callStateKey struct{}
+
+// Configure loads every .wasm file of the plugin directory, in the order of their names. The plugins loaded
+// before are unloaded, requests they are still deciding about continue without a decision
+func Configure(settings domains.PluginSettings) error {
+	if settings.Timeout > 0 {
+		Timeout = time.Duration(settings.Timeout) * time.Millisecond
+	}
+	if settings.MaxMemory > 0 {
+		MaxMemory = settings.MaxMemory
+	}
+	if settings.Instances > 0 {
+		Instances = settings.Instances
+	}
+
+	var engine wazero.Runtime
+	plugins := []*Plugin{}
+	if settings.Directory != "" {
+		files, err := filepath.Glob(filepath.Join(settings.Directory, "*.wasm"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(files)
+
+		if len(files) != 0 {
+			engine, err = newEngine()
+			if err != nil {
+				return err
+			}
+		}
+		for _, file := range files {
+			plugin, err := load(engine, file)
+			if err != nil {
+				engine.Close(context.Background())
+				return errors.New("failed to load plugin " + filepath.Base(file) + ": " + err.Error())
+			}
+			plugins = append(plugins, plugin)
+		}
+	}
+
+	loadedMutex.Lock()
+	previous := loadedEngine
+	loaded = plugins
+	loadedEngine = engine
+	atomic.StoreInt32(&loadedCount, int32(len(plugins)))
+	loadedMutex.Unlock()
+
+	if previous != nil {
+		previous.Close(context.Background())
+	}
+	return nil
+}
+
+// newEngine creates the runtime plugins are run in. Plugins get wasi without any files, environment or network,
+// and the host functions of the "baloo" module
+func newEngine() (wazero.Runtime, error) {
+	ctx := context.Background()
+	engine := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(uint32(MaxMemory*16)))
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, engine); err != nil {
+		engine.Close(ctx)
+		return nil, err
+	}
+
+	_, err := engine.NewHostModuleBuilder("baloo").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, module api.Module, ptr uint32, size uint32) {
+		if state, ok := ctx.Value(callStateKey{}).(*callState); ok {
+			if reason, ok := module.Memory().Read(ptr, size); ok {
+				state.reason = string(reason)
+			}
+		}
+	}).Export("set_reason").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, module api.Module, ptr uint32, size uint32) {
+		state, _ := ctx.Value(callStateKey{}).(*callState)
+		if message, ok := module.Memory().Read(ptr, size); ok && state != nil {
+			logger.Info(string(message), logger.F("plugin", state.plugin))
+		}
+	}).Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		engine.Close(ctx)
+		return nil, err
+	}
+	return engine, nil
+}
+
+func load(engine wazero.Runtime, file string) (*Plugin, error) {
+	wasm, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := engine.CompileModule(context.Background(), wasm)
+	if err != nil {
+		return nil, err
+	}
+
+	exports := compiled.ExportedFunctions()
+	for _, name := range []string{"baloo_alloc", "baloo_filter"} {
+		if _, ok := exports[name]; !ok {
+			return nil, errors.New("it doesn't export " + name)
+		}
+	}
+	if len(compiled.ExportedMemories()) == 0 {
+		return nil, errors.New("it doesn't export its memory")
+	}
+
+	plugin := &Plugin{
+		Name:      strings.TrimSuffix(filepath.Base(file), ".wasm"),
+		compiled:  compiled,
+		engine:    engine,
+		instances: make(chan api.Module, Instances),
+	}
+
+	// Instantiating once makes plugins that fail to start fail to load
+	module, err := plugin.instantiate()
+	if err != nil {
+		return nil, err
+	}
+	plugin.instances <- module
+	for i := 1; i < Instances; i++ {
+		plugin.instances <- nil
+	}
+	return plugin, nil
+}
+
+func (plugin *Plugin) instantiate() (api.Module, error) {
+	return plugin.engine.InstantiateModule(context.Background(), plugin.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader))
+}
+
+// Loaded returns whether there are plugins requests have to be passed to
+func Loaded() bool {
+	return atomic.LoadInt32(&loadedCount) != 0
+}
+
+// PluginStatus is how often a plugin was asked and failed since it was loaded
+type PluginStatus struct {
+	Name     string `json:"name"`
+	Calls    uint64 `json:"calls"`
+	Failures uint64 `json:"failures"`
+}
+
+// Status returns the plugins that are loaded, in the order they are asked in
+func Status() []PluginStatus {
+	loadedMutex.RLock()
+	defer loadedMutex.RUnlock()
+	status := []PluginStatus{}
+	for _, plugin := range loaded {
+		status = append(status, PluginStatus{Name: plugin.Name, Calls: atomic.LoadUint64(&plugin.Calls), Failures: atomic.LoadUint64(&plugin.Failures)})
+	}
+	return status
+}
+
+// Filter passes request to the plugins in order, until one of them decides about it. Plugins that fail or take longer
+// than Timeout don't decide, so a broken plugin lets requests through instead of taking the domain down
+func Filter(request Request) (decision Decision, reason string, plugin string) {
+	loadedMutex.RLock()
+	plugins := loaded
+	loadedMutex.RUnlock()
+	if len(plugins) == 0 {
+		return Continue, "", ""
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return Continue, "", ""
+	}
+	for _, plugin := range plugins {
+		decision, reason, err := plugin.filter(payload)
+		if err != nil {
+			plugin.failed(err)
+			continue
+		}
+		if decision != Continue {
+			return decision, reason, plugin.Name
+		}
+	}
+	return Continue, "", ""
+}
+
+func (plugin *Plugin) filter(payload []byte) (Decision, string, error) {
+	atomic.AddUint64(&plugin.Calls, 1)
+
+	state := &callState{plugin: plugin.Name}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), callStateKey{}, state), Timeout)
+	defer cancel()
+
+	var module api.Module
+	select {
+	case module = <-plugin.instances:
+	case <-ctx.Done():
+		return Continue, "", errors.New("no free instance within " + Timeout.String())
+	}
+
+	var err error
+	if module == nil {
+		module, err = plugin.instantiate()
+		if err != nil {
+			plugin.instances <- nil
+			return Continue, "", err
+		}
+	}
+
+	decision, err := call(ctx, module, payload)
+	if err != nil {
+		// The instance may be closed or corrupted, a new one is created the next time it's needed
+		module.Close(context.Background())
+		plugin.instances <- nil
+		return Continue, "", err
+	}
+	plugin.instances <- module
+	return decision, state.reason, nil
+}
+
+func call(ctx context.Context, module api.Module, payload []byte) (Decision, error) {
+	results, err := module.ExportedFunction("baloo_alloc").Call(ctx, uint64(len(payload)))
+	if err != nil {
+		return Continue, err
+	}
+	ptr := uint32(results[0])
+	if !module.Memory().Write(ptr, payload) {
+		return Continue, errors.New("baloo_alloc returned memory out of range")
+	}
+
+	results, err = module.ExportedFunction("baloo_filter").Call(ctx, uint64(ptr), uint64(len(payload)))
+	if err != nil {
+		return Continue, err
+	}
+	if free := module.ExportedFunction("baloo_free"); free != nil {
+		if _, err := free.Call(ctx, uint64(ptr), uint64(len(payload))); err != nil {
+			return Continue, err
+		}
+	}
+
+	decision := Decision(int32(results[0]))
+	if decision < Continue || decision > Block {
+		return Continue, errors.New("unknown decision " + strconv.Itoa(int(decision)))
+	}
+	return decision, nil
+}
+
+// failed counts a failure of the plugin and logs it, unless it already failed shortly before
+func (plugin *Plugin) failed(err error) {
+	failures := atomic.AddUint64(&plugin.Failures, 1)
+
+	plugin.lastErrorMutex.Lock()
+	defer plugin.lastErrorMutex.Unlock()
+	if time.Since(plugin.lastError) < ErrorLogInterval {
+		return
+	}
+	plugin.lastError = time.Now()
+	logger.Error("Plugin failed", logger.F("plugin", plugin.Name), logger.F("failures", failures), logger.Err(err))
+}
@@ -3,6 +3,7 @@ package pnc
 import (
 	"bytes"
 	"fmt"
+	"goProxy/core/logger"
 	"log"
 	"os"
 	"runtime"
@@ -31,7 +32,7 @@ func PanicHndl() {
 	}
 }
 
+// LogError logs msg as an error without any fields. Panics stay in crash.log, everything else goes through the logger
 func LogError(msg string) {
-	errMsg := fmt.Sprintf("[ "+time.Now().Format("15:05:04")+" ]: Error: %s\n", msg)
-	logFile.WriteString(errMsg)
+	logger.Error(msg)
 }
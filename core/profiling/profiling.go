@@ -0,0 +1,165 @@
+package profiling
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"goProxy/core/proxy"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	runtimepprof "runtime/pprof"
+	"sync"
+	"time"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	DefaultAddress = "127.0.0.1:6060"
+
+	running     *http.Server
+	runningWith domains.ProfilingSettings
+	serverLock  = &sync.Mutex{}
+)
+
+// Configure starts the debug listener with the profiling settings of the config, or stops it if they're disabled.
+// The listener is bound before Configure returns, so an address that is taken fails the config
+func Configure(settings domains.ProfilingSettings) error {
+
+	serverLock.Lock()
+	defer serverLock.Unlock()
+
+	if settings.Enabled && settings.Address == "" {
+		settings.Address = DefaultAddress
+	}
+	if running != nil && runningWith == settings {
+		return nil
+	}
+
+	if running != nil {
+		// Profiles that are still being taken are cut off, they're not worth keeping the old address bound for
+		running.Close()
+		running = nil
+	}
+	if !settings.Enabled {
+		return nil
+	}
+	if proxy.APISecret == "" {
+		return errors.New("profiling needs an apiSecret, requests to it are authorized with the secret")
+	}
+
+	listener, err := net.Listen("tcp", settings.Address)
+	if err != nil {
+		return err
+	}
+	if host, _, _ := net.SplitHostPort(settings.Address); !isLoopback(host) {
+		logger.Warn("Profiling endpoint is reachable from other hosts, bind it to 127.0.0.1 unless that's on purpose", logger.F("address", settings.Address))
+	}
+
+	// Profiles take up to 30 seconds by default, WriteTimeout would cut them off
+	server := &http.Server{Handler: authorize(newMux()), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		defer pnc.PanicHndl()
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Profiling endpoint stopped", logger.F("address", settings.Address), logger.Err(err))
+		}
+	}()
+
+	running, runningWith = server, settings
+	return nil
+}
+
+// newMux registers the handlers of net/http/pprof on their own mux, the default mux they register on by themselves
+// is never served
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", goroutines)
+	mux.HandleFunc("/debug/gc", gcStats)
+	return mux
+}
+
+// authorize only lets requests with the secret of the api through, the same proxy-secret header the api checks.
+// An empty secret lets nothing through
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if proxy.APISecret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Proxy-Secret")), []byte(proxy.APISecret)) != 1 {
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// goroutines dumps the stack of every goroutine, like a panic does
+func goroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+type gcResponse struct {
+	Goroutines    int       `json:"goroutines"`
+	MaxProcs      int       `json:"maxProcs"`
+	HeapAlloc     uint64    `json:"heapAlloc"` // bytes
+	HeapInuse     uint64    `json:"heapInuse"`
+	HeapObjects   uint64    `json:"heapObjects"`
+	Sys           uint64    `json:"sys"`
+	NextGC        uint64    `json:"nextGC"`
+	TotalAlloc    uint64    `json:"totalAlloc"`
+	NumGC         int64     `json:"numGC"`
+	LastGC        time.Time `json:"lastGC"`
+	PauseTotal    string    `json:"pauseTotal"`
+	RecentPauses  []string  `json:"recentPauses"` // most recent first
+	GCCPUFraction float64   `json:"gcCPUFraction"`
+}
+
+// gcStats returns the memory and garbage collector statistics of the runtime as json
+func gcStats(w http.ResponseWriter, r *http.Request) {
+
+	memStats := runtime.MemStats{}
+	runtime.ReadMemStats(&memStats)
+	stats := debug.GCStats{}
+	debug.ReadGCStats(&stats)
+
+	response := gcResponse{
+		Goroutines:    runtime.NumGoroutine(),
+		MaxProcs:      runtime.GOMAXPROCS(0),
+		HeapAlloc:     memStats.HeapAlloc,
+		HeapInuse:     memStats.HeapInuse,
+		HeapObjects:   memStats.HeapObjects,
+		Sys:           memStats.Sys,
+		NextGC:        memStats.NextGC,
+		TotalAlloc:    memStats.TotalAlloc,
+		NumGC:         stats.NumGC,
+		LastGC:        stats.LastGC,
+		PauseTotal:    stats.PauseTotal.String(),
+		RecentPauses:  []string{},
+		GCCPUFraction: memStats.GCCPUFraction,
+	}
+	for i, pause := range stats.Pause {
+		if i == 16 {
+			break
+		}
+		response.RecentPauses = append(response.RecentPauses, pause.String())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
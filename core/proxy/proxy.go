@@ -49,6 +49,8 @@ var (
 	FailChallengeRatelimit int
 	FailRequestRatelimit   int
 
+	MaxBodySize int64 // bytes, 0 means no limit
+
 	CurrHour               int
 	CurrHourStr            string
 	LastSecondTime         time.Time
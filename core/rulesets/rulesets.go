@@ -0,0 +1,183 @@
+package rulesets
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxRules a single ruleset may contain. The rules of the n-th subscription (counting from 1) are numbered from n*MaxRules
+	MaxRules = 1000
+
+	maxRulesetSize = 4 * 1024 * 1024
+)
+
+var (
+	DefaultInterval = 300 // seconds
+	MinInterval     = 30  // seconds
+
+	rulesetClient = &http.Client{Timeout: 30 * time.Second}
+
+	// ruleset routines per domain, so a config reload can stop the old ones
+	running      = map[string]chan struct{}{}
+	runningMutex = &sync.Mutex{}
+)
+
+// CompileFunc compiles the rules of a ruleset the same way local rules are compiled, numbering them from firstIndex
+type CompileFunc func(rules []domains.JsonRule, firstIndex int) ([]domains.Rule, error)
+
+// SignedRuleset is what a ruleset url serves. Signature is the ed25519 signature of the decoded payload
+type SignedRuleset struct {
+	Payload   string `json:"payload"`   // base64 encoded Ruleset
+	Signature string `json:"signature"` // base64
+}
+
+type Ruleset struct {
+	Name    string             `json:"name"`
+	URL     string             `json:"url"`     // url the ruleset is served at, it's rejected everywhere else
+	Version int                `json:"version"` // has to increase with every update, older versions are rejected
+	Rules   []domains.JsonRule `json:"rules"`
+}
+
+// FirstIndex returns the index the rules of a subscription are numbered from
+func FirstIndex(subscription int) int {
+	return (subscription + 1) * MaxRules
+}
+
+// Start begins fetching the remote rulesets of a domain, replacing any routines previously started for it.
+// Does nothing (apart from stopping the old routines) if the domain isn't subscribed to any ruleset
+func Start(domainName string, subscriptions []domains.RemoteRuleset, remote *domains.RemoteRules, compile CompileFunc) {
+
+	Stop(domainName)
+
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	runningMutex.Lock()
+	running[domainName] = stop
+	runningMutex.Unlock()
+
+	for index, subscription := range subscriptions {
+		go run(domainName, index, subscription, remote, compile, stop)
+	}
+}
+
+// Stop ends fetching the remote rulesets of a domain
+func Stop(domainName string) {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+
+	if stop, ok := running[domainName]; ok {
+		close(stop)
+		delete(running, domainName)
+	}
+}
+
+func run(domainName string, index int, subscription domains.RemoteRuleset, remote *domains.RemoteRules, compile CompileFunc, stop chan struct{}) {
+
+	defer pnc.PanicHndl()
+
+	interval := DefaultInterval
+	if subscription.Interval > 0 {
+		interval = subscription.Interval
+	}
+	if interval < MinInterval {
+		interval = MinInterval
+	}
+
+	// The version that was accepted last survives restarts, so an older ruleset can't be brought back by serving it again
+	accepted := acceptedVersion(subscription.URL)
+	active := -1
+	for {
+		ruleset, err := Fetch(subscription.URL, subscription.PublicKey)
+		if err == nil && ruleset.Version < accepted {
+			err = errors.New("version " + strconv.Itoa(ruleset.Version) + " is older than the accepted version " + strconv.Itoa(accepted))
+		}
+		if err == nil && ruleset.Version > active {
+			var rules []domains.Rule
+			rules, err = compile(ruleset.Rules, FirstIndex(index))
+			if err == nil {
+				remote.Set(index, rules)
+				active = ruleset.Version
+				if active > accepted {
+					accepted = active
+					if err := saveVersion(subscription.URL, accepted); err != nil {
+						logger.Error("Failed to save the version of a remote ruleset", logger.Domain(domainName), logger.F("url", subscription.URL), logger.Err(err))
+					}
+				}
+			}
+		}
+		if err != nil {
+			// Keep the last good rules, a broken or unreachable ruleset shouldn't take away mitigations that are already active
+			logger.Error("Remote ruleset failed", logger.Domain(domainName), logger.F("url", subscription.URL), logger.Err(err))
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+		}
+	}
+}
+
+// Fetch downloads a ruleset and verifies it was signed with publicKey (base64)
+func Fetch(url string, publicKey string) (Ruleset, error) {
+
+	ruleset := Ruleset{}
+
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return ruleset, errors.New("publicKey has to be a base64 encoded ed25519 public key")
+	}
+
+	resp, err := rulesetClient.Get(url)
+	if err != nil {
+		return ruleset, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ruleset, errors.New("unexpected status " + resp.Status)
+	}
+
+	signed := SignedRuleset{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRulesetSize)).Decode(&signed); err != nil {
+		return ruleset, err
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return ruleset, errors.New("invalid payload: " + err.Error())
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), payload, signature) {
+		return ruleset, errors.New("invalid signature")
+	}
+
+	if err := json.Unmarshal(payload, &ruleset); err != nil {
+		return ruleset, errors.New("invalid payload: " + err.Error())
+	}
+	// Signed rulesets of other subscriptions of the same publisher can't be served in place of this one
+	if ruleset.URL == "" {
+		return ruleset, errors.New("ruleset doesn't name the url it's served at")
+	}
+	if ruleset.URL != url {
+		return ruleset, errors.New("ruleset was signed for " + ruleset.URL + ", not for this url")
+	}
+	if len(ruleset.Rules) > MaxRules {
+		return ruleset, errors.New("more than " + strconv.Itoa(MaxRules) + " rules")
+	}
+	return ruleset, nil
+}
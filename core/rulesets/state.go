@@ -0,0 +1,58 @@
+package rulesets
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var (
+	// url -> version of the ruleset that was accepted last, so restarts don't accept older versions again
+	StatePath = "rulesets.json"
+
+	versions      map[string]int // loaded from StatePath on first use
+	versionsMutex = &sync.Mutex{}
+)
+
+// acceptedVersion returns the version of the ruleset of url that was accepted last, -1 if none was
+func acceptedVersion(url string) int {
+	versionsMutex.Lock()
+	defer versionsMutex.Unlock()
+
+	loadVersions()
+	if version, ok := versions[url]; ok {
+		return version
+	}
+	return -1
+}
+
+// saveVersion remembers that version of the ruleset of url was accepted. The file is replaced at once, a crash while
+// writing it can't lose the versions of the other subscriptions
+func saveVersion(url string, version int) error {
+	versionsMutex.Lock()
+	defer versionsMutex.Unlock()
+
+	loadVersions()
+	versions[url] = version
+
+	jsonVersions, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(StatePath+".tmp", jsonVersions, 0644); err != nil {
+		return err
+	}
+	return os.Rename(StatePath+".tmp", StatePath)
+}
+
+// loadVersions reads StatePath once. Has to be called with versionsMutex locked
+func loadVersions() {
+	if versions != nil {
+		return
+	}
+	versions = map[string]int{}
+	if content, err := ioutil.ReadFile(StatePath); err == nil {
+		json.Unmarshal(content, &versions)
+	}
+}
@@ -0,0 +1,352 @@
+package scripts
+
+import (
+	"context"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/plugins"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Hooks scripts can define
+const (
+	OnRequest         = "on_request"
+	OnChallengeResult = "on_challenge_result"
+	OnBlock           = "on_block"
+)
+
+var (
+	DefaultTimeout   = 10 * time.Millisecond
+	Instances        = runtime.NumCPU()
+	ErrorLogInterval = 1 * time.Minute // failures of a script are logged at most this often
+
+	// Actions hooks can return and their challenge level, -1 blocks. Returning nothing doesn't decide
+	Actions = map[string]int{
+		"allow":     0,
+		"cookie":    1,
+		"js":        2,
+		"challenge": 2,
+		"captcha":   3,
+		"block":     -1,
+	}
+
+	// domain -> its script
+	scripts      = map[string]*Script{}
+	scriptsMutex = &sync.RWMutex{}
+)
+
+// Script is the compiled lua script of a domain along with the states its hooks run in
+type Script struct {
+	File    string
+	Timeout time.Duration
+	proto   *lua.FunctionProto
+	hooks   map[string]bool
+	states  chan *state // nil entries are created when they are taken
+
+	lastError      time.Time
+	lastErrorMutex sync.Mutex
+}
+
+// state is a lua state along with the request its hook is currently called for
+type state struct {
+	lua     *lua.LState
+	request *http.Request
+	writer  http.ResponseWriter
+}
+
+// Load compiles the script of a domain, replacing the one it had. Domains without a script file have no script
+func Load(domainName string, settings domains.ScriptSettings) error {
+	if settings.File == "" {
+		scriptsMutex.Lock()
+		delete(scripts, domainName)
+		scriptsMutex.Unlock()
+		return nil
+	}
+
+	source, err := os.Open(settings.File)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	chunk, err := parse.Parse(source, settings.File)
+	if err != nil {
+		return err
+	}
+	proto, err := lua.Compile(chunk, settings.File)
+	if err != nil {
+		return err
+	}
+
+	script := &Script{
+		File:    settings.File,
+		Timeout: DefaultTimeout,
+		proto:   proto,
+		hooks:   map[string]bool{},
+		states:  make(chan *state, Instances),
+	}
+	if settings.Timeout > 0 {
+		script.Timeout = time.Duration(settings.Timeout) * time.Millisecond
+	}
+
+	// Running the script once makes scripts that fail to start fail to load, and tells which hooks they define
+	first, err := script.newState()
+	if err != nil {
+		return err
+	}
+	for _, hook := range []string{OnRequest, OnChallengeResult, OnBlock} {
+		if first.lua.GetGlobal(hook).Type() == lua.LTFunction {
+			script.hooks[hook] = true
+		}
+	}
+	script.states <- first
+	for i := 1; i < Instances; i++ {
+		script.states <- nil
+	}
+
+	scriptsMutex.Lock()
+	scripts[domainName] = script
+	scriptsMutex.Unlock()
+	return nil
+}
+
+// newState creates a lua state with the script loaded. Scripts only get the base, table, string and math libraries
+// and the functions of the "baloo" table, they can't read files or run commands
+func (script *Script) newState() (*state, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	for _, unsafe := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(unsafe, lua.LNil)
+	}
+
+	current := &state{lua: L}
+	L.SetGlobal("baloo", L.SetFuncs(L.NewTable(), current.functions(script.File)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), script.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(script.proto))
+	err := L.PCall(0, lua.MultRet, nil)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		return nil, err
+	}
+	L.SetTop(0)
+	return current, nil
+}
+
+// functions returns the functions of the "baloo" table. Headers are set on the request that is passed to the backend
+func (current *state) functions(file string) map[string]lua.LGFunction {
+	return map[string]lua.LGFunction{
+		"log": func(L *lua.LState) int {
+			logger.Info(L.CheckString(1), logger.F("script", file))
+			return 0
+		},
+		"set_header": func(L *lua.LState) int {
+			if current.request != nil {
+				current.request.Header.Set(L.CheckString(1), L.CheckString(2))
+			}
+			return 0
+		},
+		"remove_header": func(L *lua.LState) int {
+			if current.request != nil {
+				current.request.Header.Del(L.CheckString(1))
+			}
+			return 0
+		},
+		"set_response_header": func(L *lua.LState) int {
+			if current.writer != nil {
+				current.writer.Header().Set(L.CheckString(1), L.CheckString(2))
+			}
+			return 0
+		},
+		"country": func(L *lua.LState) int {
+			L.Push(lua.LString(firewall.GetIPCountry(L.CheckString(1))))
+			return 1
+		},
+		"asn": func(L *lua.LState) int {
+			L.Push(lua.LNumber(firewall.GetIPASN(L.CheckString(1))))
+			return 1
+		},
+		"reputation": func(L *lua.LState) int {
+			L.Push(lua.LNumber(firewall.GetReputationScore(L.CheckString(1))))
+			return 1
+		},
+	}
+}
+
+// Hooked returns whether the script of a domain defines hook
+func Hooked(domainName string, hook string) bool {
+	scriptsMutex.RLock()
+	script, ok := scripts[domainName]
+	scriptsMutex.RUnlock()
+	return ok && script.hooks[hook]
+}
+
+// Request calls on_request. It returns the action the script chose for the request ("" if it didn't) and why
+func Request(domainName string, req plugins.Request, request *http.Request, writer http.ResponseWriter) (string, string) {
+	return call(domainName, OnRequest, req, request, writer, nil)
+}
+
+// ChallengeResult calls on_challenge_result with whether the client passed its challenge
+func ChallengeResult(domainName string, req plugins.Request, passed bool, request *http.Request, writer http.ResponseWriter) (string, string) {
+	return call(domainName, OnChallengeResult, req, request, writer, lua.LBool(passed))
+}
+
+// Block calls on_block with why the request was blocked. The response was already sent
+func Block(domainName string, req plugins.Request, reason string) {
+	call(domainName, OnBlock, req, nil, nil, lua.LString(reason))
+}
+
+// call runs a hook of the script of a domain. Hooks that fail or take longer than the timeout of the script don't decide
+func call(domainName string, hook string, req plugins.Request, request *http.Request, writer http.ResponseWriter, arg lua.LValue) (string, string) {
+	scriptsMutex.RLock()
+	script, ok := scripts[domainName]
+	scriptsMutex.RUnlock()
+	if !ok || !script.hooks[hook] {
+		return "", ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), script.Timeout)
+	defer cancel()
+
+	var current *state
+	select {
+	case current = <-script.states:
+	case <-ctx.Done():
+		script.failed(hook, errors.New("no free state within "+script.Timeout.String()))
+		return "", ""
+	}
+
+	var err error
+	if current == nil {
+		current, err = script.newState()
+		if err != nil {
+			script.states <- nil
+			script.failed(hook, err)
+			return "", ""
+		}
+	}
+
+	action, reason, err := current.call(ctx, hook, req, request, writer, arg)
+	if err != nil {
+		// A hook that was interrupted may have left its state half way, a new one is created the next time it's needed
+		current.lua.Close()
+		script.states <- nil
+		script.failed(hook, err)
+		return "", ""
+	}
+	script.states <- current
+
+	if _, known := Actions[action]; action != "" && !known {
+		script.failed(hook, errors.New("returned unknown action "+action))
+		return "", ""
+	}
+	return action, reason
+}
+
+func (current *state) call(ctx context.Context, hook string, req plugins.Request, request *http.Request, writer http.ResponseWriter, arg lua.LValue) (string, string, error) {
+	L := current.lua
+	current.request, current.writer = request, writer
+	defer func() {
+		current.request, current.writer = nil, nil
+	}()
+
+	args := []lua.LValue{requestTable(L, req)}
+	if arg != nil {
+		args = append(args, arg)
+	}
+
+	L.SetContext(ctx)
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal(hook), NRet: 2, Protect: true}, args...)
+	L.RemoveContext()
+	if err != nil {
+		return "", "", err
+	}
+	action, reason := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+
+	if action == lua.LNil {
+		return "", "", nil
+	}
+	if reason == lua.LNil {
+		return action.String(), "", nil
+	}
+	return action.String(), reason.String(), nil
+}
+
+// requestTable passes a request to lua. Header names are lower case, multiple values are joined with ", "
+func requestTable(L *lua.LState, req plugins.Request) *lua.LTable {
+	headers := L.NewTable()
+	for name, values := range req.Headers {
+		headers.RawSetString(strings.ToLower(name), lua.LString(strings.Join(values, ", ")))
+	}
+
+	table := L.NewTable()
+	for name, value := range map[string]string{
+		"domain":            req.Domain,
+		"ip":                req.IP,
+		"method":            req.Method,
+		"url":               req.URL,
+		"path":              req.Path,
+		"query":             req.Query,
+		"proto":             req.Proto,
+		"user_agent":        req.UserAgent,
+		"country":           req.Country,
+		"tls_fingerprint":   req.TLSFingerprint,
+		"ja3":               req.JA3,
+		"ja4":               req.JA4,
+		"ja4h":              req.JA4H,
+		"http2_fingerprint": req.HTTP2Fingerprint,
+		"browser":           req.Browser,
+		"bot":               req.Bot,
+	} {
+		table.RawSetString(name, lua.LString(value))
+	}
+	for name, value := range map[string]int{
+		"asn":        req.ASN,
+		"reputation": req.Reputation,
+		"stage":      req.Stage,
+		"sus_lv":     req.SusLv,
+	} {
+		table.RawSetString(name, lua.LNumber(value))
+	}
+	table.RawSetString("attack", lua.LBool(req.Attack))
+	table.RawSetString("headers", headers)
+	return table
+}
+
+// failed logs a failure of a hook, unless the script already failed shortly before
+func (script *Script) failed(hook string, err error) {
+	script.lastErrorMutex.Lock()
+	defer script.lastErrorMutex.Unlock()
+	if time.Since(script.lastError) < ErrorLogInterval {
+		return
+	}
+	script.lastError = time.Now()
+	logger.Error("Script failed", logger.F("script", script.File), logger.F("hook", hook), logger.Err(err))
+}
+
+// Level returns the challenge level of action, -1 if it blocks
+func Level(action string) int {
+	return Actions[action]
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"io"
+	"net/http"
+)
+
+// inspectRequestBody buffers the beginning of the request body for firewall rules and puts it back in front of the rest, so the
+// backend still receives the whole body. Returns false if the body couldn't be read and the request was already answered
+func inspectRequestBody(writer http.ResponseWriter, request *http.Request, domainSettings domains.DomainSettings, buffer *bytes.Buffer) (firewall.InspectedBody, bool) {
+
+	if !domainSettings.BodyInspection.Enabled || request.Body == nil || request.Body == http.NoBody {
+		return firewall.InspectedBody{}, true
+	}
+
+	inspected, body, err := firewall.InspectBody(request.Body, domainSettings.BodyInspection.MaxSize*1024, request.Header.Get("Content-Type"))
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			SendResponse("Blocked by BalooProxy.\nRequest body too large.", buffer, writer)
+		} else {
+			writer.WriteHeader(http.StatusBadRequest)
+			SendResponse("Blocked by BalooProxy.\nFailed to read request body.", buffer, writer)
+		}
+		return inspected, false
+	}
+
+	request.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, request.Body}
+	return inspected, true
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"goProxy/core/domains"
+	"goProxy/core/proxy"
+	"strings"
+)
+
+// bodyLimit returns the maximum body size for a request path. Path limits win over the domain limit, which wins over the global one.
+// A result of 0 or less means the body isn't limited
+func bodyLimit(domainSettings domains.DomainSettings, path string) int64 {
+
+	// BodyLimits are sorted longest prefix first
+	for _, limit := range domainSettings.BodyLimits {
+		if strings.HasPrefix(path, limit.Path) {
+			return limit.MaxBodySize
+		}
+	}
+
+	if domainSettings.MaxBodySize != 0 {
+		return domainSettings.MaxBodySize
+	}
+	return proxy.MaxBodySize
+}
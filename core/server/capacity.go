@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"net/http"
+	"time"
+)
+
+type backendKey struct{}
+
+// backendReservation is the backend a request holds capacity of. Retries move it to the backend they're sent to
+type backendReservation struct {
+	backend  string // empty once the capacity was given up
+	priority bool
+}
+
+// backendFromContext returns the backend reserveCapacity picked for a request, if any
+func backendFromContext(ctx context.Context) string {
+	if reservation, ok := ctx.Value(backendKey{}).(*backendReservation); ok {
+		return reservation.backend
+	}
+	return ""
+}
+
+// reserveCapacity waits until the domain and the backend a request is forwarded to have capacity for it, prioritized requests first.
+// The returned function has to be called once the response was sent. Returns false after answering the request if there is no capacity in time
+func reserveCapacity(writer http.ResponseWriter, request *http.Request, domainSettings domains.DomainSettings, priority bool, buffer *bytes.Buffer) (*http.Request, func(), bool) {
+
+	releaseDomain := func() {}
+	if maxInFlight := domainSettings.Concurrency.MaxInFlight; maxInFlight > 0 {
+		if !firewall.AcquireDomain(domainSettings.Name, maxInFlight, time.Duration(domainSettings.Concurrency.QueueTimeout)*time.Millisecond, priority) {
+			overloaded(writer, "Too many requests are being processed.", buffer)
+			return request, nil, false
+		}
+		releaseDomain = func() {
+			firewall.ReleaseDomain(domainSettings.Name)
+		}
+	}
+
+	if !firewall.BackendProtectionEnabled() {
+		return request, releaseDomain, true
+	}
+
+	backend := domainSettings.Backends.Next()
+	if !firewall.AcquireBackend(backend, priority) {
+		releaseDomain()
+		overloaded(writer, "The backend is overloaded.", buffer)
+		return request, nil, false
+	}
+
+	reservation := &backendReservation{backend: backend, priority: priority}
+	return request.WithContext(context.WithValue(request.Context(), backendKey{}, reservation)), func() {
+		if reservation.backend != "" {
+			firewall.ReleaseBackend(reservation.backend)
+		}
+		releaseDomain()
+	}, true
+}
+
+// reserveRetry picks the backend a retry of a request is sent to. Requests that hold capacity of a backend only move to
+// backends that have capacity, other backends are preferred and the one they had is given up. Returns false if no backend has capacity
+func reserveRetry(ctx context.Context, backends *domains.BackendPool) (string, bool) {
+
+	reservation, ok := ctx.Value(backendKey{}).(*backendReservation)
+	if !ok {
+		return backends.Next(), true
+	}
+
+	current := reservation.backend
+	for range backends.List() {
+		if backend := backends.Next(); backend != current && firewall.TryAcquireBackend(backend, reservation.priority) {
+			firewall.ReleaseBackend(current)
+			reservation.backend = backend
+			return backend, true
+		}
+	}
+
+	// The retry counts against the limits of the backend like every other request
+	firewall.ReleaseBackend(current)
+	if !firewall.TryAcquireBackend(current, reservation.priority) {
+		reservation.backend = ""
+		return "", false
+	}
+	return current, true
+}
+
+func overloaded(writer http.ResponseWriter, reason string, buffer *bytes.Buffer) {
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.Header().Set("Retry-After", "1")
+	writer.WriteHeader(http.StatusServiceUnavailable)
+	SendResponse("Blocked by BalooProxy.\n"+reason+" Please try again later.", buffer, writer)
+}
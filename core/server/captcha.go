@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	captchaPath   = "/_bProxy/captcha"
+	captchaAction = "challenge" // action reCAPTCHA v3 tokens are requested for
+
+	// Styles of the built-in captcha. The widget part is sent along with custom stage 3 templates
+	captchaPageCSS   = `body{background-color:#f5f5f5;font-family:Arial,sans-serif}.center{display:flex;align-items:center;justify-content:center;height:100vh}.box{background-color:#fff;border:1px solid #ddd;border-radius:4px;padding:20px;width:500px}.box{background-color:#fff;border:1px solid #ddd;border-radius:4px;padding:20px;width:500px;transition:height .1s;position:block}.box *{transition:opacity .1s}.collapsible{background-color:#f5f5f5;color:#444;cursor:pointer;padding:18px;width:100%;border:none;text-align:left;outline:0;font-size:15px}.collapsible:after{content:'\002B';color:#777;font-weight:700;float:right;margin-left:5px}.collapsible.active:after{content:"\2212"}.collapsible:hover{background-color:#e5e5e5}.collapsible-content{padding:0 18px;max-height:0;overflow:hidden;transition:max-height .2s ease-out;background-color:#f5f5f5}`
+	captchaWidgetCSS = `canvas{display:block;margin:0 auto;max-width:100%;width:100%;height:auto}input[type=text]{width:100%;padding:12px 20px;margin:8px 0;box-sizing:border-box;border:2px solid #ccc;border-radius:4px}button{width:100%;background-color:#4caf50;color:#fff;padding:14px 20px;margin:8px 0;border:none;border-radius:4px;cursor:pointer}button:hover{background-color:#45a049}.success{background-color:#dff0d8;border:1px solid #d6e9c6;border-radius:4px;color:#3c763d;padding:20px}.failure{background-color:#f0d8d8;border:1px solid #e9c6c6;border-radius:4px;color:#763c3c;padding:20px}.captcha-wrapper{position:relative;width:100%;height:200px}.captcha-wrapper canvas{position:absolute}input[type=range]{-webkit-appearance:none;width:100%;height:25px;background:#ddd;outline:0;opacity:.7;transition:opacity .2s;border-radius:4px;margin:8px 0}input[type=range]:hover{opacity:1}input[type=range]::-webkit-slider-thumb{-webkit-appearance:none;appearance:none;width:25px;height:25px;background:#4caf50;cursor:pointer;border-radius:50%}input[type=range]::-moz-range-thumb{width:25px;height:25px;background:#4caf50;cursor:pointer;border-radius:50%}`
+)
+
+// How the widget of a captcha provider is embedded and which form field it puts its token in
+type captchaWidget struct {
+	script string
+	class  string
+	field  string
+}
+
+var captchaWidgets = map[string]captchaWidget{
+	"hcaptcha": {
+		script: "https://js.hcaptcha.com/1/api.js",
+		class:  "h-captcha",
+		field:  "h-captcha-response",
+	},
+	"turnstile": {
+		script: "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		class:  "cf-turnstile",
+		field:  "cf-turnstile-response",
+	},
+	"recaptcha": {
+		script: "https://www.google.com/recaptcha/api.js?render=",
+		field:  "g-recaptcha-response",
+	},
+}
+
+// serveCaptchaProvider handles stage 3 for domains that use an external captcha provider instead of the built-in captcha.
+// Solved tokens are posted to captchaPath, verified with the provider and exchanged for clearanceCookie (a Set-Cookie value).
+// Returns false if the client has to solve the built-in captcha instead, because its reCAPTCHA v3 score was inconclusive
+func serveCaptchaProvider(writer http.ResponseWriter, request *http.Request, domainSettings domains.DomainSettings, ip string, clearanceCookie string, buffer *bytes.Buffer) bool {
+
+	settings := domainSettings.Captcha
+	widget := captchaWidgets[settings.Provider]
+	scoreBased := settings.Provider == "recaptcha"
+
+	if scoreBased && firewall.InteractiveCaptchaRequired(ip) {
+		return false
+	}
+
+	if firewall.CaptchaFailureLimited(ip, settings.MaxFailures) {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusTooManyRequests)
+		SendResponse("Blocked by BalooProxy.\nToo many failed captchas.", buffer, writer)
+		return true
+	}
+
+	if request.URL.Path == captchaPath && request.Method == http.MethodPost {
+		request.Body = http.MaxBytesReader(writer, request.Body, 64*1024)
+
+		result, err := firewall.VerifyCaptcha(settings.Provider, settings.Secret, request.PostFormValue(widget.field), ip)
+		if err != nil {
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusBadGateway)
+			SendResponse("BalooProxy Error: "+err.Error(), buffer, writer)
+			return true
+		}
+
+		decision := firewall.CaptchaBlock
+		if result.Success {
+			decision = firewall.CaptchaAllow
+		}
+		if scoreBased {
+			if result.Action != captchaAction {
+				result.Success = false
+			}
+			decision = firewall.ScoreCaptcha(result, ip, settings.ScoreWeight, settings.AllowScore, settings.BlockScore)
+		}
+
+		switch decision {
+		case firewall.CaptchaAllow:
+			writer.Header().Set("Set-Cookie", clearanceCookie)
+		case firewall.CaptchaChallenge:
+			firewall.RequireInteractiveCaptcha(ip)
+		case firewall.CaptchaBlock:
+			scoreEvent(domainSettings, ip, "challenge_failure")
+			firewall.RecordIPChallengeFailure(ip)
+			firewall.RecordCaptchaFailure(ip)
+			if scoreBased {
+				writer.Header().Set("Content-Type", "text/plain")
+				writer.WriteHeader(http.StatusForbidden)
+				SendResponse("Blocked by BalooProxy.\nYour request looks automated.", buffer, writer)
+				return true
+			}
+		}
+		http.Redirect(writer, request, captchaReturn(request.URL.Query().Get("return")), http.StatusSeeOther)
+		return true
+	}
+
+	// The page to return to is part of the url, so the clearance is issued for the scope of that page
+	formAction := html.EscapeString(captchaPath + "?return=" + url.QueryEscape(request.URL.RequestURI()))
+
+	// Score based captchas run without any interaction of the user
+	if scoreBased {
+		siteKey := html.EscapeString(settings.SiteKey)
+		captchaForm := `<form id=captcha method=POST action="` + formAction + `"><input type=hidden id=token name=` + widget.field + `></form><script src="` + widget.script + siteKey + `"></script><script>grecaptcha.ready(function(){grecaptcha.execute("` + siteKey + `",{action:"` + captchaAction + `"}).then(function(t){document.getElementById("token").value=t,document.getElementById("captcha").submit()})});</script>`
+		writer.Header().Set("Content-Type", "text/html")
+		writer.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0") // Prevent special(ed) browsers from caching the challenge
+		if domainSettings.Templates.Stage3 != nil {
+			SendResponse(renderChallenge(domainSettings.Templates, domainSettings.Templates.Stage3, domainSettings.Name, request, captchaForm), buffer, writer)
+			return true
+		}
+		SendResponse(`<!doctypehtml><html lang=en><meta charset=UTF-8><meta content="width=device-width,initial-scale=1"name=viewport><title>Checking your browser ...</title><style>body,html{height:100%;width:100%;margin:0;display:flex;flex-direction:column;justify-content:center;align-items:center;background-color:#f0f0f0;font-family:Arial,sans-serif}.message{text-align:center;color:#333}</style><div class=message><p>Checking your browser ...</div>`+captchaForm, buffer, writer)
+		return true
+	}
+
+	appearance := ""
+	if settings.Appearance != "" {
+		appearance = ` data-appearance="` + html.EscapeString(settings.Appearance) + `"`
+	}
+
+	captchaForm := `<form id=captcha method=POST action="` + formAction + `"><div class="` + widget.class + `" data-sitekey="` + html.EscapeString(settings.SiteKey) + `"` + appearance + ` data-callback=solved></div></form>`
+	captchaScript := `<script>function solved(){document.getElementById("captcha").submit()}</script><script src="` + widget.script + `" async defer></script>`
+
+	writer.Header().Set("Content-Type", "text/html")
+	writer.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0") // Prevent special(ed) browsers from caching the challenge
+	if domainSettings.Templates.Stage3 != nil {
+		SendResponse(renderChallenge(domainSettings.Templates, domainSettings.Templates.Stage3, domainSettings.Name, request, captchaForm+captchaScript), buffer, writer)
+		return true
+	}
+	SendResponse(`<!doctypehtml><html lang=en><meta charset=UTF-8><meta content="width=device-width,initial-scale=1"name=viewport><title>Verifying you are human ...</title><style>body,html{height:100%;width:100%;margin:0;display:flex;flex-direction:column;justify-content:center;align-items:center;background-color:#f5f5f5;font-family:Arial,sans-serif}.box{background-color:#fff;border:1px solid #ddd;border-radius:4px;padding:20px;text-align:center}</style><div class=box><h1>Please verify you are human</h1>`+captchaForm+`</div>`+captchaScript, buffer, writer)
+	return true
+}
+
+// challengeAnswer checks whether a request posts the answer to a challenge, instead of asking for one
+func challengeAnswer(request *http.Request) bool {
+	return request.Method == http.MethodPost && (request.URL.Path == captchaPath || request.URL.Path == fallbackPath)
+}
+
+// captchaReturn only allows redirects back to a path on the same domain
+func captchaReturn(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") || strings.HasPrefix(target, "/_bProxy/") {
+		return "/"
+	}
+	return target
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const blockedPrefix = "Blocked by BalooProxy.\n"
+
+// captureResponseWriter remembers the status and the start of the response of a sampled request, to tell what happened to it
+type captureResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	size     int64
+	body     []byte
+	hijacked bool
+}
+
+func (writer *captureResponseWriter) WriteHeader(status int) {
+	if writer.status == 0 {
+		writer.status = status
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *captureResponseWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	if missing := 256 - len(writer.body); missing > 0 {
+		if len(data) < missing {
+			missing = len(data)
+		}
+		writer.body = append(writer.body, data[:missing]...)
+	}
+	n, err := writer.ResponseWriter.Write(data)
+	writer.size += int64(n)
+	return n, err
+}
+
+func (writer *captureResponseWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack keeps websocket upgrades and the tarpit working on sampled requests
+func (writer *captureResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := writer.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	writer.hijacked = true
+	return hijacker.Hijack()
+}
+
+func (writer *captureResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// action returns what happened to the request. marked is "challenge" or "allow" if the middleware got that far
+func (writer *captureResponseWriter) action(marked string) (string, string) {
+	switch {
+	case writer.hijacked && marked != "allow":
+		return "tarpit", ""
+	case bytes.HasPrefix(writer.body, []byte(blockedPrefix)):
+		reason := strings.TrimPrefix(string(writer.body), blockedPrefix)
+		if end := strings.IndexByte(reason, '\n'); end != -1 {
+			reason = reason[:end]
+		}
+		return "block", strings.TrimSpace(reason)
+	case marked != "":
+		return marked, ""
+	}
+	return "other", ""
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"goProxy/core/proxy"
+	"goProxy/core/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clearanceScope returns what the clearance of a request is bound to besides the client (its scope, the current period of its lifetime
+// and the generation of the scope), the prefix of its cookie name and the attributes its cookie has to be set with.
+// period 0 is the current period, -1 the one before
+func clearanceScope(domainSettings domains.DomainSettings, domainData domains.DomainData, path string, period int64) (string, string, string) {
+
+	settings := domainSettings.Clearance
+	lifetime := clearanceLifetime(settings, domainData)
+
+	// Cookies of all paths are set on /, so the challenge pages can verify them. Their names differ instead,
+	// so clearances of different paths don't overwrite each other
+	scopePath := "/"
+	cookiePrefix := ""
+	if settings.Scope == "path" {
+		// Paths are sorted longest prefix first
+		for _, prefix := range settings.Paths {
+			if strings.HasPrefix(path, prefix) {
+				scopePath = prefix
+				cookiePrefix = "p" + utils.EncryptSha(prefix, "")[:8]
+				break
+			}
+		}
+	}
+
+	now := proxy.LastSecondTime.Unix()
+	maxAge := lifetime - now%lifetime
+	if settings.Renew {
+		// Expired clearances can still be renewed for another lifetime
+		maxAge += lifetime
+	}
+
+	scope := domainSettings.ClearanceScope + scopePath + "|" + firewall.ClearanceGeneration(domainSettings.ClearanceScope) + "|" + strconv.FormatInt(lifetime, 10) + "|" + strconv.FormatInt(now/lifetime+period, 10)
+	return scope, cookiePrefix, clearanceCookieAttributes(settings, maxAge)
+}
+
+// clearanceCookieAttributes returns the attributes clearance cookies expiring in maxAge seconds are set with
+func clearanceCookieAttributes(settings domains.ClearanceSettings, maxAge int64) string {
+	attributes := "; SameSite=Lax; path=/"
+	if settings.Scope == "subdomains" {
+		attributes += "; Domain=" + settings.CookieDomain
+	}
+	return attributes + "; Max-Age=" + strconv.FormatInt(maxAge, 10) + "; Secure"
+}
+
+// clearanceTokenValid checks whether the cookies of a request contain a clearance token that's valid for susLv, the client and the scope of cookiePrefix.
+// client is what the token is bound to besides the ip prefix, difficulty the one the js challenge currently has
+func clearanceTokenValid(request *http.Request, domainSettings domains.DomainSettings, cookiePrefix string, ip string, client string, susLv int, difficulty int) bool {
+
+	cookie, err := request.Cookie(cookiePrefix + "__bProxy_t")
+	if err != nil {
+		return false
+	}
+	token, valid := firewall.VerifyClearanceToken(cookie.Value)
+
+	// Tokens of a higher level also clear lower ones, js challenge tokens only clear challenges up to the difficulty they solved
+	if valid && token.Level == 2 && susLv == 2 && token.Difficulty < difficulty {
+		return false
+	}
+	return valid && token.Level >= susLv && token.Scope == domainSettings.ClearanceScope+cookiePrefix &&
+		token.Generation == firewall.ClearanceGeneration(domainSettings.ClearanceScope) &&
+		token.IPPrefix == firewall.ClearanceTokenPrefix(ip) && token.Fingerprint == firewall.ClearanceTokenFingerprint(client)
+}
+
+// issueClearanceToken hands a client that passed the challenge of susLv a clearance token, which lasts one lifetime and is honored by every node
+func issueClearanceToken(writer http.ResponseWriter, domainSettings domains.DomainSettings, domainData domains.DomainData, cookiePrefix string, ip string, client string, susLv int, difficulty int) {
+
+	lifetime := clearanceLifetime(domainSettings.Clearance, domainData)
+	token := firewall.IssueClearanceToken(firewall.ClearanceToken{
+		Level:       susLv,
+		Scope:       domainSettings.ClearanceScope + cookiePrefix,
+		Generation:  firewall.ClearanceGeneration(domainSettings.ClearanceScope),
+		IPPrefix:    firewall.ClearanceTokenPrefix(ip),
+		Fingerprint: firewall.ClearanceTokenFingerprint(client),
+		Expiry:      proxy.LastSecondTime.Unix() + lifetime,
+		Difficulty:  difficulty,
+	})
+	writer.Header().Add("Set-Cookie", cookiePrefix+"__bProxy_t="+token+clearanceCookieAttributes(domainSettings.Clearance, lifetime))
+}
+
+// renewClearance lets a client pass whose clearance of susLv expired during the last lifetime and issues it the new one, if the domain renews clearances.
+// client is what the clearance is bound to besides its scope
+func renewClearance(writer http.ResponseWriter, request *http.Request, domainSettings domains.DomainSettings, domainData domains.DomainData, scopePath string, client string, susLv int, clearance string) bool {
+
+	if !domainSettings.Clearance.Renew || susLv < 1 || susLv > 3 {
+		return false
+	}
+
+	prevScope, cookiePrefix, cookieAttributes := clearanceScope(domainSettings, domainData, scopePath, -1)
+	prevClearance := utils.Encrypt(client+prevScope, clearanceOTP(susLv))
+	if susLv == 2 && domainSettings.BrowserSignals.Enabled {
+		prevClearance = signalsClearance(prevClearance)
+	}
+	if !strings.Contains(request.Header.Get("Cookie"), "__bProxy_v="+prevClearance) {
+		return false
+	}
+
+	writer.Header().Add("Set-Cookie", cookiePrefix+"_"+strconv.Itoa(susLv)+"__bProxy_v="+clearance+cookieAttributes)
+	return true
+}
+
+// clearanceScopePath returns the path the clearance of a request is scoped to. Challenges verify and issue their clearances
+// on reserved paths, which carry the page they were solved on
+func clearanceScopePath(request *http.Request) string {
+
+	var page string
+	switch request.URL.Path {
+	case "/_bProxy/verified", signalsPath:
+		page = request.URL.Query().Get("path")
+	case captchaPath, fallbackPath:
+		page, _, _ = strings.Cut(request.URL.Query().Get("return"), "?")
+	}
+	if page == "" {
+		return request.URL.Path
+	}
+	return page
+}
+
+// clearanceLifetime returns how long clearances of a domain stay valid in seconds, which is shorter while it's under attack if configured
+func clearanceLifetime(settings domains.ClearanceSettings, domainData domains.DomainData) int64 {
+	if settings.AttackLifetime > 0 && (domainData.RawAttack || domainData.BypassAttack) {
+		return int64(settings.AttackLifetime)
+	}
+	return int64(settings.Lifetime)
+}
+
+// clearanceOTP returns the secret the clearances of a challenge level are derived from
+func clearanceOTP(susLv int) string {
+	switch susLv {
+	case 1:
+		return proxy.CookieOTP
+	case 2:
+		return proxy.JSOTP
+	default:
+		return proxy.CaptchaOTP
+	}
+}
+
+// normalizeClearance validates the clearance settings of a domain and fills in defaults
+func normalizeClearance(domain domains.Domain) (domains.ClearanceSettings, string, error) {
+
+	settings := domain.Clearance
+	if settings.Lifetime <= 0 {
+		settings.Lifetime = int(time.Hour.Seconds())
+	}
+	if settings.Lifetime < 60 || settings.Lifetime > 86400 || settings.AttackLifetime > 86400 || (settings.AttackLifetime != 0 && settings.AttackLifetime < 60) {
+		return settings, "", errors.New("lifetime has to be between 60 and 86400 seconds")
+	}
+
+	// Both end up in cookie attributes, which are also set from js
+	for _, value := range append([]string{settings.CookieDomain}, settings.Paths...) {
+		if strings.ContainsAny(value, ";\"'\\` \t\r\n") {
+			return settings, "", errors.New("invalid character in " + value)
+		}
+	}
+
+	scope := domain.Name
+	switch settings.Scope {
+	case "", "domain":
+		settings.Scope = "domain"
+	case "subdomains":
+		if settings.CookieDomain == "" || !strings.HasSuffix("."+domain.Name, "."+strings.TrimPrefix(settings.CookieDomain, ".")) {
+			return settings, "", errors.New("cookieDomain has to be " + domain.Name + " or one of its parent domains")
+		}
+		settings.CookieDomain = strings.TrimPrefix(settings.CookieDomain, ".")
+		// Clearances are shared between all domains with the same cookieDomain
+		scope = "." + settings.CookieDomain
+	case "path":
+		for _, path := range settings.Paths {
+			if !strings.HasPrefix(path, "/") {
+				return settings, "", errors.New("path " + path + " has to start with /")
+			}
+		}
+		paths := append([]string{}, settings.Paths...)
+		sort.SliceStable(paths, func(i, j int) bool {
+			return len(paths[i]) > len(paths[j])
+		})
+		settings.Paths = paths
+	default:
+		return settings, "", errors.New("unknown scope " + settings.Scope)
+	}
+	return settings, scope, nil
+}
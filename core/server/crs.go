@@ -0,0 +1,35 @@
+package server
+
+import (
+	"goProxy/core/firewall"
+	"net/http"
+)
+
+// crsRequest collects what crs rules can check of a request
+func crsRequest(request *http.Request, body firewall.InspectedBody) firewall.CRSRequest {
+
+	args := [][2]string{}
+	for name, values := range request.URL.Query() {
+		for _, value := range values {
+			args = append(args, [2]string{name, value})
+		}
+	}
+
+	cookies := map[string]string{}
+	for _, cookie := range request.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+
+	return firewall.CRSRequest{
+		Method:      request.Method,
+		URI:         request.RequestURI,
+		Path:        request.URL.Path,
+		QueryString: request.URL.RawQuery,
+		Args:        args,
+		BodyKeys:    body.Keys,
+		BodyValues:  body.Values,
+		Headers:     request.Header,
+		Cookies:     cookies,
+		Body:        string(body.Raw),
+	}
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"goProxy/core/accesslog"
+	"goProxy/core/discovery"
+	"goProxy/core/domains"
+	"goProxy/core/feeds"
+	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/proxy"
+	"goProxy/core/rulesets"
+	"goProxy/core/scripts"
+	"goProxy/core/utils"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InitDomain builds the runtime settings for a configured domain and registers its backend transport.
+// Shared between config.Load and ReloadConfig, so both pick up new per-domain options the same way
+func InitDomain(domain domains.Domain) (domains.DomainSettings, error) {
+
+	firewallRules, failed, err := firewall.CompileRules(domain.FirewallRules, 0, domain.ShadowRules)
+	if err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Custom Firewall Rules For " + domain.Name + " ( Rule " + strconv.Itoa(failed) + " ) : " + utils.PrimaryColor(err.Error()))
+	}
+
+	for _, subscription := range domain.RemoteRulesets {
+		if !strings.HasPrefix(subscription.URL, "https://") && !strings.HasPrefix(subscription.URL, "http://") {
+			return domains.DomainSettings{}, errors.New("Error Loading Remote Rulesets For " + domain.Name + ": " + utils.PrimaryColor("invalid url "+subscription.URL))
+		}
+		if key, err := base64.StdEncoding.DecodeString(subscription.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			return domains.DomainSettings{}, errors.New("Error Loading Remote Rulesets For " + domain.Name + ": " + utils.PrimaryColor("publicKey of "+subscription.URL+" has to be a base64 encoded ed25519 public key"))
+		}
+	}
+
+	backends := domains.NewBackendPool(domain.Backend)
+	dProxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = domain.Scheme
+			req.URL.Host = backendFromContext(req.Context())
+			if req.URL.Host == "" {
+				req.URL.Host = backends.Next()
+			}
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		Transport: &RoundTripper{
+			Backends: backends,
+			Retry:    domain.Retry,
+			Timeout:  time.Duration(domain.UpstreamTimeout.Total) * time.Second,
+		},
+	}
+
+	transportMap.Store(domain.Name, newDomainTransport(domain))
+
+	var cert tls.Certificate = tls.Certificate{}
+	if !proxy.Cloudflare {
+		var certErr error
+		cert, certErr = tls.LoadX509KeyPair(domain.Certificate, domain.Key)
+		if certErr != nil {
+			return domains.DomainSettings{}, errors.New(utils.PrimaryColor("Error Loading Certificates: " + certErr.Error()))
+		}
+	}
+
+	// Longest prefix first, so the most specific limit of a path is found first
+	bodyLimits := append([]domains.PathBodyLimit{}, domain.BodyLimits...)
+	sort.SliceStable(bodyLimits, func(i, j int) bool {
+		return len(bodyLimits[i].Path) > len(bodyLimits[j].Path)
+	})
+
+	ratelimit := domain.Ratelimit
+	switch ratelimit.Mode {
+	case "", "window":
+		ratelimit.Mode = "window"
+	case "tokenBucket":
+		if ratelimit.Rate <= 0 {
+			ratelimit.Rate = float64(proxy.IPRatelimit) / float64(proxy.RatelimitWindow)
+		}
+		if ratelimit.Burst <= 0 {
+			ratelimit.Burst = 50
+		}
+	default:
+		return domains.DomainSettings{}, errors.New("Unknown Ratelimit Mode For " + domain.Name + ": " + utils.PrimaryColor(ratelimit.Mode))
+	}
+
+	domain.Webhook.Type = strings.ToLower(domain.Webhook.Type)
+	if err := utils.ValidateWebhook(domain.Webhook); err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Webhook For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+
+	concurrency := domain.Concurrency
+	if concurrency.QueueTimeout <= 0 {
+		concurrency.QueueTimeout = 1000
+	}
+
+	pathRatelimits := append([]domains.PathRatelimit{}, domain.PathRatelimits...)
+	for i, limit := range pathRatelimits {
+		if limit.Window == "" {
+			pathRatelimits[i].Window = "short"
+		} else if !firewall.ValidWindow(limit.Window) {
+			return domains.DomainSettings{}, errors.New("Unknown Ratelimit Window For " + domain.Name + ": " + utils.PrimaryColor(limit.Window))
+		}
+		if limit.Requests < 1 {
+			return domains.DomainSettings{}, errors.New("Path Ratelimit For " + domain.Name + " Needs At Least 1 Request: " + utils.PrimaryColor(limit.Path))
+		}
+		pathRatelimits[i].Path = cleanPrefixes([]string{limit.Path})[0]
+	}
+	sort.SliceStable(pathRatelimits, func(i, j int) bool {
+		return len(pathRatelimits[i].Path) > len(pathRatelimits[j].Path)
+	})
+
+	countryRatelimits := []domains.CountryRatelimit{}
+	for _, limit := range domain.CountryRatelimits {
+		if limit.Window == "" {
+			limit.Window = "short"
+		} else if !firewall.ValidWindow(limit.Window) {
+			return domains.DomainSettings{}, errors.New("Unknown Ratelimit Window For " + domain.Name + ": " + utils.PrimaryColor(limit.Window))
+		}
+		if limit.Requests < 0 {
+			return domains.DomainSettings{}, errors.New("Country Ratelimit For " + domain.Name + " Can't Be Negative: " + utils.PrimaryColor(strings.Join(limit.Countries, ", ")))
+		}
+		countries := []string{}
+		for _, country := range limit.Countries {
+			countries = append(countries, strings.ToUpper(country))
+		}
+		limit.Countries = countries
+		countryRatelimits = append(countryRatelimits, limit)
+	}
+	if len(countryRatelimits) != 0 && !firewall.GeoFilteringEnabled {
+		return domains.DomainSettings{}, errors.New("Geo Filtering For " + domain.Name + " Has To Be Enabled When balooProxy Starts")
+	}
+
+	if err := firewall.ValidateScoreWeights(domain.ReputationWeights); err != nil {
+		return domains.DomainSettings{}, errors.New("Invalid Reputation Weights For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+
+	// Domains without a geo filter policy of their own use the one of the proxy
+	geoFiltering := domains.Config.Proxy.GeoFiltering.GeoFilterPolicy
+	if domain.GeoFiltering != nil {
+		geoFiltering = *domain.GeoFiltering
+	}
+	switch geoFiltering.Mode {
+	case "":
+		geoFiltering.Mode = "blacklist"
+	case "blacklist", "whitelist":
+	default:
+		return domains.DomainSettings{}, errors.New("Unknown Geo Filtering Mode For " + domain.Name + ": " + utils.PrimaryColor(geoFiltering.Mode))
+	}
+	switch geoFiltering.ASNMode {
+	case "", "whitelist", "bypass":
+	default:
+		return domains.DomainSettings{}, errors.New("Unknown ASN Mode For " + domain.Name + ": " + utils.PrimaryColor(geoFiltering.ASNMode))
+	}
+	if geoFiltering.Enabled && !firewall.GeoFilteringEnabled {
+		return domains.DomainSettings{}, errors.New("Geo Filtering For " + domain.Name + " Has To Be Enabled When balooProxy Starts")
+	}
+
+	if _, ok := feeds.TorPolicies[domain.TorPolicy]; !ok {
+		return domains.DomainSettings{}, errors.New("Unknown Tor Policy For " + domain.Name + ": " + utils.PrimaryColor(domain.TorPolicy))
+	}
+	if feeds.TorPolicies[domain.TorPolicy] != 0 && !domains.Config.Proxy.Tor.Enabled {
+		return domains.DomainSettings{}, errors.New("Tor Policy For " + domain.Name + " Needs tor To Be Enabled")
+	}
+
+	if domain.Captcha.Provider != "" {
+		if _, ok := firewall.CaptchaProviders[domain.Captcha.Provider]; !ok {
+			return domains.DomainSettings{}, errors.New("Unknown Captcha Provider For " + domain.Name + ": " + utils.PrimaryColor(domain.Captcha.Provider))
+		}
+		if domain.Captcha.SiteKey == "" || domain.Captcha.Secret == "" {
+			return domains.DomainSettings{}, errors.New("Captcha Provider For " + domain.Name + " Needs A siteKey And secret")
+		}
+	}
+	if domain.Captcha.ScoreWeight <= 0 || domain.Captcha.ScoreWeight > 1 {
+		domain.Captcha.ScoreWeight = 0.5
+	}
+	if domain.Captcha.AllowScore == 0 {
+		domain.Captcha.AllowScore = 50
+	}
+	if domain.Captcha.BlockScore == 0 {
+		domain.Captcha.BlockScore = 20
+	}
+
+	templates := domains.ChallengeTemplates{
+		Brand:           domain.Templates.Brand,
+		Logo:            domain.Templates.Logo,
+		DefaultLanguage: strings.ToLower(domain.Templates.DefaultLanguage),
+		Texts:           map[string]map[string]string{},
+	}
+	for lang, texts := range domain.Templates.Texts {
+		templates.Texts[strings.ToLower(lang)] = texts
+	}
+	if templates.DefaultLanguage == "" {
+		templates.DefaultLanguage = "en"
+	}
+	if templates.Brand == "" {
+		templates.Brand = domain.Name
+	}
+	var templateErr error
+	if templates.Stage2, templateErr = loadChallengeTemplate(domain.Templates.Stage2); templateErr != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Stage 2 Template For " + domain.Name + ": " + utils.PrimaryColor(templateErr.Error()))
+	}
+	if templates.Stage3, templateErr = loadChallengeTemplate(domain.Templates.Stage3); templateErr != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Stage 3 Template For " + domain.Name + ": " + utils.PrimaryColor(templateErr.Error()))
+	}
+
+	exemptions, err := parseExemptions(domain.Exemptions)
+	if err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Exemptions For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+
+	// Matched on the cleaned path like exemptions, so "//login", "/./login" or "\login" are challenged like "/login"
+	forcedChallenges := make([]domains.ForcedChallenge, 0, len(domain.ForcedChallenges))
+	for _, forced := range domain.ForcedChallenges {
+		forced.Paths = cleanPrefixes(forced.Paths)
+		forcedChallenges = append(forcedChallenges, forced)
+		if len(forced.Paths) == 0 {
+			return domains.DomainSettings{}, errors.New("Error Loading Forced Challenges For " + domain.Name + ": " + utils.PrimaryColor("forced challenge without paths"))
+		}
+		if forced.Stage != 2 && forced.Stage != 3 {
+			return domains.DomainSettings{}, errors.New("Error Loading Forced Challenges For " + domain.Name + ": " + utils.PrimaryColor("stage has to be 2 or 3"))
+		}
+	}
+
+	browserSignals := domain.BrowserSignals
+	if browserSignals.MaxInconsistencies == 0 {
+		browserSignals.MaxInconsistencies = 1
+	}
+	if browserSignals.MaxInconsistencies < 0 {
+		browserSignals.MaxInconsistencies = 0
+	}
+
+	bodyInspection := domain.BodyInspection
+	if bodyInspection.MaxSize == 0 {
+		bodyInspection.MaxSize = firewall.DefaultBodyInspectionSize
+	}
+	if bodyInspection.MaxSize < 0 || bodyInspection.MaxSize > firewall.MaxBodyInspectionSize {
+		return domains.DomainSettings{}, errors.New("Error Loading Body Inspection For " + domain.Name + ": " + utils.PrimaryColor("maxSize has to be between 1 and "+strconv.Itoa(firewall.MaxBodyInspectionSize)+" kilobytes"))
+	}
+
+	waf := domain.WAF
+	if waf.Action == "" {
+		waf.Action = "block"
+	}
+	if waf.Action != "block" && waf.Action != "challenge" && waf.Action != "log" {
+		return domains.DomainSettings{}, errors.New("Error Loading WAF For " + domain.Name + ": " + utils.PrimaryColor("unknown action "+waf.Action))
+	}
+	for _, class := range waf.Classes {
+		if !firewall.ValidWAFClass(class) {
+			return domains.DomainSettings{}, errors.New("Error Loading WAF For " + domain.Name + ": " + utils.PrimaryColor("unknown class "+class))
+		}
+	}
+	if waf.ParanoiaLevel == 0 {
+		waf.ParanoiaLevel = 1
+	}
+	if waf.ParanoiaLevel < 1 || waf.ParanoiaLevel > 4 {
+		return domains.DomainSettings{}, errors.New("Error Loading WAF For " + domain.Name + ": " + utils.PrimaryColor("paranoiaLevel has to be between 1 and 4"))
+	}
+	if waf.AnomalyThreshold < 0 {
+		return domains.DomainSettings{}, errors.New("Error Loading WAF For " + domain.Name + ": " + utils.PrimaryColor("anomalyThreshold can't be negative"))
+	}
+	crsFiles := waf.CRS
+	if !waf.Enabled {
+		crsFiles = nil
+	}
+	if _, _, err := firewall.LoadCRS(domain.Name, crsFiles, waf.ParanoiaLevel, waf.AnomalyThreshold); err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading WAF For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+
+	pathProtections, err := parsePathProtections(domain.PathProtections)
+	if err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Path Protections For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+
+	forwardAuth, err := parseForwardAuth(domain.ForwardAuth)
+	if err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Forward Auth For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+
+	if err := scripts.Load(domain.Name, domain.Script); err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Script For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+
+	if err := accesslog.Configure(domain.Name, domain.AccessLog); err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Access Log For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+
+	clearance, clearanceScope, err := normalizeClearance(domain)
+	if err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Clearance Settings For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+	if domain.Fallback.Accessible {
+		logger.Warn("fallback.accessible is ignored, the question doesn't replace the captcha anymore", logger.Domain(domain.Name))
+	}
+
+	if err := discovery.Validate(domain.BackendDiscovery); err != nil {
+		return domains.DomainSettings{}, errors.New("Error Loading Backend Discovery For " + domain.Name + ": " + utils.PrimaryColor(err.Error()))
+	}
+	discovery.Start(domain.Name, domain.Backend, domain.BackendDiscovery, backends)
+
+	remoteRules := domains.NewRemoteRules(len(domain.RemoteRulesets))
+	rulesets.Start(domain.Name, domain.RemoteRulesets, remoteRules, func(rules []domains.JsonRule, firstIndex int) ([]domains.Rule, error) {
+		compiled, failed, err := firewall.CompileRules(rules, firstIndex, domain.ShadowRules)
+		if err != nil {
+			return nil, errors.New("rule " + strconv.Itoa(failed) + ": " + err.Error())
+		}
+		return compiled, nil
+	})
+
+	return domains.DomainSettings{
+		Name: domain.Name,
+
+		CustomRules:    firewallRules,
+		RawCustomRules: domain.FirewallRules,
+		RemoteRules:    remoteRules,
+
+		DomainProxy:        dProxy,
+		Backends:           backends,
+		DomainCertificates: cert,
+		DomainWebhooks: domains.WebhookSettings{
+			Type:           domain.Webhook.Type,
+			URL:            domain.Webhook.URL,
+			Name:           domain.Webhook.Name,
+			Avatar:         domain.Webhook.Avatar,
+			AttackStartMsg: domain.Webhook.AttackStartMsg,
+			AttackStopMsg:  domain.Webhook.AttackStopMsg,
+			Token:          domain.Webhook.Token,
+			ChatID:         domain.Webhook.ChatID,
+			Template:       domain.Webhook.Template,
+			Headers:        domain.Webhook.Headers,
+		},
+
+		ProxyProtocol: domain.ProxyProtocol,
+		MaxBodySize:   domain.MaxBodySize,
+		BodyLimits:    bodyLimits,
+		Captcha:       domain.Captcha,
+		Templates:     templates,
+		Exemptions:    exemptions,
+
+		BodyInspection:    bodyInspection,
+		WAF:               waf,
+		PathRatelimits:    pathRatelimits,
+		WindowLimits:      domain.WindowLimits,
+		CountryRatelimits: countryRatelimits,
+		Ratelimit:         ratelimit,
+		Concurrency:       concurrency,
+
+		ForcedChallenges: forcedChallenges,
+
+		Clearance:      clearance,
+		ClearanceScope: clearanceScope,
+
+		Fallback:       domain.Fallback,
+		BrowserSignals: browserSignals,
+
+		ReputationWeights: domain.ReputationWeights,
+		HoneypotPaths:     cleanPrefixes(domain.HoneypotPaths),
+		TorPolicy:         domain.TorPolicy,
+		GeoFiltering:      geoFiltering,
+		ForwardAuth:       forwardAuth,
+		PathProtections:   pathProtections,
+
+		BypassStage1:        domain.BypassStage1,
+		BypassStage2:        domain.BypassStage2,
+		DisableBypassStage3: domain.DisableBypassStage3,
+		DisableRawStage3:    domain.DisableRawStage3,
+		DisableBypassStage2: domain.DisableBypassStage2,
+		DisableRawStage2:    domain.DisableRawStage2,
+	}, nil
+}
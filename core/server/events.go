@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"goProxy/core/domains"
+	"goProxy/core/events"
+	"goProxy/core/logger"
+	"sync"
+	"time"
+)
+
+var (
+	BackendDownInterval = 30 * time.Second // backend_down is published at most this often per backend
+
+	// backend -> last time it was published as down
+	backendsDown      = map[string]time.Time{}
+	backendsDownMutex = &sync.Mutex{}
+
+	// domain -> stage it was at the last second, only used by the monitor
+	lastStages = map[string]int{}
+)
+
+// publishBackendDown publishes that a request to backend failed, unless it was published recently
+func publishBackendDown(domainName string, backend string, err error) {
+	if !events.Subscribed(events.BackendDown) {
+		return
+	}
+
+	backendsDownMutex.Lock()
+	if time.Since(backendsDown[backend]) < BackendDownInterval {
+		backendsDownMutex.Unlock()
+		return
+	}
+	backendsDown[backend] = time.Now()
+	backendsDownMutex.Unlock()
+
+	events.Publish(events.Event{Type: events.BackendDown, Domain: domainName, Data: map[string]interface{}{"backend": backend, "error": err.Error()}})
+}
+
+// publishStageChange publishes the stage of a domain if it changed since the last second, whether automatically or by hand
+func publishStageChange(domainName string, domainData domains.DomainData) {
+	previous, seen := lastStages[domainName]
+	lastStages[domainName] = domainData.Stage
+	if seen && previous != domainData.Stage {
+		events.Publish(events.Event{Type: events.StageChanged, Domain: domainName, Data: map[string]interface{}{
+			"from":   previous,
+			"to":     domainData.Stage,
+			"locked": domainData.StageManuallySet,
+		}})
+	}
+}
+
+// publishBlocked publishes a request that was blocked, action and reason are those of captureResponseWriter
+func publishBlocked(action string, reason string, domainName string, ip string, url string, susLv int) {
+	if action != "block" {
+		return
+	}
+	events.Publish(events.Event{Type: events.RequestBlocked, Domain: domainName, IP: ip, Data: map[string]interface{}{
+		"reason": reason,
+		"url":    url,
+		"susLv":  susLv,
+	}})
+}
+
+// logBlocked logs a request that was blocked at debug level, action and reason are those of captureResponseWriter
+func logBlocked(action string, reason string, domainName string, ip string, url string, fingerprint string) {
+	if action != "block" || !logger.Enabled(logger.DebugLevel) {
+		return
+	}
+	logger.Debug("Request blocked", logger.Domain(domainName), logger.IP(ip), logger.Action(action), logger.F("reason", reason), logger.F("url", url), logger.Fingerprint(fingerprint))
+}
+
+// publishAttackStart publishes that a domain came under attack, "bypass" if it bypassed stage 1 and "raw" otherwise
+func publishAttackStart(domainName string, domainData domains.DomainData, kind string) {
+	events.Publish(events.Event{Type: events.AttackStarted, Domain: domainName, Data: map[string]interface{}{
+		"kind":                      kind,
+		"requestsPerSecond":         domainData.RequestsPerSecond,
+		"requestsBypassedPerSecond": domainData.RequestsBypassedPerSecond,
+	}})
+}
+
+// publishCertRenewal publishes that a domain has a different certificate after a reload
+func publishCertRenewal(previous domains.DomainSettings, current domains.DomainSettings) {
+	if !certificateChanged(previous.DomainCertificates, current.DomainCertificates) {
+		return
+	}
+	data := map[string]interface{}{}
+	if leaf, err := x509.ParseCertificate(current.DomainCertificates.Certificate[0]); err == nil {
+		data["subject"] = leaf.Subject.CommonName
+		data["notAfter"] = leaf.NotAfter
+	}
+	events.Publish(events.Event{Type: events.CertRenewed, Domain: current.Name, Data: data})
+}
+
+func certificateChanged(previous tls.Certificate, current tls.Certificate) bool {
+	if len(previous.Certificate) == 0 || len(current.Certificate) == 0 {
+		return false
+	}
+	return !bytes.Equal(previous.Certificate[0], current.Certificate[0])
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseExemptions validates the exemptions of a domain and parses their cidrs
+func parseExemptions(exemptions []domains.ChallengeExemption) ([]domains.ChallengeExemption, error) {
+
+	parsed := make([]domains.ChallengeExemption, 0, len(exemptions))
+	for _, exemption := range exemptions {
+		if len(exemption.Paths) == 0 && len(exemption.Methods) == 0 && len(exemption.Headers) == 0 && len(exemption.CIDRs) == 0 {
+			// Would exempt every request
+			return nil, errors.New("exemption without conditions")
+		}
+
+		networks, err := parseCIDRs(exemption.CIDRs)
+		if err != nil {
+			return nil, err
+		}
+		exemption.Networks = networks
+		exemption.Paths = cleanPrefixes(exemption.Paths)
+		parsed = append(parsed, exemption)
+	}
+	return parsed, nil
+}
+
+// parseCIDRs parses source ips or cidrs, single ips are networks of their own
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("invalid cidr " + cidr + ": " + err.Error())
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks, nil
+}
+
+// challengeExempted checks whether a request matches one of the exemptions of its domain.
+// A request matches an exemption if it satisfies all of its conditions, each condition matches if any of its values does
+func challengeExempted(domainSettings domains.DomainSettings, request *http.Request, ip string) bool {
+
+	for _, exemption := range domainSettings.Exemptions {
+		if matchExemption(exemption, request, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forcedStage returns the lowest stage requests to scopePath have to be challenged with, 0 if the path isn't forced to be challenged.
+// Answers to challenges are posted to reserved paths and have to be checked against the stage of the page they were solved on, no matter their method
+func forcedStage(domainSettings domains.DomainSettings, request *http.Request, scopePath string) int {
+
+	answer := scopePath != request.URL.Path
+	stage := 0
+	for _, forced := range domainSettings.ForcedChallenges {
+		if forced.Stage <= stage {
+			continue
+		}
+		methods := forced.Methods
+		if answer {
+			methods = nil
+		}
+		if matchExemption(domains.ChallengeExemption{Paths: forced.Paths, Methods: methods}, &http.Request{Method: request.Method, URL: &url.URL{Path: scopePath}}, "") {
+			stage = forced.Stage
+		}
+	}
+	return stage
+}
+
+func matchExemption(exemption domains.ChallengeExemption, request *http.Request, ip string) bool {
+
+	// Paths have to be cleaned like the backend resolves them, "/api/webhooks/../../login" isn't below "/api/webhooks"
+	if len(exemption.Paths) != 0 && !matchesPrefixes(cleanPath(request.URL.Path), exemption.Paths) {
+		return false
+	}
+
+	if len(exemption.Methods) != 0 {
+		matched := false
+		for _, method := range exemption.Methods {
+			if strings.EqualFold(request.Method, method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for header, value := range exemption.Headers {
+		if request.Header.Get(header) != value {
+			return false
+		}
+	}
+
+	if len(exemption.Networks) != 0 {
+		parsedIP := net.ParseIP(ip)
+		if parsedIP == nil {
+			return false
+		}
+		matched := false
+		for _, ipNet := range exemption.Networks {
+			if ipNet.Contains(parsedIP) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
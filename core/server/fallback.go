@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"goProxy/core/proxy"
+	"goProxy/core/utils"
+	"html"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const fallbackPath = "/_bProxy/fallback"
+
+var (
+	// Answers a client may post in a row, refilled with fallbackAnswerRate per second. Wrong answers are limited by
+	// captcha.maxFailures on top of that
+	fallbackAnswerBurst = 3
+	fallbackAnswerRate  = 1.0 / 20
+
+	// 3x5 pixel glyphs the question is drawn with, so it can't be read from the html as text
+	fallbackGlyphs = map[byte][5]string{
+		'0': {"###", "#.#", "#.#", "#.#", "###"},
+		'1': {".#.", "##.", ".#.", ".#.", "###"},
+		'2': {"###", "..#", "###", "#..", "###"},
+		'3': {"###", "..#", "###", "..#", "###"},
+		'4': {"#.#", "#.#", "###", "..#", "..#"},
+		'5': {"###", "#..", "###", "..#", "###"},
+		'6': {"###", "#..", "###", "#.#", "###"},
+		'7': {"###", "..#", ".#.", ".#.", ".#."},
+		'8': {"###", "#.#", "###", "#.#", "###"},
+		'9': {"###", "#.#", "###", "..#", "###"},
+		'+': {"...", ".#.", "###", ".#.", "..."},
+		'-': {"...", "...", "###", "...", "..."},
+		'=': {"...", "###", "...", "###", "..."},
+		'?': {"###", "..#", ".##", "...", ".#."},
+	}
+)
+
+// fallbackEnabled checks whether clients can answer a question instead of solving the challenge of susLv. The question
+// is far easier for bots than the captcha, so it only ever replaces the js challenge
+func fallbackEnabled(settings domains.FallbackSettings, susLv int) bool {
+	return settings.NoScript && susLv == 2
+}
+
+// fallbackSeed is what the question of a client is derived from. It's only known to the proxy
+// and changes whenever the client answers wrong
+func fallbackSeed(ip string, encryptedIP string) string {
+	return utils.EncryptSha(encryptedIP+strconv.Itoa(firewall.CaptchaFailures(ip)), proxy.CaptchaOTP)
+}
+
+// fallbackQuestion derives a calculation that can be solved without javascript from seed
+func fallbackQuestion(seed string) (string, int) {
+
+	sum := sha256.Sum256([]byte(seed))
+	a := int(sum[1])%10 + 1
+	b := int(sum[2])%10 + 1
+
+	if sum[0]%2 == 0 {
+		return strconv.Itoa(a) + "+" + strconv.Itoa(b) + "=?", a + b
+	}
+	if a < b {
+		a, b = b, a
+	}
+	return strconv.Itoa(a) + "-" + strconv.Itoa(b) + "=?", a - b
+}
+
+// fallbackImage draws question as an inline svg. The pixels are jittered and written in random order with a few lines
+// across them, a script has to recognize the glyphs instead of reading the question from the html
+func fallbackImage(question string) string {
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	const pixel = 6
+
+	rects := []string{}
+	for i := 0; i < len(question); i++ {
+		glyph := fallbackGlyphs[question[i]]
+		left := 10 + i*4*pixel + random.Intn(5) - 2
+		top := 10 + random.Intn(9) - 4
+		for row, line := range glyph {
+			for column := 0; column < len(line); column++ {
+				if line[column] != '#' {
+					continue
+				}
+				x := left + column*pixel + random.Intn(3) - 1
+				y := top + row*pixel + random.Intn(3) - 1
+				rects = append(rects, `<rect x="`+strconv.Itoa(x)+`" y="`+strconv.Itoa(y)+`" width="`+strconv.Itoa(pixel-random.Intn(2))+`" height="`+strconv.Itoa(pixel-random.Intn(2))+`"/>`)
+			}
+		}
+	}
+	random.Shuffle(len(rects), func(i, j int) {
+		rects[i], rects[j] = rects[j], rects[i]
+	})
+
+	width, height := 20+len(question)*4*pixel, 20+5*pixel
+	image := `<svg xmlns="http://www.w3.org/2000/svg" width="` + strconv.Itoa(width) + `" height="` + strconv.Itoa(height) + `" fill="#333" aria-hidden="true">` + strings.Join(rects, "")
+	for i := 0; i < 3; i++ {
+		image += `<line x1="0" y1="` + strconv.Itoa(random.Intn(height)) + `" x2="` + strconv.Itoa(width) + `" y2="` + strconv.Itoa(random.Intn(height)) + `" stroke="#333"/>`
+	}
+	return image + `</svg>`
+}
+
+// fallbackMarkup returns the form-based alternative to the js challenge, that's embedded into the challenge page for
+// clients without javascript
+func fallbackMarkup(settings domains.FallbackSettings, request *http.Request, ip string, encryptedIP string, susLv int) string {
+
+	if !fallbackEnabled(settings, susLv) {
+		return ""
+	}
+
+	question, _ := fallbackQuestion(fallbackSeed(ip, encryptedIP))
+	form := `<form method=POST action="` + html.EscapeString(fallbackPath+"?return="+url.QueryEscape(request.URL.RequestURI())) + `"><p>` + fallbackImage(question) + `</p><label for=bproxy-answer>Enter the result of the calculation with digits.</label> <input id=bproxy-answer type=text name=answer inputmode=numeric autocomplete=off required> <button type=submit>Submit</button></form>`
+
+	return `<noscript><p>Javascript is disabled. Solve the calculation to continue:</p>` + form + `</noscript>`
+}
+
+// serveFallback checks an answer posted to fallbackPath and sets clearanceCookie (a Set-Cookie value) if it's correct.
+// Wrong answers count as failed captchas. Returns false if the request isn't an answer
+func serveFallback(writer http.ResponseWriter, request *http.Request, domainSettings domains.DomainSettings, ip string, encryptedIP string, susLv int, clearanceCookie string, buffer *bytes.Buffer) bool {
+
+	if request.URL.Path != fallbackPath || request.Method != http.MethodPost || !fallbackEnabled(domainSettings.Fallback, susLv) {
+		return false
+	}
+
+	if !firewall.TakeToken("fallback "+domainSettings.Name, ip, fallbackAnswerRate, fallbackAnswerBurst) {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.Header().Set("Retry-After", "20")
+		writer.WriteHeader(http.StatusTooManyRequests)
+		SendResponse("Blocked by BalooProxy.\nToo many answers, please wait a bit.", buffer, writer)
+		return true
+	}
+	if firewall.CaptchaFailureLimited(ip, domainSettings.Captcha.MaxFailures) {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusTooManyRequests)
+		SendResponse("Blocked by BalooProxy.\nToo many failed captchas.", buffer, writer)
+		return true
+	}
+
+	request.Body = http.MaxBytesReader(writer, request.Body, 4*1024)
+
+	_, answer := fallbackQuestion(fallbackSeed(ip, encryptedIP))
+	if strings.TrimSpace(request.PostFormValue("answer")) == strconv.Itoa(answer) {
+		writer.Header().Set("Set-Cookie", clearanceCookie)
+	} else {
+		scoreEvent(domainSettings, ip, "challenge_failure")
+		firewall.RecordIPChallengeFailure(ip)
+		firewall.RecordCaptchaFailure(ip)
+	}
+	http.Redirect(writer, request, captchaReturn(request.URL.Query().Get("return")), http.StatusSeeOther)
+	return true
+}
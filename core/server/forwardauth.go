@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const maxForwardAuthBody = 1024 * 1024
+
+// Headers that only concern a single connection and aren't passed on between the client, the auth service and the backend
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length"}
+
+// parseForwardAuth validates the forward auth settings of a domain and creates the client the service is asked with
+func parseForwardAuth(settings domains.ForwardAuthSettings) (domains.ForwardAuthSettings, error) {
+	if settings.URL == "" {
+		return settings, nil
+	}
+	authURL, err := url.Parse(settings.URL)
+	if err != nil {
+		return settings, err
+	}
+	if authURL.Scheme != "http" && authURL.Scheme != "https" {
+		return settings, errors.New("url has to be http or https")
+	}
+	if settings.Timeout <= 0 {
+		settings.Timeout = 5
+	}
+	settings.Exclude = cleanPrefixes(settings.Exclude)
+	settings.Client = &http.Client{
+		Timeout: time.Duration(settings.Timeout) * time.Second,
+		// Redirects to the login page are for the client to follow
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return settings, nil
+}
+
+// forwardAuth asks the auth service of the domain whether request may reach the backend. If it may not, the client gets the answer
+// of the service (usually a redirect to its login page or a 401) and false is returned
+func forwardAuth(writer http.ResponseWriter, request *http.Request, settings domains.ForwardAuthSettings, ip string) bool {
+
+	// Clients can't pretend to be authenticated by sending the headers the service sets themselves
+	for _, name := range settings.ResponseHeaders {
+		request.Header.Del(name)
+	}
+
+	if settings.URL == "" {
+		return true
+	}
+	// "/public/../admin" isn't excluded, the backend resolves it to "/admin"
+	if matchesPrefixes(cleanPath(request.URL.Path), settings.Exclude) {
+		return true
+	}
+
+	authRequest, err := http.NewRequestWithContext(request.Context(), http.MethodGet, settings.URL, nil)
+	if err != nil {
+		forwardAuthUnavailable(writer)
+		return false
+	}
+	if len(settings.RequestHeaders) == 0 {
+		authRequest.Header = request.Header.Clone()
+		for _, name := range hopHeaders {
+			authRequest.Header.Del(name)
+		}
+	} else {
+		for _, name := range settings.RequestHeaders {
+			if values := request.Header.Values(name); len(values) != 0 {
+				authRequest.Header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	}
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	authRequest.Header.Set("X-Forwarded-Method", request.Method)
+	authRequest.Header.Set("X-Forwarded-Proto", scheme)
+	authRequest.Header.Set("X-Forwarded-Host", request.Host)
+	authRequest.Header.Set("X-Forwarded-Uri", request.RequestURI)
+	authRequest.Header.Set("X-Forwarded-For", ip)
+
+	response, err := settings.Client.Do(authRequest)
+	if err != nil {
+		forwardAuthUnavailable(writer)
+		return false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		for _, name := range settings.ResponseHeaders {
+			if values := response.Header.Values(name); len(values) != 0 {
+				request.Header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		return true
+	}
+
+	for name, values := range response.Header {
+		writer.Header()[name] = values
+	}
+	for _, name := range hopHeaders {
+		writer.Header().Del(name)
+	}
+	writer.WriteHeader(response.StatusCode)
+	io.Copy(writer, io.LimitReader(response.Body, maxForwardAuthBody))
+	return false
+}
+
+func forwardAuthUnavailable(writer http.ResponseWriter) {
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.WriteHeader(http.StatusBadGateway)
+	writer.Write([]byte("BalooProxy Error: Authentication service unavailable"))
+}
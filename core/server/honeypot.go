@@ -0,0 +1,11 @@
+package server
+
+import (
+	"goProxy/core/domains"
+)
+
+// honeypot checks whether path belongs to a honeypot of the domain. Nothing links to those paths, so only scanners request them.
+// HoneypotPaths are cleaned when the domain is loaded
+func honeypot(domainSettings domains.DomainSettings, path string) bool {
+	return matchesPrefixes(cleanPath(path), domainSettings.HoneypotPaths)
+}
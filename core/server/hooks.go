@@ -0,0 +1,18 @@
+package server
+
+import (
+	"bytes"
+	"goProxy/core/firewall"
+	"net/http"
+)
+
+// blockedBy answers a request that a plugin or script blocked, who is e.g. "plugin geo" or "script"
+func blockedBy(writer http.ResponseWriter, buffer *bytes.Buffer, ip string, who string, reason string) {
+	if reason == "" {
+		reason = "no reason given"
+	}
+	firewall.RecordIPRequest(ip, false, true)
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.WriteHeader(http.StatusForbidden)
+	SendResponse("Blocked by BalooProxy.\nBlocked by "+who+" ("+reason+").", buffer, writer)
+}
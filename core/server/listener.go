@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+type tlsStateKey struct{}
+
+// serveTLS serves service on listener, terminating TLS itself instead of leaving it to net/http.
+// This way the decrypted stream can be tapped, which is needed to see the order clients send their headers in
+func serveTLS(service *http.Server, h2Server *http2.Server, listener net.Listener) error {
+
+	// HTTP/1 connections are handed to net/http once their handshake is done. It reports StateNew itself,
+	// which already happened when the connection was accepted
+	http1Listener := newConnListener(listener.Addr())
+	http1Service := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// net/http only sets TLS for connections that are a *tls.Conn, which tapped connections aren't
+			if r.TLS == nil {
+				r.TLS, _ = r.Context().Value(tlsStateKey{}).(*tls.ConnectionState)
+			}
+			service.Handler.ServeHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			if tapped, ok := conn.(*firewall.TapConn); ok {
+				state := tapped.ConnectionState()
+				return context.WithValue(ctx, tlsStateKey{}, &state)
+			}
+			return ctx
+		},
+		IdleTimeout:       service.IdleTimeout,
+		ReadTimeout:       service.ReadTimeout,
+		WriteTimeout:      service.WriteTimeout,
+		ReadHeaderTimeout: service.ReadHeaderTimeout,
+		MaxHeaderBytes:    service.MaxHeaderBytes,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state != http.StateNew && service.ConnState != nil {
+				service.ConnState(conn, state)
+			}
+		},
+	}
+	go func() {
+		defer pnc.PanicHndl()
+		http1Service.Serve(http1Listener)
+	}()
+
+	// Running out of file descriptors during a flood (EMFILE, ENFILE) or connections aborted before they were accepted
+	// mustn't stop the proxy. Like net/http, every error is retried with a backoff until the listener is closed
+	backoff := time.Duration(0)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				http1Listener.Close()
+				return err
+			}
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			logAcceptError(err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		go handshake(service, h2Server, http1Listener, conn)
+	}
+}
+
+var lastAcceptError time.Time
+
+// logAcceptError logs failed accepts at most once a minute, they come in masses while file descriptors are exhausted
+func logAcceptError(err error) {
+	if time.Since(lastAcceptError) < time.Minute {
+		return
+	}
+	lastAcceptError = time.Now()
+	logger.Warn("Failed to accept connections", logger.Err(err))
+}
+
+func handshake(service *http.Server, h2Server *http2.Server, http1Listener *connListener, conn net.Conn) {
+
+	defer pnc.PanicHndl()
+
+	if service.ConnState != nil {
+		service.ConnState(conn, http.StateNew)
+	}
+
+	tlsConn := tls.Server(conn, service.TLSConfig)
+
+	// Same deadline net/http would use for the handshake
+	deadline := service.ReadHeaderTimeout
+	if deadline == 0 || (service.ReadTimeout != 0 && service.ReadTimeout < deadline) {
+		deadline = service.ReadTimeout
+	}
+	if deadline != 0 {
+		conn.SetDeadline(time.Now().Add(deadline))
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		if service.ConnState != nil {
+			service.ConnState(conn, http.StateClosed)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		tapped := firewall.Tap(tlsConn, true)
+		h2Server.ServeConn(tapped, &http2.ServeConnOpts{
+			Context:    context.Background(),
+			BaseConfig: service,
+			Handler:    service.Handler,
+		})
+		tapped.Close()
+		if service.ConnState != nil {
+			service.ConnState(conn, http.StateClosed)
+		}
+		return
+	}
+
+	if !http1Listener.push(firewall.Tap(tlsConn, false)) {
+		tlsConn.Close()
+		if service.ConnState != nil {
+			service.ConnState(conn, http.StateClosed)
+		}
+	}
+}
+
+// connListener hands connections that were accepted elsewhere to a http.Server
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -3,10 +3,17 @@ package server
 import (
 	"bytes"
 	"encoding/base64"
+	"goProxy/core/accesslog"
 	"goProxy/core/api"
 	"goProxy/core/domains"
+	"goProxy/core/events"
+	"goProxy/core/feeds"
 	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/plugins"
 	"goProxy/core/proxy"
+	"goProxy/core/scripts"
+	"goProxy/core/tracing"
 	"goProxy/core/utils"
 	"image"
 	"image/color"
@@ -18,8 +25,10 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kor44/gofilter"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func SendResponse(str string, buffer *bytes.Buffer, writer http.ResponseWriter) {
@@ -37,6 +46,8 @@ func Middleware(writer http.ResponseWriter, request *http.Request) {
 
 	domainName := request.Host
 
+	firewall.SlowReadHeadersDone(request.RemoteAddr)
+
 	firewall.Mutex.RLock()
 	domainData, domainFound := domains.DomainsData[domainName]
 	firewall.Mutex.RUnlock()
@@ -47,8 +58,13 @@ func Middleware(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	var ip string
 	var tlsFp string
+	var ja3 string
+	var ja4 string
+	var http2Fp string
+	var headerOrder []string
+	var headerOrderStr string
+	var headerOrderFp string
 	var browser string
 	var botFp string
 
@@ -56,9 +72,13 @@ func Middleware(writer http.ResponseWriter, request *http.Request) {
 	var ipCount int
 	var ipCountCookie int
 
-	if domains.Config.Proxy.Cloudflare {
+	ip, forwarded := firewall.ResolveClientIP(request.RemoteAddr, request.Header)
 
-		ip = request.Header.Get("Cf-Connecting-Ip")
+	//The request continues the trace of the client, if it sent one
+	request, requestSpan := tracing.StartRequest(request, domainName, ip)
+	defer requestSpan.End()
+
+	if domains.Config.Proxy.Cloudflare {
 
 		tlsFp = "Cloudflare"
 		browser = "Cloudflare"
@@ -70,20 +90,63 @@ func Middleware(writer http.ResponseWriter, request *http.Request) {
 		ipCountCookie = firewall.AccessIpsCookie[ip]
 		firewall.Mutex.RUnlock()
 	} else {
-		ip = strings.Split(request.RemoteAddr, ":")[0]
 
 		//Retrieve information about the client
 		firewall.Mutex.RLock()
 		tlsFp = firewall.Connections[request.RemoteAddr]
+		ja3 = firewall.ConnectionsJA3[request.RemoteAddr]
+		ja4 = firewall.ConnectionsJA4[request.RemoteAddr]
 		fpCount = firewall.UnkFps[tlsFp]
 		ipCount = firewall.AccessIps[ip]
 		ipCountCookie = firewall.AccessIpsCookie[ip]
 		firewall.Mutex.RUnlock()
+		http2Fp = firewall.HTTP2Fingerprint(request.RemoteAddr)
+		headerOrder = firewall.HeaderOrder(request.RemoteAddr, request.Method, request.RequestURI)
+		headerOrderStr, headerOrderFp = firewall.HeaderOrderFingerprint(headerOrder)
 
-		//Read-Only IMPORTANT: Must be put in mutex if you add the ability to change indexed fingerprints while program is running
+		//Fingerprint lists can be refreshed while running
+		firewall.FingerprintsMutex.RLock()
 		browser = firewall.KnownFingerprints[tlsFp]
 		botFp = firewall.BotFingerprints[tlsFp]
+
+		//Fingerprint lists can contain JA3 hashes aswell
+		if browser == "" && botFp == "" && ja3 != "" {
+			browser = firewall.KnownFingerprints[ja3]
+			botFp = firewall.BotFingerprints[ja3]
+		}
+
+		//And HTTP/2 fingerprints
+		if browser == "" && botFp == "" && http2Fp != "" {
+			browser = firewall.KnownFingerprints[http2Fp]
+			botFp = firewall.BotFingerprints[http2Fp]
+		}
+
+		//And hashes of header orders
+		if browser == "" && botFp == "" && headerOrderFp != "" {
+			browser = firewall.KnownFingerprints[headerOrderFp]
+			botFp = firewall.BotFingerprints[headerOrderFp]
+		}
+		firewall.FingerprintsMutex.RUnlock()
+	}
+
+	ja4h := firewall.JA4H(request, headerOrder)
+
+	//JA4 lists are checked last, JA4 (tls) before JA4H (http)
+	firewall.FingerprintsMutex.RLock()
+	for _, fp := range []string{ja4, ja4h} {
+		if browser != "" || botFp != "" || fp == "" {
+			continue
+		}
+		browser = firewall.KnownJA4Fingerprints[fp]
+		botFp = firewall.BotJA4Fingerprints[fp]
 	}
+	firewall.FingerprintsMutex.RUnlock()
+
+	//Count the request towards the statistics of its fingerprint. It counts as blocked unless it gets challenged or passes
+	fpBlocked := true
+	defer func() {
+		firewall.RecordFingerprintRequest(tlsFp, browser+botFp, ip, fpBlocked)
+	}()
 
 	firewall.Mutex.Lock()
 	// Leaving this here for future reference. When the monitor thread that's supposed to prefill these maps lags
@@ -100,57 +163,258 @@ func Middleware(writer http.ResponseWriter, request *http.Request) {
 	firewall.Mutex.Unlock()
 
 	// Record request in multi-window tracking
-	firewall.RecordRequest(ip)
+	firewall.RecordRequest(domainName, ip)
+	firewall.RecordASNRequest(ip)
+	firewall.RecordAttackRequest(domainName, request.URL.Path, tlsFp)
+
+	//Sample requests to domains under attack, along with what happened to them
+	var susLv int
+	captureAction := ""
+	requestURI := request.RequestURI
+
+	//What plugins and scripts get to see of the request
+	hookRequest := func() plugins.Request {
+		return plugins.Request{
+			Domain:           domainName,
+			IP:               ip,
+			Method:           request.Method,
+			URL:              requestURI,
+			Path:             request.URL.Path,
+			Query:            request.URL.RawQuery,
+			Proto:            request.Proto,
+			UserAgent:        request.UserAgent(),
+			Headers:          request.Header,
+			Country:          firewall.GetIPCountryForFilter(ip),
+			ASN:              firewall.GetIPASNForFilter(ip),
+			Reputation:       firewall.GetReputationScore(ip),
+			TLSFingerprint:   tlsFp,
+			JA3:              ja3,
+			JA4:              ja4,
+			JA4H:             ja4h,
+			HTTP2Fingerprint: http2Fp,
+			Browser:          browser,
+			Bot:              botFp,
+			Stage:            domainData.Stage,
+			SusLv:            susLv,
+			Attack:           domainData.RawAttack || domainData.BypassAttack,
+		}
+	}
+
+	//Everyone who wants to know what happened to the request, once it's answered
+	requestStart := time.Now()
+	requestDone := func(watched *captureResponseWriter, action string, reason string) {
+		firewall.ObserveRequest(domainName, ip, action, domainData.Stage, time.Since(requestStart))
+		tracing.Finish(requestSpan, action, reason, watched.status)
+		publishBlocked(action, reason, domainName, ip, requestURI, susLv)
+		logBlocked(action, reason, domainName, ip, requestURI, tlsFp)
+		if action == "block" && scripts.Hooked(domainName, scripts.OnBlock) {
+			scripts.Block(domainName, hookRequest(), reason)
+		}
+		if accesslog.Enabled(domainName) {
+			accesslog.Write(accesslog.Entry{
+				Time:           requestStart,
+				Domain:         domainName,
+				IP:             ip,
+				Method:         request.Method,
+				URI:            requestURI,
+				Proto:          request.Proto,
+				Status:         watched.status,
+				Bytes:          watched.size,
+				Referer:        request.Referer(),
+				UserAgent:      request.UserAgent(),
+				Duration:       float64(time.Since(requestStart).Microseconds()) / 1000,
+				Action:         action,
+				Reason:         reason,
+				SusLv:          susLv,
+				TLSFingerprint: tlsFp,
+				JA4:            ja4,
+			}, request.Header)
+		}
+	}
+
+	if domainData.BufferCooldown > 0 && firewall.ShouldCapture() {
+		captured := &captureResponseWriter{ResponseWriter: writer}
+		writer = captured
+		scheme := "http://"
+		if request.TLS != nil {
+			scheme = "https://"
+		}
+		capturedRequest := firewall.CapturedRequest{
+			Time:             proxy.LastSecondTime,
+			Domain:           domainName,
+			IP:               ip,
+			Method:           request.Method,
+			URL:              scheme + domainName + requestURI,
+			Proto:            request.Proto,
+			Headers:          request.Header.Clone(),
+			HeaderOrder:      headerOrder,
+			TLSFingerprint:   tlsFp,
+			JA3:              ja3,
+			JA4:              ja4,
+			JA4H:             ja4h,
+			HTTP2Fingerprint: http2Fp,
+			Browser:          browser,
+			Bot:              botFp,
+			Stage:            domainData.Stage,
+		}
+		defer func() {
+			capturedRequest.SusLv = susLv
+			capturedRequest.Status = captured.status
+			capturedRequest.Action, capturedRequest.Reason = captured.action(captureAction)
+			firewall.CaptureRequest(capturedRequest)
+			requestDone(captured, capturedRequest.Action, capturedRequest.Reason)
+		}()
+	} else if events.Subscribed(events.RequestBlocked) || scripts.Hooked(domainName, scripts.OnBlock) || logger.Enabled(logger.DebugLevel) || accesslog.Enabled(domainName) || firewall.MetricsEnabled || tracing.Enabled() {
+		//Blocks are told apart by their response, like captured requests
+		watched := &captureResponseWriter{ResponseWriter: writer}
+		writer = watched
+		defer func() {
+			action, reason := watched.action(captureAction)
+			requestDone(watched, action, reason)
+		}()
+	}
 
 	writer.Header().Set("baloo-Proxy", "1.5")
 
+	//SyncMap because semi-readonly
+	settingsQuery, _ := domains.DomainsMap.Load(domainName)
+	domainSettings := settingsQuery.(domains.DomainSettings)
+
 	//Check IP reputation before processing
 	if firewall.IsIPBlocked(ip) {
 		firewall.RecordIPRequest(ip, false, true)
+		firewall.RecordASNAbuse(ip)
+		if firewall.TarpitRepeatOffenders && firewall.Tarpit(writer, request) {
+			return
+		}
 		writer.Header().Set("Content-Type", "text/plain")
 		SendResponse("Blocked by BalooProxy.\nYour IP has been blocked due to suspicious activity.", buffer, writer)
 		return
 	}
 
-	//Start the suspicious level where the stage currently is
-	susLv := domainData.Stage
-
-	// Check whitelist first
-	if firewall.CheckWhitelist(ip) {
-		// Whitelisted IPs bypass rate limiting
-		goto skipRateLimit
+	//Ips on threat feeds are treated according to the strictest list they are on
+	feedAction := feeds.Action(ip)
+	if feeds.Actions[feedAction] < 0 {
+		firewall.RecordIPRequest(ip, false, true)
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusForbidden)
+		SendResponse("Blocked by BalooProxy.\nYour IP is listed as a threat.", buffer, writer)
+		return
 	}
 
-	// Apply adaptive rate limiting
-	adaptiveIPLimit := firewall.GetAdaptiveRateLimit(proxy.IPRatelimit, domainName)
-	adaptiveChallengeLimit := firewall.GetAdaptiveRateLimit(proxy.FailChallengeRatelimit, domainName)
+	//Tor exits are treated according to the tor policy of the domain
+	torLevel := 0
+	if feeds.TorPolicies[domainSettings.TorPolicy] != 0 && feeds.Listed(ip, feeds.TorList) {
+		torLevel = feeds.TorPolicies[domainSettings.TorPolicy]
+		if torLevel < 0 {
+			firewall.RecordIPRequest(ip, false, true)
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusForbidden)
+			SendResponse("Blocked by BalooProxy.\nTor is not allowed on this site.", buffer, writer)
+			return
+		}
+	}
 
-	//Ratelimit faster if client repeatedly fails the verification challenge (feel free to play around with the threshhold)
-	if ipCountCookie > adaptiveChallengeLimit {
-		firewall.UpdateReputation(ip, firewall.ScoreRateLimitHit, "rate_limit_hit")
-		firewall.RecordIPRateLimitHit(ip)
+	//Reject header bloat before it reaches any further parsing
+	if reason := firewall.CheckHeaderLimits(request.Header); reason != "" {
+		scoreEvent(domainSettings, ip, "header_limit")
 		firewall.RecordIPRequest(ip, false, true)
 		writer.Header().Set("Content-Type", "text/plain")
-		SendResponse("Blocked by BalooProxy.\nYou have been ratelimited. (R1)", buffer, writer)
+		writer.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+		SendResponse("Blocked by BalooProxy.\n"+reason+".", buffer, writer)
 		return
 	}
 
-	//Ratelimit spamming Ips (feel free to play around with the threshhold)
-	if ipCount > adaptiveIPLimit {
-		firewall.UpdateReputation(ip, firewall.ScoreRateLimitHit, "rate_limit_hit")
-		firewall.RecordIPRateLimitHit(ip)
+	//Nothing links to honeypots, whoever requests them is scanning the domain
+	if honeypot(domainSettings, request.URL.Path) {
+		scoreEvent(domainSettings, ip, "honeypot_hit")
 		firewall.RecordIPRequest(ip, false, true)
 		writer.Header().Set("Content-Type", "text/plain")
-		SendResponse("Blocked by BalooProxy.\nYou have been ratelimited. (R2)", buffer, writer)
+		writer.WriteHeader(http.StatusForbidden)
+		SendResponse("Blocked by BalooProxy.\nYour request looks like a scan.", buffer, writer)
 		return
 	}
 
-skipRateLimit:
+	//Start the suspicious level where the stage currently is
+	susLv = domainData.Stage
+
+	//Nodes of a cluster challenge as hard as the node that is hit the hardest, unless the stage was locked on this one
+	if !domainData.StageManuallySet {
+		susLv = firewall.ClusterStage(domainName, susLv)
+	}
+
+	//Challenge every ip according to how it behaved so far on top of the stage of the domain. Escalation only ever raises the challenge
+	if firewall.EscalationEnabled && susLv >= 1 && susLv <= 3 {
+		level, banned := firewall.EscalationLevel(ip)
+		if banned {
+			firewall.RecordIPRequest(ip, false, true)
+			writer.Header().Set("Content-Type", "text/plain")
+			SendResponse("Blocked by BalooProxy.\nYou failed too many challenges. Please try again later.", buffer, writer)
+			return
+		}
+		if level > susLv {
+			susLv = level
+		}
+	}
+
+	//Reputation tiers only ever raise the challenge, ips whose tier blocks them were turned away already
+	if level := firewall.ReputationLevel(ip); susLv >= 1 && susLv < level {
+		susLv = level
+	}
+	if level := feeds.Level(feedAction); susLv >= 1 && susLv < level {
+		susLv = level
+	}
+	if susLv >= 1 && susLv < torLevel {
+		susLv = torLevel
+	}
+
+	// Whitelisted IPs bypass rate limiting
+	if !firewall.CheckWhitelist(ip) {
+
+		// Apply adaptive rate limiting, datacenter and vpn ips get less room
+		datacenter, vpn := firewall.ClassifyIP(ip)
+		adaptiveIPLimit := firewall.ClassifiedRateLimit(firewall.GetAdaptiveRateLimit(proxy.IPRatelimit, domainName), datacenter || vpn)
+		adaptiveChallengeLimit := firewall.ClassifiedRateLimit(firewall.GetAdaptiveRateLimit(proxy.FailChallengeRatelimit, domainName), datacenter || vpn)
+
+		//Ratelimit faster if client repeatedly fails the verification challenge (feel free to play around with the threshhold)
+		if ipCountCookie > adaptiveChallengeLimit {
+			scoreEvent(domainSettings, ip, "rate_limit_hit")
+			firewall.RecordIPRateLimitHit(ip)
+			firewall.RecordIPRequest(ip, false, true)
+			writer.Header().Set("Content-Type", "text/plain")
+			SendResponse("Blocked by BalooProxy.\nYou have been ratelimited. (R1)", buffer, writer)
+			return
+		}
+
+		//Ratelimit spamming Ips (feel free to play around with the threshhold). Token buckets let short bursts through and only limit sustained floods
+		ratelimited := ipCount > adaptiveIPLimit
+		if domainSettings.Ratelimit.Mode == "tokenBucket" {
+			ratelimited = !firewall.TakeToken(domainName, ip, domainSettings.Ratelimit.Rate, firewall.GetAdaptiveRateLimit(domainSettings.Ratelimit.Burst, domainName))
+		}
+		if ratelimited {
+			scoreEvent(domainSettings, ip, "rate_limit_hit")
+			firewall.RecordIPRateLimitHit(ip)
+			firewall.RecordIPRequest(ip, false, true)
+			writer.Header().Set("Content-Type", "text/plain")
+			SendResponse("Blocked by BalooProxy.\nYou have been ratelimited. (R2)", buffer, writer)
+			return
+		}
+
+		//Ratelimit ips that keep sending requests for longer than the ratelimit window
+		if firewall.CheckWindowLimits(domainName, ip, domainSettings.WindowLimits) {
+			scoreEvent(domainSettings, ip, "rate_limit_hit")
+			firewall.RecordIPRateLimitHit(ip)
+			firewall.RecordIPRequest(ip, false, true)
+			writer.Header().Set("Content-Type", "text/plain")
+			SendResponse("Blocked by BalooProxy.\nYou have been ratelimited. (R6)", buffer, writer)
+			return
+		}
+	}
 
 	//Ratelimit fingerprints that don't belong to major browsers
 	if browser == "" {
 		if fpCount > proxy.FPRatelimit {
-			firewall.UpdateReputation(ip, firewall.ScoreFingerprintMismatch, "fingerprint_mismatch")
+			scoreEvent(domainSettings, ip, "fingerprint_mismatch")
 			writer.Header().Set("Content-Type", "text/plain")
 			SendResponse("Blocked by BalooProxy.\nYou have been ratelimited. (R3)", buffer, writer)
 			return
@@ -162,51 +426,141 @@ skipRateLimit:
 	}
 
 	//Block user-specified fingerprints
+	firewall.FingerprintsMutex.RLock()
 	forbiddenFp := firewall.ForbiddenFingerprints[tlsFp]
+	if forbiddenFp == "" && ja3 != "" {
+		forbiddenFp = firewall.ForbiddenFingerprints[ja3]
+	}
+	if forbiddenFp == "" && ja4 != "" {
+		forbiddenFp = firewall.ForbiddenJA4Fingerprints[ja4]
+	}
+	if forbiddenFp == "" {
+		forbiddenFp = firewall.ForbiddenJA4Fingerprints[ja4h]
+	}
+	//Bots impersonating the tls fingerprint of a browser usually give themselves away with their HTTP/2 fingerprint
+	if forbiddenFp == "" && http2Fp != "" {
+		forbiddenFp = firewall.ForbiddenFingerprints[http2Fp]
+	}
+	if forbiddenFp == "" && headerOrderFp != "" {
+		forbiddenFp = firewall.ForbiddenFingerprints[headerOrderFp]
+	}
+	firewall.FingerprintsMutex.RUnlock()
 	if forbiddenFp != "" {
+		scoreEvent(domainSettings, ip, "fingerprint_mismatch")
 		writer.Header().Set("Content-Type", "text/plain")
 		SendResponse("Blocked by BalooProxy.\nYour browser "+forbiddenFp+" is not allowed.", buffer, writer)
 		return
 	}
 
 	// Check geo/ASN filtering
-	if firewall.GeoFilteringEnabled {
-		blocked, reason := firewall.CheckGeoFilter(ip)
-		if blocked {
-			if reason == "challenge" {
-				// Challenge unknown IPs instead of blocking
-				susLv = 3 // Force captcha challenge
-			} else {
-				writer.Header().Set("Content-Type", "text/plain")
-				SendResponse("Blocked by BalooProxy.\n"+reason, buffer, writer)
-				return
-			}
+	geoBypass := false
+	if domainSettings.GeoFiltering.Enabled {
+		_, geoSpan := tracing.Start(request.Context(), "geo.lookup")
+		action, reason := firewall.CheckGeoFilter(ip, domainSettings.GeoFiltering)
+		geoSpan.SetAttributes(attribute.String("balooproxy.geo.action", action))
+		geoSpan.End()
+		if action == "block" {
+			scoreEvent(domainSettings, ip, "geo_violation")
+			writer.Header().Set("Content-Type", "text/plain")
+			SendResponse("Blocked by BalooProxy.\n"+reason, buffer, writer)
+			return
 		}
+		// Challenged countries, ASNs and unknown ips have to solve at least their challenge
+		if level := firewall.GeoActionLevels[action]; susLv < level {
+			susLv = level
+		}
+		geoBypass = action == "bypass"
 	}
 
 	//Demonstration of how to use "susLv". Essentially allows you to challenge specific requests with a higher challenge
 
-	//SyncMap because semi-readonly
-	settingsQuery, _ := domains.DomainsMap.Load(domainName)
-	domainSettings := settingsQuery.(domains.DomainSettings)
+	//Tighter limits for expensive paths, e.g. logins, on top of the global ratelimit
+	if limit, ok := pathRatelimit(domainSettings, request.URL.Path); ok && !firewall.CheckWhitelist(ip) {
+		key := firewall.PathWindowKey(ip, limit.Path)
+		firewall.RecordRequest(domainName, key)
+		if firewall.GetRequestCount(domainName, key, limit.Window) > limit.Requests {
+			scoreEvent(domainSettings, ip, "rate_limit_hit")
+			firewall.RecordIPRateLimitHit(ip)
+			firewall.RecordIPRequest(ip, false, true)
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusTooManyRequests)
+			SendResponse("Blocked by BalooProxy.\nYou have been ratelimited. (R5)", buffer, writer)
+			return
+		}
+	}
+
+	//Shape the traffic of whole countries, ips that are still being looked up aren't counted
+	if len(domainSettings.CountryRatelimits) != 0 && !firewall.CheckWhitelist(ip) {
+		if country := firewall.GetIPCountry(ip); country != "" {
+			if limit, ok := countryRatelimit(domainSettings, strings.ToUpper(country)); ok {
+				key := firewall.CountryWindowKey(strings.ToUpper(country))
+				firewall.RecordRequest(domainName, key)
+				if firewall.GetRequestCount(domainName, key, limit.Window) > limit.Requests {
+					firewall.RecordIPRequest(ip, false, true)
+					writer.Header().Set("Content-Type", "text/plain")
+					writer.WriteHeader(http.StatusTooManyRequests)
+					SendResponse("Blocked by BalooProxy.\nYou have been ratelimited. (R7)", buffer, writer)
+					return
+				}
+			}
+		}
+	}
+
+	//Reject oversized bodies before anything gets to buffer or forward them
+	if maxBodySize := bodyLimit(domainSettings, request.URL.Path); maxBodySize > 0 {
+		if request.ContentLength > maxBodySize {
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			SendResponse("Blocked by BalooProxy.\nRequest body too large.", buffer, writer)
+			return
+		}
+		request.Body = http.MaxBytesReader(writer, request.Body, maxBodySize)
+	}
+	if firewall.SlowReadEnabled && request.Body != nil && request.Body != http.NoBody {
+		request.Body = firewall.TrackBodyRead(request.RemoteAddr, request.Body)
+	}
 
 	reqUa := request.UserAgent()
 
-		if len(domainSettings.CustomRules) != 0 {
+	body, ok := inspectRequestBody(writer, request, domainSettings, buffer)
+	if !ok {
+		return
+	}
+
+	ruleResult := firewall.RuleResult{SusLv: susLv, Ratelimit: -1}
+	if len(domainSettings.CustomRules) != 0 || domainSettings.RemoteRules.Len() != 0 {
+		_, rulesSpan := tracing.Start(request.Context(), "firewall.rules")
+
 		// Get geo data for firewall rules
 		ipCountry := firewall.GetIPCountryForFilter(ip)
 		ipASN := firewall.GetIPASNForFilter(ip)
+		datacenter, vpn := firewall.ClassifyIP(ip)
 		
 		requestVariables := gofilter.Message{
 			"ip.src":                net.ParseIP(ip),
 			"ip.country":            ipCountry,
 			"ip.asn":                ipASN,
+			"ip.reputation":         firewall.GetReputationScore(ip),
+			"ip.subnet_reputation":  firewall.GetSubnetReputationScore(ip),
+			"ip.datacenter":         datacenter,
+			"ip.is_datacenter":      datacenter,
+			"ip.is_vpn":             vpn,
+			"asn.reputation":        firewall.GetASNReputationScore(ipASN),
+			"ip.threat_feeds":       strings.Join(feeds.Lookup(ip), ","),
+			"ip.tor":                feeds.Listed(ip, feeds.TorList),
 			"ip.engine":             browser,
 			"ip.bot":                botFp,
 			"ip.fingerprint":        tlsFp,
+			"ip.ja3":                ja3,
+			"ip.ja4":                ja4,
+			"ip.ja4h":               ja4h,
+			"ip.http2_fingerprint":  http2Fp,
 			"ip.http_requests":      ipCount,
 			"ip.challenge_requests": ipCountCookie,
 
+			"tls.ja3": ja3,
+			"tls.ja4": ja4,
+
 			"http.host":       domainName,
 			"http.version":    request.Proto,
 			"http.method":     request.Method,
@@ -216,6 +570,9 @@ skipRateLimit:
 			"http.user_agent": strings.ToLower(reqUa),
 			"http.cookie":     request.Header.Get("Cookie"),
 
+			"http.header_order":      headerOrderStr,
+			"http.header_order_hash": headerOrderFp,
+
 			"proxy.stage":         domainData.Stage,
 			"proxy.cloudflare":    domains.Config.Proxy.Cloudflare,
 			"proxy.stage_locked":  domainData.StageManuallySet,
@@ -225,14 +582,127 @@ skipRateLimit:
 			"proxy.rps_allowed":   domainData.RequestsBypassedPerSecond,
 		}
 
-		susLv = firewall.EvalFirewallRule(domainSettings, requestVariables, susLv)
+		if domainSettings.BodyInspection.Enabled {
+			requestVariables["http.body"] = string(body.Raw)
+			requestVariables["http.body.keys"] = body.Keys
+			requestVariables["http.body.values"] = body.Values
+			requestVariables["http.body.truncated"] = body.Truncated
+		}
+
+		for _, name := range firewall.RuleHeaders() {
+			requestVariables["http.header."+name] = request.Header.Values(name)
+		}
+
+		ruleResult = firewall.EvalFirewallRule(domainSettings, requestVariables, susLv)
+		susLv = ruleResult.SusLv
+		rulesSpan.SetAttributes(attribute.Int("balooproxy.suslv", susLv))
+		rulesSpan.End()
+	}
+
+	if ruleResult.Ratelimit != -1 {
+		scoreEvent(domainSettings, ip, "rate_limit_hit")
+		firewall.RecordIPRateLimitHit(ip)
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusTooManyRequests)
+		SendResponse("Blocked by BalooProxy.\nYou have been ratelimited. (R4)", buffer, writer)
+		return
+	}
+
+	if ruleResult.Redirect != "" {
+		http.Redirect(writer, request, ruleResult.Redirect, http.StatusFound)
+		return
+	}
+
+	//Injection attempts are rare among legitimate requests, so the waf doesn't wait for an attack. Whitelisted requests are left alone
+	wafMatch := ""
+	if domainSettings.WAF.Enabled && susLv >= 1 && susLv <= 3 {
+		signature, matched := firewall.CheckWAF(firewall.WAFRequest{
+			Path:    request.URL.Path,
+			Query:   request.URL.RawQuery,
+			Body:    body.Values,
+			Headers: []string{reqUa, request.Referer()},
+		}, domainSettings.WAF.Classes, domainSettings.WAF.Exclude)
+		if !matched && firewall.HasCRSRules(domainName) {
+			signature, matched = firewall.CheckCRS(domainName, crsRequest(request, body), domainSettings.WAF.Exclude)
+		}
+		if matched {
+			scoreEvent(domainSettings, ip, "waf_match")
+			switch domainSettings.WAF.Action {
+			case "block":
+				writer.Header().Set("Content-Type", "text/plain")
+				writer.WriteHeader(http.StatusForbidden)
+				SendResponse("Blocked by BalooProxy.\nYour request looks like an attack ("+signature.ID+").", buffer, writer)
+				return
+			case "challenge":
+				if susLv < 2 {
+					susLv = 2
+				}
+			}
+			wafMatch = signature.ID
+		}
+	}
+
+	scopePath := clearanceScopePath(request)
+
+	//Sensitive paths (login, checkout, ...) are challenged even if the domain isn't under attack. Whitelisted and blocked requests are left alone
+	if forced := forcedStage(domainSettings, request, scopePath); susLv >= 1 && susLv < forced {
+		susLv = forced
+	}
+
+	//Make new clients prove they are human before they queue up for an overloaded backend
+	if firewall.BackendOverloadAction == "challenge" && susLv == 1 && firewall.BackendsSaturated(domainSettings.Backends.List()) {
+		susLv = 2
+	}
+
+	//Plugins get the last say before the challenge, blocked requests are already gone
+	if plugins.Loaded() && susLv <= 3 {
+		decision, reason, plugin := plugins.Filter(hookRequest())
+		switch decision {
+		case plugins.Block:
+			blockedBy(writer, buffer, ip, "plugin "+plugin, reason)
+			return
+		case plugins.Challenge:
+			if susLv >= 1 && susLv < 2 {
+				susLv = 2
+			}
+		case plugins.Allow:
+			if susLv >= 1 {
+				susLv = 0
+			}
+		}
+	}
+
+	//Scripts decide after plugins, they can't unblock requests either
+	if susLv <= 3 && scripts.Hooked(domainName, scripts.OnRequest) {
+		switch action, reason := scripts.Request(domainName, hookRequest(), request, writer); action {
+		case "":
+		case "block":
+			blockedBy(writer, buffer, ip, "script", reason)
+			return
+		case "allow":
+			if susLv >= 1 {
+				susLv = 0
+			}
+		default:
+			if level := scripts.Level(action); susLv >= 1 && susLv < level {
+				susLv = level
+			}
+		}
+	}
+
+	//Exempted requests (webhooks, monitoring, trusted ASNs, ...) skip challenges, but are still ratelimited and can still be blocked
+	if susLv >= 1 && susLv <= 3 && (geoBypass || challengeExempted(domainSettings, request, ip)) {
+		susLv = 0
 	}
 
 	//Check if encryption-result is already "cached" to prevent load on reverse proxy
 	encryptedIP := ""
 	hashedEncryptedIP := ""
 	susLvStr := utils.StageToString(susLv)
-	accessKey := ip + tlsFp + reqUa + proxy.CurrHourStr
+	binding := firewall.CookieBinding(ip, tlsFp, ja4, http2Fp)
+
+	clearanceKey, cookiePrefix, cookieAttributes := clearanceScope(domainSettings, domainData, scopePath, 0)
+	accessKey := binding + reqUa + clearanceKey
 	encryptedCache, encryptedExists := firewall.CacheIps.Load(accessKey + susLvStr)
 
 	if !encryptedExists {
@@ -248,11 +718,15 @@ skipRateLimit:
 		case 3:
 			encryptedIP = utils.Encrypt(accessKey, proxy.CaptchaOTP)
 		default:
+			if susLv == firewall.SusLvTarpit && firewall.Tarpit(writer, request) {
+				return
+			}
 			writer.Header().Set("Content-Type", "text/plain")
 			SendResponse("Blocked by BalooProxy.\nSuspicious request of level "+susLvStr+" (base "+strconv.Itoa(domainData.Stage)+")", buffer, writer)
 			return
 		}
 		firewall.CacheIps.Store(accessKey+susLvStr, encryptedIP)
+		firewall.RecordClearance(encryptedIP, binding)
 	} else {
 		encryptedIP = encryptedCache.(string)
 		cachedHIP, foundCachedHIP := firewall.CacheIps.Load(encryptedIP)
@@ -261,34 +735,108 @@ skipRateLimit:
 		}
 	}
 
-	//Check if client provided correct verification result
-	if !strings.Contains(request.Header.Get("Cookie"), "__bProxy_v="+encryptedIP) {
+	//With browser signals solving the js challenge isn't enough, its clearance is only handed out once the signals were verified
+	clearance := encryptedIP
+	if susLv == 2 && domainSettings.BrowserSignals.Enabled {
+		clearance = signalsClearance(encryptedIP)
+		if !encryptedExists {
+			firewall.RecordClearance(clearance, binding)
+		}
+	}
+
+	// Calculate dynamic difficulty based on reputation and attack status
+	dynamicDifficulty := 0
+	if susLv == 2 {
+		dynamicDifficulty = firewall.GetEffectiveDifficulty(ip, domainName)
+		if ruleResult.Difficulty != 0 {
+			dynamicDifficulty = ruleResult.Difficulty
+		}
+	}
+
+	//Clearance tokens are verified without any state, so they are honored no matter which node issued them. Tokens of an easier js challenge don't clear a harder one
+	tokenCleared := firewall.ClearanceTokensEnabled && susLv >= 1 && susLv <= 3 && clearanceTokenValid(request, domainSettings, cookiePrefix, ip, binding+reqUa, susLv, dynamicDifficulty)
+
+	fpBlocked = false
+
+	//Check if client provided correct verification result. Requests that aren't challenged (whitelisted/exempted) don't count as failed challenges
+	verified := true
+	if susLv != 0 {
+		_, verifySpan := tracing.Start(request.Context(), "challenge.verify", attribute.Int("balooproxy.challenge.level", susLv))
+		verified = tokenCleared || strings.Contains(request.Header.Get("Cookie"), "__bProxy_v="+clearance) || renewClearance(writer, request, domainSettings, domainData, scopePath, binding+reqUa, susLv, clearance)
+		verifySpan.SetAttributes(attribute.Bool("balooproxy.challenge.passed", verified))
+		verifySpan.End()
+	}
+	if !verified {
+
+		//Clearances solved by someone else are rejected like any other wrong cookie, but the client gets penalized for it aswell
+		if firewall.SharedClearance(request.Header.Get("Cookie"), binding) {
+			scoreEvent(domainSettings, ip, "cookie_sharing")
+		}
 
 		firewall.Mutex.Lock()
 		firewall.WindowAccessIpsCookie[proxy.Last10SecondTimestamp][ip]++
 		firewall.Mutex.Unlock()
+		captureAction = "challenge"
+
+		//Clients that sent a clearance which isn't valid (anymore) failed their challenge, the others didn't try yet
+		if strings.Contains(request.Header.Get("Cookie"), "__bProxy_v=") && susLv <= 3 && scripts.Hooked(domainName, scripts.OnChallengeResult) {
+			if action, reason := scripts.ChallengeResult(domainName, hookRequest(), false, request, writer); action == "block" {
+				blockedBy(writer, buffer, ip, "script", reason)
+				return
+			}
+		}
+
+		//Only a clearance of this level that was rejected counts as failed here, challenges that are never solved count once they're abandoned
+		if firewall.EscalationEnabled && susLv <= 3 && strings.Contains(request.Header.Get("Cookie"), "_"+strconv.Itoa(susLv)+"__bProxy_v=") {
+			firewall.RecordEscalationFailure(ip, susLv)
+		}
 
 		//Respond with verification challenge if client didnt provide correct result/none
 		switch susLv {
 		case 0:
 			//This request is not to be challenged (whitelist)
 		case 1:
+			firewall.RecordChallengeIssued(encryptedIP, domainName, 1, 0, ip)
+
 			// Track challenge failure for reputation
-			firewall.UpdateReputation(ip, firewall.ScoreChallengeFailure, "challenge_failure")
+			scoreEvent(domainSettings, ip, "challenge_failure")
 			firewall.RecordIPChallengeFailure(ip)
 			firewall.RecordIPRequest(ip, false, false)
-			writer.Header().Set("Set-Cookie", "_1__bProxy_v="+encryptedIP+"; SameSite=Lax; path=/; Secure")
+			writer.Header().Set("Set-Cookie", cookiePrefix+"_1__bProxy_v="+encryptedIP+cookieAttributes)
 			http.Redirect(writer, request, request.URL.RequestURI(), http.StatusFound)
 			return
 		case 2:
-			// Calculate dynamic difficulty based on reputation and attack status
-			dynamicDifficulty := firewall.GetEffectiveDifficulty(ip, domainName)
+			if serveBrowserSignals(writer, request, domainSettings, ip, encryptedIP, cookiePrefix+"_2__bProxy_v="+clearance+cookieAttributes, buffer) {
+				return
+			}
+			if serveFallback(writer, request, domainSettings, ip, encryptedIP, 2, cookiePrefix+"_2__bProxy_v="+clearance+cookieAttributes, buffer) {
+				return
+			}
+
 			publicSalt := encryptedIP[:len(encryptedIP)-dynamicDifficulty]
+			firewall.RecordChallengeIssued(encryptedIP, domainName, 2, dynamicDifficulty, ip)
 			writer.Header().Set("Content-Type", "text/html")
 			writer.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0") // Prevent special(ed) browsers from caching the challenge
-			SendResponse(`<!doctypehtml><html lang=en><meta charset=UTF-8><meta content="width=device-width,initial-scale=1"name=viewport><title>Completing challenge ...</title><style>body,html{height:100%;width:100%;margin:0;display:flex;flex-direction:column;justify-content:center;align-items:center;background-color:#f0f0f0;font-family:Arial,sans-serif}.loader{display:flex;justify-content:space-around;align-items:center;width:100px;height:100px}.loader div{width:20px;height:20px;background-color:#333;border-radius:50%;animation:bounce .6s infinite alternate}.loader div:nth-child(2){animation-delay:.2s}.loader div:nth-child(3){animation-delay:.4s}@keyframes bounce{to{transform:translateY(-30px)}}.message{text-align:center;margin-top:20px;color:#333}.subtext{text-align:center;color:#666;font-size:.9em;margin-top:5px}.placeholder-container{width:25%;text-align:center;margin:10px 0}.placeholder-label{font-weight:700;margin-bottom:5px}.placeholder{background-color:#e0e0e0;padding:10px;border-radius:5px;word-break:break-all;font-family:monospace;cursor:pointer;}</style><div class=loader><div></div><div></div><div></div></div><div class=message><p>Completing challenge ...<div class=subtext>The process is automatic and shouldn't take too long. Please be patient.</div></div><div class=placeholder-container><div class=placeholder-label>publicSalt:</div><div class=placeholder id=publicSalt onclick='ctc("publicSalt")'><span>`+publicSalt+`</span></div></div><div class=placeholder-container><div class=placeholder-label>challenge:</div><div class=placeholder id=challenge onclick='ctc("challenge")'><span>`+hashedEncryptedIP+`</span></div></div><script>function ctc(t){navigator.clipboard.writeText(document.getElementById(t).innerText)}</script><script src="https://cdn.jsdelivr.net/gh/41Baloo/balooPow@main/balooPow.min.js"></script><script src="https://cdnjs.cloudflare.com/ajax/libs/crypto-js/4.0.0/crypto-js.min.js"></script><script>function solved(e){document.cookie="_2__bProxy_v=`+publicSalt+`"+e.solution+"; SameSite=Lax; path=/; Secure",location.href=location.href}new BalooPow("`+publicSalt+`",`+strconv.Itoa(dynamicDifficulty)+`,"`+hashedEncryptedIP+`",!1).Solve().then(e=>{if(e.match == ""){solved(e)}else alert("Navigator Missmatch ("+e.match+"). Please contact @ddosmitigation")});</script>`, buffer, writer)
+			solvedScript := `document.cookie="` + cookiePrefix + `_2__bProxy_v=` + publicSalt + `"+e.solution+"` + cookieAttributes + `",location.href=location.href`
+			if domainSettings.BrowserSignals.Enabled {
+				solvedScript = browserSignalsScript(publicSalt)
+			}
+			challengeScript := `<script src="https://cdn.jsdelivr.net/gh/41Baloo/balooPow@main/balooPow.min.js"></script><script src="https://cdnjs.cloudflare.com/ajax/libs/crypto-js/4.0.0/crypto-js.min.js"></script><script>function solved(e){` + solvedScript + `}new BalooPow("` + publicSalt + `",` + strconv.Itoa(dynamicDifficulty) + `,"` + hashedEncryptedIP + `",!1).Solve().then(e=>{if(e.match == ""){solved(e)}else alert("Navigator Missmatch ("+e.match+"). Please contact @ddosmitigation")});</script>`
+			challengeScript += fallbackMarkup(domainSettings.Fallback, request, ip, encryptedIP, 2)
+			if domainSettings.Templates.Stage2 != nil {
+				SendResponse(renderChallenge(domainSettings.Templates, domainSettings.Templates.Stage2, domainName, request, challengeScript), buffer, writer)
+				return
+			}
+			SendResponse(`<!doctypehtml><html lang=en><meta charset=UTF-8><meta content="width=device-width,initial-scale=1"name=viewport><title>Completing challenge ...</title><style>body,html{height:100%;width:100%;margin:0;display:flex;flex-direction:column;justify-content:center;align-items:center;background-color:#f0f0f0;font-family:Arial,sans-serif}.loader{display:flex;justify-content:space-around;align-items:center;width:100px;height:100px}.loader div{width:20px;height:20px;background-color:#333;border-radius:50%;animation:bounce .6s infinite alternate}.loader div:nth-child(2){animation-delay:.2s}.loader div:nth-child(3){animation-delay:.4s}@keyframes bounce{to{transform:translateY(-30px)}}.message{text-align:center;margin-top:20px;color:#333}.subtext{text-align:center;color:#666;font-size:.9em;margin-top:5px}.placeholder-container{width:25%;text-align:center;margin:10px 0}.placeholder-label{font-weight:700;margin-bottom:5px}.placeholder{background-color:#e0e0e0;padding:10px;border-radius:5px;word-break:break-all;font-family:monospace;cursor:pointer;}</style><div class=loader><div></div><div></div><div></div></div><div class=message><p>Completing challenge ...<div class=subtext>The process is automatic and shouldn't take too long. Please be patient.</div></div><div class=placeholder-container><div class=placeholder-label>publicSalt:</div><div class=placeholder id=publicSalt onclick='ctc("publicSalt")'><span>`+publicSalt+`</span></div></div><div class=placeholder-container><div class=placeholder-label>challenge:</div><div class=placeholder id=challenge onclick='ctc("challenge")'><span>`+hashedEncryptedIP+`</span></div></div><script>function ctc(t){navigator.clipboard.writeText(document.getElementById(t).innerText)}</script>`+challengeScript, buffer, writer)
 			return
 		case 3:
+			if !challengeAnswer(request) {
+				firewall.RecordChallengeIssued(encryptedIP, domainName, 3, 0, ip)
+			}
+			if domainSettings.Captcha.Provider != "" && serveCaptchaProvider(writer, request, domainSettings, ip, cookiePrefix+"_3__bProxy_v="+encryptedIP+cookieAttributes, buffer) {
+				return
+			}
+
 			secretPart := encryptedIP[:6]
 			publicPart := encryptedIP[6:]
 
@@ -348,15 +896,37 @@ skipRateLimit:
 				maskData = captchaDataTmp[1]
 			}
 
+			captchaWidget := `<div class=captcha-wrapper><canvas height=37 id=captcha width=100></canvas><canvas height=37 id=mask width=100></canvas></div><input id=captcha-slider max=50 min=-50 type=range><form onsubmit="return checkAnswer(event)"><input id=text type=text maxlength=6 placeholder=Solution required> <button type=submit>Submit</button></form><div class=success id=successMessage style=display:none>Success! Redirecting ...</div><div class=failure id=failMessage style=display:none>Failed! Please try again.</div>`
+			captchaScript := `<script>let captcha_canvas=document.getElementById("captcha"),captcha_ctx=captcha_canvas.getContext("2d"),mask_canvas=document.getElementById("mask"),mask_ctx=mask_canvas.getContext("2d"),slider=document.getElementById("captcha-slider"),demo_slider=!1,demo_val=1;var i,captcha_image=new Image,mask_image=new Image;function checkAnswer(e){e.preventDefault();var a=document.getElementById("text").value;document.cookie="` + cookiePrefix + ip + `_3__bProxy_v="+a+"` + publicPart + cookieAttributes + `",fetch("https://"+location.hostname+"/_bProxy/verified?path="+encodeURIComponent(location.pathname)).then(function(e){return e.text()}).then(function(e){"verified"===e?(document.getElementById("successMessage").style.display="block",setInterval(function(){var e=document.getElementById("box"),a=e.offsetHeight,t=setInterval(function(){a-=20,e.style.height=a+"px";for(var c=e.children,s=0;s<c.length;s++)c[s].style.opacity=0;a<=0&&(e.style.height="0",e.remove(),clearInterval(t),location.href=location.href)},20)},1e3)):(document.getElementById("failMessage").style.display="block",setInterval(function(){location.href=location.href},1e3))}).catch(function(e){document.getElementById("failMessage").style.display="block",setInterval(function(){location.href=location.href},1e3)})}captcha_image.onload=function(){captcha_ctx.drawImage(captcha_image,(captcha_canvas.width-captcha_image.width)/2,(captcha_canvas.height-captcha_image.height)/2)},captcha_image.src="data:image/png;base64,` + captchaData + `",mask_image.onload=function(){mask_ctx.drawImage(mask_image,(mask_canvas.width-mask_image.width)/2,(mask_canvas.height-mask_image.height)/2)},mask_image.src="data:image/png;base64,` + maskData + `";let demo_int=setInterval(()=>{if(!demo_slider){clearInterval(demo_int);return}slider.value<=-50&&(demo_val=1),slider.value>=50&&(demo_val=-1),slider.value=parseInt(slider.value)+demo_val,updateCaptcha()},50);function updateCaptcha(){let e=parseInt(slider.value);mask_ctx.clearRect(0,0,mask_canvas.width,mask_canvas.height),mask_ctx.drawImage(mask_image,(mask_canvas.width-mask_image.width)/2+e,0)}slider.oninput=function(){demo_slider=!1,updateCaptcha()};var coll=document.getElementsByClassName("collapsible");for(i=0;i<coll.length;i++)coll[i].addEventListener("click",function(){this.classList.toggle("active");var e=this.nextElementSibling;e.style.maxHeight?e.style.maxHeight=null:e.style.maxHeight=e.scrollHeight+"px"});</script>`
+
 			writer.Header().Set("Content-Type", "text/html")
 			writer.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0") // Prevent special(ed) browsers from caching the challenge
-			SendResponse(`<style>body{background-color:#f5f5f5;font-family:Arial,sans-serif}.center{display:flex;align-items:center;justify-content:center;height:100vh}.box{background-color:#fff;border:1px solid #ddd;border-radius:4px;padding:20px;width:500px}canvas{display:block;margin:0 auto;max-width:100%;width:100%;height:auto}input[type=text]{width:100%;padding:12px 20px;margin:8px 0;box-sizing:border-box;border:2px solid #ccc;border-radius:4px}button{width:100%;background-color:#4caf50;color:#fff;padding:14px 20px;margin:8px 0;border:none;border-radius:4px;cursor:pointer}button:hover{background-color:#45a049}.box{background-color:#fff;border:1px solid #ddd;border-radius:4px;padding:20px;width:500px;transition:height .1s;position:block}.box *{transition:opacity .1s}.success{background-color:#dff0d8;border:1px solid #d6e9c6;border-radius:4px;color:#3c763d;padding:20px}.failure{background-color:#f0d8d8;border:1px solid #e9c6c6;border-radius:4px;color:#763c3c;padding:20px}.collapsible{background-color:#f5f5f5;color:#444;cursor:pointer;padding:18px;width:100%;border:none;text-align:left;outline:0;font-size:15px}.collapsible:after{content:'\002B';color:#777;font-weight:700;float:right;margin-left:5px}.collapsible.active:after{content:"\2212"}.collapsible:hover{background-color:#e5e5e5}.collapsible-content{padding:0 18px;max-height:0;overflow:hidden;transition:max-height .2s ease-out;background-color:#f5f5f5}.captcha-wrapper{position:relative;width:100%;height:200px}.captcha-wrapper canvas{position:absolute}input[type=range]{-webkit-appearance:none;width:100%;height:25px;background:#ddd;outline:0;opacity:.7;transition:opacity .2s;border-radius:4px;margin:8px 0}input[type=range]:hover{opacity:1}input[type=range]::-webkit-slider-thumb{-webkit-appearance:none;appearance:none;width:25px;height:25px;background:#4caf50;cursor:pointer;border-radius:50%}input[type=range]::-moz-range-thumb{width:25px;height:25px;background:#4caf50;cursor:pointer;border-radius:50%}</style><div class=center id=center><div class=box id=box><h1>Drag the <b>slider</b> and enter the <b>green</b> text you see in the picture</h1><div class=captcha-wrapper><canvas height=37 id=captcha width=100></canvas><canvas height=37 id=mask width=100></canvas></div><input id=captcha-slider max=50 min=-50 type=range><form onsubmit="return checkAnswer(event)"><input id=text type=text maxlength=6 placeholder=Solution required> <button type=submit>Submit</button></form><div class=success id=successMessage style=display:none>Success! Redirecting ...</div><div class=failure id=failMessage style=display:none>Failed! Please try again.</div><button class=collapsible>Why am I seeing this page?</button><div class=collapsible-content><p>The website you are trying to visit needs to make sure that you are not a bot. This is a common security measure to protect websites from automated spam and abuse. By entering the characters you see in the picture, you are helping to verify that you are a real person.</div></div></div><script>let captcha_canvas=document.getElementById("captcha"),captcha_ctx=captcha_canvas.getContext("2d"),mask_canvas=document.getElementById("mask"),mask_ctx=mask_canvas.getContext("2d"),slider=document.getElementById("captcha-slider"),demo_slider=!1,demo_val=1;var i,captcha_image=new Image,mask_image=new Image;function checkAnswer(e){e.preventDefault();var a=document.getElementById("text").value;document.cookie="`+ip+`_3__bProxy_v="+a+"`+publicPart+`; SameSite=Lax; path=/; Secure",fetch("https://"+location.hostname+"/_bProxy/verified").then(function(e){return e.text()}).then(function(e){"verified"===e?(document.getElementById("successMessage").style.display="block",setInterval(function(){var e=document.getElementById("box"),a=e.offsetHeight,t=setInterval(function(){a-=20,e.style.height=a+"px";for(var c=e.children,s=0;s<c.length;s++)c[s].style.opacity=0;a<=0&&(e.style.height="0",e.remove(),clearInterval(t),location.href=location.href)},20)},1e3)):(document.getElementById("failMessage").style.display="block",setInterval(function(){location.href=location.href},1e3))}).catch(function(e){document.getElementById("failMessage").style.display="block",setInterval(function(){location.href=location.href},1e3)})}captcha_image.onload=function(){captcha_ctx.drawImage(captcha_image,(captcha_canvas.width-captcha_image.width)/2,(captcha_canvas.height-captcha_image.height)/2)},captcha_image.src="data:image/png;base64,`+captchaData+`",mask_image.onload=function(){mask_ctx.drawImage(mask_image,(mask_canvas.width-mask_image.width)/2,(mask_canvas.height-mask_image.height)/2)},mask_image.src="data:image/png;base64,`+maskData+`";let demo_int=setInterval(()=>{if(!demo_slider){clearInterval(demo_int);return}slider.value<=-50&&(demo_val=1),slider.value>=50&&(demo_val=-1),slider.value=parseInt(slider.value)+demo_val,updateCaptcha()},50);function updateCaptcha(){let e=parseInt(slider.value);mask_ctx.clearRect(0,0,mask_canvas.width,mask_canvas.height),mask_ctx.drawImage(mask_image,(mask_canvas.width-mask_image.width)/2+e,0)}slider.oninput=function(){demo_slider=!1,updateCaptcha()};var coll=document.getElementsByClassName("collapsible");for(i=0;i<coll.length;i++)coll[i].addEventListener("click",function(){this.classList.toggle("active");var e=this.nextElementSibling;e.style.maxHeight?e.style.maxHeight=null:e.style.maxHeight=e.scrollHeight+"px"});</script>`, buffer, writer)
+			if domainSettings.Templates.Stage3 != nil {
+				SendResponse(renderChallenge(domainSettings.Templates, domainSettings.Templates.Stage3, domainName, request, `<style>`+captchaWidgetCSS+`</style><div id=box>`+captchaWidget+`</div>`+captchaScript), buffer, writer)
+				return
+			}
+			SendResponse(`<style>`+captchaPageCSS+captchaWidgetCSS+`</style><div class=center id=center><div class=box id=box><h1>Drag the <b>slider</b> and enter the <b>green</b> text you see in the picture</h1>`+captchaWidget+`<button class=collapsible>Why am I seeing this page?</button><div class=collapsible-content><p>The website you are trying to visit needs to make sure that you are not a bot. This is a common security measure to protect websites from automated spam and abuse. By entering the characters you see in the picture, you are helping to verify that you are a real person.</div></div></div>`+captchaScript, buffer, writer)
 			return
 		default:
+			fpBlocked = true
 			writer.Header().Set("Content-Type", "text/plain")
 			SendResponse("Blocked by BalooProxy.\nSuspicious request of level "+susLvStr, buffer, writer)
 			return
 		}
+	} else if susLv != 0 {
+		if scripts.Hooked(domainName, scripts.OnChallengeResult) {
+			if action, reason := scripts.ChallengeResult(domainName, hookRequest(), true, request, writer); action == "block" {
+				blockedBy(writer, buffer, ip, "script", reason)
+				return
+			}
+		}
+		firewall.RecordChallengeSolved(encryptedIP)
+		if firewall.EscalationEnabled {
+			firewall.RecordEscalationPass(ip)
+		}
+		if !tokenCleared && firewall.CanIssueClearanceTokens() {
+			issueClearanceToken(writer, domainSettings, domainData, cookiePrefix, ip, binding+reqUa, susLv, dynamicDifficulty)
+		}
 	}
 
 	//Access logs of clients that passed the challenge
@@ -367,8 +937,16 @@ skipRateLimit:
 		BrowserFP: browser,
 		BotFP:     botFp,
 		TLSFP:     tlsFp,
+		JA3:       ja3,
+		JA4:       ja4,
+		JA4H:      ja4h,
+		HTTP2:     http2Fp,
+		HeaderFP:  headerOrderFp,
 		Useragent: reqUa,
 		Path:      request.RequestURI,
+
+		LoggedRules: ruleResult.Logged,
+		WAF:         wafMatch,
 	}, domainName)
 
 	domainData = domains.DomainsData[domainName]
@@ -377,7 +955,7 @@ skipRateLimit:
 	firewall.Mutex.Unlock()
 
 	// Update reputation for successful access
-	firewall.UpdateReputation(ip, firewall.ScoreSuccessfulAccess, "successful_access")
+	scoreEvent(domainSettings, ip, "successful_access")
 	
 	// Update whitelist learning
 	firewall.UpdateWhitelistLearning(ip, true)
@@ -421,11 +999,42 @@ skipRateLimit:
 		}
 	}
 
+	//Paths only some networks or users may see, challenges come first so passwords can't be guessed at full speed
+	if !protectPath(writer, request, domainSettings, ip, buffer) {
+		return
+	}
+
+	//Protected apps only get requests the auth service let through, along with who made them
+	if !forwardAuth(writer, request, domainSettings.ForwardAuth, ip) {
+		return
+	}
+
 	//Allow backend to read client information
 	request.Header.Add("x-real-ip", ip)
 	request.Header.Add("proxy-real-ip", ip)
 	request.Header.Add("proxy-tls-fp", tlsFp)
+	request.Header.Add("proxy-tls-ja3", ja3)
+	request.Header.Add("proxy-tls-ja4", ja4)
+	request.Header.Add("proxy-http-ja4h", ja4h)
+	request.Header.Add("proxy-http2-fingerprint", http2Fp)
+	request.Header.Add("proxy-http-header-order", headerOrderFp)
 	request.Header.Add("proxy-tls-name", browser+botFp)
 
+	if domainSettings.ProxyProtocol != 0 {
+		clientPort := 0
+		if !forwarded {
+			_, portStr, _ := net.SplitHostPort(request.RemoteAddr)
+			clientPort, _ = strconv.Atoi(portStr)
+		}
+		request = request.WithContext(WithClientAddr(request.Context(), ip, clientPort))
+	}
+
+	request, release, ok := reserveCapacity(writer, request, domainSettings, firewall.Prioritized(ip, susLv != 0 && verified), buffer)
+	if !ok {
+		return
+	}
+	defer release()
+
+	captureAction = "allow"
 	domainSettings.DomainProxy.ServeHTTP(writer, request)
 }
@@ -2,11 +2,9 @@ package server
 
 import (
 	"bufio"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"runtime"
 	"strconv"
@@ -15,20 +13,31 @@ import (
 	"time"
 
 	"github.com/inancgumus/screen"
-	"github.com/kor44/gofilter"
 	"github.com/shirou/gopsutil/cpu"
 	"golang.org/x/term"
 
+	"goProxy/core/crowdsec"
 	"goProxy/core/domains"
+	"goProxy/core/events"
+	"goProxy/core/feeds"
 	"goProxy/core/firewall"
+	"goProxy/core/kernel"
+	"goProxy/core/logger"
+	"goProxy/core/plugins"
 	"goProxy/core/pnc"
+	"goProxy/core/profiling"
 	"goProxy/core/proxy"
+	"goProxy/core/shipping"
+	"goProxy/core/tracing"
 	"goProxy/core/utils"
 )
 
 var (
-	PrintMutex = &sync.Mutex{}
-	helpMode   = false
+	PrintMutex    = &sync.Mutex{}
+	helpMode      = false
+	challengeMode = false
+	rulesMode     = false
+	backendsMode  = false
 )
 
 func Monitor() {
@@ -88,6 +97,8 @@ func Monitor() {
 		firewall.Mutex.Lock()
 		for name, data := range domains.DomainsData {
 			checkAttack(name, data)
+			publishStageChange(name, domains.DomainsData[name])
+			firewall.ShareDomainState(name, domains.DomainsData[name])
 		}
 		firewall.Mutex.Unlock()
 
@@ -126,7 +137,9 @@ func checkAttack(domainName string, domainData domains.DomainData) {
 				Allowed:  domainData.RequestsBypassedPerSecond,
 				Total:    domainData.RequestsPerSecond,
 				CpuUsage: proxy.CpuUsage,
+				Stage:    domainData.Stage,
 			})
+			firewall.RecordAttackSample(domainName, attackSample(domainData))
 		}
 
 		settingQuery, _ := domains.DomainsMap.Load(domainName)
@@ -136,7 +149,16 @@ func checkAttack(domainName string, domainData domains.DomainData) {
 			domainData.BufferCooldown--
 
 			if domainData.BufferCooldown == 0 {
-				go utils.SendWebhook(domainData, domainSettings, int(1))
+				var report *firewall.AttackReport
+				if attackReport, recorded := firewall.EndAttackSession(domainName); recorded {
+					report = &attackReport
+					go utils.WriteAttackReport(attackReport)
+				}
+				go utils.SendWebhook(domainData, domainSettings, int(1), report)
+				events.Publish(events.Event{Type: events.AttackEnded, Domain: domainName, Data: map[string]interface{}{
+					"peakRequestsPerSecond":         domainData.PeakRequestsPerSecond,
+					"peakRequestsBypassedPerSecond": domainData.PeakRequestsBypassedPerSecond,
+				}})
 				domainData.PeakRequestsPerSecond = 0
 				domainData.PeakRequestsBypassedPerSecond = 0
 				domainData.RequestLogger = []domains.RequestLog{}
@@ -157,8 +179,14 @@ func checkAttack(domainName string, domainData domains.DomainData) {
 						Allowed:  domainData.RequestsBypassedPerSecond,
 						Total:    domainData.RequestsPerSecond,
 						CpuUsage: proxy.CpuUsage,
+						Stage:    domainData.Stage,
 					})
-					go utils.SendWebhook(domainData, domainSettings, int(0))
+					if utils.AttackReportsEnabled {
+						firewall.StartAttackSession(domainName)
+						firewall.RecordAttackSample(domainName, attackSample(domainData))
+					}
+					go utils.SendWebhook(domainData, domainSettings, int(0), nil)
+					publishAttackStart(domainName, domainData, "bypass")
 				}
 				// Start/Set cooldown
 				domainData.BufferCooldown = 10
@@ -193,8 +221,14 @@ func checkAttack(domainName string, domainData domains.DomainData) {
 					Allowed:  domainData.RequestsBypassedPerSecond,
 					Total:    domainData.RequestsPerSecond,
 					CpuUsage: proxy.CpuUsage,
+					Stage:    domainData.Stage,
 				})
-				go utils.SendWebhook(domainData, domainSettings, int(0))
+				if utils.AttackReportsEnabled {
+					firewall.StartAttackSession(domainName)
+					firewall.RecordAttackSample(domainName, attackSample(domainData))
+				}
+				go utils.SendWebhook(domainData, domainSettings, int(0), nil)
+				publishAttackStart(domainName, domainData, "raw")
 			}
 
 			//Set/Start cooldown
@@ -208,6 +242,17 @@ func checkAttack(domainName string, domainData domains.DomainData) {
 	domains.DomainsData[domainName] = domainData
 }
 
+// attackSample is the second of an attack domainData is at, for its report
+func attackSample(domainData domains.DomainData) firewall.AttackSample {
+	return firewall.AttackSample{
+		Time:              time.Now(),
+		RequestsPerSecond: domainData.RequestsPerSecond,
+		BypassedPerSecond: domainData.RequestsBypassedPerSecond,
+		Stage:             domainData.Stage,
+		CpuUsage:          proxy.CpuUsage,
+	}
+}
+
 func printStats() {
 
 	proxy.LastSecondTime = time.Now()
@@ -265,6 +310,58 @@ func printStats() {
 		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("add") + " ]: " + utils.PrimaryColor("Usage: ") + "add " + utils.PrimaryColor("Starts a dialouge to add another domain to the proxy"))
 		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("clrlogs") + " ]: " + utils.PrimaryColor("Usage: ") + "clrlogs " + utils.PrimaryColor("Clears all logs for the current domain"))
 		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("reload") + " ]: " + utils.PrimaryColor("Usage: ") + "reload " + utils.PrimaryColor("Reload your proxy in order for changes in your ") + "config.json " + utils.PrimaryColor("to take effect"))
+		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("challenges") + " ]: " + utils.PrimaryColor("Usage: ") + "challenges " + utils.PrimaryColor("Shows how many challenges of the current domain were solved, failed and abandoned"))
+		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("rules") + " ]: " + utils.PrimaryColor("Usage: ") + "rules " + utils.PrimaryColor("Shows how many requests each firewall rule of the current domain matched"))
+		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("backends") + " ]: " + utils.PrimaryColor("Usage: ") + "backends " + utils.PrimaryColor("Shows how fast the backends of the current domain answered in the last minute and with which status codes"))
+		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("export") + " ]: " + utils.PrimaryColor("Usage: ") + "export [file] " + utils.PrimaryColor("Exports the firewall rules of the current domain to a file"))
+		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("import") + " ]: " + utils.PrimaryColor("Usage: ") + "import [file] " + utils.PrimaryColor("Imports firewall rules from a file into the current domain, skipping duplicates"))
+		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("reputations") + " ]: " + utils.PrimaryColor("Usage: ") + "reputations export|import [file] [strategy] " + utils.PrimaryColor("Exports the reputation store to a json or csv file, or merges one into it (replace, keep or lowest)"))
+	} else if challengeMode {
+
+		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("Domain") + " ] > [ " + utils.PrimaryColor(proxy.WatchedDomain) + " ]")
+		fmt.Println("")
+		fmt.Println("[ " + utils.PrimaryColor("Challenges") + " ]")
+		for _, stat := range firewall.GetChallengeStats(proxy.WatchedDomain, "level") {
+			fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor(challengeLevelName(stat.ChallengeStatKey)) + " ] > [ " + utils.PrimaryColor(formatChallengeStats(stat)) + " ]")
+		}
+		fmt.Println("")
+		fmt.Println("[ " + utils.PrimaryColor("Top Countries") + " ]")
+		for i, stat := range firewall.GetChallengeStats(proxy.WatchedDomain, "country") {
+			if i >= 5 {
+				break
+			}
+			fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor(stat.Country) + " ] > [ " + utils.PrimaryColor(formatChallengeStats(stat)) + " ]")
+		}
+	} else if backendsMode {
+
+		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("Domain") + " ] > [ " + utils.PrimaryColor(proxy.WatchedDomain) + " ]")
+		fmt.Println("")
+		fmt.Println("[ " + utils.PrimaryColor("Backends") + " ]")
+		for i, stats := range firewall.GetUpstreamStats(proxy.WatchedDomain) {
+			if i >= proxy.MaxLogLength {
+				break
+			}
+			fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor(stats.Backend) + " ] > [ " + utils.PrimaryColor(formatUpstreamStats(stats)) + " ]")
+		}
+	} else if rulesMode {
+
+		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("Domain") + " ] > [ " + utils.PrimaryColor(proxy.WatchedDomain) + " ]")
+		fmt.Println("")
+		fmt.Println("[ " + utils.PrimaryColor("Firewall Rules") + " ]")
+		for i, stat := range firewall.GetRuleStats(proxy.WatchedDomain) {
+			if i >= proxy.MaxLogLength {
+				break
+			}
+			sample := stat.Sample
+			if len(sample) > 80 {
+				sample = sample[:80] + "..."
+			}
+			action := stat.Action
+			if stat.Shadow {
+				action += ", shadow"
+			}
+			fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("Rule "+strconv.Itoa(stat.Index)+" ("+action+")") + " ] > [ " + utils.PrimaryColor(strconv.Itoa(stat.Matches)+" matches, last "+time.Since(stat.LastMatch).Round(time.Second).String()+" ago") + " ] - " + sample)
+		}
 	} else {
 
 		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("Domain") + " ] > [ " + utils.PrimaryColor(proxy.WatchedDomain) + " ]")
@@ -274,7 +371,12 @@ func printStats() {
 		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("Total") + " ] > [ " + utils.PrimaryColor(fmt.Sprint(domainData.RequestsPerSecond)+" r/s") + " ]")
 		fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("Bypassed") + " ] > [ " + utils.PrimaryColor(fmt.Sprint(domainData.RequestsBypassedPerSecond)+" r/s") + " ]")
 
-		fmt.Println("")
+		// Show where an attack comes from while it's going on
+		if domainData.BypassAttack || domainData.RawAttack {
+			fmt.Println("[" + utils.PrimaryColor("+") + "] [ " + utils.PrimaryColor("Top Attackers") + " ] > [ " + utils.PrimaryColor(formatAttackers(firewall.TopAttackers(proxy.WatchedDomain, 3))) + " ]")
+		} else {
+			fmt.Println("")
+		}
 		fmt.Println("[ " + utils.PrimaryColor("Latest Logs") + " ]")
 
 		utils.ReadLogs(proxy.WatchedDomain)
@@ -283,6 +385,56 @@ func printStats() {
 	utils.MoveInputLine()
 }
 
+func formatAttackers(top firewall.AttackSources) string {
+	sources := []string{}
+	for _, source := range top.IPs {
+		sources = append(sources, source.Source+" ("+strconv.Itoa(source.Count)+")")
+	}
+	for _, source := range top.Countries {
+		sources = append(sources, source.Source+" ("+strconv.Itoa(source.Count)+")")
+	}
+	for _, source := range top.ASNs {
+		sources = append(sources, "AS"+strconv.Itoa(source.ASN)+" ("+strconv.Itoa(source.Count)+")")
+	}
+	if len(sources) == 0 {
+		return "None Yet"
+	}
+	// Wrapping would push the logs down
+	formatted := strings.Join(sources, ", ")
+	if maxLength := proxy.TWidth - 48; len(formatted) > maxLength && maxLength > 3 {
+		formatted = formatted[:maxLength-3] + "..."
+	}
+	return formatted
+}
+
+func challengeLevelName(key firewall.ChallengeStatKey) string {
+	switch key.Level {
+	case 1:
+		return "Cookie"
+	case 2:
+		return "JS (Difficulty " + strconv.Itoa(key.Difficulty) + ")"
+	default:
+		return "Captcha"
+	}
+}
+
+func formatUpstreamStats(stats firewall.UpstreamStats) string {
+	formatted := fmt.Sprintf("%d requests, %s avg, %s p95", stats.Requests, stats.Average.Round(time.Millisecond), stats.P95.Round(time.Millisecond))
+	for class := 1; class < len(stats.Statuses); class++ {
+		if stats.Statuses[class] != 0 {
+			formatted += fmt.Sprintf(", %dxx %d", class, stats.Statuses[class])
+		}
+	}
+	if stats.Errors != 0 {
+		formatted += fmt.Sprintf(", %d errors", stats.Errors)
+	}
+	return formatted
+}
+
+func formatChallengeStats(stat firewall.ChallengeStats) string {
+	return fmt.Sprintf("%d issued, %d solved, %d failed, %d abandoned, %s median", stat.Issued, stat.Solved, stat.Failed, stat.Abandoned, stat.Median.Round(time.Millisecond))
+}
+
 func commands() {
 
 	defer pnc.PanicHndl()
@@ -302,6 +454,9 @@ func commands() {
 			domainData := domains.DomainsData[proxy.WatchedDomain]
 			firewall.Mutex.RUnlock()
 			helpMode = false
+			challengeMode = false
+			rulesMode = false
+			backendsMode = false
 
 			switch details[0] {
 			case "stage":
@@ -353,7 +508,9 @@ func commands() {
 				fmt.Println("[ " + utils.PrimaryColor("Loading") + " ] ...")
 				fmt.Println("\033[" + fmt.Sprint(12+proxy.MaxLogLength) + ";1H")
 				fmt.Print("[ " + utils.PrimaryColor("Command") + " ]: \033[s")
-				ReloadConfig()
+				if err := ReloadConfig(); err != nil {
+					fmt.Println("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+				}
 			case "clrlogs":
 				screen.Clear()
 				screen.MoveTopLeft()
@@ -376,7 +533,85 @@ func commands() {
 				screen.Clear()
 				screen.MoveTopLeft()
 				fmt.Println("[ " + utils.PrimaryColor("Reloading Proxy") + " ] ...")
-				ReloadConfig()
+				if err := ReloadConfig(); err != nil {
+					fmt.Println("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+				}
+				fmt.Println("\033[" + fmt.Sprint(12+proxy.MaxLogLength) + ";1H")
+				fmt.Print("[ " + utils.PrimaryColor("Command") + " ]: \033[s")
+			case "export", "import":
+				screen.Clear()
+				screen.MoveTopLeft()
+				path := proxy.WatchedDomain + ".rules.json"
+				if len(details) > 1 {
+					path = details[1]
+				}
+				if details[0] == "export" {
+					exported, err := utils.ExportRulesFile(proxy.WatchedDomain, path)
+					if err != nil {
+						fmt.Println("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor("Failed To Export Rules: "+err.Error()) + " ]")
+					} else {
+						fmt.Println("[ " + utils.PrimaryColor("Exported "+strconv.Itoa(exported)+" Rules Of "+proxy.WatchedDomain+" To "+path) + " ] ...")
+					}
+				} else {
+					imported, duplicates, err := utils.ImportRulesFile(proxy.WatchedDomain, path)
+					if err != nil {
+						fmt.Println("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor("Failed To Import Rules: "+err.Error()) + " ]")
+					} else {
+						fmt.Println("[ " + utils.PrimaryColor("Imported "+strconv.Itoa(imported)+" Rules Into "+proxy.WatchedDomain+", Skipped "+strconv.Itoa(duplicates)+" Duplicates") + " ] ...")
+					}
+				}
+				fmt.Println("\033[" + fmt.Sprint(12+proxy.MaxLogLength) + ";1H")
+				fmt.Print("[ " + utils.PrimaryColor("Command") + " ]: \033[s")
+			case "reputations":
+				screen.Clear()
+				screen.MoveTopLeft()
+				path := "reputations.json"
+				if len(details) > 2 {
+					path = details[2]
+				}
+				switch {
+				case len(details) > 1 && details[1] == "export":
+					exported, err := firewall.ExportReputationsFile(path)
+					if err != nil {
+						fmt.Println("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor("Failed To Export Reputations: "+err.Error()) + " ]")
+					} else {
+						fmt.Println("[ " + utils.PrimaryColor("Exported "+strconv.Itoa(exported)+" Reputations To "+path) + " ] ...")
+					}
+				case len(details) > 1 && details[1] == "import":
+					strategy := ""
+					if len(details) > 3 {
+						strategy = details[3]
+					}
+					imported, skipped, err := firewall.ImportReputationsFile(path, strategy)
+					if err != nil {
+						fmt.Println("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor("Failed To Import Reputations: "+err.Error()) + " ]")
+					} else {
+						fmt.Println("[ " + utils.PrimaryColor("Imported "+strconv.Itoa(imported)+" Reputations, Skipped "+strconv.Itoa(skipped)) + " ] ...")
+					}
+				default:
+					fmt.Println("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor("Usage: reputations export|import [file] [strategy]") + " ]")
+				}
+				fmt.Println("\033[" + fmt.Sprint(12+proxy.MaxLogLength) + ";1H")
+				fmt.Print("[ " + utils.PrimaryColor("Command") + " ]: \033[s")
+			case "rules":
+				rulesMode = true
+				screen.Clear()
+				screen.MoveTopLeft()
+				fmt.Println("[ " + utils.PrimaryColor("Loading") + " ] ...")
+				fmt.Println("\033[" + fmt.Sprint(12+proxy.MaxLogLength) + ";1H")
+				fmt.Print("[ " + utils.PrimaryColor("Command") + " ]: \033[s")
+			case "backends":
+				backendsMode = true
+				screen.Clear()
+				screen.MoveTopLeft()
+				fmt.Println("[ " + utils.PrimaryColor("Loading") + " ] ...")
+				fmt.Println("\033[" + fmt.Sprint(12+proxy.MaxLogLength) + ";1H")
+				fmt.Print("[ " + utils.PrimaryColor("Command") + " ]: \033[s")
+			case "challenges":
+				challengeMode = true
+				screen.Clear()
+				screen.MoveTopLeft()
+				fmt.Println("[ " + utils.PrimaryColor("Loading") + " ] ...")
 				fmt.Println("\033[" + fmt.Sprint(12+proxy.MaxLogLength) + ";1H")
 				fmt.Print("[ " + utils.PrimaryColor("Command") + " ]: \033[s")
 			case "help":
@@ -398,19 +633,38 @@ func commands() {
 }
 
 // This would ideally be in package config, however import cycles seem to not allow this.
-func ReloadConfig() {
+// Returns an error without applying anything else if the config can't be read or its clearance token or backend protection settings are invalid
+func ReloadConfig() error {
 
-	domains.Domains = []string{}
+	domains.ConfigLock.Lock()
+	defer domains.ConfigLock.Unlock()
 
 	file, err := os.Open("config.json")
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer file.Close()
 	json.NewDecoder(file).Decode(&domains.Config)
 
+	// Checked before anything else is applied, invalid settings keep the current ones in place
+	if tokens := domains.Config.Proxy.ClearanceTokens; tokens.Enabled {
+		if err := firewall.ConfigureClearanceTokens(tokens.Algorithm, tokens.Secret, tokens.PrivateKey, tokens.PublicKeys); err != nil {
+			return errors.New("Error Loading Clearance Tokens: " + err.Error())
+		}
+	}
+	firewall.ClearanceTokensEnabled = domains.Config.Proxy.ClearanceTokens.Enabled
+	if err := firewall.ConfigureBackendProtection(domains.Config.Proxy.BackendProtection); err != nil {
+		return errors.New("Error Loading Backend Protection: " + err.Error())
+	}
+
+	domains.Domains = []string{}
+
 	proxy.Cloudflare = domains.Config.Proxy.Cloudflare
 
+	if err := firewall.SetTrustedProxies(domains.Config.Proxy.TrustedProxies, proxy.Cloudflare); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+	}
+
 	proxy.CookieSecret = domains.Config.Proxy.Secrets["cookie"]
 	proxy.JSSecret = domains.Config.Proxy.Secrets["javascript"]
 	proxy.CaptchaSecret = domains.Config.Proxy.Secrets["captcha"]
@@ -441,67 +695,148 @@ func ReloadConfig() {
 		utils.SetColor(domains.Config.Proxy.Colors)
 	}
 
+	if err := logger.Configure(domains.Config.Proxy.Logging); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+	}
+
 	proxy.IPRatelimit = domains.Config.Proxy.Ratelimits["requests"]
 	proxy.FPRatelimit = domains.Config.Proxy.Ratelimits["unknownFingerprint"]
 	proxy.FailChallengeRatelimit = domains.Config.Proxy.Ratelimits["challengeFailures"]
 	proxy.FailRequestRatelimit = domains.Config.Proxy.Ratelimits["noRequestsSent"]
 
-	for i, domain := range domains.Config.Domains {
-		domains.Domains = append(domains.Domains, domain.Name)
+	proxy.MaxBodySize = domains.Config.Proxy.MaxBodySize
 
-		firewallRules := []domains.Rule{}
-		rawFirewallRules := domains.Config.Domains[i].FirewallRules
-		for _, fwRule := range domains.Config.Domains[i].FirewallRules {
+	if err := utils.ConfigureAttackReports(domains.Config.Proxy.AttackReports); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+	}
 
-			rule, err := gofilter.NewFilter(fwRule.Expression)
-			if err != nil {
-				panic("[ " + utils.PrimaryColor("!") + " ] [ Error Loading Custom Firewall Rules: " + utils.PrimaryColor(err.Error()) + " ]")
-			}
+	utils.ConfigureWebhooks(domains.Config.Proxy.Webhooks)
 
-			firewallRules = append(firewallRules, domains.Rule{
-				Filter: rule,
-				Action: fwRule.Action,
-			})
-		}
+	if err := events.Configure(domains.Config.Proxy.EventSinks); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+	}
 
-		dProxy := httputil.NewSingleHostReverseProxy(&url.URL{
-			Scheme: domain.Scheme,
-			Host:   domain.Backend,
-		})
-		dProxy.Transport = &RoundTripper{}
-
-		var cert tls.Certificate = tls.Certificate{}
-		if !proxy.Cloudflare {
-			var certErr error
-			cert, certErr = tls.LoadX509KeyPair(domain.Certificate, domain.Key)
-			if certErr != nil {
-				panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor("Error Loading Certificates: "+certErr.Error()) + " ]")
-			}
-		}
+	if err := plugins.Configure(domains.Config.Proxy.Plugins); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+	}
 
-		domains.DomainsMap.Store(domain.Name, domains.DomainSettings{
-			Name: domain.Name,
-
-			CustomRules:    firewallRules,
-			RawCustomRules: rawFirewallRules,
-
-			DomainProxy:        dProxy,
-			DomainCertificates: cert,
-			DomainWebhooks: domains.WebhookSettings{
-				URL:            domain.Webhook.URL,
-				Name:           domain.Webhook.Name,
-				Avatar:         domain.Webhook.Avatar,
-				AttackStartMsg: domain.Webhook.AttackStartMsg,
-				AttackStopMsg:  domain.Webhook.AttackStopMsg,
-			},
-
-			BypassStage1:        domain.BypassStage1,
-			BypassStage2:        domain.BypassStage2,
-			DisableBypassStage3: domain.DisableBypassStage3,
-			DisableRawStage3:    domain.DisableRawStage3,
-			DisableBypassStage2: domain.DisableBypassStage2,
-			DisableRawStage2:    domain.DisableRawStage2,
-		})
+	if err := shipping.Configure(domains.Config.Proxy.LogShipping); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+	}
+
+	if err := tracing.Configure(domains.Config.Proxy.Tracing); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+	}
+
+	if err := profiling.Configure(domains.Config.Proxy.Profiling); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + utils.PrimaryColor(err.Error()) + " ]")
+	}
+
+	if domains.Config.Proxy.HeaderLimits.MaxCount != 0 {
+		firewall.MaxHeaderCount = domains.Config.Proxy.HeaderLimits.MaxCount
+	}
+	if domains.Config.Proxy.HeaderLimits.MaxHeaderSize != 0 {
+		firewall.MaxHeaderSize = domains.Config.Proxy.HeaderLimits.MaxHeaderSize
+	}
+	if domains.Config.Proxy.HeaderLimits.MaxTotalSize != 0 {
+		firewall.MaxTotalHeaderBytes = domains.Config.Proxy.HeaderLimits.MaxTotalSize
+	}
+
+	firewall.SlowReadEnabled = domains.Config.Proxy.SlowRead.Enabled
+	if domains.Config.Proxy.SlowRead.MinRate > 0 {
+		firewall.SlowReadMinRate = domains.Config.Proxy.SlowRead.MinRate
+	}
+	if domains.Config.Proxy.SlowRead.GracePeriod > 0 {
+		firewall.SlowReadGracePeriod = time.Duration(domains.Config.Proxy.SlowRead.GracePeriod) * time.Second
+	}
+	if domains.Config.Proxy.SlowRead.MaxOffenses != 0 {
+		firewall.MaxSlowConnsPerIP = domains.Config.Proxy.SlowRead.MaxOffenses
+	}
+
+	if domains.Config.Proxy.Tarpit.MaxConnections != 0 {
+		firewall.TarpitMaxConnections = domains.Config.Proxy.Tarpit.MaxConnections
+	}
+	if domains.Config.Proxy.Tarpit.Interval > 0 {
+		firewall.TarpitInterval = time.Duration(domains.Config.Proxy.Tarpit.Interval) * time.Second
+	}
+	if domains.Config.Proxy.Tarpit.Duration > 0 {
+		firewall.TarpitDuration = time.Duration(domains.Config.Proxy.Tarpit.Duration) * time.Second
+	}
+	firewall.TarpitRepeatOffenders = domains.Config.Proxy.Tarpit.RepeatOffenders
+
+	firewall.LoadJA4Fingerprints(domains.Config.Proxy.JA4Fingerprints.Known, domains.Config.Proxy.JA4Fingerprints.Bot, domains.Config.Proxy.JA4Fingerprints.Malicious)
+
+	if domains.Config.Proxy.FingerprintStatsRetention > 0 {
+		firewall.FingerprintStatsRetention = domains.Config.Proxy.FingerprintStatsRetention
+	}
+
+	if domains.Config.Proxy.CookieBinding.IPv4Prefix != 0 {
+		firewall.CookieBindIPv4Prefix = domains.Config.Proxy.CookieBinding.IPv4Prefix
+	}
+	if domains.Config.Proxy.CookieBinding.IPv6Prefix != 0 {
+		firewall.CookieBindIPv6Prefix = domains.Config.Proxy.CookieBinding.IPv6Prefix
+	}
+	firewall.CookieBindJA4 = domains.Config.Proxy.CookieBinding.JA4
+	firewall.CookieBindHTTP2 = domains.Config.Proxy.CookieBinding.HTTP2
+
+	firewall.EscalationEnabled = domains.Config.Proxy.Escalation.Enabled
+	if domains.Config.Proxy.Escalation.Failures > 0 {
+		firewall.EscalationFailures = domains.Config.Proxy.Escalation.Failures
+	}
+	if domains.Config.Proxy.Escalation.Window > 0 {
+		firewall.EscalationWindow = time.Duration(domains.Config.Proxy.Escalation.Window) * time.Second
+	}
+	if domains.Config.Proxy.Escalation.BanTime > 0 {
+		firewall.EscalationBanTime = time.Duration(domains.Config.Proxy.Escalation.BanTime) * time.Second
+	}
+	if domains.Config.Proxy.Escalation.JSScore > 0 {
+		firewall.EscalationJSScore = domains.Config.Proxy.Escalation.JSScore
+	}
+	if domains.Config.Proxy.Escalation.CaptchaScore > 0 {
+		firewall.EscalationCaptchaScore = domains.Config.Proxy.Escalation.CaptchaScore
+	}
+
+	if err := firewall.SetScoreWeights(domains.Config.Proxy.Reputation.Weights); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+	if err := firewall.SetReputationTiers(domains.Config.Proxy.Reputation.Tiers); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	classification := domains.Config.Proxy.IPClassification
+	firewall.IPClassificationEnabled = classification.Enabled
+	firewall.SetClassifiedASNs(classification.DatacenterASNs, classification.VPNASNs)
+	if classification.DifficultyAdjustment != 0 {
+		firewall.ClassificationDifficulty = classification.DifficultyAdjustment
+	}
+	if classification.RatelimitFactor > 0 {
+		firewall.ClassificationRatelimitFactor = classification.RatelimitFactor
+	}
+
+	if err := feeds.Start(append(feeds.BuiltIn(domains.Config.Proxy), domains.Config.Proxy.ThreatFeeds...)); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+	if err := crowdsec.Start(domains.Config.Proxy.CrowdSec); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+	if err := kernel.Start(domains.Config.Proxy.KernelBans); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+	if err := kernel.StartXDP(domains.Config.Proxy.XDP); err != nil {
+		panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+	}
+
+	for _, domain := range domains.Config.Domains {
+		domains.Domains = append(domains.Domains, domain.Name)
+
+		domainSettings, err := InitDomain(domain)
+		if err != nil {
+			panic("[ " + utils.PrimaryColor("!") + " ] [ " + err.Error() + " ]")
+		}
+		if previous, ok := domains.DomainsMap.Load(domain.Name); ok {
+			publishCertRenewal(previous.(domains.DomainSettings), domainSettings)
+		}
+		domains.DomainsMap.Store(domain.Name, domainSettings)
 
 		firewall.Mutex.Lock()
 		domains.DomainsData[domain.Name] = domains.DomainData{
@@ -528,6 +863,7 @@ func ReloadConfig() {
 	}
 
 	proxy.WatchedDomain = domains.Domains[0]
+	return nil
 }
 
 func clearProxyCache() {
@@ -554,6 +890,10 @@ func clearProxyCache() {
 				firewall.CacheIps.Delete(key)
 				return true
 			})
+			firewall.IssuedClearances.Range(func(key, value any) bool {
+				firewall.IssuedClearances.Delete(key)
+				return true
+			})
 		}
 		// Same for here
 		imgCachelen := 0
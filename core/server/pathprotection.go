@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sha256 of hash and password -> struct{}, so bcrypt only has to be run once for every password that is right
+var verifiedPasswords = sync.Map{}
+
+// parsePathProtections validates the path protections of a domain and parses their cidrs
+func parsePathProtections(protections []domains.PathProtection) ([]domains.PathProtection, error) {
+
+	parsed := make([]domains.PathProtection, 0, len(protections))
+	for _, protection := range protections {
+		if len(protection.Paths) == 0 {
+			return nil, errors.New("path protection without paths")
+		}
+		if len(protection.CIDRs) == 0 && len(protection.Users) == 0 {
+			return nil, errors.New("path protection without cidrs or users")
+		}
+
+		switch protection.Satisfy {
+		case "":
+			protection.Satisfy = "all"
+		case "all", "any":
+		default:
+			return nil, errors.New("unknown satisfy " + protection.Satisfy + ", use all or any")
+		}
+		if protection.Realm == "" {
+			protection.Realm = "Restricted"
+		}
+		protection.Paths = cleanPrefixes(protection.Paths)
+
+		for user, hash := range protection.Users {
+			if strings.HasPrefix(hash, "$2") {
+				if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+					return nil, errors.New("invalid bcrypt hash of " + user + ": " + err.Error())
+				}
+			}
+		}
+
+		networks, err := parseCIDRs(protection.CIDRs)
+		if err != nil {
+			return nil, err
+		}
+		protection.Networks = networks
+		parsed = append(parsed, protection)
+	}
+	return parsed, nil
+}
+
+// protectPath enforces every path protection the request matches. It answers the request and returns false if it
+// isn't allowed, with a 403 if its ip isn't and a 401 to ask for credentials otherwise
+func protectPath(writer http.ResponseWriter, request *http.Request, domainSettings domains.DomainSettings, ip string, buffer *bytes.Buffer) bool {
+
+	requestPath := cleanPath(request.URL.Path)
+	for _, protection := range domainSettings.PathProtections {
+		if !matchesPrefixes(requestPath, protection.Paths) {
+			continue
+		}
+
+		needsNetwork, needsLogin := len(protection.Networks) != 0, len(protection.Users) != 0
+		inNetwork := needsNetwork && inNetworks(protection.Networks, ip)
+		loggedIn := needsLogin && basicAuthValid(request, protection.Users)
+
+		allowed := (!needsNetwork || inNetwork) && (!needsLogin || loggedIn)
+		if protection.Satisfy == "any" {
+			allowed = inNetwork || loggedIn
+		}
+		if allowed {
+			continue
+		}
+
+		// Logging in won't help clients that aren't in the network they have to be in
+		if needsLogin && (protection.Satisfy == "any" || !needsNetwork || inNetwork) {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="`+strings.ReplaceAll(protection.Realm, `"`, "")+`", charset="UTF-8"`)
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusUnauthorized)
+			SendResponse("401 Unauthorized", buffer, writer)
+			return false
+		}
+
+		firewall.RecordIPRequest(ip, false, true)
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusForbidden)
+		SendResponse("Blocked by BalooProxy.\nAccess to this path is restricted.", buffer, writer)
+		return false
+	}
+	return true
+}
+
+// cleanPath returns the path backends resolve requestPath to, so "//wp-admin/", "/./wp-admin/" and "/foo/../wp-admin/"
+// are all "/wp-admin/". Backslashes count as slashes, some backends treat them like that
+func cleanPath(requestPath string) string {
+	requestPath = strings.ReplaceAll(requestPath, "\\", "/")
+	cleaned := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// cleanPrefixes cleans configured path prefixes for matchesPrefixes, without their trailing slash
+func cleanPrefixes(prefixes []string) []string {
+	cleaned := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		cleaned = append(cleaned, strings.TrimSuffix(cleanPath(prefix), "/"))
+	}
+	return cleaned
+}
+
+// matchesPrefixes returns whether the cleaned requestPath is one of prefixes or lies below one of them. Whole segments
+// are compared, "/admin" matches "/admin" and "/admin/users" but not "/administrator"
+func matchesPrefixes(requestPath string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if matchesPrefix(requestPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPrefix is matchesPrefixes for a single prefix
+func matchesPrefix(requestPath string, prefix string) bool {
+	return prefix == "" || requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+}
+
+func inNetworks(networks []*net.IPNet, ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	for _, ipNet := range networks {
+		if ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// basicAuthValid checks the basic auth credentials of request. Passwords are bcrypt hashes, or the password itself
+func basicAuthValid(request *http.Request, users map[string]string) bool {
+	user, password, ok := request.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := users[user]
+	if !ok {
+		return false
+	}
+
+	if !strings.HasPrefix(hash, "$2") {
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+
+	key := sha256.Sum256([]byte(hash + "\x00" + password))
+	if _, verified := verifiedPasswords.Load(key); verified {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	verifiedPasswords.Store(key, struct{}{})
+	return true
+}
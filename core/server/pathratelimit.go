@@ -0,0 +1,35 @@
+package server
+
+import (
+	"goProxy/core/domains"
+)
+
+// pathRatelimit returns the ratelimit of the longest path prefix that matches path
+func pathRatelimit(domainSettings domains.DomainSettings, path string) (domains.PathRatelimit, bool) {
+
+	// PathRatelimits are cleaned and sorted longest prefix first
+	path = cleanPath(path)
+	for _, limit := range domainSettings.PathRatelimits {
+		if matchesPrefix(path, limit.Path) {
+			return limit, true
+		}
+	}
+	return domains.PathRatelimit{}, false
+}
+
+// countryRatelimit returns the ratelimit of country, the one of "*" if no limit lists it
+func countryRatelimit(domainSettings domains.DomainSettings, country string) (domains.CountryRatelimit, bool) {
+
+	wildcard, found := domains.CountryRatelimit{}, false
+	for _, limit := range domainSettings.CountryRatelimits {
+		for _, listed := range limit.Countries {
+			if listed == country {
+				return limit, limit.Requests > 0
+			}
+			if listed == "*" && !found {
+				wildcard, found = limit, limit.Requests > 0
+			}
+		}
+	}
+	return wildcard, found
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+type clientAddrKey struct{}
+
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// WithClientAddr attaches the real client address to a request context, so the backend dialer can announce it via the PROXY protocol
+func WithClientAddr(ctx context.Context, ip string, port int) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, &net.TCPAddr{IP: net.ParseIP(ip), Port: port})
+}
+
+func clientAddrFromContext(ctx context.Context) *net.TCPAddr {
+	addr, _ := ctx.Value(clientAddrKey{}).(*net.TCPAddr)
+	return addr
+}
+
+// writeProxyHeader prepends a PROXY protocol header (version 1 or 2) announcing src as the origin of conn
+func writeProxyHeader(conn net.Conn, version int, src *net.TCPAddr) error {
+
+	dst, _ := conn.RemoteAddr().(*net.TCPAddr)
+
+	var header []byte
+	if version == 2 {
+		header = proxyHeaderV2(src, dst)
+	} else {
+		header = proxyHeaderV1(src, dst)
+	}
+
+	_, err := conn.Write(header)
+	return err
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || src.IP == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		// Both addresses have to share a family, v4 addresses get mapped if the other side is v6
+		family = "TCP6"
+	}
+	srcIP, dstIP := proxyV1Addr(src.IP, family == "TCP6"), proxyV1Addr(dst.IP, family == "TCP6")
+
+	return []byte("PROXY " + family + " " + srcIP + " " + dstIP + " " + strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n")
+}
+
+func proxyV1Addr(ip net.IP, v6 bool) string {
+	if v6 && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	header := bytes.NewBuffer(make([]byte, 0, 52))
+	header.Write(proxyProtocolV2Signature)
+
+	if src == nil || src.IP == nil || dst == nil {
+		// LOCAL command, the backend will use the real connection endpoints
+		header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		header.Write([]byte{0x21, 0x11})
+		binary.Write(header, binary.BigEndian, uint16(12))
+		header.Write(src.IP.To4())
+		header.Write(dst.IP.To4())
+	} else {
+		header.Write([]byte{0x21, 0x21})
+		binary.Write(header, binary.BigEndian, uint16(36))
+		header.Write(src.IP.To16())
+		header.Write(dst.IP.To16())
+	}
+	binary.Write(header, binary.BigEndian, uint16(src.Port))
+	binary.Write(header, binary.BigEndian, uint16(dst.Port))
+
+	return header.Bytes()
+}
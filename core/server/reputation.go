@@ -0,0 +1,15 @@
+package server
+
+import (
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+)
+
+// scoreEvent updates the reputation of ip for event, weighted the way the domain it happened on wants it to be.
+// Abuse is counted for the top attackers of the domain aswell
+func scoreEvent(domainSettings domains.DomainSettings, ip string, event string) {
+	firewall.UpdateReputation(ip, firewall.ScoreWeight(event, domainSettings.ReputationWeights), event)
+	if event != "successful_access" {
+		firewall.RecordAttack(domainSettings.Name, ip)
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"goProxy/core/domains"
 	"goProxy/core/firewall"
 	"goProxy/core/pnc"
 	"goProxy/core/proxy"
+	"goProxy/core/tracing"
 	"io"
 	"net"
 	"net/http"
@@ -76,8 +78,9 @@ func Serve() {
 			MaxHeaderBytes: 1 << 20,
 		}
 
+		h2ServerH := &http2.Server{}
 		http2.ConfigureServer(service, &http2.Server{})
-		http2.ConfigureServer(serviceH, &http2.Server{})
+		http2.ConfigureServer(serviceH, h2ServerH)
 
 		service.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			firewall.Mutex.RLock()
@@ -104,12 +107,20 @@ func Serve() {
 
 		go func() {
 			defer pnc.PanicHndl()
-			if err := serviceH.ListenAndServeTLS("", ""); err != nil {
+			listenerH, err := net.Listen("tcp", serviceH.Addr)
+			if err != nil {
+				panic(err)
+			}
+			if err := serveTLS(serviceH, h2ServerH, firewall.CaptureClientHello(firewall.TrackSlowReads(listenerH))); err != nil {
 				panic(err)
 			}
 		}()
 
-		if err := service.ListenAndServe(); err != nil {
+		listener, err := net.Listen("tcp", service.Addr)
+		if err != nil {
+			panic(err)
+		}
+		if err := service.Serve(firewall.TrackSlowReads(listener)); err != nil {
 			panic(err)
 		}
 	}
@@ -124,8 +135,76 @@ func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	//Use Proxy Read Timeout
 	transport := getTripperForDomain(req.Host)
 
-	//Use inbuild RoundTrip
-	resp, err := transport.RoundTrip(req)
+	cancel := context.CancelFunc(func() {})
+	if rt.Timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), rt.Timeout)
+		req = req.WithContext(ctx)
+	}
+	streaming := false
+	defer func() {
+		// A successful response is still being read after RoundTrip returns, its body cancels once it's closed
+		if !streaming {
+			cancel()
+		}
+	}()
+
+	//Use inbuild RoundTrip. Small bodies are read first, so a request that carries one can still be retried
+	var resp *http.Response
+	err := rt.bufferBody(req)
+	if err == nil {
+		resp, err = rt.send(transport, req)
+	}
+
+	for attempt := 0; attempt < rt.Retry.Attempts && rt.shouldRetry(req, resp, err); attempt++ {
+
+		select {
+		case <-req.Context().Done():
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, req.Context().Err()
+		case <-time.After(time.Duration(rt.Retry.Backoff) * time.Millisecond << attempt):
+		}
+
+		// Give another backend a chance, if there is one. Without capacity anywhere the client gets the last answer
+		backend := ""
+		if rt.Backends != nil {
+			var ok bool
+			if backend, ok = reserveRetry(req.Context(), rt.Backends); !ok {
+				break
+			}
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		req = req.Clone(req.Context())
+		if req.GetBody != nil {
+			req.Body, _ = req.GetBody()
+		}
+		if backend != "" {
+			req.URL.Host = backend
+		}
+
+		resp, err = rt.send(transport, req)
+	}
+
+	//Client sent more than the body limit of this path while the request was being forwarded
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &http.Response{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("Blocked by BalooProxy.\nRequest body too large.")),
+		}, nil
+	}
+
+	//Backend couldn't be reached. Clients that went away don't say anything about the backend
+	if err != nil && !errors.Is(req.Context().Err(), context.Canceled) {
+		publishBackendDown(req.Host, req.URL.Host, err)
+	}
 
 	//Connection to backend failed. Display error message
 	if err != nil {
@@ -192,9 +271,44 @@ func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 		}, nil
 	}
 
+	streaming = true
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
 	return resp, nil
 }
 
+// send sends req to its backend once, recording how long the backend took to answer and what it answered
+func (rt *RoundTripper) send(transport *http.Transport, req *http.Request) (*http.Response, error) {
+
+	req, span := tracing.StartUpstream(req, req.URL.Host)
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	tracing.FinishUpstream(span, status, err)
+
+	// Clients that went away or sent too large bodies don't say anything about the backend
+	var maxBytesErr *http.MaxBytesError
+	if err != nil && (errors.Is(req.Context().Err(), context.Canceled) || errors.As(err, &maxBytesErr)) {
+		return resp, err
+	}
+	firewall.RecordUpstream(req.Host, req.URL.Host, status, time.Since(start), err != nil)
+	return resp, err
+}
+
+// cancelBody releases the total timeout of a backend request once its body was fully handled
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
 var defaultTransport = &http.Transport{
 	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 		return (&net.Dialer{
@@ -210,6 +324,60 @@ var defaultTransport = &http.Transport{
 	MaxIdleConnsPerHost: 50,    // Added limit per host
 }
 
+// newDomainTransport returns the backend transport for a domain, based on defaultTransport
+func newDomainTransport(domain domains.Domain) *http.Transport {
+
+	transport := defaultTransport.Clone()
+
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if domain.UpstreamTimeout.Dial > 0 {
+		dialer.Timeout = time.Duration(domain.UpstreamTimeout.Dial) * time.Second
+	}
+	transport.DialContext = dialer.DialContext
+	if domain.UpstreamTimeout.ResponseHeader > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(domain.UpstreamTimeout.ResponseHeader) * time.Second
+	}
+
+	// Only override what was configured, everything else keeps the defaults above
+	if domain.UpstreamPool.MaxIdleConns > 0 {
+		transport.MaxIdleConns = domain.UpstreamPool.MaxIdleConns
+	}
+	if domain.UpstreamPool.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = domain.UpstreamPool.MaxIdleConnsPerHost
+	}
+	if domain.UpstreamPool.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = domain.UpstreamPool.MaxConnsPerHost
+	}
+	if domain.UpstreamPool.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(domain.UpstreamPool.IdleConnTimeout) * time.Second
+	}
+	if domain.UpstreamPool.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(domain.UpstreamPool.TLSHandshakeTimeout) * time.Second
+	}
+
+	if domain.ProxyProtocol != 0 {
+		version := domain.ProxyProtocol
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeProxyHeader(conn, version, clientAddrFromContext(ctx)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+		// The PROXY header is bound to a single client, so backend connections can't be shared between clients
+		transport.DisableKeepAlives = true
+	}
+
+	return transport
+}
+
 func getTripperForDomain(domain string) *http.Transport {
 
 	transport, ok := transportMap.Load(domain)
@@ -220,4 +388,83 @@ func getTripperForDomain(domain string) *http.Transport {
 }
 
 type RoundTripper struct {
+	Backends *domains.BackendPool
+	Retry    domains.RetrySettings
+	Timeout  time.Duration // total time a backend request may take, 0 means no limit
+}
+
+var (
+	defaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+
+	// Largest request body that is kept in memory to be sent again on a retry
+	retryBodyLimit int64 = 64 * 1024
+)
+
+// bufferBody reads bodies of a known length up to retryBodyLimit into memory and sets GetBody, so shouldRetry lets
+// requests with a body be sent again. Larger bodies and bodies of unknown length stay streamed and aren't retried
+func (rt *RoundTripper) bufferBody(req *http.Request) error {
+
+	if rt.Retry.Attempts <= 0 || req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return nil
+	}
+	if req.ContentLength <= 0 || req.ContentLength > retryBodyLimit || !rt.retryableMethod(req.Method) {
+		return nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+// retryableMethod checks whether requests of method may be sent twice
+func (rt *RoundTripper) retryableMethod(method string) bool {
+	if rt.Retry.NonIdempotent {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// shouldRetry checks whether a failed backend request may be sent again
+func (rt *RoundTripper) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+
+	if err != nil && req.Context().Err() != nil {
+		// Client went away, nobody is waiting for a retry
+		return false
+	}
+
+	// Bodies that weren't buffered by bufferBody are streamed from the client and can't be replayed
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	if !rt.retryableMethod(req.Method) {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	statusCodes := rt.Retry.StatusCodes
+	if len(statusCodes) == 0 {
+		statusCodes = defaultRetryStatusCodes
+	}
+	for _, code := range statusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
 }
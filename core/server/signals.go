@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"goProxy/core/proxy"
+	"goProxy/core/utils"
+	"net/http"
+	"strings"
+)
+
+const signalsPath = "/_bProxy/signals"
+
+// signalsClearance derives the clearance of a solved js challenge whose browser signals have to be verified.
+// Unlike the solution it can't be computed by the client, so solving the pow alone doesn't earn a clearance
+func signalsClearance(encryptedIP string) string {
+	return utils.Encrypt(encryptedIP+signalsPath, proxy.JSOTP)
+}
+
+// browserSignalsScript collects the browser signals once the pow of the js challenge is solved (as e.solution) and posts them along with the solution.
+// The response carries the clearance, after which the page is reloaded
+func browserSignalsScript(publicSalt string) string {
+	return `var s={solution:"` + publicSalt + `"+e.solution,webdriver:!!navigator.webdriver,userAgent:navigator.userAgent,platform:navigator.platform,languages:navigator.languages||[],offset:new Date().getTimezoneOffset(),timezone:"",canvas:"",webgl:"",renderer:""};` +
+		`try{s.timezone=Intl.DateTimeFormat().resolvedOptions().timeZone||""}catch(o){}` +
+		`try{var c=document.createElement("canvas"),x=c.getContext("2d");c.width=200,c.height=50,x.textBaseline="top",x.font="16px Arial",x.fillStyle="#f60",x.fillRect(100,1,62,20),x.fillStyle="#069",x.fillText("balooProxy 🛡",2,15),x.fillStyle="rgba(102,204,0,.7)",x.fillText("balooProxy 🛡",4,17),s.canvas=CryptoJS.SHA256(c.toDataURL()).toString()}catch(o){}` +
+		`try{var g=document.createElement("canvas").getContext("webgl"),d=g.getExtension("WEBGL_debug_renderer_info");s.renderer=d?g.getParameter(d.UNMASKED_RENDERER_WEBGL):g.getParameter(g.RENDERER),s.webgl=CryptoJS.SHA256([s.renderer,d?g.getParameter(d.UNMASKED_VENDOR_WEBGL):g.getParameter(g.VENDOR),g.getParameter(g.MAX_TEXTURE_SIZE),g.getParameter(g.MAX_RENDERBUFFER_SIZE),g.getSupportedExtensions().join()].join("|")).toString()}catch(o){}` +
+		`fetch("` + signalsPath + `?path="+encodeURIComponent(location.pathname),{method:"POST",headers:{"Content-Type":"application/json"},body:JSON.stringify(s)}).then(function(r){r.ok?location.href=location.href:r.text().then(function(t){document.body.innerText=t})})`
+}
+
+// serveBrowserSignals verifies the solution and browser signals posted to signalsPath and sets clearanceCookie (a Set-Cookie value) if they add up.
+// Returns false if the request doesn't post signals
+func serveBrowserSignals(writer http.ResponseWriter, request *http.Request, domainSettings domains.DomainSettings, ip string, encryptedIP string, clearanceCookie string, buffer *bytes.Buffer) bool {
+
+	settings := domainSettings.BrowserSignals
+	if request.URL.Path != signalsPath || request.Method != http.MethodPost || !settings.Enabled {
+		return false
+	}
+
+	writer.Header().Set("Content-Type", "text/plain")
+
+	signals := firewall.BrowserSignals{}
+	if err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 16*1024)).Decode(&signals); err != nil || signals.Solution != encryptedIP {
+		writer.WriteHeader(http.StatusForbidden)
+		SendResponse("Blocked by BalooProxy.\nWrong solution. Please reload the page.", buffer, writer)
+		return true
+	}
+
+	automated, inconsistencies := firewall.CheckBrowserSignals(signals, request.UserAgent(), request.Header.Get("Accept-Language"))
+	if automated || len(inconsistencies) > settings.MaxInconsistencies {
+		scoreEvent(domainSettings, ip, "browser_signal_mismatch")
+		firewall.RecordIPChallengeFailure(ip)
+		writer.WriteHeader(http.StatusForbidden)
+		if automated {
+			SendResponse("Blocked by BalooProxy.\nYour browser is automated.", buffer, writer)
+		} else {
+			SendResponse("Blocked by BalooProxy.\nYour browser failed the integrity check ("+strings.Join(inconsistencies, ", ")+").", buffer, writer)
+		}
+		return true
+	}
+
+	writer.Header().Set("Set-Cookie", clearanceCookie)
+	SendResponse("verified", buffer, writer)
+	return true
+}
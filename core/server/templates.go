@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"goProxy/core/domains"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Placeholders every challenge template may use, besides {{text.<key>}}
+var templatePlaceholders = map[string]bool{
+	"challenge": true, // markup and scripts needed to solve the challenge
+	"brand":     true,
+	"logo":      true,
+	"domain":    true,
+	"lang":      true, // language the texts were picked in
+}
+
+// loadChallengeTemplate reads a challenge page template and splits it at its placeholders.
+// Every odd element of the result is the name of a placeholder. An empty path returns nil, which serves the built-in page
+func loadChallengeTemplate(path string) ([]string, error) {
+
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := []string{}
+	rest := string(content)
+	for {
+		before, after, found := strings.Cut(rest, "{{")
+		if !found {
+			parts = append(parts, rest)
+			break
+		}
+		name, after, found := strings.Cut(after, "}}")
+		if !found {
+			return nil, errors.New(path + ": unclosed placeholder")
+		}
+		name = strings.TrimSpace(name)
+		if !templatePlaceholders[name] && !strings.HasPrefix(name, "text.") {
+			return nil, errors.New(path + ": unknown placeholder {{" + name + "}}")
+		}
+		parts = append(parts, before, name)
+		rest = after
+	}
+
+	hasChallenge := false
+	for i := 1; i < len(parts); i += 2 {
+		hasChallenge = hasChallenge || parts[i] == "challenge"
+	}
+	if !hasChallenge {
+		// Without it nobody would be able to pass the challenge
+		return nil, errors.New(path + ": missing placeholder {{challenge}}")
+	}
+
+	return parts, nil
+}
+
+// renderChallenge fills a challenge template of domainName with the challenge payload and the texts in the language the client prefers
+func renderChallenge(templates domains.ChallengeTemplates, template []string, domainName string, request *http.Request, payload string) string {
+
+	lang := challengeLanguage(request.Header.Get("Accept-Language"), templates)
+	texts := templates.Texts[lang]
+	fallbackTexts := templates.Texts[templates.DefaultLanguage]
+
+	var page strings.Builder
+	for i, part := range template {
+		if i%2 == 0 {
+			page.WriteString(part)
+			continue
+		}
+		switch part {
+		case "challenge":
+			page.WriteString(payload)
+		case "brand":
+			page.WriteString(templates.Brand)
+		case "logo":
+			page.WriteString(templates.Logo)
+		case "domain":
+			page.WriteString(domainName)
+		case "lang":
+			page.WriteString(lang)
+		default:
+			key := strings.TrimPrefix(part, "text.")
+			text, ok := texts[key]
+			if !ok {
+				text = fallbackTexts[key]
+			}
+			page.WriteString(text)
+		}
+	}
+	return page.String()
+}
+
+// challengeLanguage picks the first language of an Accept-Language header there are texts for, either exactly or by its primary tag (de-AT -> de)
+func challengeLanguage(acceptLanguage string, templates domains.ChallengeTemplates) string {
+	for _, entry := range strings.Split(acceptLanguage, ",") {
+		lang, _, _ := strings.Cut(entry, ";")
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if _, ok := templates.Texts[lang]; ok {
+			return lang
+		}
+		primary, _, _ := strings.Cut(lang, "-")
+		if _, ok := templates.Texts[primary]; ok {
+			return primary
+		}
+	}
+	return templates.DefaultLanguage
+}
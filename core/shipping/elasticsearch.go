@@ -0,0 +1,114 @@
+package shipping
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// elasticsearchTarget indexes records through the bulk api of Elasticsearch or OpenSearch, as documents with the
+// fields of the record and its "source"
+type elasticsearchTarget struct {
+	url      string
+	headers  map[string]string
+	username string
+	password string
+	index    string
+	client   *http.Client
+}
+
+func newElasticsearchTarget(settings domains.LogShipperSettings, client *http.Client) *elasticsearchTarget {
+	url := strings.TrimSuffix(settings.URL, "/")
+	if !strings.HasSuffix(url, "/_bulk") {
+		url += "/_bulk"
+	}
+	index := settings.Index
+	if index == "" {
+		index = "balooproxy-{date}"
+	}
+	return &elasticsearchTarget{url: url, headers: settings.Headers, username: settings.Username, password: settings.Password, index: index, client: client}
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (target *elasticsearchTarget) Push(batch []Record) error {
+	payload := &bytes.Buffer{}
+	for _, record := range batch {
+		document, err := record.Document()
+		if err != nil {
+			continue
+		}
+		index := strings.ReplaceAll(target.index, "{date}", record.Time.UTC().Format("2006.01.02"))
+		payload.WriteString(`{"create":{"_index":` + strconv.Quote(index) + "}}\n")
+		payload.Write(document)
+		payload.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", target.url, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for name, value := range target.headers {
+		req.Header.Set(name, value)
+	}
+	if target.username != "" {
+		req.SetBasicAuth(target.username, target.password)
+	}
+	resp, err := target.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New(resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+
+	// The bulk api answers with 200 even if documents were rejected, e.g. because they don't fit the mapping.
+	// Rejected documents aren't pushed again, they would be rejected again
+	result := bulkResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || !result.Errors {
+		return nil
+	}
+	rejected, reason := 0, ""
+	for _, item := range result.Items {
+		for _, action := range item {
+			if action.Status >= 300 {
+				rejected++
+				if reason == "" {
+					reason = action.Error.Type + ": " + action.Error.Reason
+				}
+			}
+		}
+	}
+	if rejected != 0 {
+		return &RejectedError{Rejected: rejected, Reason: reason}
+	}
+	return nil
+}
+
+// RejectedError is returned if a log store took the batch but rejected some of its records. Batches it's returned
+// for are not pushed again
+type RejectedError struct {
+	Rejected int
+	Reason   string
+}
+
+func (err *RejectedError) Error() string {
+	return strconv.Itoa(err.Rejected) + " records were rejected (" + err.Reason + ")"
+}
@@ -0,0 +1,104 @@
+package shipping
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lokiTarget pushes records to the push api of Grafana Loki. Every record is a line of json in the stream of its
+// source and domain, along with the labels of the config
+type lokiTarget struct {
+	url      string
+	headers  map[string]string
+	username string
+	password string
+	labels   map[string]string
+	client   *http.Client
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func newLokiTarget(settings domains.LogShipperSettings, client *http.Client) *lokiTarget {
+	url := strings.TrimSuffix(settings.URL, "/")
+	if !strings.HasSuffix(url, "/loki/api/v1/push") {
+		url += "/loki/api/v1/push"
+	}
+	labels := map[string]string{"job": "balooproxy"}
+	for name, value := range settings.Labels {
+		labels[name] = value
+	}
+	return &lokiTarget{url: url, headers: settings.Headers, username: settings.Username, password: settings.Password, labels: labels, client: client}
+}
+
+func (target *lokiTarget) Push(batch []Record) error {
+	streams := map[string]*lokiStream{}
+	keys := []string{}
+	for _, record := range batch {
+		line, err := json.Marshal(record.Data)
+		if err != nil {
+			continue
+		}
+
+		key := record.Source + "\x00" + record.Domain
+		stream, ok := streams[key]
+		if !ok {
+			labels := make(map[string]string, len(target.labels)+2)
+			for name, value := range target.labels {
+				labels[name] = value
+			}
+			labels["source"] = record.Source
+			if record.Domain != "" {
+				labels["domain"] = record.Domain
+			}
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			keys = append(keys, key)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(record.Time.UnixNano(), 10), string(line)})
+	}
+
+	sort.Strings(keys)
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{Streams: make([]*lokiStream, 0, len(keys))}
+	for _, key := range keys {
+		push.Streams = append(push.Streams, streams[key])
+	}
+	payload, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", target.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range target.headers {
+		req.Header.Set(name, value)
+	}
+	if target.username != "" {
+		req.SetBasicAuth(target.username, target.password)
+	}
+	resp, err := target.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New(resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
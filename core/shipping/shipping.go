@@ -0,0 +1,299 @@
+package shipping
+
+import (
+	"encoding/json"
+	"errors"
+	"goProxy/core/accesslog"
+	"goProxy/core/domains"
+	"goProxy/core/events"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	DefaultBatchSize     = 500
+	DefaultFlushInterval = 5 * time.Second
+	DefaultQueueSize     = 10000
+	DefaultTimeout       = 10 * time.Second
+
+	Attempts         = 3               // pushes of a batch before it's dropped
+	ErrorLogInterval = 1 * time.Minute // failures of a shipper are logged at most this often
+
+	// shippers of the config, replaced on reload
+	configured      = []*Shipper{}
+	configuredMutex = &sync.Mutex{}
+)
+
+// Record is an access log entry or an event on its way to a log store
+type Record struct {
+	Source string // "access" or "events"
+	Time   time.Time
+	Domain string
+	Data   interface{} // accesslog.Entry or events.Event
+}
+
+// Type returns the type of the event of the record, "access" for access log entries
+func (record Record) Type() string {
+	if event, ok := record.Data.(events.Event); ok {
+		return event.Type
+	}
+	return record.Source
+}
+
+// Document returns the json of the record with its source added as "source"
+func (record Record) Document() ([]byte, error) {
+	data, err := json.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || data[0] != '{' {
+		return nil, errors.New("records have to be json objects")
+	}
+	prefix := `{"source":` + strconv.Quote(record.Source)
+	if len(data) > 2 {
+		prefix += ","
+	}
+	return append([]byte(prefix), data[1:]...), nil
+}
+
+// Target is a log store batches are pushed to. Targets that are an io.Closer are closed once their shipper stopped
+type Target interface {
+	Push(batch []Record) error
+}
+
+// Shipper collects records in batches and pushes them to its target in its own goroutine. Records are dropped
+// while the queue is full, so a slow or unreachable log store never slows requests down
+type Shipper struct {
+	Type          string
+	Target        Target
+	BatchSize     int
+	FlushInterval time.Duration
+
+	queue       chan Record
+	done        chan struct{}
+	dropped     uint64
+	lastError   time.Time
+	unsubscribe []func()
+}
+
+// Configure replaces the shippers of the config with settings
+func Configure(settings []domains.LogShipperSettings) error {
+
+	shippers := []*Shipper{}
+	for _, shipperSettings := range settings {
+		shipper, err := NewShipper(shipperSettings)
+		if err != nil {
+			return err
+		}
+		shippers = append(shippers, shipper)
+	}
+
+	configuredMutex.Lock()
+	defer configuredMutex.Unlock()
+	for _, shipper := range configured {
+		shipper.Stop()
+	}
+	configured = shippers
+	for i, shipper := range shippers {
+		shipper.Start(settings[i].Logs, settings[i].Events)
+	}
+	return nil
+}
+
+// NewShipper creates the shipper settings describe, it doesn't receive anything until it's started
+func NewShipper(settings domains.LogShipperSettings) (*Shipper, error) {
+	for _, log := range settings.Logs {
+		if log != "access" && log != "events" {
+			return nil, errors.New("unknown log " + log + ", use access or events")
+		}
+	}
+	for _, eventType := range settings.Events {
+		if !events.Known(eventType) {
+			return nil, errors.New("unknown event " + eventType)
+		}
+	}
+	if settings.URL == "" && settings.Type != "kafka" {
+		return nil, errors.New(settings.Type + " log shippers need an url")
+	}
+
+	timeout := DefaultTimeout
+	if settings.Timeout > 0 {
+		timeout = time.Duration(settings.Timeout) * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	var target Target
+	switch settings.Type {
+	case "loki":
+		target = newLokiTarget(settings, client)
+	case "elasticsearch":
+		target = newElasticsearchTarget(settings, client)
+	case "syslog":
+		syslog, err := newSyslogTarget(settings, timeout)
+		if err != nil {
+			return nil, err
+		}
+		target = syslog
+	case "kafka":
+		kafka, err := newKafkaTarget(settings, timeout)
+		if err != nil {
+			return nil, err
+		}
+		target = kafka
+	case "nats":
+		nats, err := newNATSTarget(settings, timeout)
+		if err != nil {
+			return nil, err
+		}
+		target = nats
+	default:
+		return nil, errors.New("unknown log shipper " + settings.Type + ", use loki, elasticsearch, syslog, kafka or nats")
+	}
+
+	shipper := &Shipper{
+		Type:          settings.Type,
+		Target:        target,
+		BatchSize:     DefaultBatchSize,
+		FlushInterval: DefaultFlushInterval,
+		queue:         make(chan Record, DefaultQueueSize),
+	}
+	if settings.BatchSize > 0 {
+		shipper.BatchSize = settings.BatchSize
+	}
+	if settings.FlushInterval > 0 {
+		shipper.FlushInterval = time.Duration(settings.FlushInterval) * time.Second
+	}
+	if settings.QueueSize > 0 {
+		shipper.queue = make(chan Record, settings.QueueSize)
+	}
+	return shipper, nil
+}
+
+// Start subscribes the shipper to the logs (both if empty) and types of events (all if empty) it ships
+func (shipper *Shipper) Start(logs []string, eventTypes []string) {
+	shipper.done = make(chan struct{})
+	go shipper.run()
+
+	wanted := map[string]bool{}
+	for _, log := range logs {
+		wanted[log] = true
+	}
+	if len(wanted) == 0 || wanted["access"] {
+		shipper.unsubscribe = append(shipper.unsubscribe, accesslog.Subscribe(func(entry accesslog.Entry) {
+			shipper.Enqueue(Record{Source: "access", Time: entry.Time, Domain: entry.Domain, Data: entry})
+		}))
+	}
+	if len(wanted) == 0 || wanted["events"] {
+		shipper.unsubscribe = append(shipper.unsubscribe, events.Subscribe(eventTypes, eventSink{shipper}, nil))
+	}
+}
+
+// Stop unsubscribes the shipper and pushes what it still has in the background
+func (shipper *Shipper) Stop() {
+	for _, unsubscribe := range shipper.unsubscribe {
+		unsubscribe()
+	}
+	shipper.unsubscribe = nil
+	close(shipper.done)
+}
+
+// Enqueue queues record to be pushed with the next batch, it's dropped if the queue is full
+func (shipper *Shipper) Enqueue(record Record) {
+	select {
+	case shipper.queue <- record:
+	default:
+		atomic.AddUint64(&shipper.dropped, 1)
+	}
+}
+
+type eventSink struct {
+	shipper *Shipper
+}
+
+func (sink eventSink) Handle(event events.Event) error {
+	sink.shipper.Enqueue(Record{Source: "events", Time: event.Time, Domain: event.Domain, Data: event})
+	return nil
+}
+
+func (shipper *Shipper) run() {
+	defer pnc.PanicHndl()
+
+	ticker := time.NewTicker(shipper.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, shipper.BatchSize)
+	for {
+		select {
+		case record := <-shipper.queue:
+			batch = append(batch, record)
+			if len(batch) >= shipper.BatchSize {
+				batch = shipper.flush(batch)
+			}
+		case <-ticker.C:
+			if len(batch) != 0 {
+				batch = shipper.flush(batch)
+			}
+		case <-shipper.done:
+			// Whatever is still queued is pushed once more, without retrying
+			for {
+				drained := false
+				for len(batch) < shipper.BatchSize && !drained {
+					select {
+					case record := <-shipper.queue:
+						batch = append(batch, record)
+					default:
+						drained = true
+					}
+				}
+				if len(batch) == 0 {
+					if closer, ok := shipper.Target.(io.Closer); ok {
+						closer.Close()
+					}
+					return
+				}
+				if err := shipper.Target.Push(batch); err != nil {
+					shipper.failed(err, len(batch))
+				}
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush pushes batch, retrying with a growing delay, and returns it emptied
+func (shipper *Shipper) flush(batch []Record) []Record {
+	var err error
+	for attempt := 0; attempt < Attempts; attempt++ {
+		if attempt != 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-shipper.done:
+			}
+		}
+		if err = shipper.Target.Push(batch); err == nil {
+			return batch[:0]
+		}
+		if rejected := (*RejectedError)(nil); errors.As(err, &rejected) {
+			break
+		}
+	}
+	shipper.failed(err, len(batch))
+	return batch[:0]
+}
+
+// failed logs a batch that couldn't be pushed along with the records dropped since the last failure, unless the
+// shipper already failed shortly before
+func (shipper *Shipper) failed(err error, records int) {
+	if time.Since(shipper.lastError) < ErrorLogInterval {
+		return
+	}
+	shipper.lastError = time.Now()
+	logger.Error("Log shipper failed", logger.F("shipper", shipper.Type), logger.F("records", records), logger.F("dropped", atomic.SwapUint64(&shipper.dropped, 0)), logger.Err(err))
+}
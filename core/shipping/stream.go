@@ -0,0 +1,131 @@
+package shipping
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"goProxy/core/domains"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// topic returns the topic or subject of record, with {source} and {type} replaced
+func topic(pattern string, record Record) string {
+	return strings.NewReplacer("{source}", record.Source, "{type}", record.Type()).Replace(pattern)
+}
+
+// kafkaTarget produces every record as a message with its json to the topic of the config. Messages are keyed by
+// their domain, so the records of a domain end up in the same partition and keep their order
+type kafkaTarget struct {
+	topic   string
+	timeout time.Duration
+	writer  *kafka.Writer
+}
+
+func newKafkaTarget(settings domains.LogShipperSettings, timeout time.Duration) (*kafkaTarget, error) {
+	if len(settings.Brokers) == 0 {
+		return nil, errors.New("kafka log shippers need brokers")
+	}
+
+	transport := &kafka.Transport{DialTimeout: timeout}
+	if settings.TLS {
+		transport.TLS = &tls.Config{}
+	}
+	if settings.Username != "" {
+		transport.SASL = plain.Mechanism{Username: settings.Username, Password: settings.Password}
+	}
+
+	target := &kafkaTarget{topic: settings.Topic, timeout: timeout}
+	if target.topic == "" {
+		target.topic = "balooproxy.{source}"
+	}
+	target.writer = &kafka.Writer{
+		Addr:         kafka.TCP(settings.Brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireOne,
+		MaxAttempts:  1, // the shipper retries batches by itself
+		BatchTimeout: 10 * time.Millisecond,
+		WriteTimeout: timeout,
+		Transport:    transport,
+	}
+	return target, nil
+}
+
+func (target *kafkaTarget) Push(batch []Record) error {
+	messages := make([]kafka.Message, 0, len(batch))
+	for _, record := range batch {
+		document, err := record.Document()
+		if err != nil {
+			continue
+		}
+		messages = append(messages, kafka.Message{Topic: topic(target.topic, record), Key: []byte(record.Domain), Value: document, Time: record.Time})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), target.timeout)
+	defer cancel()
+	return target.writer.WriteMessages(ctx, messages...)
+}
+
+func (target *kafkaTarget) Close() error {
+	return target.writer.Close()
+}
+
+// natsTarget publishes every record as a message with its json to the subject of the config. The connection is
+// opened by the first push and reconnects by itself
+type natsTarget struct {
+	url      string
+	subject  string
+	username string
+	password string
+	timeout  time.Duration
+	conn     *nats.Conn
+}
+
+func newNATSTarget(settings domains.LogShipperSettings, timeout time.Duration) (*natsTarget, error) {
+	if settings.URL == "" {
+		return nil, errors.New("nats log shippers need an url")
+	}
+	target := &natsTarget{url: settings.URL, subject: settings.Topic, username: settings.Username, password: settings.Password, timeout: timeout}
+	if target.subject == "" {
+		target.subject = "balooproxy.{source}"
+	}
+	return target, nil
+}
+
+func (target *natsTarget) Push(batch []Record) error {
+	if target.conn == nil {
+		options := []nats.Option{nats.Name("balooProxy"), nats.Timeout(target.timeout), nats.MaxReconnects(-1)}
+		if target.username != "" {
+			options = append(options, nats.UserInfo(target.username, target.password))
+		}
+		conn, err := nats.Connect(target.url, options...)
+		if err != nil {
+			return err
+		}
+		target.conn = conn
+	}
+
+	for _, record := range batch {
+		document, err := record.Document()
+		if err != nil {
+			continue
+		}
+		if err := target.conn.Publish(topic(target.subject, record), document); err != nil {
+			return err
+		}
+	}
+	// Messages are only buffered by Publish, the batch counts as pushed once the server got all of them
+	return target.conn.FlushTimeout(target.timeout)
+}
+
+func (target *natsTarget) Close() error {
+	if target.conn != nil {
+		target.conn.Close()
+		target.conn = nil
+	}
+	return nil
+}
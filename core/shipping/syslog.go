@@ -0,0 +1,211 @@
+package shipping
+
+import (
+	"crypto/tls"
+	"errors"
+	"goProxy/core/accesslog"
+	"goProxy/core/domains"
+	"goProxy/core/events"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	syslogFacilities = map[string]int{
+		"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+		"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+		"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+	}
+
+	// Severities of events, the rest are notices
+	syslogEventSeverities = map[string]int{
+		events.BackendDown:   3, // error
+		events.AttackStarted: 4, // warning
+		events.IPBanned:      4,
+	}
+
+	SyslogMaxMessage = 64 * 1024 // bytes, longer messages are cut
+)
+
+// syslogTarget sends every record as an RFC 5424 message with the record as json. Messages are sent as datagrams
+// over udp and unix sockets, and with octet counting framing (RFC 6587) over tcp and tls
+type syslogTarget struct {
+	network  string // "udp", "tcp", "tls" or "unix"
+	address  string
+	facility int
+	hostname string
+	timeout  time.Duration
+	conn     net.Conn
+	framing  string // "octet" for tcp and tls, "newline" for unix stream sockets, "" for datagrams
+}
+
+func newSyslogTarget(settings domains.LogShipperSettings, timeout time.Duration) (*syslogTarget, error) {
+	parsed, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &syslogTarget{network: parsed.Scheme, address: parsed.Host, timeout: timeout}
+	switch parsed.Scheme {
+	case "udp", "tcp", "tls":
+		if parsed.Port() == "" {
+			port := "514"
+			if parsed.Scheme == "tls" {
+				port = "6514"
+			}
+			target.address = net.JoinHostPort(parsed.Hostname(), port)
+		}
+	case "unix":
+		target.address = parsed.Path
+	default:
+		return nil, errors.New("unknown syslog scheme " + parsed.Scheme + ", use udp, tcp, tls or unix")
+	}
+
+	facility := settings.Facility
+	if facility == "" {
+		facility = "local0"
+	}
+	code, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, errors.New("unknown syslog facility " + facility)
+	}
+	target.facility = code
+
+	target.hostname, _ = os.Hostname()
+	if target.hostname == "" {
+		target.hostname = "-"
+	}
+	return target, nil
+}
+
+func (target *syslogTarget) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: target.timeout}
+	switch target.network {
+	case "tls":
+		target.framing = "octet"
+		host, _, _ := net.SplitHostPort(target.address)
+		return tls.DialWithDialer(dialer, "tcp", target.address, &tls.Config{ServerName: host})
+	case "tcp":
+		target.framing = "octet"
+	case "unix":
+		// Local syslog daemons usually listen on a datagram socket, some on a stream socket
+		target.framing = ""
+		conn, err := dialer.Dial("unixgram", target.address)
+		if err == nil {
+			return conn, nil
+		}
+		target.framing = "newline"
+		return dialer.Dial("unix", target.address)
+	}
+	return dialer.Dial(target.network, target.address)
+}
+
+func (target *syslogTarget) Push(batch []Record) error {
+	if target.conn == nil {
+		conn, err := target.dial()
+		if err != nil {
+			return err
+		}
+		target.conn = conn
+	}
+
+	message := []byte{}
+	for _, record := range batch {
+		message = target.format(message[:0], record)
+		switch target.framing {
+		case "octet":
+			message = append([]byte(strconv.Itoa(len(message))+" "), message...)
+		case "newline":
+			message = append(message, '\n')
+		}
+
+		target.conn.SetWriteDeadline(time.Now().Add(target.timeout))
+		if _, err := target.conn.Write(message); err != nil {
+			// The connection is opened again when the batch is pushed again, the messages that were sent already
+			// are sent twice then
+			target.conn.Close()
+			target.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (target *syslogTarget) Close() error {
+	if target.conn != nil {
+		target.conn.Close()
+		target.conn = nil
+	}
+	return nil
+}
+
+// format appends the RFC 5424 message of record to message:
+// <PRI>1 TIMESTAMP HOSTNAME balooproxy PROCID MSGID [balooproxy@32473 domain="..." ip="..."] {json}
+func (target *syslogTarget) format(message []byte, record Record) []byte {
+	severity, ip := 5, ""
+	switch data := record.Data.(type) {
+	case accesslog.Entry:
+		severity, ip = 6, data.IP
+		switch data.Action {
+		case "block", "tarpit":
+			severity = 4
+		case "challenge":
+			severity = 5
+		}
+	case events.Event:
+		ip = data.IP
+		if eventSeverity, ok := syslogEventSeverities[data.Type]; ok {
+			severity = eventSeverity
+		}
+	}
+
+	message = append(message, '<')
+	message = strconv.AppendInt(message, int64(target.facility*8+severity), 10)
+	message = append(message, ">1 "...)
+	message = record.Time.UTC().AppendFormat(message, "2006-01-02T15:04:05.000000Z")
+	message = append(message, ' ')
+	message = append(message, target.hostname...)
+	message = append(message, " balooproxy "...)
+	message = strconv.AppendInt(message, int64(os.Getpid()), 10)
+	message = append(message, ' ')
+	message = append(message, record.Type()...)
+
+	if record.Domain == "" && ip == "" {
+		message = append(message, " -"...)
+	} else {
+		message = append(message, " [balooproxy@32473"...)
+		if record.Domain != "" {
+			message = appendSDParam(message, "domain", record.Domain)
+		}
+		if ip != "" {
+			message = appendSDParam(message, "ip", ip)
+		}
+		message = append(message, ']')
+	}
+
+	if document, err := record.Document(); err == nil {
+		message = append(message, ' ')
+		message = append(message, document...)
+	}
+	if len(message) > SyslogMaxMessage {
+		message = message[:SyslogMaxMessage]
+	}
+	return message
+}
+
+// appendSDParam appends a parameter of structured data, escaping '"', '\' and ']' as RFC 5424 requires
+func appendSDParam(message []byte, name string, value string) []byte {
+	message = append(message, ' ')
+	message = append(message, name...)
+	message = append(message, `="`...)
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == '"' || c == '\\' || c == ']' {
+			message = append(message, '\\')
+		}
+		message = append(message, value[i])
+	}
+	return append(message, '"')
+}
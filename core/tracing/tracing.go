@@ -0,0 +1,237 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	ExportTimeout      = 10 * time.Second
+	ErrorLogInterval   = 1 * time.Minute // failed exports are logged at most this often
+	DefaultServiceName = "balooproxy"
+
+	// The W3C trace context, what the traceparent and tracestate headers carry
+	propagator = propagation.TraceContext{}
+
+	current       atomic.Pointer[exporter]
+	configureLock = &sync.Mutex{}
+
+	// Handed out while tracing is off, a span of the request that was started before it was turned off stays untouched
+	noSpan = trace.SpanFromContext(context.Background())
+
+	lastErrorLog  time.Time
+	errorLogMutex = &sync.Mutex{}
+)
+
+// exporter is a tracer provider along with the settings it was created with
+type exporter struct {
+	settings domains.TracingSettings
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+func init() {
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		errorLogMutex.Lock()
+		defer errorLogMutex.Unlock()
+		if time.Since(lastErrorLog) < ErrorLogInterval {
+			return
+		}
+		lastErrorLog = time.Now()
+		logger.Warn("Failed to export traces", logger.Err(err))
+	}))
+}
+
+// Configure starts exporting spans with the tracing settings of the config, or stops if no endpoint is set.
+// The spans of the previous settings are still exported
+func Configure(settings domains.TracingSettings) error {
+
+	configureLock.Lock()
+	defer configureLock.Unlock()
+
+	previous := current.Load()
+	if previous != nil && reflect.DeepEqual(previous.settings, settings) {
+		return nil
+	}
+
+	next := (*exporter)(nil)
+	if settings.Endpoint != "" {
+		var err error
+		next, err = newExporter(settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	current.Store(next)
+	if previous != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), ExportTimeout)
+			defer cancel()
+			previous.provider.Shutdown(ctx)
+		}()
+	}
+	return nil
+}
+
+func newExporter(settings domains.TracingSettings) (*exporter, error) {
+
+	endpoint, err := url.Parse(settings.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, errors.New("tracing endpoint has to start with http:// or https://, like http://localhost:4318")
+	}
+	if settings.SampleRatio < 0 || settings.SampleRatio > 1 {
+		return nil, errors.New("tracing sampleRatio has to be between 0 and 1")
+	}
+
+	var client otlptrace.Client
+	switch settings.Protocol {
+	case "", "http":
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host), otlptracehttp.WithHeaders(settings.Headers), otlptracehttp.WithTimeout(ExportTimeout)}
+		if endpoint.Scheme == "http" {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		if endpoint.Path != "" && endpoint.Path != "/" {
+			options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+		}
+		client = otlptracehttp.NewClient(options...)
+	case "grpc":
+		options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint.Host), otlptracegrpc.WithHeaders(settings.Headers), otlptracegrpc.WithTimeout(ExportTimeout)}
+		if endpoint.Scheme == "http" {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(options...)
+	default:
+		return nil, errors.New("unknown tracing protocol " + settings.Protocol + ", use http or grpc")
+	}
+
+	// The client connects by itself once there are spans to export, an unreachable collector doesn't stop the proxy
+	spanExporter, err := otlptrace.New(context.Background(), client)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := settings.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	ratio := settings.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+
+	// Clients choose the sampled flag of their traceparent, trusting it would let anyone make every request of theirs exported.
+	// Remote parents are sampled by ratio aswell, the flag only keeps unsampled traces out
+	sampler := sdktrace.TraceIDRatioBased(ratio)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler, sdktrace.WithRemoteParentSampled(sampler))),
+	)
+	return &exporter{settings: settings, provider: provider, tracer: provider.Tracer("goProxy")}, nil
+}
+
+// Enabled returns whether spans are exported
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// StartRequest starts the span of a request to domainName, continuing the trace of the traceparent header if the
+// client sent one. The returned request carries the span for the spans started while the request is handled
+func StartRequest(request *http.Request, domainName string, ip string) (*http.Request, trace.Span) {
+	active := current.Load()
+	if active == nil {
+		return request, noSpan
+	}
+
+	ctx := propagator.Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+	ctx, span := active.tracer.Start(ctx, "HTTP "+request.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.method", request.Method),
+		attribute.String("http.target", request.RequestURI),
+		attribute.String("http.flavor", request.Proto),
+		attribute.String("http.user_agent", request.UserAgent()),
+		attribute.String("net.host.name", domainName),
+		attribute.String("http.client_ip", ip),
+	))
+	return request.WithContext(ctx), span
+}
+
+// Finish records what happened to the request of span, the span still has to be ended
+func Finish(span trace.Span, action string, reason string, status int) {
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(attribute.String("balooproxy.action", action), attribute.Int("http.status_code", status))
+	if reason != "" {
+		span.SetAttributes(attribute.String("balooproxy.reason", reason))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// Start starts a span of what the proxy does with a request, as child of the span in ctx
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	active := current.Load()
+	if active == nil {
+		return ctx, noSpan
+	}
+	return active.tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// StartUpstream starts the span of a request to backend and sets its traceparent header, so the backend continues
+// the trace. Without tracing the headers of the client are forwarded as they are
+func StartUpstream(request *http.Request, backend string) (*http.Request, trace.Span) {
+	active := current.Load()
+	if active == nil {
+		return request, noSpan
+	}
+
+	ctx, span := active.tracer.Start(request.Context(), "upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.method", request.Method),
+		attribute.String("http.url", request.URL.String()),
+		attribute.String("net.peer.name", backend),
+	))
+	request = request.WithContext(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+	return request, span
+}
+
+// FinishUpstream records how the backend answered and ends span
+func FinishUpstream(span trace.Span, status int, err error) {
+	if span.IsRecording() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(attribute.Int("http.status_code", status))
+			if status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		}
+	}
+	span.End()
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"goProxy/core/logger"
 	"os"
 	"runtime"
 	"runtime/pprof"
@@ -11,26 +12,26 @@ import (
 func LogHeapProfile() {
 	f, err := os.Create(fmt.Sprintf("heap_%v.prof", time.Now().Unix()))
 	if err != nil {
-		fmt.Println("Could not create heap profile: ", err)
+		logger.Error("Could not create heap profile", logger.Err(err))
 		return
 	}
 	defer f.Close()
 
 	runtime.GC() // get up-to-date statistics
 	if err := pprof.WriteHeapProfile(f); err != nil {
-		fmt.Println("Could not write heap profile: ", err)
+		logger.Error("Could not write heap profile", logger.Err(err))
 	}
 }
 
 func LogGoroutineProfile() {
 	f, err := os.Create(fmt.Sprintf("goroutine_%v.prof", time.Now().Unix()))
 	if err != nil {
-		fmt.Println("Could not create goroutine profile: ", err)
+		logger.Error("Could not create goroutine profile", logger.Err(err))
 		return
 	}
 	defer f.Close()
 
 	if err := pprof.Lookup("goroutine").WriteTo(f, 0); err != nil {
-		fmt.Println("Could not write goroutine profile: ", err)
+		logger.Error("Could not write goroutine profile", logger.Err(err))
 	}
 }
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	AttackReportsEnabled       = false
+	AttackReportDirectory      = "reports"
+	AttackReportFormats        = []string{"json", "html"}
+	AttackReportWebhookSummary = false
+)
+
+// ConfigureAttackReports applies the attackReports settings of the config
+func ConfigureAttackReports(settings domains.AttackReportSettings) error {
+	formats := []string{"json", "html"}
+	if len(settings.Formats) != 0 {
+		formats = []string{}
+		for _, format := range settings.Formats {
+			format = strings.ToLower(format)
+			if format != "json" && format != "html" {
+				return errors.New("unknown attack report format " + format + ", use json or html")
+			}
+			formats = append(formats, format)
+		}
+	}
+
+	AttackReportsEnabled = settings.Enabled
+	AttackReportFormats = formats
+	AttackReportWebhookSummary = settings.WebhookSummary
+	AttackReportDirectory = "reports"
+	if settings.Directory != "" {
+		AttackReportDirectory = settings.Directory
+	}
+	return nil
+}
+
+// WriteAttackReport writes report to AttackReportDirectory in every AttackReportFormats
+func WriteAttackReport(report firewall.AttackReport) {
+
+	defer pnc.PanicHndl()
+
+	if err := os.MkdirAll(AttackReportDirectory, 0755); err != nil {
+		logger.Error("Failed to create attack report directory", logger.F("directory", AttackReportDirectory), logger.Err(err))
+		return
+	}
+
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(report.Domain) + "-" + report.Start.Format("20060102-150405")
+	for _, format := range AttackReportFormats {
+		var err error
+		path := filepath.Join(AttackReportDirectory, name+"."+format)
+		switch format {
+		case "json":
+			err = writeJSONReport(path, report)
+		case "html":
+			err = writeHTMLReport(path, report)
+		}
+		if err != nil {
+			logger.Error("Failed to write attack report", logger.F("file", path), logger.Err(err))
+		}
+	}
+}
+
+func writeJSONReport(path string, report firewall.AttackReport) error {
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, reportJSON, 0644)
+}
+
+func writeHTMLReport(path string, report firewall.AttackReport) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return reportTemplate.Execute(file, struct {
+		Report   firewall.AttackReport
+		Total    string
+		Bypassed string
+	}{
+		Report:   report,
+		Total:    chartPoints(report.Timeline, report.PeakRequestsPerSecond, func(sample firewall.AttackSample) int { return sample.RequestsPerSecond }),
+		Bypassed: chartPoints(report.Timeline, report.PeakRequestsPerSecond, func(sample firewall.AttackSample) int { return sample.BypassedPerSecond }),
+	})
+}
+
+// chartPoints returns the points of an svg polyline of the timeline, scaled to a 800x200 chart
+func chartPoints(timeline []firewall.AttackSample, peak int, value func(firewall.AttackSample) int) string {
+	if peak == 0 {
+		peak = 1
+	}
+	points := []string{}
+	for i, sample := range timeline {
+		x := 0.0
+		if len(timeline) > 1 {
+			x = float64(i) * 800 / float64(len(timeline)-1)
+		}
+		y := 200 - float64(value(sample))*200/float64(peak)
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return strings.Join(points, " ")
+}
+
+// AttackSummary lists the top sources of an attack for webhooks
+func AttackSummary(sources []firewall.SourceCount, n int) string {
+	summary := ""
+	for i, source := range sources {
+		if i == n {
+			break
+		}
+		summary += source.Source + " (" + fmt.Sprint(source.Count) + ")\n"
+	}
+	if summary == "" {
+		return "None"
+	}
+	return summary
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Attack on {{.Report.Domain}}</title>
+<style>
+body{font-family:sans-serif;background:#2B2D31;color:#ddd;margin:2em}
+table{border-collapse:collapse;margin:0 2em 2em 0;display:inline-table;vertical-align:top}
+td,th{border:1px solid #555;padding:4px 10px;text-align:left}
+svg{background:#222;margin-bottom:2em}
+</style>
+</head>
+<body>
+<h1>Attack on {{.Report.Domain}}</h1>
+<table>
+<tr><th>Start</th><td>{{.Report.Start.Format "2006-01-02 15:04:05"}}</td></tr>
+<tr><th>End</th><td>{{.Report.End.Format "2006-01-02 15:04:05"}}</td></tr>
+<tr><th>Peak total requests per second</th><td>{{.Report.PeakRequestsPerSecond}}</td></tr>
+<tr><th>Peak bypassed requests per second</th><td>{{.Report.PeakBypassedPerSecond}}</td></tr>
+<tr><th>Total requests</th><td>{{.Report.TotalRequests}}</td></tr>
+<tr><th>Bypassed requests</th><td>{{.Report.BypassedRequests}}</td></tr>
+<tr><th>Highest stage</th><td>{{.Report.HighestStage}}</td></tr>
+</table>
+<h2>Requests per second</h2>
+<svg width="800" height="200" viewBox="0 0 800 200" preserveAspectRatio="none">
+<polyline fill="none" stroke="#aaa" stroke-width="2" points="{{.Total}}"/>
+<polyline fill="none" stroke="#239fd9" stroke-width="2" points="{{.Bypassed}}"/>
+</svg>
+<p>Grey: total, blue: bypassed</p>
+<h2>Top sources</h2>
+<table><tr><th>IP</th><th>Abuse</th></tr>{{range .Report.TopIPs}}<tr><td>{{.Source}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+<table><tr><th>Country</th><th>Abuse</th></tr>{{range .Report.TopCountries}}<tr><td>{{.Source}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+<table><tr><th>ASN</th><th>Abuse</th></tr>{{range .Report.TopASNs}}<tr><td>AS{{.ASN}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+<table><tr><th>Path</th><th>Requests</th></tr>{{range .Report.TopPaths}}<tr><td>{{.Source}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+<table><tr><th>Fingerprint</th><th>Requests</th></tr>{{range .Report.TopFingerprints}}<tr><td>{{.Source}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+<h2>Timeline</h2>
+<table><tr><th>Time</th><th>Total</th><th>Bypassed</th><th>Stage</th><th>CPU</th></tr>{{range .Report.Timeline}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.RequestsPerSecond}}</td><td>{{.BypassedPerSecond}}</td><td>{{.Stage}}</td><td>{{.CpuUsage}}%</td></tr>{{end}}</table>
+</body>
+</html>
+`))
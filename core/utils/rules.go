@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// RuleExportVersion is the version of the format rules are exported in
+const RuleExportVersion = 1
+
+// RuleExport is a portable copy of the firewall rules of a domain, which can be imported into any domain of any proxy
+type RuleExport struct {
+	Version int                `json:"version"`
+	Domain  string             `json:"domain"` // domain the rules were exported from
+	Rules   []domains.JsonRule `json:"rules"`
+}
+
+// ExportRules returns the configured firewall rules of a domain
+func ExportRules(domainName string) (RuleExport, error) {
+
+	domains.ConfigLock.RLock()
+	defer domains.ConfigLock.RUnlock()
+
+	for _, domain := range domains.Config.Domains {
+		if domain.Name == domainName {
+			return RuleExport{
+				Version: RuleExportVersion,
+				Domain:  domainName,
+				Rules:   domain.FirewallRules,
+			}, nil
+		}
+	}
+	return RuleExport{}, errors.New("domain " + domainName + " not found")
+}
+
+// ImportRules validates rules and appends the ones the domain doesn't have yet to its firewall rules. The rules take effect immediately
+// and are saved to the config.json. Rules with the same expression and action as an existing rule are skipped as duplicates
+func ImportRules(domainName string, rules []domains.JsonRule) (imported int, duplicates int, err error) {
+
+	if _, failed, err := firewall.CompileRules(rules, 0, false); err != nil {
+		return 0, 0, errors.New("rule " + strconv.Itoa(failed) + ": " + err.Error())
+	}
+
+	// Same lock as ReloadConfig, a reload in between would lose the imported rules or save a half decoded config
+	domains.ConfigLock.Lock()
+	defer domains.ConfigLock.Unlock()
+
+	index := -1
+	for i, domain := range domains.Config.Domains {
+		if domain.Name == domainName {
+			index = i
+			break
+		}
+	}
+	uncastedDomainSettings, ok := domains.DomainsMap.Load(domainName)
+	if index == -1 || !ok {
+		return 0, 0, errors.New("domain " + domainName + " not found")
+	}
+	domain := domains.Config.Domains[index]
+
+	known := map[string]bool{}
+	for _, rule := range domain.FirewallRules {
+		known[ruleKey(rule)] = true
+	}
+	merged := append([]domains.JsonRule{}, domain.FirewallRules...)
+	for _, rule := range rules {
+		if known[ruleKey(rule)] {
+			duplicates++
+			continue
+		}
+		known[ruleKey(rule)] = true
+		merged = append(merged, rule)
+		imported++
+	}
+	if imported == 0 {
+		return 0, duplicates, nil
+	}
+
+	compiled, failed, err := firewall.CompileRules(merged, 0, domain.ShadowRules)
+	if err != nil {
+		return 0, 0, errors.New("rule " + strconv.Itoa(failed) + ": " + err.Error())
+	}
+
+	domain.FirewallRules = merged
+	domains.Config.Domains[index] = domain
+	if err := saveConfig(); err != nil {
+		return 0, 0, err
+	}
+
+	domainSettings := uncastedDomainSettings.(domains.DomainSettings)
+	domainSettings.CustomRules = compiled
+	domainSettings.RawCustomRules = merged
+	domains.DomainsMap.Store(domainName, domainSettings)
+
+	return imported, duplicates, nil
+}
+
+// ruleKey identifies a rule regardless of how its expression is formatted
+func ruleKey(rule domains.JsonRule) string {
+	return strings.Join(strings.Fields(rule.Expression), " ") + "\x00" + strings.TrimSpace(rule.Action)
+}
+
+func saveConfig() error {
+	jsonConfig, err := json.Marshal(domains.Config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile("config.json", jsonConfig, 0644)
+}
+
+// ExportRulesFile writes the firewall rules of a domain to path and returns how many were exported
+func ExportRulesFile(domainName string, path string) (int, error) {
+	export, err := ExportRules(domainName)
+	if err != nil {
+		return 0, err
+	}
+	jsonExport, err := json.MarshalIndent(export, "", "    ")
+	if err != nil {
+		return 0, err
+	}
+	return len(export.Rules), ioutil.WriteFile(path, jsonExport, 0644)
+}
+
+// ImportRulesFile imports the rules of an export written by ExportRulesFile (or returned by the api) into a domain
+func ImportRulesFile(domainName string, path string) (imported int, duplicates int, err error) {
+	jsonExport, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	export := RuleExport{}
+	if err := json.Unmarshal(jsonExport, &export); err != nil {
+		return 0, 0, errors.New("invalid export: " + err.Error())
+	}
+	if export.Version > RuleExportVersion {
+		return 0, 0, errors.New("export version " + strconv.Itoa(export.Version) + " is not supported")
+	}
+	return ImportRules(domainName, export.Rules)
+}
@@ -26,10 +26,21 @@ func AddLogs(entry domains.DomainLog, domainName string) {
 }
 
 func FormatLogs(log domains.DomainLog) string {
+	rules := ""
+	if len(log.LoggedRules) != 0 {
+		indexes := make([]string, len(log.LoggedRules))
+		for i, index := range log.LoggedRules {
+			indexes[i] = strconv.Itoa(index)
+		}
+		rules = " - \033[33mRule " + strings.Join(indexes, ", ") + "\033[0m"
+	}
+	if log.WAF != "" {
+		rules += " - \033[33mWAF " + log.WAF + "\033[0m"
+	}
 	if log.BrowserFP != "" || log.BotFP != "" {
-		return "[ " + PrimaryColor(log.Time) + " ] > \033[35m" + log.IP + "\033[0m - \033[32m" + log.BrowserFP + log.BotFP + "\033[0m - " + PrimaryColor(log.Useragent) + " - " + PrimaryColor(log.Path)
+		return "[ " + PrimaryColor(log.Time) + " ] > \033[35m" + log.IP + "\033[0m - \033[32m" + log.BrowserFP + log.BotFP + "\033[0m - " + PrimaryColor(log.Useragent) + " - " + PrimaryColor(log.Path) + rules
 	}
-	return "[ " + PrimaryColor(log.Time) + " ] > \033[35m" + log.IP + "\033[0m - \033[31mUNK (" + log.TLSFP + ")\033[0m - " + PrimaryColor(log.Useragent) + " - " + PrimaryColor(log.Path)
+	return "[ " + PrimaryColor(log.Time) + " ] > \033[35m" + log.IP + "\033[0m - \033[31mUNK (" + log.TLSFP + ")\033[0m - " + PrimaryColor(log.Useragent) + " - " + PrimaryColor(log.Path) + rules
 }
 
 // Only run in locked thread
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"goProxy/core/domains"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// Default settings (will be overridden by config)
+	WebhookQueueSize         = 256
+	WebhookWorkers           = 4
+	WebhookRetries           = 5               // retries after the first attempt
+	WebhookBackoff           = 2 * time.Second // doubles with every retry
+	WebhookMaxBackoff        = 1 * time.Minute
+	WebhookMinAttackDuration = 0 * time.Second // attacks that end sooner aren't notified about at all
+	WebhookDeadLetterPath    = "webhooks.failed.log"
+
+	webhookQueue     chan *webhookDelivery
+	webhookQueueOnce = &sync.Once{}
+
+	// domain -> timer of an attack start notification that waits for WebhookMinAttackDuration
+	pendingStarts      = map[string]*time.Timer{}
+	pendingStartsMutex = &sync.Mutex{}
+
+	deadLetterMutex = &sync.Mutex{}
+)
+
+// webhookDelivery is a rendered alert on its way to a service
+type webhookDelivery struct {
+	domain   string
+	event    string
+	url      string
+	headers  map[string]string
+	payload  []byte
+	attempts int
+}
+
+// ConfigureWebhooks applies the webhooks settings of the config. The queue is only sized once
+func ConfigureWebhooks(settings domains.WebhookQueueSettings) {
+	if settings.QueueSize > 0 {
+		WebhookQueueSize = settings.QueueSize
+	}
+	if settings.Retries != 0 {
+		WebhookRetries = settings.Retries
+	}
+	if settings.Backoff > 0 {
+		WebhookBackoff = time.Duration(settings.Backoff) * time.Second
+	}
+	if settings.MaxBackoff > 0 {
+		WebhookMaxBackoff = time.Duration(settings.MaxBackoff) * time.Second
+	}
+	WebhookMinAttackDuration = time.Duration(settings.MinAttackDuration) * time.Second
+	if settings.DeadLetterFile != "" {
+		WebhookDeadLetterPath = settings.DeadLetterFile
+	}
+}
+
+// StartWebhookDispatcher starts the workers that deliver queued alerts
+func StartWebhookDispatcher() {
+	webhookQueueOnce.Do(func() {
+		webhookQueue = make(chan *webhookDelivery, WebhookQueueSize)
+		for i := 0; i < WebhookWorkers; i++ {
+			go func() {
+				for delivery := range webhookQueue {
+					deliverWebhook(delivery)
+				}
+			}()
+		}
+	})
+}
+
+// queueWebhook queues an alert. Attack starts wait for WebhookMinAttackDuration, if the attack ends before that neither
+// its start nor its end are sent, so flapping attacks don't flood the channel
+func queueWebhook(delivery *webhookDelivery, notificationType int) {
+	StartWebhookDispatcher()
+
+	pendingStartsMutex.Lock()
+	defer pendingStartsMutex.Unlock()
+
+	switch notificationType {
+	case 0:
+		if WebhookMinAttackDuration <= 0 {
+			enqueueWebhook(delivery)
+			return
+		}
+		if timer, pending := pendingStarts[delivery.domain]; pending {
+			timer.Stop()
+		}
+		pendingStarts[delivery.domain] = time.AfterFunc(WebhookMinAttackDuration, func() {
+			pendingStartsMutex.Lock()
+			delete(pendingStarts, delivery.domain)
+			pendingStartsMutex.Unlock()
+			enqueueWebhook(delivery)
+		})
+	case 1:
+		if timer, pending := pendingStarts[delivery.domain]; pending {
+			delete(pendingStarts, delivery.domain)
+			if timer.Stop() {
+				return
+			}
+		}
+		enqueueWebhook(delivery)
+	}
+}
+
+func enqueueWebhook(delivery *webhookDelivery) {
+	select {
+	case webhookQueue <- delivery:
+	default:
+		deadLetter(delivery, errors.New("webhook queue is full"))
+	}
+}
+
+// deliverWebhook sends an alert once and schedules a retry if the service couldn't take it
+func deliverWebhook(delivery *webhookDelivery) {
+
+	defer pnc.PanicHndl()
+
+	delivery.attempts++
+	retryAfter, err := postWebhook(delivery)
+	if err == nil {
+		return
+	}
+	if retryAfter < 0 || delivery.attempts > WebhookRetries {
+		deadLetter(delivery, err)
+		return
+	}
+
+	if retryAfter == 0 {
+		retryAfter = WebhookBackoff << (delivery.attempts - 1)
+		if retryAfter > WebhookMaxBackoff || retryAfter <= 0 {
+			retryAfter = WebhookMaxBackoff
+		}
+	}
+	time.AfterFunc(retryAfter, func() {
+		enqueueWebhook(delivery)
+	})
+}
+
+// postWebhook posts an alert. On failure it returns how long to wait before retrying, 0 for the backoff and -1 if retrying won't help
+func postWebhook(delivery *webhookDelivery) (time.Duration, error) {
+	req, err := http.NewRequest("POST", delivery.url, bytes.NewBuffer(delivery.payload))
+	if err != nil {
+		return -1, withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range delivery.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, withoutURL(err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(retryAfter) * time.Second, errors.New(resp.Status)
+	case resp.StatusCode >= 500:
+		return 0, errors.New(resp.Status)
+	}
+	return -1, errors.New(resp.Status)
+}
+
+// withoutURL strips the url from errors of the http client, it usually contains the secret of the webhook
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return errors.New(urlErr.Op + ": " + urlErr.Err.Error())
+	}
+	return err
+}
+
+// deadLetter logs an alert that couldn't be delivered to WebhookDeadLetterPath, one json object per line.
+// The url is left out, it usually contains the secret of the webhook
+func deadLetter(delivery *webhookDelivery, err error) {
+	logger.Error("Failed to deliver webhook", logger.Domain(delivery.domain), logger.F("event", delivery.event), logger.F("attempts", delivery.attempts), logger.Err(err))
+
+	entry, _ := json.Marshal(map[string]interface{}{
+		"time":     time.Now(),
+		"domain":   delivery.domain,
+		"event":    delivery.event,
+		"attempts": delivery.attempts,
+		"error":    err.Error(),
+		"payload":  json.RawMessage(delivery.payload),
+	})
+
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	file, openErr := os.OpenFile(WebhookDeadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if openErr != nil {
+		return
+	}
+	defer file.Close()
+	file.Write(append(entry, '\n'))
+}
@@ -0,0 +1,292 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goProxy/core/domains"
+	"goProxy/core/firewall"
+	"goProxy/core/logger"
+	"goProxy/core/pnc"
+	"goProxy/core/proxy"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	WebhookTypes = []string{"", "discord", "slack", "telegram", "generic"}
+
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+const defaultWebhookTemplate = `{"event":"{{event}}","domain":"{{domain.name}}","title":"{{title}}","message":"{{message}}","fields":{{fields}}}`
+
+// webhookMessage is what an alert says, it's rendered into the format of the service the webhook goes to
+type webhookMessage struct {
+	Event       string // "attack_start" or "attack_stop"
+	Title       string
+	Description string
+	Fields      []WebhookField
+	Image       string // url of a chart, if there is one
+}
+
+func InitPlaceholders(msg string, domainData domains.DomainData, domain string) string {
+	return strings.NewReplacer(placeholders(domainData, domain)...).Replace(msg)
+}
+
+// placeholders returns the placeholders of alert messages and their values, in pairs for a strings.Replacer
+func placeholders(domainData domains.DomainData, domain string) []string {
+	start := domainData.RequestLogger[0]
+	end := domainData.RequestLogger[len(domainData.RequestLogger)-1]
+
+	highestStage := domainData.Stage
+	for _, request := range domainData.RequestLogger {
+		if request.Stage > highestStage {
+			highestStage = request.Stage
+		}
+	}
+
+	// The abuse of the last minutes, looked up at send time
+	topCountry, topASN, topIP := "Unknown", "Unknown", "Unknown"
+	top := firewall.TopAttackers(domain, 1)
+	if len(top.Countries) != 0 {
+		topCountry = top.Countries[0].Source
+	}
+	if len(top.ASNs) != 0 {
+		topASN = "AS" + strconv.Itoa(top.ASNs[0].ASN)
+	}
+	if len(top.IPs) != 0 {
+		topIP = top.IPs[0].Source
+	}
+
+	return []string{
+		"{{domain.name}}", domain,
+		"{{attack.start}}", start.Time.Format("15:04:05"),
+		"{{attack.end}}", end.Time.Format("15:04:05"),
+		"{{attack.duration}}", end.Time.Sub(start.Time).Round(time.Second).String(),
+		"{{attack.rps}}", strconv.Itoa(domainData.RequestsPerSecond),
+		"{{attack.bypassed_rps}}", strconv.Itoa(domainData.RequestsBypassedPerSecond),
+		"{{attack.peak_rps}}", strconv.Itoa(domainData.PeakRequestsPerSecond),
+		"{{attack.peak_bypassed_rps}}", strconv.Itoa(domainData.PeakRequestsBypassedPerSecond),
+		"{{attack.stage}}", strconv.Itoa(domainData.Stage),
+		"{{attack.highest_stage}}", strconv.Itoa(highestStage),
+		"{{attack.top_country}}", topCountry,
+		"{{attack.top_asn}}", topASN,
+		"{{attack.top_ip}}", topIP,
+		"{{proxy.cpu}}", proxy.CpuUsage,
+		"{{proxy.ram}}", proxy.RamUsage,
+	}
+}
+
+// SendWebhook notifies about the start (0) or end (1) of an attack. The report of an attack that ended is summarized if AttackReportWebhookSummary is set
+func SendWebhook(domainData domains.DomainData, domainSettings domains.DomainSettings, notificationType int, report *firewall.AttackReport) {
+
+	defer pnc.PanicHndl()
+
+	settings := domainSettings.DomainWebhooks
+	url := webhookURL(settings)
+	if url == "" {
+		return
+	}
+
+	message := webhookMessage{Title: "DDoS Alert"}
+
+	switch notificationType {
+	case 0:
+		message.Event = "attack_start"
+		message.Description = InitPlaceholders(settings.AttackStartMsg, domainData, domainSettings.Name)
+		message.Fields = []WebhookField{
+			{
+				Name:  "Total requests per second",
+				Value: fmt.Sprint(domainData.RequestsPerSecond),
+			},
+			{
+				Name:  "Allowed requests per second",
+				Value: fmt.Sprint(domainData.RequestsBypassedPerSecond),
+			},
+		}
+	case 1:
+		message.Event = "attack_stop"
+		message.Description = InitPlaceholders(settings.AttackStopMsg, domainData, domainSettings.Name)
+		message.Fields = []WebhookField{
+			{
+				Name:  "Peak total requests per second",
+				Value: fmt.Sprint(domainData.PeakRequestsPerSecond),
+			},
+			{
+				Name:  "Peak allowed requests per second",
+				Value: fmt.Sprint(domainData.PeakRequestsBypassedPerSecond),
+			},
+		}
+
+		// Telegram and generic webhooks can't show the chart
+		if settings.Type == "" || settings.Type == "discord" || settings.Type == "slack" {
+			if chartUrl, chartErr := attackChart(domainData.RequestLogger); chartErr == nil {
+				message.Image = chartUrl
+			}
+		}
+
+		if report != nil && AttackReportWebhookSummary {
+			message.Fields = append(message.Fields,
+				WebhookField{
+					Name:  "Top attacking ips",
+					Value: AttackSummary(report.TopIPs, 5),
+				},
+				WebhookField{
+					Name:  "Top attacking countries",
+					Value: AttackSummary(report.TopCountries, 5),
+				},
+				WebhookField{
+					Name:  "Top paths",
+					Value: AttackSummary(report.TopPaths, 5),
+				},
+			)
+		}
+	}
+
+	webhookPayload, err := renderWebhook(settings, message, domainData, domainSettings.Name)
+	if err != nil {
+		logger.Error("Failed to render webhook", logger.Domain(domainSettings.Name), logger.Err(err))
+		return
+	}
+
+	delivery := &webhookDelivery{
+		domain:  domainSettings.Name,
+		event:   message.Event,
+		url:     url,
+		payload: webhookPayload,
+	}
+	if settings.Type == "generic" {
+		delivery.headers = settings.Headers
+	}
+	queueWebhook(delivery, notificationType)
+}
+
+// webhookURL returns where the webhook is sent to, telegram webhooks can use a bot token instead of an url
+func webhookURL(settings domains.WebhookSettings) string {
+	if settings.URL == "" && settings.Type == "telegram" && settings.Token != "" {
+		return "https://api.telegram.org/bot" + settings.Token + "/sendMessage"
+	}
+	return settings.URL
+}
+
+// ValidateWebhook checks that the webhook settings of a domain can be sent
+func ValidateWebhook(settings domains.WebhookSettings) error {
+	known := false
+	for _, webhookType := range WebhookTypes {
+		known = known || settings.Type == webhookType
+	}
+	if !known {
+		return errors.New("unknown webhook type " + settings.Type + ", use discord, slack, telegram or generic")
+	}
+	if settings.Type == "telegram" && webhookURL(settings) != "" && settings.ChatID == "" {
+		return errors.New("telegram webhooks need a chat_id")
+	}
+	if settings.Type == "generic" && settings.Template != "" {
+		if _, err := renderTemplate(settings.Template, webhookMessage{}, domains.DomainData{RequestLogger: []domains.RequestLog{{}}}, ""); err != nil {
+			return errors.New("template of generic webhook is not valid json: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func renderWebhook(settings domains.WebhookSettings, message webhookMessage, domainData domains.DomainData, domain string) ([]byte, error) {
+	switch settings.Type {
+	case "slack":
+		return slackWebhook(message)
+	case "telegram":
+		return telegramWebhook(settings, message)
+	case "generic":
+		template := settings.Template
+		if template == "" {
+			template = defaultWebhookTemplate
+		}
+		return renderTemplate(template, message, domainData, domain)
+	}
+	return discordWebhook(settings, message)
+}
+
+// slackWebhook renders message as blocks of a slack incoming webhook
+func slackWebhook(message webhookMessage) ([]byte, error) {
+	fields := []map[string]string{}
+	for _, field := range message.Fields {
+		fields = append(fields, map[string]string{"type": "mrkdwn", "text": "*" + field.Name + "*\n```" + field.Value + "```"})
+	}
+
+	blocks := []map[string]interface{}{
+		{"type": "header", "text": map[string]string{"type": "plain_text", "text": message.Title}},
+	}
+	if message.Description != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": message.Description}})
+	}
+	// Sections can't have more than 10 fields
+	for start := 0; start < len(fields); start += 10 {
+		end := start + 10
+		if end > len(fields) {
+			end = len(fields)
+		}
+		blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields[start:end]})
+	}
+	if message.Image != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "image", "image_url": message.Image, "alt_text": "Requests during the attack"})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"text":   message.Title + ": " + message.Description,
+		"blocks": blocks,
+	})
+}
+
+// telegramWebhook renders message as a sendMessage call of the telegram bot api
+func telegramWebhook(settings domains.WebhookSettings, message webhookMessage) ([]byte, error) {
+	text := message.Title + "\n"
+	if message.Description != "" {
+		text += "\n" + message.Description + "\n"
+	}
+	for _, field := range message.Fields {
+		text += "\n" + field.Name + ":\n" + strings.TrimSuffix(field.Value, "\n") + "\n"
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"chat_id":                  settings.ChatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	})
+}
+
+// renderTemplate fills the placeholders of the json template of a generic webhook. Placeholders are escaped to be put into strings,
+// {{fields}} is replaced with an object of the field names and values. Takes the placeholders of InitPlaceholders aswell
+func renderTemplate(template string, message webhookMessage, domainData domains.DomainData, domain string) ([]byte, error) {
+	fields := map[string]string{}
+	for _, field := range message.Fields {
+		fields[field.Name] = strings.TrimSuffix(field.Value, "\n")
+	}
+	fieldsJSON, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	replacements := []string{
+		"{{event}}", jsonEscape(message.Event),
+		"{{title}}", jsonEscape(message.Title),
+		"{{message}}", jsonEscape(message.Description),
+		"{{fields}}", string(fieldsJSON),
+	}
+	pairs := placeholders(domainData, domain)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		replacements = append(replacements, pairs[i], jsonEscape(pairs[i+1]))
+	}
+	body := strings.NewReplacer(replacements...).Replace(template)
+
+	if !json.Valid([]byte(body)) {
+		return nil, errors.New("rendered template is not valid json")
+	}
+	return []byte(body), nil
+}
+
+func jsonEscape(value string) string {
+	escaped, _ := json.Marshal(value)
+	return string(escaped[1 : len(escaped)-1])
+}
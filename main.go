@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"goProxy/core/config"
 	"goProxy/core/firewall"
+	"goProxy/core/kernel"
 	"goProxy/core/pnc"
 	"goProxy/core/proxy"
 	"goProxy/core/server"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -29,6 +32,7 @@ func main() {
 
 	defer pnc.PanicHndl()
 	defer firewall.CloseReputationDB()
+	defer kernel.StopXDP()
 
 	//Disable Error Logging
 	log.SetOutput(io.Discard /*logFile*/) // if we ever need to log to a file
@@ -48,6 +52,16 @@ func main() {
 
 	go server.Serve()
 
+	//Write reputations that are still queued and detach the xdp program before exiting, it would keep dropping packets of bans that never expire
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-shutdown
+		firewall.CloseReputationDB()
+		kernel.StopXDP()
+		os.Exit(0)
+	}()
+
 	//Keep server running
 	select {}
 }